@@ -0,0 +1,264 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"fmt"
+	"iter"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// The apex of the RPZ output: the SOA, the NS RRset and the glue for the
+// nameservers that are inside the zone. All of it comes from services.rpz;
+// what is not configured falls back to the values POP has always used.
+
+var defaultRpzApex = RpzConf{
+	Soa: RpzSoaConf{
+		Mname:   "mname.",
+		Rname:   "hostmaster.dnstapir.se.",
+		Ttl:     3600,
+		Refresh: 60,
+		Retry:   60,
+		Expire:  86400,
+		Minimum: 60,
+	},
+	Nameservers: []RpzNameserverConf{
+		{Name: "ns1", Addresses: []string{"127.0.0.1"}},
+		{Name: "ns2", Addresses: []string{"::1"}},
+	},
+}
+
+type RpzApex struct {
+	SOA   dns.SOA // the serial is not part of the apex
+	NSrrs []dns.RR
+	Glue  []dns.RR // A and AAAA RRs in canonical order
+}
+
+// NewRpzApex builds and validates the apex of the RPZ zone from the config.
+// Names that do not end in a dot are relative to the zone, as in a zone file.
+func NewRpzApex(conf RpzConf) (*RpzApex, error) {
+	zone := dns.Fqdn(conf.ZoneName)
+	if _, ok := dns.IsDomainName(zone); !ok || zone == "." {
+		return nil, fmt.Errorf("services.rpz.zonename: %q is not a valid zone name", conf.ZoneName)
+	}
+	abs := func(name string) string {
+		if dns.IsFqdn(name) {
+			return dns.CanonicalName(name)
+		}
+		return dns.CanonicalName(name + "." + zone)
+	}
+
+	soa := conf.Soa
+	def := defaultRpzApex.Soa
+	for _, f := range []struct {
+		val *uint32
+		def uint32
+	}{
+		{&soa.Ttl, def.Ttl}, {&soa.Refresh, def.Refresh}, {&soa.Retry, def.Retry},
+		{&soa.Expire, def.Expire}, {&soa.Minimum, def.Minimum},
+	} {
+		if *f.val == 0 {
+			*f.val = f.def
+		}
+	}
+	if soa.Mname == "" {
+		soa.Mname = def.Mname
+	}
+	if soa.Rname == "" {
+		soa.Rname = def.Rname
+	}
+	for key, name := range map[string]string{"mname": soa.Mname, "rname": soa.Rname} {
+		if _, ok := dns.IsDomainName(name); !ok {
+			return nil, fmt.Errorf("services.rpz.soa.%s: %q is not a valid domain name", key, name)
+		}
+	}
+	if soa.Retry > soa.Refresh {
+		return nil, fmt.Errorf("services.rpz.soa: retry (%d) must not be larger than refresh (%d)", soa.Retry, soa.Refresh)
+	}
+	if soa.Expire <= soa.Refresh+soa.Retry {
+		return nil, fmt.Errorf("services.rpz.soa: expire (%d) must be larger than refresh + retry (%d)",
+			soa.Expire, soa.Refresh+soa.Retry)
+	}
+	if soa.Minimum > 86400 {
+		// RFC 2308, section 5: the negative TTL should be at most a day.
+		return nil, fmt.Errorf("services.rpz.soa: minimum (%d) must not be larger than 86400", soa.Minimum)
+	}
+
+	apex := RpzApex{
+		SOA: dns.SOA{
+			Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: soa.Ttl},
+			Ns:      abs(soa.Mname),
+			Mbox:    abs(soa.Rname),
+			Refresh: soa.Refresh,
+			Retry:   soa.Retry,
+			Expire:  soa.Expire,
+			Minttl:  soa.Minimum,
+		},
+	}
+
+	nameservers := conf.Nameservers
+	if len(nameservers) == 0 {
+		nameservers = defaultRpzApex.Nameservers
+	}
+	seen := map[string]bool{}
+	for _, ns := range nameservers {
+		if _, ok := dns.IsDomainName(ns.Name); !ok || ns.Name == "" {
+			return nil, fmt.Errorf("services.rpz.nameservers: %q is not a valid nameserver name", ns.Name)
+		}
+		name := abs(ns.Name)
+		if seen[name] {
+			return nil, fmt.Errorf("services.rpz.nameservers: %s is listed more than once", name)
+		}
+		seen[name] = true
+		apex.NSrrs = append(apex.NSrrs, &dns.NS{
+			Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: soa.Ttl},
+			Ns:  name,
+		})
+
+		inzone := dns.IsSubDomain(zone, name)
+		switch {
+		case name == zone:
+			return nil, fmt.Errorf("services.rpz.nameservers: the nameserver cannot be the zone apex %s", zone)
+		case inzone && len(ns.Addresses) == 0:
+			return nil, fmt.Errorf("services.rpz.nameservers: %s is inside the zone and needs addresses (glue)", name)
+		case !inzone && len(ns.Addresses) > 0:
+			return nil, fmt.Errorf("services.rpz.nameservers: %s is outside the zone and cannot have glue", name)
+		}
+		for _, a := range ns.Addresses {
+			addr, err := netip.ParseAddr(a)
+			if err != nil {
+				return nil, fmt.Errorf("services.rpz.nameservers: %s: %v", name, err)
+			}
+			hdr := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: soa.Ttl}
+			if addr.Is4() || addr.Is4In6() {
+				hdr.Rrtype = dns.TypeA
+				apex.Glue = append(apex.Glue, &dns.A{Hdr: hdr, A: addr.Unmap().AsSlice()})
+			} else {
+				hdr.Rrtype = dns.TypeAAAA
+				apex.Glue = append(apex.Glue, &dns.AAAA{Hdr: hdr, AAAA: addr.AsSlice()})
+			}
+		}
+	}
+	slices.SortFunc(apex.Glue, func(a, b dns.RR) int {
+		if c := canonicalCompare(a.Header().Name, b.Header().Name); c != 0 {
+			return c
+		}
+		if a.Header().Rrtype != b.Header().Rrtype {
+			return int(a.Header().Rrtype) - int(b.Header().Rrtype)
+		}
+		return strings.Compare(a.String(), b.String())
+	})
+	apex.Glue = slices.CompactFunc(apex.Glue, dns.IsDuplicate)
+	return &apex, nil
+}
+
+// ReadRpzApex reads services.rpz from the main config file. It reads the file
+// again rather than use the global viper, so that a SIGHUP picks up changes.
+func ReadRpzApex(cfgfile string) (*RpzApex, error) {
+	v := viper.New()
+	v.SetConfigFile(cfgfile)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	var conf RpzConf
+	if err := v.UnmarshalKey("services.rpz", &conf); err != nil {
+		return nil, err
+	}
+	return NewRpzApex(conf)
+}
+
+// diffRRs returns the RRs in a that are not in b.
+func diffRRs(a, b []dns.RR) []dns.RR {
+	var res []dns.RR
+	for _, rr := range a {
+		if !slices.ContainsFunc(b, func(o dns.RR) bool { return dns.IsDuplicate(rr, o) }) {
+			res = append(res, rr)
+		}
+	}
+	return res
+}
+
+// SetRpzApex publishes apex as the apex of the RPZ output. If that changes
+// anything the zone gets a new serial with an IXFR that removes the old apex
+// RRs and adds the new ones, and the downstreams are notified.
+func (pd *PopData) SetRpzApex(apex *RpzApex) (RpzIxfr, error) {
+	pd.Rpz.wmu.Lock()
+	cur := pd.Rpz.Current()
+
+	soa := apex.SOA
+	soa.Serial = cur.SOA.Serial
+	oldglue := cur.Glue
+	removed := append(diffRRs(cur.NSrrs, apex.NSrrs), diffRRs(oldglue, apex.Glue)...)
+	added := append(diffRRs(apex.NSrrs, cur.NSrrs), diffRRs(apex.Glue, oldglue)...)
+	if soa.String() == cur.SOA.String() && len(removed) == 0 && len(added) == 0 {
+		pd.Rpz.wmu.Unlock()
+		return RpzIxfr{}, nil // nothing changed
+	}
+
+	next := cur.clone()
+	next.SOA, next.NSrrs, next.Glue = soa, apex.NSrrs, apex.Glue
+	next.Serial = cur.Serial + 1 // XXX: not dealing with serial wraps
+	next.Owners = cur.Owners     // the trigger names have not changed
+	next.seal()
+	ixfr := RpzIxfr{
+		FromSerial:  cur.Serial,
+		ToSerial:    next.Serial,
+		FromSOA:     cur.SOA,
+		ToSOA:       next.SOA,
+		ApexRemoved: append(removed, cur.apexRRs()...),
+		ApexAdded:   append(added, next.apexRRs()...),
+	}
+	next.IxfrChain = append(next.IxfrChain, ixfr)
+	pd.Rpz.publish(next)
+	pd.Rpz.wmu.Unlock()
+
+	pd.Logger.Printf("SetRpzApex: RPZ %s apex changed (%d RRs removed, %d added), new serial %d",
+		pd.Rpz.ZoneName, len(removed), len(added), next.Serial)
+	if err := pd.NotifyDownstreams(); err != nil {
+		return ixfr, err
+	}
+	return ixfr, nil
+}
+
+// ReloadRpzApex re-reads the apex config in cfgfile and applies it. If the
+// config is invalid, the current apex is kept and the error returned.
+func (pd *PopData) ReloadRpzApex(cfgfile string) error {
+	apex, err := ReadRpzApex(cfgfile)
+	if err != nil {
+		return fmt.Errorf("invalid RPZ apex config, keeping the current apex: %v", err)
+	}
+	_, err = pd.SetRpzApex(apex)
+	return err
+}
+
+// zoneRRs yields the RRs of the snapshot below the apex in canonical order:
+// the trigger names with the glue merged in.
+func (s *RpzSnapshot) zoneRRs() iter.Seq[dns.RR] {
+	return func(yield func(dns.RR) bool) {
+		glue := s.Glue
+		for _, name := range s.Owners {
+			rr := s.rr(name, s.Data[name])
+			for len(glue) > 0 && canonicalCompare(glue[0].Header().Name, rr.Header().Name) <= 0 {
+				if !yield(glue[0]) {
+					return
+				}
+				glue = glue[1:]
+			}
+			if !yield(rr) {
+				return
+			}
+		}
+		for _, rr := range glue {
+			if !yield(rr) {
+				return
+			}
+		}
+	}
+}
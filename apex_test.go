@@ -0,0 +1,177 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/dnstapir/tapir"
+	"github.com/miekg/dns"
+)
+
+func TestNewRpzApex(t *testing.T) {
+	ns := func(name string, addrs ...string) RpzNameserverConf {
+		return RpzNameserverConf{Name: name, Addresses: addrs}
+	}
+	cases := []struct {
+		name    string
+		conf    RpzConf
+		wantErr string // empty: valid
+		wantSOA string
+		wantNS  int
+		wantGlu int
+	}{
+		{
+			name:    "defaults",
+			conf:    RpzConf{ZoneName: "rpz.test."},
+			wantSOA: "rpz.test.\t3600\tIN\tSOA\tmname. hostmaster.dnstapir.se. 0 60 60 86400 60",
+			wantNS:  2,
+			wantGlu: 2,
+		},
+		{
+			name: "relative_names",
+			conf: RpzConf{
+				ZoneName:    "rpz.test",
+				Soa:         RpzSoaConf{Mname: "ns1", Rname: "Hostmaster", Ttl: 600, Refresh: 3600, Retry: 600, Expire: 604800, Minimum: 300},
+				Nameservers: []RpzNameserverConf{ns("ns1", "192.0.2.1", "2001:db8::1"), ns("ns.example.net.")},
+			},
+			wantSOA: "rpz.test.\t600\tIN\tSOA\tns1.rpz.test. hostmaster.rpz.test. 0 3600 600 604800 300",
+			wantNS:  2,
+			wantGlu: 2,
+		},
+		{
+			name:    "retry_above_refresh",
+			conf:    RpzConf{ZoneName: "rpz.test.", Soa: RpzSoaConf{Refresh: 60, Retry: 120}},
+			wantErr: "retry",
+		},
+		{
+			name:    "expire_too_small",
+			conf:    RpzConf{ZoneName: "rpz.test.", Soa: RpzSoaConf{Expire: 100}},
+			wantErr: "expire",
+		},
+		{
+			name:    "minimum_too_large",
+			conf:    RpzConf{ZoneName: "rpz.test.", Soa: RpzSoaConf{Minimum: 86401}},
+			wantErr: "minimum",
+		},
+		{
+			name:    "in_zone_without_glue",
+			conf:    RpzConf{ZoneName: "rpz.test.", Nameservers: []RpzNameserverConf{ns("ns1")}},
+			wantErr: "needs addresses",
+		},
+		{
+			name:    "out_of_zone_with_glue",
+			conf:    RpzConf{ZoneName: "rpz.test.", Nameservers: []RpzNameserverConf{ns("ns.example.net.", "192.0.2.1")}},
+			wantErr: "cannot have glue",
+		},
+		{
+			name:    "duplicate_nameserver",
+			conf:    RpzConf{ZoneName: "rpz.test.", Nameservers: []RpzNameserverConf{ns("ns1", "192.0.2.1"), ns("ns1.rpz.test.", "192.0.2.2")}},
+			wantErr: "more than once",
+		},
+		{
+			name:    "bad_address",
+			conf:    RpzConf{ZoneName: "rpz.test.", Nameservers: []RpzNameserverConf{ns("ns1", "192.0.2.300")}},
+			wantErr: "ns1.rpz.test.",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			apex, err := NewRpzApex(c.conf)
+			if c.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+					t.Fatalf("err = %v, want one mentioning %q", err, c.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewRpzApex: %v", err)
+			}
+			if got := apex.SOA.String(); got != c.wantSOA {
+				t.Errorf("SOA = %q, want %q", got, c.wantSOA)
+			}
+			if len(apex.NSrrs) != c.wantNS || len(apex.Glue) != c.wantGlu {
+				t.Errorf("%d NS and %d glue RRs, want %d and %d", len(apex.NSrrs), len(apex.Glue), c.wantNS, c.wantGlu)
+			}
+		})
+	}
+}
+
+// TestSetRpzApex changes the NS set and the SOA timers and checks that the
+// change is served as an IXFR and that an unchanged apex is a no-op.
+func TestSetRpzApex(t *testing.T) {
+	pd := newXfrTestPopData()
+	apex, err := NewRpzApex(RpzConf{
+		ZoneName:    "rpz.test.",
+		Soa:         RpzSoaConf{Refresh: 3600, Retry: 600},
+		Nameservers: []RpzNameserverConf{{Name: "ns2", Addresses: []string{"192.0.2.2"}}},
+	})
+	if err != nil {
+		t.Fatalf("NewRpzApex: %v", err)
+	}
+	// Enough names that the IXFR is cheaper than the full zone.
+	var tm tapir.TapirMsg
+	feed := pd.Lists["denylist"]["feed"]
+	for i := range 10 {
+		name := fmt.Sprintf("name%d.example.", i)
+		feed.Names.Put(tapir.TapirName{Name: name})
+		tm.Added = append(tm.Added, tapir.Domain{Name: name})
+	}
+	if _, err := pd.UpdateRpz(&tm, AuditCause{}); err != nil {
+		t.Fatalf("UpdateRpz: %v", err)
+	}
+
+	ixfr, err := pd.SetRpzApex(apex)
+	if err != nil {
+		t.Fatalf("SetRpzApex: %v", err)
+	}
+	if ixfr.FromSerial != 2 || ixfr.ToSerial != 3 {
+		t.Fatalf("IXFR from %d to %d, want 2 to 3", ixfr.FromSerial, ixfr.ToSerial)
+	}
+	if again, _ := pd.SetRpzApex(apex); again.ToSerial != 0 {
+		t.Errorf("unchanged apex gave a new serial %d", again.ToSerial)
+	}
+
+	r := new(dns.Msg)
+	r.SetIxfr(pd.Rpz.ZoneName, 2, "mname.", "hostmaster.dnstapir.se.")
+	w := &xfrRecorder{remote: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5300}}
+	if _, _, err := pd.RpzIxfrOut(w, r); err != nil {
+		t.Fatalf("RpzIxfrOut: %v", err)
+	}
+
+	var lines []string
+	var refresh []uint32
+	for _, rr := range w.answer() {
+		if soa, ok := rr.(*dns.SOA); ok {
+			refresh = append(refresh, soa.Refresh)
+			lines = append(lines, "SOA")
+			continue
+		}
+		if rr.Header().Rrtype == dns.TypeZONEMD {
+			lines = append(lines, "ZONEMD")
+			continue
+		}
+		lines = append(lines, rr.String())
+	}
+	want := []string{
+		"SOA",
+		"SOA", "rpz.test.\t3600\tIN\tNS\tns1.rpz.test.", "ZONEMD",
+		"SOA", "rpz.test.\t3600\tIN\tNS\tns2.rpz.test.", "ns2.rpz.test.\t3600\tIN\tA\t192.0.2.2", "ZONEMD",
+		"SOA",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("IXFR:\n%s\nwant:\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+	// The from SOA has the old timers, the others the new ones.
+	wantRefresh := []uint32{3600, 60, 3600, 3600}
+	for i, r := range refresh {
+		if r != wantRefresh[i] {
+			t.Errorf("SOA %d has refresh %d, want %d", i, r, wantRefresh[i])
+		}
+	}
+}
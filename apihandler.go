@@ -16,6 +16,7 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/ryanuber/columnize"
 	"github.com/spf13/viper"
 
 	"github.com/dnstapir/tapir"
@@ -29,6 +30,11 @@ type RpzCmdData struct {
 	RpzSource string // Name of one feed
 	Policy    string
 	Action    string
+	Update    *tapir.TapirMsg // LIST-UPDATE: names to add to and remove from a list
+	Caller    string          // LIST-UPDATE, OVERRIDE-*: the API identity, for the audit log
+	Override  *Override       // OVERRIDE-SET: the override; OVERRIDE-REMOVE takes the name in Domain
+	Bootstrap *tapir.WBGlist  // LIST-BOOTSTRAP: the bootstrapped list
+	Since     time.Time       // LIST-BOOTSTRAP: when the bootstrap was requested
 	Result    chan RpzCmdResponse
 }
 
@@ -103,12 +109,7 @@ func APIcommand(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 				Status: "stopping",
 				Msg:    "Daemon was happy, but now winding down",
 			}
-			log.Printf("Stopping MQTT engine\n")
-			_, err := conf.PopData.MqttEngine.StopEngine()
-			if err != nil {
-				resp.Error = true
-				resp.ErrorMsg = err.Error()
-			}
+			// mainloop shuts down everything, the MQTT engine included.
 			conf.Internal.APIStopCh <- struct{}{}
 		case "bump":
 			resp.Msg, err = BumpSerial(conf, cp.Zone)
@@ -202,6 +203,16 @@ func APIcommand(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 			}
 			resp.Msg = rpzresp.Msg
 
+		case "rpz-digest":
+			snap := conf.PopData.Rpz.Current()
+			if snap.ZONEMD() == nil {
+				resp.Error = true
+				resp.ErrorMsg = fmt.Sprintf("RPZ %s has no zone digest (yet)", conf.PopData.Rpz.ZoneName)
+				break
+			}
+			resp.Msg = fmt.Sprintf("RPZ %s serial %d: %d names, ZONEMD %s",
+				conf.PopData.Rpz.ZoneName, snap.Serial, len(snap.Data), snap.ZONEMD().String())
+
 		case "rpz-list-sources":
 			log.Printf("Received RPZ-LIST-SOURCES command")
 
@@ -290,15 +301,17 @@ func APIbootstrap(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 				resp.ErrorMsg = fmt.Sprintf("Doubtlist '%s' not found", bp.ListName)
 				return
 			}
-			log.Printf("Found %s doubtlist containing %d names", bp.ListName, len(doubtlist.Names))
+			log.Printf("Found %s doubtlist containing %d names", bp.ListName, doubtlist.Names.Len())
 
 			switch bp.Encoding {
 			case "gob":
 				w.Header().Set("Content-Type", "application/octet-stream")
 				w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=doubtlist-%s.gob", bp.ListName))
 
+				exported := *doubtlist.WBGlist
+				exported.Names = doubtlist.nameMap()
 				encoder := gob.NewEncoder(w)
-				err := encoder.Encode(doubtlist)
+				err := encoder.Encode(&exported)
 				if err != nil {
 					log.Printf("Error encoding doubtlist: %v", err)
 					resp.Error = true
@@ -408,7 +421,7 @@ func APIdebug(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 		switch dp.Command {
 		case "rrset":
 			log.Printf("TAPIR-POP debug rrset inquiry")
-			if zd, ok := td.RpzSources[dp.Zone]; ok {
+			if zd, ok := td.RpzSource(dp.Zone); ok {
 				if owner := &zd.Owners[zd.OwnerIndex[dp.Qname]]; owner != nil {
 					if rrset, ok := owner.RRtypes[dp.Qtype]; ok {
 						resp.RRset = rrset
@@ -421,7 +434,7 @@ func APIdebug(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 
 		case "zonedata":
 			log.Printf("TAPIR-POP debug zone inquiry")
-			if zd, ok := td.RpzSources[dp.Zone]; ok {
+			if zd, ok := td.RpzSource(dp.Zone); ok {
 				//			       resp.ZoneData = *zd
 				//			       resp.ZoneData.RRKeepFunc = nil
 				//			       resp.ZoneData.RRParseFunc = nil
@@ -447,6 +460,14 @@ func APIdebug(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 
+		case "xfr-stats":
+			log.Printf("TAPIR-POP debug xfr stats")
+			out := []string{"IXFR strategy|Responses"}
+			for s := IxfrChained; s < numIxfrStrategies; s++ {
+				out = append(out, fmt.Sprintf("%s|%d", s, td.XfrStats.Ixfr[s].Load()))
+			}
+			resp.Msg = columnize.SimpleFormat(out)
+
 		case "filterlists":
 			log.Printf("TAPIR-POP debug allow/deny/doubt lists")
 			resp.Lists = map[string]map[string]*tapir.WBGlist{}
@@ -458,7 +479,7 @@ func APIdebug(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 						Description: td.Lists[t][n].Description,
 						Type:        td.Lists[t][n].Type,
 						Format:      td.Lists[t][n].Format,
-						Names:       td.Lists[t][n].Names,
+						Names:       td.Lists[t][n].nameMap(),
 						Filename:    td.Lists[t][n].Filename,
 						RpzZoneName: td.Lists[t][n].RpzZoneName,
 						RpzSerial:   td.Lists[t][n].RpzSerial,
@@ -474,10 +495,19 @@ func APIdebug(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 				resp.Error = true
 				resp.ErrorMsg = err.Error()
 			}
-			resp.DenylistedNames = td.DenylistedNames
-			resp.DoubtlistedNames = td.DoubtlistedNames
-			for _, rpzn := range td.Rpz.Axfr.Data {
-				resp.RpzOutput = append(resp.RpzOutput, *rpzn)
+			td.mu.RLock()
+			deny, doubt := td.listedNames()
+			td.mu.RUnlock()
+			resp.DenylistedNames = deny
+			resp.DoubtlistedNames = make(map[string]*tapir.TapirName, len(doubt))
+			for name, e := range doubt {
+				tn := e.tapirName(name)
+				resp.DoubtlistedNames[name] = &tn
+			}
+			snap := td.Rpz.Current()
+			for name, action := range snap.Data {
+				rr := snap.rr(name, action)
+				resp.RpzOutput = append(resp.RpzOutput, tapir.RpzName{Name: name, RR: &rr, Action: action})
 			}
 
 		case "send-status":
@@ -521,21 +551,45 @@ func APIdebug(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 func SetupRouter(conf *Config) *mux.Router {
 	r := mux.NewRouter().StrictSlash(true)
 
-	sr := r.PathPrefix("/api/v1").Headers("X-API-Key",
-		viper.GetString("apiserver.key")).Subrouter()
+	// Unauthenticated, for orchestration and load balancers.
+	r.HandleFunc("/healthz", APIhealthz(conf)).Methods("GET", "HEAD")
+	r.HandleFunc("/readyz", APIreadyz(conf)).Methods("GET", "HEAD")
+
+	auth, err := NewApiAuth()
+	if err != nil {
+		POPExiter("SetupRouter: Error from NewApiAuth(): %v", err)
+	}
+
+	sr := r.PathPrefix("/api/v1").Subrouter()
+	sr.Use(auth.Middleware(v1Need))
 	sr.HandleFunc("/ping", tapir.APIping("tapir-pop", conf.BootTime)).Methods("POST")
 	sr.HandleFunc("/command", APIcommand(conf)).Methods("POST")
 	sr.HandleFunc("/bootstrap", APIbootstrap(conf)).Methods("POST")
 	sr.HandleFunc("/debug", APIdebug(conf)).Methods("POST")
 	// sr.HandleFunc("/show/api", tapir.APIshowAPI(r)).Methods("GET")
 
+	v2 := r.PathPrefix("/api/v2").Subrouter()
+	v2.Use(auth.Middleware(v2Need))
+	for _, rt := range apiv2Routes() {
+		if rt.Handler != nil {
+			v2.HandleFunc(rt.Path, rt.Handler(conf)).Methods(rt.Method).Name(rt.Name)
+		}
+	}
+	v2.HandleFunc("/openapi.json", APIv2openapi(r)).Methods("GET").Name("getOpenAPI")
+
 	return r
 }
 
 func SetupBootstrapRouter(conf *Config) *mux.Router {
 	r := mux.NewRouter().StrictSlash(true)
 
-	sr := r.PathPrefix("/api/v1").Headers("X-API-Key", viper.GetString("apiserver.key")).Subrouter()
+	auth, err := NewApiAuth()
+	if err != nil {
+		POPExiter("SetupBootstrapRouter: Error from NewApiAuth(): %v", err)
+	}
+
+	sr := r.PathPrefix("/api/v1").Subrouter()
+	sr.Use(auth.Middleware(v1Need))
 	sr.HandleFunc("/ping", tapir.APIping("tapir-pop", conf.BootTime)).Methods("POST")
 	sr.HandleFunc("/bootstrap", APIbootstrap(conf)).Methods("POST")
 	// sr.HandleFunc("/debug", APIdebug(conf)).Methods("POST")
@@ -561,8 +615,8 @@ func walkRoutes(router *mux.Router, address string) {
 	//	return nil
 }
 
-// In practice APIdispatcher doesn't need a termination signal, as it will
-// just sit inside http.ListenAndServe, but we keep it for symmetry.
+// APIhandler doesn't need the termination signal, as the servers are closed
+// by the shutdown (see serveHTTP), but we keep it for symmetry.
 func APIhandler(conf *Config, done <-chan struct{}) {
 	gob.Register(tapir.WBGlist{}) // Must register the type for gob encoding
 	router := SetupRouter(conf)
@@ -626,7 +680,7 @@ func APIhandler(conf *Config, done <-chan struct{}) {
 
 				log.Printf("*** API: Starting API dispatcher #%d. Listening on %s", idx+1, address)
 				wg.Done()
-				POPExiter(apiServer.ListenAndServe())
+				serveHTTP(conf, apiServer, "", "")
 			}(&wg)
 		}
 	}
@@ -645,7 +699,7 @@ func APIhandler(conf *Config, done <-chan struct{}) {
 					}
 					log.Printf("*** API: Starting TLS API dispatcher #%d. Listening on %s", idx+1, tlsaddress)
 					wg.Done()
-					POPExiter(tlsServer.ListenAndServeTLS(certfile, keyfile))
+					serveHTTP(conf, tlsServer, certfile, keyfile)
 				}(&wg)
 			}
 		} else {
@@ -665,7 +719,7 @@ func APIhandler(conf *Config, done <-chan struct{}) {
 				}
 				log.Printf("*** API: Starting Bootstrap API dispatcher #%d. Listening on %s", idx+1, address)
 				wg.Done()
-				POPExiter(apiServer.ListenAndServe())
+				serveHTTP(conf, apiServer, "", "")
 			}(&wg)
 		}
 	} else {
@@ -687,7 +741,7 @@ func APIhandler(conf *Config, done <-chan struct{}) {
 
 					log.Printf("*** API: Starting Bootstrap TLS API dispatcher #%d. Listening on %s", idx+1, address)
 					wg.Done()
-					POPExiter(bootstrapTlsServer.ListenAndServeTLS(certfile, keyfile))
+					serveHTTP(conf, bootstrapTlsServer, certfile, keyfile)
 				}(&wg)
 			}
 		} else {
@@ -698,7 +752,7 @@ func APIhandler(conf *Config, done <-chan struct{}) {
 	}
 
 	wg.Wait()
-	log.Println("API dispatcher: unclear how to stop the http server nicely.")
+	// The servers are closed by the shutdown, see serveHTTP.
 }
 
 func BumpSerial(conf *Config, zone string) (string, error) {
@@ -0,0 +1,1376 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/gorilla/mux"
+	"github.com/miekg/dns"
+	"github.com/smhanov/dawg"
+)
+
+// The v2 API: the sources, lists, names, outputs, downstreams, RPZ and policy
+// of the POP as REST resources under /api/v2, next to the command-style v1
+// API. Collections are paged (see pageReq) and every body has a JSON schema,
+// served under /api/v2/schemas and in /api/v2/openapi.json.
+
+// apiRoute describes one route of the v2 API. SetupRouter registers the
+// routes and GenerateOpenAPI documents them.
+type apiRoute struct {
+	Name     string
+	Method   string
+	Path     string // relative to /api/v2
+	Summary  string
+	Query    []apiParam
+	Request  any     // the request body, nil if none
+	Response any     // the response body on success
+	Export   any     // if set, the response can also be CSV or lines of this, see tagQuery
+	Role     apiRole // the role needed; if not set, read-only for GET and operator otherwise
+	Handler  func(conf *Config) func(w http.ResponseWriter, r *http.Request)
+}
+
+func (rt apiRoute) role() apiRole {
+	switch {
+	case rt.Role != roleNone:
+		return rt.Role
+	case rt.Method == "GET":
+		return roleReadOnly
+	default:
+		return roleOperator
+	}
+}
+
+type apiParam struct {
+	Name        string
+	Description string
+}
+
+// listTypeVar matches the list types in a route.
+const listTypeVar = "{type:allowlist|denylist|doubtlist}"
+
+var pageParams = []apiParam{
+	{"prefix", "only items whose name starts with this"},
+	{"limit", fmt.Sprintf("number of items per page, at most %d (default %d)", apiMaxLimit, apiDefaultLimit)},
+	{"cursor", "the next cursor of the previous page"},
+}
+
+var tagQueryParams = slices.Concat([]apiParam{
+	{"type", "only the lists of this type: allowlist | denylist | doubtlist"},
+	{"source", "only the list of this source"},
+	{"tags", "comma-separated tags that a name must all have"},
+	{"nottags", "comma-separated tags that a name must have none of"},
+	{"mintags", "the least number of tags a name must have"},
+	{"maxtags", "the largest number of tags a name may have"},
+	{"format", "json (default) | csv; csv is not paged"},
+	{"stream", "true for all the names as they are found, not paged or sorted; json is then one object per line, and limit and cursor are not allowed"},
+}, pageParams)
+
+var historyParams = []apiParam{
+	{"limit", fmt.Sprintf("number of the latest changes, at most %d (default %d)", apiMaxLimit, apiDefaultLimit)},
+}
+
+func apiv2Routes() []apiRoute {
+	return []apiRoute{
+		{Name: "listSources", Method: "GET", Path: "/sources", Summary: "List the sources",
+			Query: pageParams, Response: Page[SourceInfo]{}, Handler: APIv2sources},
+		{Name: "getSource", Method: "GET", Path: "/sources/{source}", Summary: "Get a source",
+			Response: SourceInfo{}, Handler: APIv2source},
+		{Name: "listLists", Method: "GET", Path: "/lists", Summary: "List the list types and their sources",
+			Response: []ListInfo{}, Handler: APIv2lists},
+		{Name: "listListSources", Method: "GET", Path: "/lists/" + listTypeVar, Summary: "List the sources of a list type",
+			Query: pageParams, Response: Page[SourceInfo]{}, Handler: APIv2sources},
+		{Name: "getList", Method: "GET", Path: "/lists/" + listTypeVar + "/{source}", Summary: "Get a list",
+			Response: SourceInfo{}, Handler: APIv2source},
+		{Name: "listListNames", Method: "GET", Path: "/lists/" + listTypeVar + "/{source}/names", Summary: "List the names in a list",
+			Query: pageParams, Response: Page[ListName]{}, Handler: APIv2listNames},
+		{Name: "addListNames", Method: "POST", Path: "/lists/" + listTypeVar + "/{source}/names", Summary: "Add names to a list managed through the API",
+			Request: NamesUpdate{}, Response: UpdateResult{}, Handler: APIv2addListNames},
+		{Name: "removeListName", Method: "DELETE", Path: "/lists/" + listTypeVar + "/{source}/names/{name}", Summary: "Remove a name from a list managed through the API",
+			Response: UpdateResult{}, Handler: APIv2removeListName},
+		// Source names are unique across the list types, so the type may be left out.
+		{Name: "listSourceNames", Method: "GET", Path: "/lists/{source}/names", Summary: "List the names in a list",
+			Query: pageParams, Response: Page[ListName]{}, Handler: APIv2listNames},
+		{Name: "addSourceNames", Method: "POST", Path: "/lists/{source}/names", Summary: "Add names to a list managed through the API",
+			Request: NamesUpdate{}, Response: UpdateResult{}, Handler: APIv2addListNames},
+		{Name: "removeSourceName", Method: "DELETE", Path: "/lists/{source}/names/{name}", Summary: "Remove a name from a list managed through the API",
+			Response: UpdateResult{}, Handler: APIv2removeListName},
+		{Name: "queryNames", Method: "GET", Path: "/names", Summary: "Find the names in the lists by their tags",
+			Query: tagQueryParams, Response: Page[TaggedName]{}, Export: TaggedName{}, Handler: APIv2queryNames},
+		{Name: "getName", Method: "GET", Path: "/names/{name}", Summary: "Get the policy decision for a name",
+			Response: NameInfo{}, Handler: APIv2name},
+		{Name: "getNameHistory", Method: "GET", Path: "/names/{name}/history", Summary: "Get the changes to the RPZ action for a name from the audit log",
+			Query: historyParams, Response: NameHistory{}, Handler: APIv2nameHistory},
+		{Name: "listOverrides", Method: "GET", Path: "/overrides", Summary: "List the overrides",
+			Query: pageParams, Response: Page[OverrideInfo]{}, Handler: APIv2overrides},
+		{Name: "getOverride", Method: "GET", Path: "/overrides/{name}", Summary: "Get the override for a name",
+			Response: OverrideInfo{}, Handler: APIv2override},
+		{Name: "setOverride", Method: "PUT", Path: "/overrides/{name}", Summary: "Add or replace the override for a name",
+			Request: OverrideUpdate{}, Response: UpdateResult{}, Handler: APIv2setOverride},
+		{Name: "removeOverride", Method: "DELETE", Path: "/overrides/{name}", Summary: "Remove the override for a name before it ends",
+			Response: UpdateResult{}, Handler: APIv2removeOverride},
+		{Name: "listOutputs", Method: "GET", Path: "/outputs", Summary: "List the outputs",
+			Query: pageParams, Response: Page[OutputInfo]{}, Handler: APIv2outputs},
+		{Name: "listDownstreams", Method: "GET", Path: "/downstreams", Summary: "List the RPZ downstreams",
+			Query: pageParams, Response: Page[DownstreamInfo]{}, Handler: APIv2downstreams},
+		{Name: "getRpz", Method: "GET", Path: "/rpz", Summary: "Get the RPZ output",
+			Response: RpzInfo{}, Handler: APIv2rpz},
+		{Name: "listRpzNames", Method: "GET", Path: "/rpz/names", Summary: "List the names in the RPZ output, in canonical order",
+			Query: pageParams, Response: Page[RpzEntry]{}, Handler: APIv2rpzNames},
+		{Name: "getPolicy", Method: "GET", Path: "/policy", Summary: "Get the policy",
+			Response: PolicyInfo{}, Handler: APIv2policy},
+		{Name: "listLogLevels", Method: "GET", Path: "/logging", Summary: "Get the log level of each component",
+			Response: []LogLevelInfo{}, Handler: APIv2logLevels},
+		{Name: "setLogLevel", Method: "PUT", Path: "/logging/{component}", Summary: "Change the log level of a component",
+			Request: LogLevelUpdate{}, Response: LogLevelInfo{}, Role: roleAdmin, Handler: APIv2setLogLevel},
+		{Name: "listSchemas", Method: "GET", Path: "/schemas", Summary: "Get the JSON schemas of all bodies",
+			Response: map[string]any{}, Handler: APIv2schemas},
+		{Name: "getSchema", Method: "GET", Path: "/schemas/{name}", Summary: "Get a JSON schema",
+			Response: map[string]any{}, Handler: APIv2schema},
+		// Registered by SetupRouter, as it needs the router.
+		{Name: "getOpenAPI", Method: "GET", Path: "/openapi.json", Summary: "Get this OpenAPI document",
+			Response: map[string]any{}},
+	}
+}
+
+type ApiError struct {
+	Error string `json:"error"`
+}
+
+// Page is one page of a collection, in order of name.
+type Page[T any] struct {
+	Items []T    `json:"items"`
+	Next  string `json:"next,omitempty" doc:"cursor for the next page; not set on the last page"`
+}
+
+type SourceInfo struct {
+	Name        string `json:"name"`
+	ListType    string `json:"listtype"`
+	Datasource  string `json:"datasource" doc:"file | xfr | mqtt | api"`
+	Format      string `json:"format" doc:"internal storage: map | dawg"`
+	Description string `json:"description,omitempty"`
+	Names       int    `json:"names" doc:"number of names in the list"`
+	Writable    bool   `json:"writable" doc:"names can be added and removed through the API"`
+	Filename    string `json:"filename,omitempty"`
+	Upstream    string `json:"upstream,omitempty"`
+	Zone        string `json:"zone,omitempty"`
+	Serial      int    `json:"serial,omitempty"`
+}
+
+type ListInfo struct {
+	Type    string   `json:"type"`
+	Sources []string `json:"sources"`
+	Names   int      `json:"names" doc:"number of names in all the sources together"`
+}
+
+type ListName struct {
+	Name      string    `json:"name"`
+	TimeAdded time.Time `json:"time_added,omitzero" doc:"ignored when adding a name"`
+	TTL       int       `json:"ttl,omitempty" doc:"seconds until the name is removed again; 0 is never"`
+	Tags      []string  `json:"tags,omitempty"`
+}
+
+type NamesUpdate struct {
+	Names []ListName `json:"names"`
+}
+
+type UpdateResult struct {
+	Added   int    `json:"added,omitempty"`
+	Removed int    `json:"removed,omitempty"`
+	Serial  uint32 `json:"serial" doc:"RPZ serial with the change"`
+}
+
+type NameInfo struct {
+	Name   string     `json:"name"`
+	Action string     `json:"action" doc:"the RPZ action; allowlist means not filtered"`
+	Stage  string     `json:"stage" doc:"the deciding stage: override | allowlist | denylist | doubtlist | none"`
+	Lists  []NameHit  `json:"lists,omitempty" doc:"every list that has the name"`
+	Rules  []NameRule `json:"rules,omitempty" doc:"the doubtlist rules that fired, or the override"`
+	Rpz    *RpzEntry  `json:"rpz,omitempty" doc:"the entry in the served RPZ, if any"`
+	Serial uint32     `json:"serial" doc:"the served RPZ serial"`
+
+	FirstSeen time.Time `json:"first_seen,omitzero" doc:"when a source first listed the name; not set if no source gave a time"`
+	LastSeen  time.Time `json:"last_seen,omitzero"`
+	Age       int       `json:"age,omitempty" doc:"seconds since the name was first seen"`
+}
+
+// TaggedName is a name in one list, as found by a tag query.
+type TaggedName struct {
+	Name      string    `json:"name"`
+	ListType  string    `json:"listtype"`
+	Source    string    `json:"source"`
+	TimeAdded time.Time `json:"time_added,omitzero"`
+	TTL       int       `json:"ttl,omitempty"`
+	Tags      []string  `json:"tags,omitempty"`
+}
+
+type NameHistory struct {
+	Name    string        `json:"name"`
+	Changes []AuditRecord `json:"changes" doc:"oldest first"`
+}
+
+type NameHit struct {
+	ListType  string    `json:"listtype"`
+	Source    string    `json:"source"`
+	TimeAdded time.Time `json:"time_added,omitzero"`
+	TTL       int       `json:"ttl,omitempty"`
+	Tags      []string  `json:"tags,omitempty"`
+}
+
+type NameRule struct {
+	Rule   string `json:"rule"`
+	Action string `json:"action"`
+	Detail string `json:"detail"`
+}
+
+type RpzEntry struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+}
+
+type OverrideInfo struct {
+	Name      string    `json:"name"`
+	Action    string    `json:"action"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	Active    bool      `json:"active" doc:"the override decides the name now"`
+	Comment   string    `json:"comment,omitempty"`
+	Caller    string    `json:"caller,omitempty" doc:"the API key or client certificate that made it"`
+	Created   time.Time `json:"created"`
+}
+
+type OverrideUpdate struct {
+	Action    string    `json:"action" doc:"allowlist | nxdomain | nodata | drop"`
+	NotBefore time.Time `json:"not_before,omitzero" doc:"when the override starts; now if not set"`
+	NotAfter  time.Time `json:"not_after,omitzero" doc:"when the override ends; either this or ttl"`
+	TTL       int       `json:"ttl,omitempty" doc:"seconds from not_before until the override ends; either this or not_after"`
+	Comment   string    `json:"comment,omitempty"`
+}
+
+type OutputInfo struct {
+	Name        string `json:"name"`
+	Active      bool   `json:"active"`
+	Description string `json:"description,omitempty"`
+	Type        string `json:"type"`
+	Format      string `json:"format"`
+	Downstream  string `json:"downstream,omitempty"`
+}
+
+type DownstreamInfo struct {
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+	Serial  uint32 `json:"serial,omitempty" doc:"the last serial the downstream is known to have"`
+}
+
+type RpzInfo struct {
+	Zone   string        `json:"zone"`
+	Serial uint32        `json:"serial"`
+	Names  int           `json:"names"`
+	Digest string        `json:"digest,omitempty" doc:"SHA-384 ZONEMD digest, in hex"`
+	Ixfrs  []RpzIxfrInfo `json:"ixfrs" doc:"the IXFR chain, oldest first"`
+}
+
+type RpzIxfrInfo struct {
+	FromSerial uint32 `json:"from_serial"`
+	ToSerial   uint32 `json:"to_serial"`
+	Added      int    `json:"added"`
+	Removed    int    `json:"removed"`
+}
+
+type LogLevelInfo struct {
+	Component string `json:"component"`
+	Level     string `json:"level" doc:"DEBUG | INFO | WARN | ERROR"`
+}
+
+type LogLevelUpdate struct {
+	Level string `json:"level" doc:"debug | info | warn | error"`
+}
+
+type PolicyInfo struct {
+	AllowlistAction string              `json:"allowlist_action"`
+	DenylistAction  string              `json:"denylist_action"`
+	Doubtlist       DoubtlistPolicyInfo `json:"doubtlist"`
+}
+
+type DoubtlistPolicyInfo struct {
+	NumSources         int      `json:"numsources"`
+	NumSourcesAction   string   `json:"numsources_action"`
+	NumTapirTags       int      `json:"numtapirtags"`
+	NumTapirTagsAction string   `json:"numtapirtags_action"`
+	DenyTapirTags      []string `json:"denytapir_tags"`
+	DenyTapirAction    string   `json:"denytapir_action"`
+	FirstSeenAge       int      `json:"firstseen_age,omitempty" doc:"seconds; not set if the firstseen rule is not used"`
+	FirstSeenAction    string   `json:"firstseen_action,omitempty"`
+}
+
+func apiWriteJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("apiWriteJSON: Error from json encoder: %v", err)
+	}
+}
+
+func apiError(w http.ResponseWriter, code int, format string, args ...any) {
+	apiWriteJSON(w, code, ApiError{Error: fmt.Sprintf(format, args...)})
+}
+
+const (
+	apiDefaultLimit = 100
+	apiMaxLimit     = 1000
+)
+
+// pageReq is the page of a collection that is asked for: at most limit items
+// with names that start with prefix and come after the name that the cursor
+// stands for.
+type pageReq struct {
+	prefix string
+	after  string
+	limit  int
+}
+
+func parsePageReq(r *http.Request) (pageReq, error) {
+	q := r.URL.Query()
+	pr := pageReq{prefix: q.Get("prefix"), limit: apiDefaultLimit}
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > apiMaxLimit {
+			return pr, fmt.Errorf("limit must be 1 to %d", apiMaxLimit)
+		}
+		pr.limit = n
+	}
+	if c := q.Get("cursor"); c != "" {
+		after, err := base64.RawURLEncoding.DecodeString(c)
+		if err != nil {
+			return pr, fmt.Errorf("invalid cursor")
+		}
+		pr.after = string(after)
+	}
+	return pr, nil
+}
+
+func pageCursor(name string) string { return base64.RawURLEncoding.EncodeToString([]byte(name)) }
+
+// pageOf pages items, which are sorted by name.
+func pageOf[T any](pr pageReq, items []T, name func(T) string) Page[T] {
+	start, _ := slices.BinarySearchFunc(items, pr.prefix, func(item T, prefix string) int {
+		return strings.Compare(name(item), prefix)
+	})
+	if pr.after != "" {
+		after, found := slices.BinarySearchFunc(items, pr.after, func(item T, after string) int {
+			return strings.Compare(name(item), after)
+		})
+		if found {
+			after++
+		}
+		start = max(start, after)
+	}
+	page := Page[T]{Items: []T{}}
+	for _, item := range items[start:] {
+		if !strings.HasPrefix(name(item), pr.prefix) {
+			break
+		}
+		if len(page.Items) == pr.limit {
+			page.Next = pageCursor(name(page.Items[len(page.Items)-1]))
+			break
+		}
+		page.Items = append(page.Items, item)
+	}
+	return page
+}
+
+// dawgPage pages the names in a dawg, which are in lexical order.
+func dawgPage(pr pageReq, df dawg.Finder) Page[ListName] {
+	page := Page[ListName]{Items: []ListName{}}
+	df.Enumerate(func(index int, word []rune, final bool) dawg.EnumerationResult {
+		s := string(word)
+		switch {
+		case !strings.HasPrefix(s, pr.prefix) && !strings.HasPrefix(pr.prefix, s):
+			return dawg.Skip
+		case s <= pr.after && !strings.HasPrefix(pr.after, s):
+			return dawg.Skip // all of this branch comes before the cursor
+		case !final || s <= pr.after || !strings.HasPrefix(s, pr.prefix):
+			return dawg.Continue
+		case len(page.Items) == pr.limit:
+			page.Next = pageCursor(page.Items[len(page.Items)-1].Name)
+			return dawg.Stop
+		}
+		page.Items = append(page.Items, ListName{Name: s})
+		return dawg.Continue
+	})
+	return page
+}
+
+func tagNames(mask tapir.TagMask) []string {
+	var tags []string
+	for i, tag := range tapir.DefinedTags {
+		if mask.HasTag(tapir.TagMask(1 << i)) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func sourceInfo(wbgl *PopList) SourceInfo {
+	si := SourceInfo{
+		Name:        wbgl.Name,
+		ListType:    wbgl.Type,
+		Datasource:  wbgl.Datasource,
+		Format:      wbgl.Format,
+		Description: wbgl.Description,
+		Names:       wbgl.Names.Len(),
+		Writable:    wbgl.Datasource == "api",
+		Filename:    wbgl.Filename,
+		Upstream:    wbgl.RpzUpstream,
+		Zone:        wbgl.RpzZoneName,
+		Serial:      wbgl.RpzSerial,
+	}
+	if wbgl.Format == "dawg" && wbgl.Dawgf != nil {
+		si.Names = wbgl.Dawgf.NumAdded()
+	}
+	if si.Zone == "." {
+		si.Zone = "" // dns.Fqdn("") for sources without a zone
+	}
+	return si
+}
+
+// apiList finds a list from the type and source route variables. The type
+// may be left out. The caller must hold pd.mu.
+func (pd *PopData) apiList(vars map[string]string) (*PopList, int, error) {
+	source := vars["source"]
+	if listtype, typed := vars["type"]; typed {
+		if wbgl, exist := pd.Lists[listtype][source]; exist {
+			return wbgl, http.StatusOK, nil
+		}
+		return nil, http.StatusNotFound, fmt.Errorf("list [%s][%s] does not exist", listtype, source)
+	}
+	var found []*PopList
+	for _, listtype := range []string{"allowlist", "denylist", "doubtlist"} {
+		if wbgl, exist := pd.Lists[listtype][source]; exist {
+			found = append(found, wbgl)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, http.StatusNotFound, fmt.Errorf("source %q does not exist", source)
+	case 1:
+		return found[0], http.StatusOK, nil
+	default:
+		return nil, http.StatusConflict, fmt.Errorf("there are lists of more than one type named %q", source)
+	}
+}
+
+// APIv2sources lists the sources, of all list types or of the one in the route.
+func APIv2sources(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pd := conf.PopData
+		pr, err := parsePageReq(r)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		listtypes := []string{"allowlist", "denylist", "doubtlist"}
+		if listtype, typed := mux.Vars(r)["type"]; typed {
+			listtypes = []string{listtype}
+		}
+		var sources []SourceInfo
+		pd.mu.RLock()
+		for _, listtype := range listtypes {
+			for _, wbgl := range pd.Lists[listtype] {
+				sources = append(sources, sourceInfo(wbgl))
+			}
+		}
+		pd.mu.RUnlock()
+		sort.Slice(sources, func(i, j int) bool { return sources[i].Name < sources[j].Name })
+		apiWriteJSON(w, http.StatusOK, pageOf(pr, sources, func(si SourceInfo) string { return si.Name }))
+	}
+}
+
+// APIv2source returns one source, by name or by list type and name.
+func APIv2source(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pd := conf.PopData
+		pd.mu.RLock()
+		wbgl, code, err := pd.apiList(mux.Vars(r))
+		var si SourceInfo
+		if err == nil {
+			si = sourceInfo(wbgl)
+		}
+		pd.mu.RUnlock()
+		if err != nil {
+			apiError(w, code, "%v", err)
+			return
+		}
+		apiWriteJSON(w, http.StatusOK, si)
+	}
+}
+
+func APIv2lists(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pd := conf.PopData
+		var lists []ListInfo
+		pd.mu.RLock()
+		for _, listtype := range []string{"allowlist", "denylist", "doubtlist"} {
+			li := ListInfo{Type: listtype, Sources: []string{}}
+			for name, wbgl := range pd.Lists[listtype] {
+				li.Sources = append(li.Sources, name)
+				li.Names += sourceInfo(wbgl).Names
+			}
+			slices.Sort(li.Sources)
+			lists = append(lists, li)
+		}
+		pd.mu.RUnlock()
+		apiWriteJSON(w, http.StatusOK, lists)
+	}
+}
+
+func APIv2listNames(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pd := conf.PopData
+		pr, err := parsePageReq(r)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		pd.mu.RLock()
+		defer pd.mu.RUnlock()
+		wbgl, code, err := pd.apiList(mux.Vars(r))
+		if err != nil {
+			apiError(w, code, "%v", err)
+			return
+		}
+		if wbgl.Format == "dawg" {
+			apiWriteJSON(w, http.StatusOK, dawgPage(pr, wbgl.Dawgf))
+			return
+		}
+		// The store gives the names in order, so a page costs only itself.
+		resp := Page[ListName]{Items: []ListName{}}
+		err = wbgl.Names.Ascend(max(pr.prefix, pr.after), func(tn tapir.TapirName) bool {
+			switch {
+			case tn.Name == pr.after:
+				return true
+			case !strings.HasPrefix(tn.Name, pr.prefix):
+				return false
+			case len(resp.Items) == pr.limit:
+				resp.Next = pageCursor(resp.Items[len(resp.Items)-1].Name)
+				return false
+			}
+			resp.Items = append(resp.Items, ListName{
+				Name:      tn.Name,
+				TimeAdded: tn.TimeAdded,
+				TTL:       int(tn.TTL / time.Second),
+				Tags:      tagNames(tn.TagMask),
+			})
+			return true
+		})
+		if err != nil {
+			apiError(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		apiWriteJSON(w, http.StatusOK, resp)
+	}
+}
+
+// apiListUpdate checks that the list in the route can be changed through the
+// API and has the RefreshEngine apply tm to it.
+func apiListUpdate(conf *Config, w http.ResponseWriter, r *http.Request, tm *tapir.TapirMsg) (UpdateResult, bool) {
+	pd := conf.PopData
+	pd.mu.RLock()
+	wbgl, code, err := pd.apiList(mux.Vars(r))
+	if err == nil && wbgl.Datasource != "api" {
+		code = http.StatusConflict
+		err = fmt.Errorf("list [%s][%s] is fed from %s and cannot be changed through the API",
+			wbgl.Type, wbgl.Name, wbgl.Datasource)
+	}
+	if err == nil {
+		tm.ListType, tm.SrcName = wbgl.Type, wbgl.Name
+	}
+	pd.mu.RUnlock()
+	if err != nil {
+		apiError(w, code, "%v", err)
+		return UpdateResult{}, false
+	}
+
+	serial, ok := apiRefreshCommand(pd, w, r, RpzCmdData{Command: "LIST-UPDATE", Update: tm})
+	return UpdateResult{Added: len(tm.Added), Removed: len(tm.Removed), Serial: serial}, ok
+}
+
+// apiRefreshCommand has the RefreshEngine carry out a change for the caller
+// of the request, and returns the RPZ serial with the change.
+func apiRefreshCommand(pd *PopData, w http.ResponseWriter, r *http.Request, cmd RpzCmdData) (uint32, bool) {
+	cmd.Caller = apiCaller(r)
+	cmd.Result = make(chan RpzCmdResponse, 1)
+	select {
+	case pd.RpzCommandCh <- cmd:
+	case <-r.Context().Done():
+		apiError(w, http.StatusServiceUnavailable, "RefreshEngine not responding")
+		return 0, false
+	}
+	var resp RpzCmdResponse
+	select {
+	case resp = <-cmd.Result:
+	case <-r.Context().Done():
+		apiError(w, http.StatusServiceUnavailable, "RefreshEngine not responding")
+		return 0, false
+	}
+	if resp.Error {
+		apiError(w, http.StatusInternalServerError, "%s", resp.ErrorMsg)
+		return 0, false
+	}
+	if resp.NewSerial == 0 {
+		return pd.Rpz.Current().Serial, true // no change in the RPZ output
+	}
+	return resp.NewSerial, true
+}
+
+func APIv2addListNames(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var nu NamesUpdate
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&nu); err != nil {
+			apiError(w, http.StatusBadRequest, "error decoding request: %v", err)
+			return
+		}
+		if len(nu.Names) == 0 {
+			apiError(w, http.StatusBadRequest, "no names to add")
+			return
+		}
+		now := time.Now()
+		tm := tapir.TapirMsg{MsgType: "api", TimeStamp: now}
+		for _, ln := range nu.Names {
+			if _, ok := dns.IsDomainName(ln.Name); !ok || ln.Name == "" {
+				apiError(w, http.StatusBadRequest, "invalid domain name %q", ln.Name)
+				return
+			}
+			if ln.TTL < 0 {
+				apiError(w, http.StatusBadRequest, "name %q: negative TTL", ln.Name)
+				return
+			}
+			mask, err := tapir.StringsToTagMask(ln.Tags)
+			if err != nil {
+				apiError(w, http.StatusBadRequest, "name %q: %v", ln.Name, err)
+				return
+			}
+			tm.Added = append(tm.Added, tapir.Domain{Name: ln.Name, TimeAdded: now, TTL: ln.TTL, TagMask: mask})
+		}
+		if res, ok := apiListUpdate(conf, w, r, &tm); ok {
+			apiWriteJSON(w, http.StatusOK, res)
+		}
+	}
+}
+
+func APIv2removeListName(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pd := conf.PopData
+		name := dns.CanonicalName(mux.Vars(r)["name"])
+		pd.mu.RLock()
+		wbgl, _, err := pd.apiList(mux.Vars(r))
+		missing := err == nil && wbgl.Format == "map" && !hasName(wbgl, name)
+		pd.mu.RUnlock()
+		if missing {
+			apiError(w, http.StatusNotFound, "%s is not in list [%s][%s]", name, wbgl.Type, wbgl.Name)
+			return
+		}
+		tm := tapir.TapirMsg{MsgType: "api", TimeStamp: time.Now(), Removed: []tapir.Domain{{Name: name}}}
+		if res, ok := apiListUpdate(conf, w, r, &tm); ok {
+			apiWriteJSON(w, http.StatusOK, res)
+		}
+	}
+}
+
+func hasName(wbgl *PopList, name string) bool {
+	_, exist := wbgl.Names.Get(name)
+	return exist
+}
+
+func APIv2name(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pd := conf.PopData
+		name := dns.CanonicalName(mux.Vars(r)["name"])
+		if _, ok := dns.IsDomainName(name); !ok {
+			apiError(w, http.StatusBadRequest, "invalid domain name %q", name)
+			return
+		}
+		snap := pd.Rpz.Current()
+
+		pd.mu.RLock()
+		action, reason := pd.decide(name)
+		ni := NameInfo{
+			Name:   name,
+			Action: tapir.ActionToString[action],
+			Stage:  reason.Stage.String(),
+			Serial: snap.Serial,
+		}
+		for _, listtype := range []string{"allowlist", "denylist", "doubtlist"} {
+			for _, hit := range pd.listOf(listtype, name) {
+				nh := NameHit{ListType: listtype, Source: hit.Source}
+				if hit.Entry != nil {
+					nh.TimeAdded = hit.Entry.TimeAdded
+					nh.TTL = int(hit.Entry.TTL / time.Second)
+					nh.Tags = tagNames(hit.Entry.TagMask)
+				}
+				ni.Lists = append(ni.Lists, nh)
+			}
+		}
+		pd.mu.RUnlock()
+
+		for _, rr := range reason.Fired {
+			ni.Rules = append(ni.Rules, NameRule{Rule: rr.Rule, Action: tapir.ActionToString[rr.Action], Detail: rr.Detail})
+		}
+		if first, last, exist := pd.Seen.Get(name); exist {
+			ni.FirstSeen, ni.LastSeen = first, last
+			ni.Age = int(time.Since(first) / time.Second)
+		}
+		if action, exist := snap.Data[name]; exist {
+			ni.Rpz = &RpzEntry{Name: name, Action: tapir.ActionToString[action]}
+		}
+		apiWriteJSON(w, http.StatusOK, ni)
+	}
+}
+
+func APIv2nameHistory(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := dns.CanonicalName(mux.Vars(r)["name"])
+		if _, ok := dns.IsDomainName(name); !ok {
+			apiError(w, http.StatusBadRequest, "invalid domain name %q", name)
+			return
+		}
+		pr, err := parsePageReq(r)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		if conf.PopData.Audit == nil {
+			apiError(w, http.StatusNotFound, "there is no audit log (services.audit.logfile)")
+			return
+		}
+		changes, err := conf.PopData.Audit.History(name, pr.limit)
+		if err != nil {
+			apiError(w, http.StatusInternalServerError, "error reading the audit log: %v", err)
+			return
+		}
+		if changes == nil {
+			changes = []AuditRecord{}
+		}
+		apiWriteJSON(w, http.StatusOK, NameHistory{Name: name, Changes: changes})
+	}
+}
+
+func overrideInfo(o Override, now time.Time) OverrideInfo {
+	return OverrideInfo{
+		Name:      o.Name,
+		Action:    tapir.ActionToString[o.Action],
+		NotBefore: o.NotBefore,
+		NotAfter:  o.NotAfter,
+		Active:    o.active(now),
+		Comment:   o.Comment,
+		Caller:    o.Caller,
+		Created:   o.Created,
+	}
+}
+
+func APIv2overrides(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pr, err := parsePageReq(r)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		page := pageOf(pr, conf.PopData.Overrides.All(), func(o Override) string { return o.Name })
+		resp := Page[OverrideInfo]{Items: make([]OverrideInfo, 0, len(page.Items)), Next: page.Next}
+		now := time.Now()
+		for _, o := range page.Items {
+			resp.Items = append(resp.Items, overrideInfo(o, now))
+		}
+		apiWriteJSON(w, http.StatusOK, resp)
+	}
+}
+
+func APIv2override(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := dns.CanonicalName(mux.Vars(r)["name"])
+		o, exist := conf.PopData.Overrides.Get(name)
+		if !exist {
+			apiError(w, http.StatusNotFound, "there is no override for %s", name)
+			return
+		}
+		apiWriteJSON(w, http.StatusOK, overrideInfo(o, time.Now()))
+	}
+}
+
+// overrideActions are the actions an override can have. REDIRECT is not
+// fully implemented.
+var overrideActions = []tapir.Action{tapir.ALLOWLIST, tapir.NXDOMAIN, tapir.NODATA, tapir.DROP}
+
+func APIv2setOverride(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := dns.CanonicalName(mux.Vars(r)["name"])
+		if _, ok := dns.IsDomainName(name); !ok {
+			apiError(w, http.StatusBadRequest, "invalid domain name %q", name)
+			return
+		}
+		var ou OverrideUpdate
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&ou); err != nil {
+			apiError(w, http.StatusBadRequest, "error decoding request: %v", err)
+			return
+		}
+		action, err := tapir.StringToAction(ou.Action)
+		if err != nil || !slices.Contains(overrideActions, action) {
+			apiError(w, http.StatusBadRequest, "action must be allowlist, nxdomain, nodata or drop")
+			return
+		}
+		now := time.Now()
+		o := Override{Name: name, Action: action, NotBefore: ou.NotBefore, NotAfter: ou.NotAfter, Comment: ou.Comment}
+		if o.NotBefore.IsZero() {
+			o.NotBefore = now
+		}
+		switch {
+		case ou.TTL < 0 || (ou.TTL > 0) == !ou.NotAfter.IsZero():
+			apiError(w, http.StatusBadRequest, "the override needs either not_after or a positive ttl")
+			return
+		case ou.TTL > 0:
+			o.NotAfter = o.NotBefore.Add(time.Duration(ou.TTL) * time.Second)
+		}
+		if !o.NotAfter.After(o.NotBefore) || !o.NotAfter.After(now) {
+			apiError(w, http.StatusBadRequest, "the override must end after it starts, and in the future")
+			return
+		}
+		serial, ok := apiRefreshCommand(conf.PopData, w, r, RpzCmdData{Command: "OVERRIDE-SET", Override: &o})
+		if ok {
+			apiWriteJSON(w, http.StatusOK, UpdateResult{Added: 1, Serial: serial})
+		}
+	}
+}
+
+func APIv2removeOverride(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := dns.CanonicalName(mux.Vars(r)["name"])
+		if _, exist := conf.PopData.Overrides.Get(name); !exist {
+			apiError(w, http.StatusNotFound, "there is no override for %s", name)
+			return
+		}
+		serial, ok := apiRefreshCommand(conf.PopData, w, r, RpzCmdData{Command: "OVERRIDE-REMOVE", Domain: name})
+		if ok {
+			apiWriteJSON(w, http.StatusOK, UpdateResult{Removed: 1, Serial: serial})
+		}
+	}
+}
+
+// tagQuery selects the names in the lists by their tags. The tags are those
+// of the name in one list, as numtapirtags and denytapir see them. Lists in
+// dawg format have no tags and are not searched.
+type tagQuery struct {
+	types    []string
+	source   string
+	all      tapir.TagMask // tags the name must all have
+	none     tapir.TagMask // tags the name must not have
+	min, max int
+	csv      bool
+	stream   bool
+}
+
+func parseTagMask(s string) (tapir.TagMask, error) {
+	var tags []string
+	for _, tag := range strings.Split(s, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tapir.StringsToTagMask(tags)
+}
+
+func parseTagQuery(r *http.Request) (tagQuery, error) {
+	v := r.URL.Query()
+	q := tagQuery{
+		types:  []string{"allowlist", "denylist", "doubtlist"},
+		source: v.Get("source"),
+		max:    len(tapir.DefinedTags),
+	}
+	if t := v.Get("type"); t != "" {
+		if !slices.Contains(q.types, t) {
+			return q, fmt.Errorf("unknown list type %q", t)
+		}
+		q.types = []string{t}
+	}
+	var err error
+	if q.all, err = parseTagMask(v.Get("tags")); err != nil {
+		return q, fmt.Errorf("tags: %v", err)
+	}
+	if q.none, err = parseTagMask(v.Get("nottags")); err != nil {
+		return q, fmt.Errorf("nottags: %v", err)
+	}
+	for _, p := range []struct {
+		name string
+		n    *int
+	}{{"mintags", &q.min}, {"maxtags", &q.max}} {
+		if s := v.Get(p.name); s != "" {
+			if *p.n, err = strconv.Atoi(s); err != nil || *p.n < 0 {
+				return q, fmt.Errorf("%s must be a number of tags", p.name)
+			}
+		}
+	}
+	if q.min > q.max {
+		return q, fmt.Errorf("mintags must not be more than maxtags")
+	}
+	switch v.Get("format") {
+	case "", "json":
+	case "csv":
+		q.csv = true
+	default:
+		return q, fmt.Errorf("format must be json or csv")
+	}
+	if s := v.Get("stream"); s != "" {
+		if q.stream, err = strconv.ParseBool(s); err != nil {
+			return q, fmt.Errorf("stream must be true or false")
+		}
+	}
+	if q.stream && (v.Has("limit") || v.Has("cursor")) {
+		return q, fmt.Errorf("limit and cursor are not used with stream")
+	}
+	return q, nil
+}
+
+func (q tagQuery) match(mask tapir.TagMask) bool {
+	n := mask.NumTags()
+	return mask&q.all == q.all && mask&q.none == 0 && n >= q.min && n <= q.max
+}
+
+// tagBatch is the most names that a tag query reads from a list under one
+// hold of the read lock.
+var tagBatch = 1000
+
+// tagCursor walks the names in one list that match a tag query and start with
+// a prefix, in order of name. It reads the list tagBatch names at a time, so
+// that a query of a big list never holds off the writers for long and never
+// has more than a batch of matches in hand. A name that changes between two
+// batches may be seen as it was or as it is.
+type tagCursor struct {
+	pd       *PopData
+	q        tagQuery
+	listtype string
+	source   string
+	prefix   string
+	from     string // the name that the next batch starts at
+	done     bool   // the last batch has been read
+	buf      []TaggedName
+	i        int // the next match in buf
+}
+
+// tagCursors returns a cursor at from (or at prefix, if that comes later)
+// for each list that q searches, in order of list type and source.
+func (pd *PopData) tagCursors(q tagQuery, prefix, from string) []*tagCursor {
+	var cursors []*tagCursor
+	pd.mu.RLock()
+	defer pd.mu.RUnlock()
+	for _, listtype := range q.types {
+		for _, source := range slices.Sorted(maps.Keys(pd.Lists[listtype])) {
+			if q.source != "" && source != q.source {
+				continue
+			}
+			cursors = append(cursors, &tagCursor{pd: pd, q: q, listtype: listtype, source: source,
+				prefix: prefix, from: max(prefix, from)})
+		}
+	}
+	return cursors
+}
+
+// fill reads the next batch of names into buf.
+func (c *tagCursor) fill() error {
+	c.buf, c.i, c.done = nil, 0, true
+	c.pd.mu.RLock()
+	defer c.pd.mu.RUnlock()
+	wbgl := c.pd.Lists[c.listtype][c.source]
+	if wbgl == nil || wbgl.Format != "map" {
+		return nil
+	}
+	n := 0
+	return wbgl.Names.Ascend(c.from, func(tn tapir.TapirName) bool {
+		if !strings.HasPrefix(tn.Name, c.prefix) {
+			return false
+		}
+		if n == tagBatch {
+			c.from, c.done = tn.Name, false
+			return false
+		}
+		n++
+		if c.q.match(tn.TagMask) {
+			c.buf = append(c.buf, TaggedName{
+				Name:      tn.Name,
+				ListType:  c.listtype,
+				Source:    c.source,
+				TimeAdded: tn.TimeAdded,
+				TTL:       int(tn.TTL / time.Second),
+				Tags:      tagNames(tn.TagMask),
+			})
+		}
+		return true
+	})
+}
+
+// next returns the next match, if there is one.
+func (c *tagCursor) next() (TaggedName, bool, error) {
+	for c.i == len(c.buf) {
+		if c.done {
+			return TaggedName{}, false, nil
+		}
+		if err := c.fill(); err != nil {
+			return TaggedName{}, false, err
+		}
+	}
+	c.i++
+	return c.buf[c.i-1], true, nil
+}
+
+// tagMatches calls fn with the names in each list that match q and start with
+// prefix, a list at a time in order of list type and source, and a batch at a
+// time within a list. The lists are not locked while fn runs.
+func (pd *PopData) tagMatches(q tagQuery, prefix string, fn func([]TaggedName) error) error {
+	for _, c := range pd.tagCursors(q, prefix, "") {
+		for !c.done {
+			if err := c.fill(); err != nil {
+				return err
+			}
+			if len(c.buf) > 0 {
+				if err := fn(c.buf); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// tagMerge calls fn with the matches of the cursors in the order of
+// taggedNameKey, until fn returns false. Only the current batch of each list
+// is held.
+func tagMerge(cursors []*tagCursor, fn func(TaggedName) bool) error {
+	heads := make([]TaggedName, len(cursors))
+	live := make([]bool, len(cursors))
+	var err error
+	for i, c := range cursors {
+		if heads[i], live[i], err = c.next(); err != nil {
+			return err
+		}
+	}
+	for {
+		first := -1
+		for i := range cursors {
+			if live[i] && (first < 0 || taggedNameKey(heads[i]) < taggedNameKey(heads[first])) {
+				first = i
+			}
+		}
+		if first < 0 || !fn(heads[first]) {
+			return nil
+		}
+		if heads[first], live[first], err = cursors[first].next(); err != nil {
+			return err
+		}
+	}
+}
+
+var taggedNameCSVHeader = []string{"name", "listtype", "source", "tags", "time_added", "ttl"}
+
+func (tn TaggedName) csvRecord() []string {
+	var added string
+	if !tn.TimeAdded.IsZero() {
+		added = tn.TimeAdded.Format(time.RFC3339)
+	}
+	return []string{tn.Name, tn.ListType, tn.Source, strings.Join(tn.Tags, ";"), added, strconv.Itoa(tn.TTL)}
+}
+
+// taggedNameKey orders the matches by name, and then by list. It is also the
+// cursor of a page.
+func taggedNameKey(tn TaggedName) string {
+	return tn.Name + "\x00" + tn.ListType + "\x00" + tn.Source
+}
+
+// APIv2queryNames finds the names in the lists by their tags. A JSON result is
+// paged like the other collections and CSV has all the names, both merged
+// from the lists in order of name. A streamed result is written a batch at a
+// time as the lists are searched. None of them holds all the matches, so an
+// export of millions of names is fine.
+func APIv2queryNames(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pd := conf.PopData
+		pr, err := parsePageReq(r)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		q, err := parseTagQuery(r)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		if q.source != "" {
+			pd.mu.RLock()
+			exist := slices.ContainsFunc(q.types, func(t string) bool { return pd.Lists[t][q.source] != nil })
+			pd.mu.RUnlock()
+			if !exist {
+				apiError(w, http.StatusNotFound, "source %q does not exist", q.source)
+				return
+			}
+		}
+
+		if q.stream {
+			rc := http.NewResponseController(w)
+			var write func([]TaggedName) error
+			if q.csv {
+				w.Header().Set("Content-Type", "text/csv")
+				cw := csv.NewWriter(w)
+				cw.Write(taggedNameCSVHeader)
+				write = func(found []TaggedName) error {
+					for _, tn := range found {
+						cw.Write(tn.csvRecord())
+					}
+					cw.Flush()
+					return cw.Error()
+				}
+			} else {
+				w.Header().Set("Content-Type", "application/x-ndjson")
+				enc := json.NewEncoder(w)
+				write = func(found []TaggedName) error {
+					for _, tn := range found {
+						if err := enc.Encode(tn); err != nil {
+							return err
+						}
+					}
+					return nil
+				}
+			}
+			w.WriteHeader(http.StatusOK)
+			err := pd.tagMatches(q, pr.prefix, func(found []TaggedName) error {
+				if err := write(found); err != nil {
+					return err
+				}
+				return rc.Flush()
+			})
+			if err != nil {
+				compLogger("api").Warn("APIv2queryNames: stream aborted", "caller", apiCaller(r), "err", err)
+			}
+			return
+		}
+
+		if !q.csv {
+			// The cursor is the key of the last match, and a name can be
+			// in several lists, so every list starts at the name.
+			afterName, _, _ := strings.Cut(pr.after, "\x00")
+			page := Page[TaggedName]{Items: []TaggedName{}}
+			err := tagMerge(pd.tagCursors(q, pr.prefix, afterName), func(tn TaggedName) bool {
+				switch {
+				case taggedNameKey(tn) <= pr.after:
+					return true
+				case len(page.Items) == pr.limit:
+					page.Next = pageCursor(taggedNameKey(page.Items[len(page.Items)-1]))
+					return false
+				}
+				page.Items = append(page.Items, tn)
+				return true
+			})
+			if err != nil {
+				apiError(w, http.StatusInternalServerError, "%v", err)
+				return
+			}
+			apiWriteJSON(w, http.StatusOK, page)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		w.WriteHeader(http.StatusOK)
+		cw := csv.NewWriter(w)
+		cw.Write(taggedNameCSVHeader)
+		err = tagMerge(pd.tagCursors(q, pr.prefix, ""), func(tn TaggedName) bool {
+			return cw.Write(tn.csvRecord()) == nil
+		})
+		if cw.Flush(); err == nil {
+			err = cw.Error()
+		}
+		if err != nil {
+			compLogger("api").Warn("APIv2queryNames: error writing CSV", "caller", apiCaller(r), "err", err)
+		}
+	}
+}
+
+func APIv2outputs(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pr, err := parsePageReq(r)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		var outputs []OutputInfo
+		for name, o := range conf.PopData.Outputs {
+			outputs = append(outputs, OutputInfo{
+				Name:        name,
+				Active:      o.Active,
+				Description: o.Description,
+				Type:        o.Type,
+				Format:      o.Format,
+				Downstream:  o.Downstream,
+			})
+		}
+		sort.Slice(outputs, func(i, j int) bool { return outputs[i].Name < outputs[j].Name })
+		apiWriteJSON(w, http.StatusOK, pageOf(pr, outputs, func(o OutputInfo) string { return o.Name }))
+	}
+}
+
+func APIv2downstreams(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pd := conf.PopData
+		pr, err := parsePageReq(r)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		var downstreams []DownstreamInfo
+		pd.mu.RLock()
+		for _, d := range pd.Downstreams {
+			downstreams = append(downstreams, DownstreamInfo{
+				Address: d.Address,
+				Port:    d.Port,
+				Serial:  pd.DownstreamSerials[d.Address],
+			})
+		}
+		pd.mu.RUnlock()
+		sort.Slice(downstreams, func(i, j int) bool { return downstreams[i].Address < downstreams[j].Address })
+		apiWriteJSON(w, http.StatusOK, pageOf(pr, downstreams, func(d DownstreamInfo) string { return d.Address }))
+	}
+}
+
+func APIv2rpz(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		snap := conf.PopData.Rpz.Current()
+		ri := RpzInfo{
+			Zone:   conf.PopData.Rpz.ZoneName,
+			Serial: snap.Serial,
+			Names:  len(snap.Data),
+			Digest: hex.EncodeToString(snap.Digest),
+			Ixfrs:  []RpzIxfrInfo{},
+		}
+		for _, ixfr := range snap.IxfrChain {
+			ri.Ixfrs = append(ri.Ixfrs, RpzIxfrInfo{
+				FromSerial: ixfr.FromSerial,
+				ToSerial:   ixfr.ToSerial,
+				Added:      len(ixfr.Added),
+				Removed:    len(ixfr.Removed),
+			})
+		}
+		apiWriteJSON(w, http.StatusOK, ri)
+	}
+}
+
+// APIv2rpzNames pages the RPZ output in canonical order, which is the order
+// of the zone transfers. The names that match a prefix are therefore not
+// next to each other, and a page with a prefix is a scan from the cursor.
+func APIv2rpzNames(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pr, err := parsePageReq(r)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		snap := conf.PopData.Rpz.Current()
+		start := 0
+		if pr.after != "" {
+			var found bool
+			start, found = slices.BinarySearchFunc(snap.Owners, pr.after, canonicalCompare)
+			if found {
+				start++
+			}
+		}
+		page := Page[RpzEntry]{Items: []RpzEntry{}}
+		for _, name := range snap.Owners[start:] {
+			if !strings.HasPrefix(name, pr.prefix) {
+				continue
+			}
+			if len(page.Items) == pr.limit {
+				page.Next = pageCursor(page.Items[len(page.Items)-1].Name)
+				break
+			}
+			page.Items = append(page.Items, RpzEntry{Name: name, Action: tapir.ActionToString[snap.Data[name]]})
+		}
+		apiWriteJSON(w, http.StatusOK, page)
+	}
+}
+
+func APIv2policy(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := conf.PopData.Policy
+		tags := tagNames(p.Doubtlist.DenyTapirTags)
+		if tags == nil {
+			tags = []string{}
+		}
+		var firstSeenAction string
+		if p.Doubtlist.FirstSeenAge > 0 {
+			firstSeenAction = tapir.ActionToString[p.Doubtlist.FirstSeenAction]
+		}
+		apiWriteJSON(w, http.StatusOK, PolicyInfo{
+			AllowlistAction: tapir.ActionToString[p.AllowlistAction],
+			DenylistAction:  tapir.ActionToString[p.DenylistAction],
+			Doubtlist: DoubtlistPolicyInfo{
+				NumSources:         p.Doubtlist.NumSources,
+				NumSourcesAction:   tapir.ActionToString[p.Doubtlist.NumSourcesAction],
+				NumTapirTags:       p.Doubtlist.NumTapirTags,
+				NumTapirTagsAction: tapir.ActionToString[p.Doubtlist.NumTapirTagsAction],
+				DenyTapirTags:      tags,
+				DenyTapirAction:    tapir.ActionToString[p.Doubtlist.DenyTapirAction],
+				FirstSeenAge:       int(p.Doubtlist.FirstSeenAge / time.Second),
+				FirstSeenAction:    firstSeenAction,
+			},
+		})
+	}
+}
+
+func APIv2logLevels(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		levels := []LogLevelInfo{}
+		for _, name := range logComponentNames() {
+			level, _ := LogLevel(name)
+			levels = append(levels, LogLevelInfo{Component: name, Level: level.String()})
+		}
+		apiWriteJSON(w, http.StatusOK, levels)
+	}
+}
+
+// APIv2setLogLevel changes the level until the next restart.
+func APIv2setLogLevel(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var lu LogLevelUpdate
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&lu); err != nil {
+			apiError(w, http.StatusBadRequest, "error decoding request: %v", err)
+			return
+		}
+		component := mux.Vars(r)["component"]
+		if _, exist := LogLevel(component); !exist {
+			apiError(w, http.StatusNotFound, "unknown log component %q", component)
+			return
+		}
+		if err := SetLogLevel(component, lu.Level); err != nil {
+			apiError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		level, _ := LogLevel(component)
+		compLogger("api").Info("APIv2setLogLevel: log level changed", "caller", apiCaller(r),
+			"logcomponent", component, "level", level.String())
+		apiWriteJSON(w, http.StatusOK, LogLevelInfo{Component: component, Level: level.String()})
+	}
+}
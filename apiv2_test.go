@@ -0,0 +1,473 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/smhanov/dawg"
+	"github.com/spf13/viper"
+)
+
+// newAPITestConf returns a Config with a test PopData, a denylist "local-deny"
+// that is managed through the API, and a RefreshEngine stand-in that applies
+// LIST-UPDATE commands.
+func newAPITestConf(t *testing.T) (*Config, http.Handler) {
+	t.Helper()
+	viper.Set("apiserver.key", "test")
+	t.Cleanup(func() { viper.Set("apiserver.key", "") })
+	pd := newRunningTestPopData(t)
+	pd.RpzCommandCh = make(chan RpzCmdData)
+	pd.Lists["denylist"]["feed"].Names.Put(
+		tapir.TapirName{Name: "a.example."},
+		tapir.TapirName{Name: "b.example."},
+		tapir.TapirName{Name: "c.test."},
+	)
+	pd.Lists["denylist"]["local-deny"] = &PopList{
+		WBGlist: &tapir.WBGlist{
+			Name: "local-deny", Type: "denylist", Format: "map", Datasource: "api",
+			ReaperData: map[time.Time]map[string]bool{},
+		},
+		Names: newMemNames("local-deny"),
+	}
+	if err := pd.GenerateRpzAxfr(); err != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		for {
+			select {
+			case cmd := <-pd.RpzCommandCh:
+				resp := RpzCmdResponse{}
+				var ixfr RpzIxfr
+				var err error
+				switch cmd.Command {
+				case "OVERRIDE-SET":
+					ixfr, err = pd.SetOverride(*cmd.Override, cmd.Caller)
+				case "OVERRIDE-REMOVE":
+					ixfr, err = pd.RemoveOverride(cmd.Domain, cmd.Caller)
+				default:
+					ixfr, err = pd.UpdateLocalList(cmd.Update, cmd.Caller)
+				}
+				if err != nil {
+					resp.Error, resp.ErrorMsg = true, err.Error()
+				}
+				resp.NewSerial = ixfr.ToSerial
+				cmd.Result <- resp
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	conf := &Config{PopData: pd}
+	return conf, SetupRouter(conf)
+}
+
+func apiDo(t *testing.T, h http.Handler, method, path, body string, out any) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("X-API-Key", "test")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if out != nil {
+		if err := json.NewDecoder(rec.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: decoding response: %v", method, path, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestAPIv2Paging(t *testing.T) {
+	_, h := newAPITestConf(t)
+
+	cases := []struct {
+		name   string
+		path   string
+		limit  string
+		prefix string
+		want   []string
+	}{
+		{name: "all", path: "/api/v2/lists/denylist/feed/names", limit: "2",
+			want: []string{"a.example.", "b.example.", "c.test."}},
+		{name: "prefix", path: "/api/v2/lists/denylist/feed/names", limit: "1", prefix: "b",
+			want: []string{"b.example."}},
+		{name: "untyped", path: "/api/v2/lists/feed/names", limit: "1",
+			want: []string{"a.example.", "b.example.", "c.test."}},
+		{name: "rpz", path: "/api/v2/rpz/names", limit: "2",
+			want: []string{"a.example.", "b.example.", "c.test."}},
+		{name: "sources", path: "/api/v2/sources", limit: "1",
+			want: []string{"feed", "local-deny"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var got []string
+			cursor := ""
+			for pages := 0; ; pages++ {
+				if pages > 10 {
+					t.Fatal("too many pages")
+				}
+				q := url.Values{"limit": {c.limit}, "prefix": {c.prefix}, "cursor": {cursor}}
+				var page struct {
+					Items []struct{ Name string }
+					Next  string
+				}
+				if code := apiDo(t, h, "GET", c.path+"?"+q.Encode(), "", &page); code != http.StatusOK {
+					t.Fatalf("GET %s: status %d", c.path, code)
+				}
+				for _, item := range page.Items {
+					got = append(got, item.Name)
+				}
+				if cursor = page.Next; cursor == "" {
+					break
+				}
+			}
+			if !slices.Equal(got, c.want) {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestDawgPage(t *testing.T) {
+	words := []string{"a.example.", "b.example.", "ba.example.", "bb.example.", "c.example."}
+	d := dawg.New()
+	for _, w := range words {
+		d.Add(w)
+	}
+	df := d.Finish()
+
+	cases := []struct {
+		prefix string
+		limit  int
+		want   []string
+	}{
+		{limit: 10, want: words},
+		{limit: 2, want: words},
+		{prefix: "b", limit: 2, want: []string{"b.example.", "ba.example.", "bb.example."}},
+		{prefix: "ba", limit: 1, want: []string{"ba.example."}},
+		{prefix: "x", limit: 1},
+	}
+	for _, c := range cases {
+		var got []string
+		pr := pageReq{prefix: c.prefix, limit: c.limit}
+		for {
+			page := dawgPage(pr, df)
+			for _, item := range page.Items {
+				got = append(got, item.Name)
+			}
+			if page.Next == "" {
+				break
+			}
+			pr.after = page.Items[len(page.Items)-1].Name
+		}
+		if !slices.Equal(got, c.want) {
+			t.Errorf("prefix %q limit %d: got %v, want %v", c.prefix, c.limit, got, c.want)
+		}
+	}
+}
+
+func TestAPIv2ListUpdate(t *testing.T) {
+	conf, h := newAPITestConf(t)
+	pd := conf.PopData
+	serial := pd.Rpz.Current().Serial
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{name: "add", method: "POST", path: "/api/v2/lists/local-deny/names",
+			body: `{"names": [{"name": "bad.example", "tags": ["likelymalware"]}]}`, code: http.StatusOK},
+		{name: "add_typed", method: "POST", path: "/api/v2/lists/denylist/local-deny/names",
+			body: `{"names": [{"name": "worse.example.", "ttl": 3600}]}`, code: http.StatusOK},
+		{name: "not_api", method: "POST", path: "/api/v2/lists/feed/names",
+			body: `{"names": [{"name": "x.example."}]}`, code: http.StatusConflict},
+		{name: "unknown_list", method: "POST", path: "/api/v2/lists/allowlist/local-deny/names",
+			body: `{"names": [{"name": "x.example."}]}`, code: http.StatusNotFound},
+		{name: "bad_name", method: "POST", path: "/api/v2/lists/local-deny/names",
+			body: `{"names": [{"name": "a..example."}]}`, code: http.StatusBadRequest},
+		{name: "bad_tag", method: "POST", path: "/api/v2/lists/local-deny/names",
+			body: `{"names": [{"name": "x.example.", "tags": ["nosuchtag"]}]}`, code: http.StatusBadRequest},
+		{name: "unknown_field", method: "POST", path: "/api/v2/lists/local-deny/names",
+			body: `{"names": [{"name": "x.example.", "action": "drop"}]}`, code: http.StatusBadRequest},
+		{name: "remove", method: "DELETE", path: "/api/v2/lists/local-deny/names/worse.example.", code: http.StatusOK},
+		{name: "remove_missing", method: "DELETE", path: "/api/v2/lists/local-deny/names/worse.example.", code: http.StatusNotFound},
+	}
+	for _, c := range cases {
+		var resp map[string]any
+		if code := apiDo(t, h, c.method, c.path, c.body, &resp); code != c.code {
+			t.Errorf("%s: status %d (%v), want %d", c.name, code, resp, c.code)
+		}
+	}
+
+	var ni NameInfo
+	if code := apiDo(t, h, "GET", "/api/v2/names/bad.example", "", &ni); code != http.StatusOK {
+		t.Fatalf("GET name: status %d", code)
+	}
+	if ni.Stage != "denylist" || ni.Rpz == nil || len(ni.Lists) != 1 || ni.Lists[0].Source != "local-deny" ||
+		!slices.Equal(ni.Lists[0].Tags, []string{"likelymalware"}) {
+		t.Errorf("GET name: %+v", ni)
+	}
+	snap := pd.Rpz.Current()
+	if _, exist := snap.Data["worse.example."]; exist {
+		t.Errorf("removed name still in the RPZ")
+	}
+	if snap.Serial != serial+3 || len(snap.IxfrChain) != 3 {
+		t.Errorf("RPZ serial %d with %d IXFRs, want %d with 3", snap.Serial, len(snap.IxfrChain), serial+3)
+	}
+}
+
+func TestAPIv2Overrides(t *testing.T) {
+	conf, h := newAPITestConf(t)
+	pd := conf.PopData
+	later := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{name: "block", method: "PUT", path: "/api/v2/overrides/new.example",
+			body: `{"action": "drop", "ttl": 14400, "comment": "incident 42"}`, code: http.StatusOK},
+		{name: "allow", method: "PUT", path: "/api/v2/overrides/a.example.",
+			body: `{"action": "allowlist", "not_after": "` + later + `"}`, code: http.StatusOK},
+		{name: "scheduled", method: "PUT", path: "/api/v2/overrides/b.example.",
+			body: `{"action": "allowlist", "not_before": "` + later + `", "ttl": 3600}`, code: http.StatusOK},
+		{name: "no_end", method: "PUT", path: "/api/v2/overrides/x.example.",
+			body: `{"action": "drop"}`, code: http.StatusBadRequest},
+		{name: "two_ends", method: "PUT", path: "/api/v2/overrides/x.example.",
+			body: `{"action": "drop", "ttl": 60, "not_after": "` + later + `"}`, code: http.StatusBadRequest},
+		{name: "ended", method: "PUT", path: "/api/v2/overrides/x.example.",
+			body: `{"action": "drop", "not_after": "2020-01-01T00:00:00Z"}`, code: http.StatusBadRequest},
+		{name: "redirect", method: "PUT", path: "/api/v2/overrides/x.example.",
+			body: `{"action": "redirect", "ttl": 60}`, code: http.StatusBadRequest},
+		{name: "bad_name", method: "PUT", path: "/api/v2/overrides/a..example.",
+			body: `{"action": "drop", "ttl": 60}`, code: http.StatusBadRequest},
+		{name: "get_missing", method: "GET", path: "/api/v2/overrides/x.example.", code: http.StatusNotFound},
+		{name: "remove_missing", method: "DELETE", path: "/api/v2/overrides/x.example.", code: http.StatusNotFound},
+	}
+	for _, c := range cases {
+		var resp map[string]any
+		if code := apiDo(t, h, c.method, c.path, c.body, &resp); code != c.code {
+			t.Errorf("%s: status %d (%v), want %d", c.name, code, resp, c.code)
+		}
+	}
+
+	var oi OverrideInfo
+	if code := apiDo(t, h, "GET", "/api/v2/overrides/new.example", "", &oi); code != http.StatusOK {
+		t.Fatalf("GET override: status %d", code)
+	}
+	if oi.Action != "DROP" || !oi.Active || oi.Comment != "incident 42" || oi.NotAfter.Sub(oi.NotBefore) != 4*time.Hour {
+		t.Errorf("GET override: %+v", oi)
+	}
+	var page Page[OverrideInfo]
+	apiDo(t, h, "GET", "/api/v2/overrides", "", &page)
+	if len(page.Items) != 3 || page.Items[1].Name != "b.example." || page.Items[1].Active {
+		t.Errorf("GET overrides: %+v", page.Items)
+	}
+
+	var ni NameInfo
+	apiDo(t, h, "GET", "/api/v2/names/a.example.", "", &ni)
+	if ni.Stage != "override" || ni.Action != "ALLOWLIST" || ni.Rpz != nil || len(ni.Rules) != 1 {
+		t.Errorf("GET name: %+v", ni)
+	}
+	snap := pd.Rpz.Current()
+	if snap.Data["new.example."] != tapir.DROP || len(snap.IxfrChain) != 2 {
+		t.Errorf("RPZ after the overrides: %v, %d IXFRs", snap.Data, len(snap.IxfrChain))
+	}
+
+	if code := apiDo(t, h, "DELETE", "/api/v2/overrides/a.example.", "", nil); code != http.StatusOK {
+		t.Errorf("DELETE override: status %d", code)
+	}
+	if snap := pd.Rpz.Current(); snap.Data["a.example."] != tapir.NODATA {
+		t.Errorf("a.example. is not denylisted again: %v", snap.Data)
+	}
+}
+
+func TestAPIv2TagQuery(t *testing.T) {
+	conf, h := newAPITestConf(t)
+	pd := conf.PopData
+	// Small batches, so that the lists are read in several.
+	old := tagBatch
+	tagBatch = 2
+	t.Cleanup(func() { tagBatch = old })
+	for _, l := range []struct {
+		source string
+		names  []tapir.TapirName
+	}{
+		{"a", []tapir.TapirName{
+			tn("malware.example.", tapir.LikelyMalware|tapir.NewName, 0),
+			tn("volume.example.", tapir.HighVolume, 0),
+			tn("both.example.", tapir.LikelyMalware|tapir.HighVolume|tapir.NewName, 0),
+		}},
+		{"b", []tapir.TapirName{
+			tn("malware.example.", tapir.LikelyMalware, 0),
+			tn("none.example.", 0, 0),
+		}},
+	} {
+		list := &PopList{WBGlist: &tapir.WBGlist{Name: l.source, Type: "doubtlist", Format: "map"}, Names: newMemNames(l.source)}
+		list.Names.Put(l.names...)
+		pd.Lists["doubtlist"][l.source] = list
+	}
+
+	cases := []struct {
+		name  string
+		query string
+		code  int
+		want  []string // name/source
+	}{
+		{name: "all_of", query: "tags=likelymalware,newname", code: http.StatusOK,
+			want: []string{"both.example./a", "malware.example./a"}},
+		{name: "none_of", query: "type=doubtlist&tags=likelymalware&nottags=highvolume", code: http.StatusOK,
+			want: []string{"malware.example./a", "malware.example./b"}},
+		{name: "mintags", query: "mintags=2", code: http.StatusOK,
+			want: []string{"both.example./a", "malware.example./a"}},
+		{name: "maxtags", query: "type=doubtlist&maxtags=0", code: http.StatusOK,
+			want: []string{"none.example./b"}},
+		{name: "source", query: "source=b&mintags=1", code: http.StatusOK,
+			want: []string{"malware.example./b"}},
+		{name: "prefix", query: "prefix=v&type=doubtlist", code: http.StatusOK,
+			want: []string{"volume.example./a"}},
+		{name: "untagged", query: "type=denylist", code: http.StatusOK,
+			want: []string{"a.example./feed", "b.example./feed", "c.test./feed"}},
+		{name: "bad_tag", query: "tags=nosuchtag", code: http.StatusBadRequest},
+		{name: "bad_type", query: "type=greylist", code: http.StatusBadRequest},
+		{name: "bad_count", query: "mintags=-1", code: http.StatusBadRequest},
+		{name: "bad_range", query: "mintags=3&maxtags=1", code: http.StatusBadRequest},
+		{name: "paged_stream", query: "stream=true", code: http.StatusBadRequest}, // with limit and cursor
+		{name: "bad_format", query: "format=xml", code: http.StatusBadRequest},
+		{name: "no_source", query: "source=nosuch", code: http.StatusNotFound},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// A page at a time, so that a name in two lists spans pages.
+			var got []string
+			cursor := ""
+			for pages := 0; ; pages++ {
+				if pages > 10 {
+					t.Fatal("too many pages")
+				}
+				var page Page[TaggedName]
+				code := apiDo(t, h, "GET", "/api/v2/names?limit=1&cursor="+cursor+"&"+c.query, "", &page)
+				if code != c.code {
+					t.Fatalf("status %d, want %d", code, c.code)
+				}
+				for _, item := range page.Items {
+					got = append(got, item.Name+"/"+item.Source)
+				}
+				if cursor = page.Next; cursor == "" {
+					break
+				}
+			}
+			if !slices.Equal(got, c.want) {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+
+	get := func(query string) (string, string) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/api/v2/names?"+query, nil)
+		req.Header.Set("X-API-Key", "test")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d", query, rec.Code)
+		}
+		return rec.Header().Get("Content-Type"), rec.Body.String()
+	}
+	want := "name,listtype,source,tags,time_added,ttl\n" +
+		"both.example.,doubtlist,a,newname;highvolume;likelymalware,,0\n" +
+		"malware.example.,doubtlist,a,newname;likelymalware,,0\n"
+	if ct, body := get("format=csv&limit=1&mintags=2"); ct != "text/csv" || body != want {
+		t.Errorf("csv: %s\n%s", ct, body)
+	}
+	// Streamed, the names come a list at a time.
+	if ct, body := get("format=csv&stream=true&tags=likelymalware&type=doubtlist"); ct != "text/csv" ||
+		!strings.HasPrefix(body, "name,") || strings.Count(body, "\n") != 4 ||
+		!strings.HasSuffix(body, "malware.example.,doubtlist,b,likelymalware,,0\n") {
+		t.Errorf("csv stream: %s\n%s", ct, body)
+	}
+	ct, body := get("stream=1&tags=likelymalware")
+	var got []string
+	dec := json.NewDecoder(strings.NewReader(body))
+	for dec.More() {
+		var tn TaggedName
+		if err := dec.Decode(&tn); err != nil {
+			t.Fatalf("json stream: %v", err)
+		}
+		got = append(got, tn.Name+"/"+tn.Source)
+	}
+	slices.Sort(got)
+	if want := []string{"both.example./a", "malware.example./a", "malware.example./b"}; ct != "application/x-ndjson" ||
+		!slices.Equal(got, want) {
+		t.Errorf("json stream: %s %v, want %v", ct, got, want)
+	}
+}
+
+// TestOpenAPI checks that the document covers the routes and that every
+// schema reference in it resolves.
+func TestOpenAPI(t *testing.T) {
+	_, h := newAPITestConf(t)
+	var doc struct {
+		Paths      map[string]map[string]any
+		Components struct{ Schemas map[string]any }
+	}
+	if code := apiDo(t, h, "GET", "/api/v2/openapi.json", "", &doc); code != http.StatusOK {
+		t.Fatalf("GET openapi.json: status %d", code)
+	}
+	for _, rt := range apiv2Routes() {
+		path := "/api/v2" + strings.Replace(rt.Path, listTypeVar, "{type}", 1)
+		if _, exist := doc.Paths[path][strings.ToLower(rt.Method)]; !exist {
+			t.Errorf("%s %s is not in the document", rt.Method, path)
+		}
+	}
+
+	var refs func(v any)
+	refs = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			if ref, isref := v["$ref"].(string); isref {
+				if _, exist := doc.Components.Schemas[strings.TrimPrefix(ref, "#/components/schemas/")]; !exist {
+					t.Errorf("unresolved reference %s", ref)
+				}
+			}
+			for _, e := range v {
+				refs(e)
+			}
+		case []any:
+			for _, e := range v {
+				refs(e)
+			}
+		}
+	}
+	for _, p := range doc.Paths {
+		refs(map[string]any(p))
+	}
+	refs(doc.Components.Schemas)
+
+	var schema map[string]any
+	if code := apiDo(t, h, "GET", "/api/v2/schemas/PageListName", "", &schema); code != http.StatusOK {
+		t.Fatalf("GET schema: status %d", code)
+	}
+	if schema["$schema"] != jsonSchemaDialect || schema["properties"].(map[string]any)["items"] == nil {
+		t.Errorf("schema PageListName: %v", schema)
+	}
+}
@@ -0,0 +1,254 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/spf13/viper"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// The audit log has one JSON line for every change to the RPZ output: a name
+// that is added, removed or gets a different action. It says what caused the
+// change and why decide() came to the new action, so that it is possible to
+// find out afterwards why a name was blocked at a given time. The log is only
+// appended to; lumberjack rotates it.
+
+// AuditCause is what caused a change to the RPZ output.
+type AuditCause struct {
+	Trigger string // "mqtt", "reaper", "api", "override", "bootstrap" or "regenerate"
+	Source  string // the source whose list was changed, if a single one
+	MsgId   string // the MQTT message, for Trigger "mqtt"
+	Caller  string // the API identity, for Trigger "api" and "override"
+}
+
+type AuditRecord struct {
+	Time      time.Time   `json:"time"`
+	Name      string      `json:"name"`
+	OldAction string      `json:"old_action,omitempty" doc:"the action before the change; empty if the name was not in the RPZ"`
+	NewAction string      `json:"new_action,omitempty" doc:"the action after the change; empty if the name was removed from the RPZ"`
+	Serial    uint32      `json:"serial" doc:"the first RPZ serial with the change"`
+	Trigger   string      `json:"trigger" doc:"mqtt | reaper | api | override | bootstrap | regenerate"`
+	Source    string      `json:"source,omitempty"`
+	MsgId     string      `json:"msg_id,omitempty" doc:"the MQTT message, as the start of the SHA-256 of its payload"`
+	Caller    string      `json:"caller,omitempty" doc:"the API key or client certificate that made the change"`
+	Reason    AuditReason `json:"reason"`
+}
+
+// AuditReason is the Reason from decide() after the change.
+type AuditReason struct {
+	Stage   string     `json:"stage"`
+	Sources []string   `json:"sources,omitempty"`
+	Rules   []NameRule `json:"rules,omitempty"`
+}
+
+type Auditor struct {
+	mu  sync.Mutex
+	out *lumberjack.Logger
+	w   *bufio.Writer
+}
+
+// NewAuditor opens the audit log in services.audit.logfile. It returns nil if
+// there is none; a nil Auditor records nothing.
+func NewAuditor() (*Auditor, error) {
+	logfile := viper.GetString("services.audit.logfile")
+	if logfile == "" {
+		return nil, nil
+	}
+	logfile = filepath.Clean(logfile)
+	maxsize := viper.GetInt("services.audit.maxsize")
+	if maxsize <= 0 {
+		maxsize = 100
+	}
+	maxbackups := viper.GetInt("services.audit.maxbackups")
+	if maxbackups < 0 {
+		return nil, fmt.Errorf("services.audit.maxbackups is negative")
+	}
+	if maxbackups == 0 {
+		maxbackups = 10
+	}
+	out := &lumberjack.Logger{
+		Filename:   logfile,
+		MaxSize:    maxsize,
+		MaxBackups: maxbackups,
+		MaxAge:     viper.GetInt("services.audit.maxage"),
+	}
+	// Open it now, so that a bad path is found at startup.
+	if _, err := out.Write(nil); err != nil {
+		return nil, fmt.Errorf("error opening audit log %s: %v", logfile, err)
+	}
+	return &Auditor{out: out, w: bufio.NewWriter(out)}, nil
+}
+
+// Record appends recs to the audit log.
+func (a *Auditor) Record(recs []AuditRecord) {
+	if a == nil || len(recs) == 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	enc := json.NewEncoder(a.w)
+	for _, rec := range recs {
+		if err := enc.Encode(rec); err != nil {
+			log.Printf("Auditor: Error writing audit record for %s: %v", rec.Name, err)
+			return
+		}
+	}
+	if err := a.w.Flush(); err != nil {
+		log.Printf("Auditor: Error writing audit log: %v", err)
+	}
+}
+
+// Close flushes and closes the audit log.
+func (a *Auditor) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	err := a.w.Flush()
+	if cerr := a.out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// files returns the audit log files, the rotated ones oldest first and the
+// current one last. lumberjack names the rotated files <name>-<time><ext>.
+func (a *Auditor) files() ([]string, error) {
+	ext := filepath.Ext(a.out.Filename)
+	prefix := strings.TrimSuffix(a.out.Filename, ext) + "-"
+	backups, err := filepath.Glob(prefix + "*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(backups) // the time in the name sorts as text
+	return append(backups, a.out.Filename), nil
+}
+
+// History returns the last limit records for name, oldest first.
+func (a *Auditor) History(name string, limit int) ([]AuditRecord, error) {
+	a.mu.Lock()
+	err := a.w.Flush()
+	a.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	files, err := a.files()
+	if err != nil {
+		return nil, err
+	}
+
+	// A quick test on the raw line, to only decode the records for name.
+	needle, _ := json.Marshal(name)
+	needle = append([]byte(`"name":`), needle...)
+	var recs []AuditRecord
+	for _, file := range files {
+		f, err := os.Open(file) // #nosec G304
+		if os.IsNotExist(err) {
+			continue // rotated away meanwhile
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			if !bytes.Contains(line, needle) {
+				continue
+			}
+			var rec AuditRecord
+			if err := json.Unmarshal(line, &rec); err != nil || rec.Name != name {
+				continue
+			}
+			recs = append(recs, rec)
+			if len(recs) > limit {
+				recs = recs[1:]
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading audit log %s: %v", file, err)
+		}
+	}
+	return recs, nil
+}
+
+// mqttMsgId identifies an MQTT message in the audit log.
+func mqttMsgId(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:8])
+}
+
+// auditRecord describes the change of name from oldAction to newAction (zero
+// for not in the RPZ). The caller must hold pd.mu, for decide().
+func (pd *PopData) auditRecord(now time.Time, name string, oldAction, newAction tapir.Action, serial uint32, cause AuditCause) AuditRecord {
+	_, reason := pd.decide(name)
+	rec := AuditRecord{
+		Time:    now,
+		Name:    name,
+		Serial:  serial,
+		Trigger: cause.Trigger,
+		Source:  cause.Source,
+		MsgId:   cause.MsgId,
+		Caller:  cause.Caller,
+		Reason:  AuditReason{Stage: reason.Stage.String()},
+	}
+	if oldAction != 0 {
+		rec.OldAction = tapir.ActionToString[oldAction]
+	}
+	if newAction != 0 {
+		rec.NewAction = tapir.ActionToString[newAction]
+	}
+	for _, hit := range reason.Sources {
+		rec.Reason.Sources = append(rec.Reason.Sources, hit.Source)
+	}
+	for _, rr := range reason.Fired {
+		rec.Reason.Rules = append(rec.Reason.Rules, NameRule{Rule: rr.Rule, Action: tapir.ActionToString[rr.Action], Detail: rr.Detail})
+	}
+	return rec
+}
+
+// auditIxfr records the changes in ixfr. Called by the writer, with
+// pd.Rpz.wmu held, so the records are in serial order.
+func (pd *PopData) auditIxfr(ixfr RpzIxfr, cause AuditCause) {
+	if pd.Audit == nil {
+		return
+	}
+	removed := make(map[string]tapir.Action, len(ixfr.Removed))
+	for _, rpzn := range ixfr.Removed {
+		removed[rpzn.Name] = rpzn.Action
+	}
+	now := time.Now()
+	var recs []AuditRecord
+	pd.mu.RLock()
+	for _, rpzn := range ixfr.Added {
+		recs = append(recs, pd.auditRecord(now, rpzn.Name, removed[rpzn.Name], rpzn.Action, ixfr.ToSerial, cause))
+		delete(removed, rpzn.Name)
+	}
+	for _, rpzn := range ixfr.Removed {
+		if _, gone := removed[rpzn.Name]; gone {
+			recs = append(recs, pd.auditRecord(now, rpzn.Name, rpzn.Action, 0, ixfr.ToSerial, cause))
+		}
+	}
+	pd.mu.RUnlock()
+	pd.Audit.Record(recs)
+}
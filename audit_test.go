@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/spf13/viper"
+)
+
+func TestAuditLog(t *testing.T) {
+	conf, h := newAPITestConf(t)
+	pd := conf.PopData
+	viper.Set("services.audit.logfile", filepath.Join(t.TempDir(), "audit.log"))
+	defer viper.Set("services.audit.logfile", "")
+	var err error
+	if pd.Audit, err = NewAuditor(); err != nil {
+		t.Fatalf("NewAuditor: %v", err)
+	}
+	defer pd.Audit.Close()
+	serial := pd.Rpz.Current().Serial
+
+	// Through the API, from an MQTT message, from a regeneration and from
+	// the reaper, with a rotation of the log in between.
+	if code := apiDo(t, h, "POST", "/api/v2/lists/local-deny/names",
+		`{"names": [{"name": "bad.example."}]}`, nil); code != http.StatusOK {
+		t.Fatalf("POST: status %d", code)
+	}
+	pd.Lists["denylist"]["feed"].ReaperData = map[time.Time]map[string]bool{}
+	now := time.Now()
+	tm := tapir.TapirMsg{SrcName: "feed", ListType: "denylist", Added: []tapir.Domain{
+		{Name: "bad.example.", TimeAdded: now, TTL: 3600}, {Name: "worse.example.", TimeAdded: now, TTL: 3600},
+	}}
+	if _, err := pd.ProcessTapirUpdate(tm, "0123456789abcdef"); err != nil {
+		t.Fatalf("ProcessTapirUpdate: %v", err)
+	}
+	if code := apiDo(t, h, "DELETE", "/api/v2/lists/local-deny/names/bad.example.", "", nil); code != http.StatusOK {
+		t.Fatalf("DELETE: status %d", code)
+	}
+	if err := pd.Audit.out.Rotate(); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	pd.mu.Lock()
+	pd.Lists["denylist"]["feed"].Names.Delete("bad.example.")
+	pd.scheduleReaping(pd.Lists["denylist"]["feed"], "worse.example.", time.Now().Add(-time.Hour))
+	pd.Policy.DenylistAction = tapir.DROP
+	pd.mu.Unlock()
+	if err := pd.GenerateRpzAxfr(); err != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+	if err := pd.Reaper(false); err != nil {
+		t.Fatalf("Reaper: %v", err)
+	}
+
+	type change struct {
+		old, new, trigger, source, msgid, caller, stage string
+		serial                                          uint32
+	}
+	cases := []struct {
+		name  string
+		limit string
+		want  []change
+	}{
+		{name: "bad.example.", want: []change{
+			{new: "NODATA", trigger: "api", source: "local-deny", caller: "key apiserver.key", stage: "denylist", serial: serial + 1},
+			{old: "NODATA", trigger: "regenerate", stage: "none", serial: serial + 3},
+		}},
+		{name: "worse.example.", want: []change{
+			{new: "NODATA", trigger: "mqtt", source: "feed", msgid: "0123456789abcdef", stage: "denylist", serial: serial + 2},
+			{old: "NODATA", new: "DROP", trigger: "regenerate", stage: "denylist", serial: serial + 3},
+			{old: "DROP", trigger: "reaper", stage: "none", serial: serial + 4},
+		}},
+		{name: "worse.example", limit: "1", want: []change{
+			{old: "DROP", trigger: "reaper", stage: "none", serial: serial + 4},
+		}},
+		{name: "good.example."},
+	}
+	for _, c := range cases {
+		path := "/api/v2/names/" + c.name + "/history"
+		if c.limit != "" {
+			path += "?limit=" + c.limit
+		}
+		var nh NameHistory
+		if code := apiDo(t, h, "GET", path, "", &nh); code != http.StatusOK {
+			t.Fatalf("GET %s: status %d", path, code)
+		}
+		var got []change
+		for _, rec := range nh.Changes {
+			got = append(got, change{rec.OldAction, rec.NewAction, rec.Trigger, rec.Source, rec.MsgId, rec.Caller, rec.Reason.Stage, rec.Serial})
+		}
+		if !slices.Equal(got, c.want) {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
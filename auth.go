@@ -0,0 +1,260 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+// Role-based authorization of the API. A client is identified by a verified
+// client certificate (on the TLS listeners) whose CN is in
+// apiserver.clientcerts, or else by an X-API-Key header that matches one of
+// apiserver.keys or the shared apiserver.key. The identity has a role, and
+// each route and command needs one. Every decision is logged.
+
+type apiRole int
+
+const (
+	roleNone apiRole = iota
+	roleReadOnly
+	roleOperator
+	roleAdmin
+)
+
+var apiRoleToString = map[apiRole]string{
+	roleNone:     "none",
+	roleReadOnly: "read-only",
+	roleOperator: "operator",
+	roleAdmin:    "admin",
+}
+
+func stringToApiRole(s string) (apiRole, error) {
+	for role, name := range apiRoleToString {
+		if role != roleNone && strings.EqualFold(s, name) {
+			return role, nil
+		}
+	}
+	return roleNone, fmt.Errorf("unknown API role %q (valid: read-only, operator, admin)", s)
+}
+
+func (role apiRole) String() string { return apiRoleToString[role] }
+
+// The role needed for each command of the v1 API. Commands that are not
+// listed need admin.
+var (
+	commandRoles = map[string]apiRole{
+		"status":           roleReadOnly,
+		"rpz-lookup":       roleReadOnly,
+		"rpz-digest":       roleReadOnly,
+		"rpz-list-sources": roleReadOnly,
+		"bump":             roleOperator,
+		"rpz-add":          roleOperator,
+		"rpz-remove":       roleOperator,
+		"mqtt-start":       roleOperator,
+		"mqtt-stop":        roleOperator,
+		"mqtt-restart":     roleOperator,
+		"stop":             roleAdmin,
+	}
+	debugRoles = map[string]apiRole{
+		"mqtt-stats":   roleReadOnly,
+		"reaper-stats": roleReadOnly,
+		"xfr-stats":    roleReadOnly,
+		"rrset":        roleOperator,
+		"zonedata":     roleOperator,
+		"filterlists":  roleOperator,
+		"gen-output":   roleAdmin,
+		"send-status":  roleAdmin,
+	}
+	bootstrapRoles = map[string]apiRole{
+		"doubtlist-status": roleReadOnly,
+		"export-doubtlist": roleReadOnly,
+	}
+)
+
+type apiKey struct {
+	name string
+	key  []byte
+	role apiRole
+}
+
+type ApiAuth struct {
+	keys  []apiKey
+	certs map[string]apiRole // by client certificate CN
+}
+
+// NewApiAuth reads the API keys and client certificate CNs from the config.
+func NewApiAuth() (*ApiAuth, error) {
+	aa := &ApiAuth{certs: map[string]apiRole{}}
+	if key := viper.GetString("apiserver.key"); key != "" {
+		aa.keys = append(aa.keys, apiKey{name: "apiserver.key", key: []byte(key), role: roleAdmin})
+	}
+
+	var keys []ApiKeyConf
+	if err := viper.UnmarshalKey("apiserver.keys", &keys); err != nil {
+		return nil, fmt.Errorf("apiserver.keys: %v", err)
+	}
+	names := map[string]bool{}
+	for _, k := range keys {
+		if k.Name == "" || k.Key == "" {
+			return nil, fmt.Errorf("apiserver.keys: every key needs a name and a key")
+		}
+		if names[k.Name] {
+			return nil, fmt.Errorf("apiserver.keys: key %q is defined twice", k.Name)
+		}
+		names[k.Name] = true
+		role, err := stringToApiRole(k.Role)
+		if err != nil {
+			return nil, fmt.Errorf("apiserver.keys: key %q: %v", k.Name, err)
+		}
+		aa.keys = append(aa.keys, apiKey{name: k.Name, key: []byte(k.Key), role: role})
+	}
+
+	var certs []ApiCertConf
+	if err := viper.UnmarshalKey("apiserver.clientcerts", &certs); err != nil {
+		return nil, fmt.Errorf("apiserver.clientcerts: %v", err)
+	}
+	for _, c := range certs {
+		if c.Cn == "" {
+			return nil, fmt.Errorf("apiserver.clientcerts: every client certificate needs a cn")
+		}
+		role, err := stringToApiRole(c.Role)
+		if err != nil {
+			return nil, fmt.Errorf("apiserver.clientcerts: cn %q: %v", c.Cn, err)
+		}
+		aa.certs[c.Cn] = role
+	}
+
+	if len(aa.keys) == 0 && len(aa.certs) == 0 {
+		return nil, fmt.Errorf("no API keys or client certificates are configured")
+	}
+	return aa, nil
+}
+
+// identify returns who the client is and its role; roleNone if unknown. A
+// verified client certificate with a known CN goes before the API key.
+func (aa *ApiAuth) identify(r *http.Request) (string, apiRole) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cn := r.TLS.PeerCertificates[0].Subject.CommonName
+		if role, exist := aa.certs[cn]; exist {
+			return "cert " + cn, role
+		}
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		// Compare with every key, so that the time taken does not say
+		// which one was the closest.
+		id, role := "", roleNone
+		for _, k := range aa.keys {
+			if subtle.ConstantTimeCompare([]byte(key), k.key) == 1 && role == roleNone {
+				id, role = "key "+k.name, k.role
+			}
+		}
+		if role != roleNone {
+			return id, role
+		}
+		return "unknown key", roleNone
+	}
+	return "anonymous", roleNone
+}
+
+// Middleware authorizes the requests to a router. need returns what the
+// request does and the role that it needs. It is only called for a caller
+// that has been identified, as it may read the body.
+func (aa *ApiAuth) Middleware(need func(r *http.Request) (string, apiRole, error)) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, role := aa.identify(r)
+			lg := compLogger("api").With("caller", id, "role", role.String(), "remote", r.RemoteAddr)
+			if role == roleNone {
+				lg.Warn("APIauth: deny: not authenticated", "request", r.Method+" "+r.URL.Path)
+				apiError(w, http.StatusUnauthorized, "not authenticated")
+				return
+			}
+			what, needed, err := need(r)
+			lg = lg.With("request", what, "needs", needed.String())
+			switch {
+			case err != nil:
+				lg.Warn("APIauth: deny", "error", err)
+				apiError(w, http.StatusRequestEntityTooLarge, "%v", err)
+			case role < needed:
+				lg.Warn("APIauth: deny: role too low")
+				apiError(w, http.StatusForbidden, "%s needs role %s", what, needed)
+			default:
+				lg.Info("APIauth: allow")
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiCallerKey{}, id)))
+			}
+		})
+	}
+}
+
+type apiCallerKey struct{}
+
+// apiCaller returns the identity that Middleware authorized the request for.
+func apiCaller(r *http.Request) string {
+	id, _ := r.Context().Value(apiCallerKey{}).(string)
+	return id
+}
+
+// maxCommandPost is the largest v1 request body. It is read to find the
+// command; a larger one is refused.
+const maxCommandPost = 1 << 20
+
+// v1Need is the role needed for a request to the v1 API: per command for
+// /command, /debug and /bootstrap, which carry it in the body.
+func v1Need(r *http.Request) (string, apiRole, error) {
+	path := r.URL.Path
+	var roles map[string]apiRole
+	switch {
+	case strings.HasSuffix(path, "/ping"):
+		return path, roleReadOnly, nil
+	case strings.HasSuffix(path, "/command"):
+		roles = commandRoles
+	case strings.HasSuffix(path, "/debug"):
+		roles = debugRoles
+	case strings.HasSuffix(path, "/bootstrap"):
+		roles = bootstrapRoles
+	default:
+		return path, roleAdmin, nil
+	}
+
+	// Read the body for the command, and put it back for the handler.
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxCommandPost+1))
+	r.Body.Close()
+	if len(body) > maxCommandPost {
+		return path, roleAdmin, fmt.Errorf("request body larger than %d bytes", maxCommandPost)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	var post struct{ Command string }
+	if err != nil || json.Unmarshal(body, &post) != nil {
+		return path + " (undecodable)", roleAdmin, nil
+	}
+	what := fmt.Sprintf("%s %q", path, post.Command)
+	if role, exist := roles[post.Command]; exist {
+		return what, role, nil
+	}
+	return what, roleAdmin, nil
+}
+
+// v2Need is the role needed for a route of the v2 API.
+func v2Need(r *http.Request) (string, apiRole, error) {
+	what := r.Method + " " + r.URL.Path
+	if route := mux.CurrentRoute(r); route != nil {
+		for _, rt := range apiv2Routes() {
+			if rt.Name == route.GetName() {
+				return what, rt.role(), nil
+			}
+		}
+	}
+	return what, roleAdmin, nil
+}
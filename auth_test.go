@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestNewApiAuth(t *testing.T) {
+	cases := []struct {
+		name  string
+		key   string
+		keys  []map[string]string
+		certs []map[string]string
+		ok    bool
+	}{
+		{name: "shared_key", key: "secret", ok: true},
+		{name: "nothing"},
+		{name: "named_keys", keys: []map[string]string{
+			{"name": "monitor", "key": "m", "role": "read-only"},
+			{"name": "ops", "key": "o", "role": "Operator"},
+		}, ok: true},
+		{name: "unknown_role", keys: []map[string]string{{"name": "x", "key": "x", "role": "root"}}},
+		{name: "duplicate", keys: []map[string]string{
+			{"name": "x", "key": "x", "role": "admin"}, {"name": "x", "key": "y", "role": "admin"},
+		}},
+		{name: "no_key", keys: []map[string]string{{"name": "x", "role": "admin"}}},
+		{name: "certs_only", certs: []map[string]string{{"cn": "cli.example", "role": "admin"}}, ok: true},
+		{name: "cert_without_cn", certs: []map[string]string{{"role": "admin"}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			viper.Set("apiserver.key", c.key)
+			viper.Set("apiserver.keys", c.keys)
+			viper.Set("apiserver.clientcerts", c.certs)
+			defer func() {
+				viper.Set("apiserver.key", "")
+				viper.Set("apiserver.keys", nil)
+				viper.Set("apiserver.clientcerts", nil)
+			}()
+			if _, err := NewApiAuth(); (err == nil) != c.ok {
+				t.Errorf("NewApiAuth: %v", err)
+			}
+		})
+	}
+}
+
+func TestApiAuthMiddleware(t *testing.T) {
+	conf, _ := newAPITestConf(t) // sets apiserver.key to "test"
+	viper.Set("apiserver.keys", []map[string]string{
+		{"name": "monitor", "key": "ro", "role": "read-only"},
+		{"name": "ops", "key": "op", "role": "operator"},
+	})
+	viper.Set("apiserver.clientcerts", []map[string]string{{"cn": "cli.example", "role": "operator"}})
+	defer func() {
+		viper.Set("apiserver.keys", nil)
+		viper.Set("apiserver.clientcerts", nil)
+	}()
+	h := SetupRouter(conf)
+
+	// A client certificate as the TLS listener would have verified it.
+	verified := func(cn string) *tls.ConnectionState {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+		return &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+
+	cases := []struct {
+		name   string
+		key    string
+		tls    *tls.ConnectionState
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{name: "anonymous", method: "GET", path: "/api/v2/rpz", code: http.StatusUnauthorized},
+		{name: "wrong_key", key: "nope", method: "GET", path: "/api/v2/rpz", code: http.StatusUnauthorized},
+		{name: "ro_get", key: "ro", method: "GET", path: "/api/v2/rpz", code: http.StatusOK},
+		{name: "ro_post", key: "ro", method: "POST", path: "/api/v2/lists/local-deny/names",
+			body: `{"names": [{"name": "x.example."}]}`, code: http.StatusForbidden},
+		{name: "op_post", key: "op", method: "POST", path: "/api/v2/lists/local-deny/names",
+			body: `{"names": [{"name": "x.example."}]}`, code: http.StatusOK},
+		{name: "ro_status", key: "ro", method: "POST", path: "/api/v1/command",
+			body: `{"Command": "rpz-digest"}`, code: http.StatusOK},
+		{name: "op_stop", key: "op", method: "POST", path: "/api/v1/command",
+			body: `{"Command": "stop"}`, code: http.StatusForbidden},
+		{name: "op_unknown_command", key: "op", method: "POST", path: "/api/v1/command",
+			body: `{"Command": "no-such-command"}`, code: http.StatusForbidden},
+		{name: "ro_debug", key: "ro", method: "POST", path: "/api/v1/debug",
+			body: `{"Command": "gen-output"}`, code: http.StatusForbidden},
+		{name: "admin_unknown_command", key: "test", method: "POST", path: "/api/v1/command",
+			body: `{"Command": "no-such-command"}`, code: http.StatusOK},
+		{name: "cert", tls: verified("cli.example"), method: "POST", path: "/api/v2/lists/local-deny/names",
+			body: `{"names": [{"name": "y.example."}]}`, code: http.StatusOK},
+		{name: "unknown_cert", tls: verified("other.example"), method: "GET", path: "/api/v2/rpz", code: http.StatusUnauthorized},
+		{name: "unverified_cert", tls: &tls.ConnectionState{PeerCertificates: verified("cli.example").PeerCertificates},
+			method: "GET", path: "/api/v2/rpz", code: http.StatusUnauthorized},
+		{name: "op_too_large", key: "op", method: "POST", path: "/api/v1/command",
+			body: `{"Command": "rpz-digest", "Pad": "` + strings.Repeat("x", maxCommandPost) + `"}`,
+			code: http.StatusRequestEntityTooLarge},
+		{name: "health", method: "GET", path: "/healthz", code: http.StatusServiceUnavailable},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+			if c.key != "" {
+				req.Header.Set("X-API-Key", c.key)
+			}
+			req.TLS = c.tls
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != c.code {
+				t.Errorf("status %d, want %d: %.200s", rec.Code, c.code, rec.Body)
+			}
+		})
+	}
+
+	// The body of an unauthenticated v1 request is not read.
+	body := &readCounter{r: strings.NewReader(`{"Command": "rpz-digest"}`)}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/command", body))
+	if rec.Code != http.StatusUnauthorized || body.n != 0 {
+		t.Errorf("anonymous v1 command: status %d, %d bytes of the body read", rec.Code, body.n)
+	}
+}
+
+type readCounter struct {
+	r io.Reader
+	n int
+}
+
+func (rc *readCounter) Read(p []byte) (int, error) {
+	n, err := rc.r.Read(p)
+	rc.n += n
+	return n, err
+}
@@ -6,9 +6,11 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"time"
 
@@ -138,14 +140,13 @@ func (td *PopData) BootstrapMqttSource(src SourceConf) (*tapir.WBGlist, error) {
 			continue
 		}
 
-		if td.Debug {
-			td.Logger.Printf("%v", doubtlist)
-			td.Logger.Printf("Names present in doubtlist %s:", src.Name)
+		if lg := compLogger("sources"); lg.Enabled(context.Background(), slog.LevelDebug) {
 			out := []string{"Name|Time added|TTL|Tags"}
 			for _, n := range doubtlist.Names {
 				out = append(out, fmt.Sprintf("%s|%v|%v|%v", n.Name, n.TimeAdded.Format(tapir.TimeLayout), n.TTL, n.TagMask))
 			}
-			td.Logger.Printf("%s", columnize.SimpleFormat(out))
+			lg.Debug("BootstrapMqttSource: names in the bootstrapped list",
+				"source", src.Name, "names", len(doubtlist.Names), "list", columnize.SimpleFormat(out))
 		}
 
 		// Successfully received and decoded bootstrap data
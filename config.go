@@ -23,9 +23,17 @@ type Config struct {
 	Sources         map[string]SourceConf
 	Policy          PolicyConf
 	Log             struct {
-		File    string `validate:"required"`
-		Verbose *bool  `validate:"required"`
-		Debug   *bool  `validate:"required"`
+		File       string            // required if Output is file
+		Output     string            // file (default) | stderr | journald
+		Format     string            // text (default) | json
+		Level      string            // of all components, default info
+		Levels     map[string]string // per component, overriding Level
+		MaxSize    int               // MB before a log file is rotated
+		MaxBackups int
+		MaxAge     int // days
+		Compress   bool
+		Verbose    *bool
+		Debug      *bool // same as Level debug
 	}
 	Loggers struct {
 		Mqtt      *log.Logger
@@ -38,32 +46,108 @@ type Config struct {
 }
 
 type ServicesConf struct {
-	Rpz struct {
-		ZoneName    string `validate:"required"`
-		SerialCache string `validate:"required"`
-	}
+	Rpz RpzConf
 
 	Reaper struct {
 		Interval int `validate:"required"`
 	}
+
+	Health struct {
+		MaxFails int // consecutive StatusFail reports before /readyz fails
+	}
+
+	Audit struct {
+		LogFile    string // no audit log if empty
+		MaxSize    int    // MB before the log is rotated
+		MaxBackups int    // rotated logs to keep
+		MaxAge     int    // days to keep rotated logs, 0 for no limit
+	}
+
+	NameStore struct {
+		Dir string // for the lists with "store: disk"
+	}
+
+	ListStore struct {
+		Dir      string // no snapshots of the MQTT-fed lists if empty
+		Interval int    // seconds between the snapshots, default 300
+	}
+}
+
+type RpzConf struct {
+	ZoneName    string `validate:"required"`
+	SerialCache string `validate:"required"`
+	Soa         RpzSoaConf
+	Nameservers []RpzNameserverConf
+}
+
+// RpzSoaConf holds the SOA fields of the RPZ output. Zero means the default.
+type RpzSoaConf struct {
+	Mname   string
+	Rname   string
+	Ttl     uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+}
+
+type RpzNameserverConf struct {
+	Name      string
+	Addresses []string // glue, only for nameservers inside the RPZ zone
 }
 
 type ApiserverConf struct {
 	Active       *bool    `validate:"required"`
 	Name         string   `validate:"required"`
-	Key          string   `validate:"required"`
-	Addresses    []string `validate:"required"`
-	TlsAddresses []string `validate:"required"`
+	Key          string   // shared key with the admin role; optional if Keys or ClientCerts are set
+	Keys         []ApiKeyConf
+	ClientCerts  []ApiCertConf // verified client certificates on TlsAddresses
+	Addresses    []string      `validate:"required"`
+	TlsAddresses []string      `validate:"required"`
+}
+
+type ApiKeyConf struct {
+	Name string // identifies the key in the log
+	Key  string
+	Role string // read-only | operator | admin
+}
+
+type ApiCertConf struct {
+	Cn   string // subject CN of the client certificate
+	Role string
 }
 
 type DnsengineConf struct {
-	Active    *bool    `validate:"required"`
-	Name      string   `validate:"required"`
-	Addresses []string `validate:"required"`
-	Logfile   string   `validate:"required"`
+	Active       *bool    `validate:"required"`
+	Name         string   `validate:"required"`
+	Addresses    []string `validate:"required"`
+	TlsAddresses []string // XoT (RFC 9103) listeners
+	Mtls         bool     // require a client cert signed by certs.cacertfile on TlsAddresses
+	UdpSize      uint16   // largest UDP response (EDNS0 buffer size), default 1232
+	Nsid         string   // server identity for NSID and CHAOS id.server, none if empty
+	MaxTransfers int      // concurrent outbound zone transfers, default 10
+	Logfile      string   // dedicated log file, the standard log if empty
+	Explain      struct {
+		Active bool
+		Acl    []string // prefixes or addresses allowed to query explain.<rpzzone>
+	}
+	Ratelimit struct {
+		Active bool     // default true
+		Exempt []string // prefixes or addresses that are never rate limited
+		Query  RateLimitConf
+		Notify RateLimitConf
+		Xfr    RateLimitConf
+	}
 	// Logger  *log.Logger
 }
 
+// RateLimitConf is a per-client token bucket: rate requests per second on
+// average, in bursts of up to burst requests.
+type RateLimitConf struct {
+	Rate  float64
+	Burst float64
+}
+
 type BootstrapServerConf struct {
 	Active       *bool    `validate:"required"`
 	Name         string   `validate:"required"`
@@ -96,7 +180,9 @@ type SourceConf struct {
 	BootstrapKey string
 	Filename     string
 	Upstream     string
+	Xot          bool // transfer from Upstream over TLS (RFC 9103)
 	Zone         string
+	Store        string // memory (default) | disk, where the names are kept
 }
 
 type PolicyConf struct {
@@ -134,6 +220,8 @@ type InternalConf struct {
 	// RpzCmdCh      chan RpzCmdData
 	APIStopCh         chan struct{}
 	ComponentStatusCh chan tapir.ComponentStatusUpdate
+	Shutdown          *Shutdown
+	CfgFile           string // the main config file, which has services.rpz
 }
 
 func ValidateConfig(v *viper.Viper, cfgfile string) error {
@@ -168,6 +256,9 @@ func ValidateConfig(v *viper.Viper, cfgfile string) error {
 	if err := ValidateBySection(&config, configsections, cfgfile); err != nil {
 		POPExiter("Config \"%s\" is missing required attributes:\n%v\n", cfgfile, err)
 	}
+	if _, err := NewRpzApex(config.Services.Rpz); err != nil {
+		POPExiter("Config \"%s\": invalid RPZ apex: %v", cfgfile, err)
+	}
 	return nil
 }
 
@@ -105,8 +105,12 @@ func (pd *PopData) ProcessTapirGlobalConfig(gconfig tapir.GlobalConfig) {
 				pd.Logger.Printf("ProcessTapirGlobalConfig: Error bootstrapping MQTT source %s: %v", wbgl.Name, err)
 			} else {
 				pd.mu.Lock()
-				*wbgl = *tmp
+				*wbgl.WBGlist = *tmp
+				err = wbgl.setNames(tmp.Names)
 				pd.mu.Unlock()
+				if err != nil {
+					pd.Logger.Printf("ProcessTapirGlobalConfig: Error storing the names of MQTT source %s: %v", wbgl.Name, err)
+				}
 			}
 		}
 
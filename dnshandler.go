@@ -5,8 +5,10 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"net"
+	"slices"
 	"strings"
 
 	"github.com/miekg/dns"
@@ -19,155 +21,244 @@ import (
 
 // func DnsEngine(scannerq chan ScanRequest, updateq chan UpdateRequest) error {
 func DnsEngine(conf *Config) error {
+	lg := compLogger("dnsengine")
 	addresses := viper.GetStringSlice("dnsengine.addresses")
 
 	//      verbose := viper.GetBool("dnsengine.verbose")
 	//      debug := viper.GetBool("dnsengine.debug")
 	dns.HandleFunc(".", createHandler(conf))
 
-	conf.Loggers.Dnsengine.Printf("DnsEngine: addresses: %v", addresses)
+	lg.Info("DnsEngine: addresses", "addresses", addresses)
 	for _, addr := range addresses {
 		for _, net := range []string{"udp", "tcp"} {
 			go func(addr, net string) {
-				conf.Loggers.Dnsengine.Printf("DnsEngine: serving on %s (%s)\n", addr, net)
+				lg.Info("DnsEngine: serving", "addr", addr, "net", net)
 				server := &dns.Server{Addr: addr, Net: net}
+				conf.Internal.Shutdown.OnShutdown(shutdownServers, "DNS server on "+addr+"/"+net, server.ShutdownContext)
 
 				// Must bump the buffer size of incoming UDP msgs, as updates
 				// may be much larger then queries
 				server.UDPSize = dns.DefaultMsgSize // 4096
-				if err := server.ListenAndServe(); err != nil {
-					conf.Loggers.Dnsengine.Printf("Failed to setup the %s server: %s\n", net, err.Error())
+				if err := listenAndServeDNS(server); err != nil {
+					lg.Error("DnsEngine: failed to set up the server", "addr", addr, "net", net, "error", err)
 				} else {
-					conf.Loggers.Dnsengine.Printf("DnsEngine: listening on %s/%s\n", addr, net)
+					lg.Info("DnsEngine: server stopped", "addr", addr, "net", net)
 				}
 			}(addr, net)
 		}
 	}
+
+	tlsaddresses := viper.GetStringSlice("dnsengine.tlsaddresses")
+	if len(tlsaddresses) == 0 {
+		return nil
+	}
+	tlsConfig, err := xotServerConfig(viper.GetString("certs.tapir-pop.cert"), viper.GetString("certs.tapir-pop.key"),
+		viper.GetString("certs.cacertfile"), viper.GetBool("dnsengine.mtls"))
+	if err != nil {
+		lg.Error("DnsEngine: cannot provide XoT service", "error", err)
+		return nil
+	}
+	lg.Info("DnsEngine: XoT addresses", "addresses", tlsaddresses, "mtls", viper.GetBool("dnsengine.mtls"))
+	for _, addr := range tlsaddresses {
+		go func(addr string) {
+			lg.Info("DnsEngine: serving", "addr", addr, "net", "tcp-tls")
+			server := &dns.Server{Addr: addr, Net: "tcp-tls", TLSConfig: tlsConfig}
+			conf.Internal.Shutdown.OnShutdown(shutdownServers, "DNS server on "+addr+"/tcp-tls", server.ShutdownContext)
+			if err := listenAndServeDNS(server); err != nil {
+				lg.Error("DnsEngine: failed to set up the server", "addr", addr, "net", "tcp-tls", "error", err)
+			}
+		}(addr)
+	}
 	return nil
 }
 
 func createHandler(conf *Config) func(w dns.ResponseWriter, r *dns.Msg) {
 
 	pd := conf.PopData
-	lg := conf.Loggers.Dnsengine
+	lg := compLogger("dnsengine")
 	zonech := conf.PopData.RpzRefreshCh
 
 	//	var rrtypes []string
 
+	udpsize, nsid := conf.DnsEngine.UdpSize, conf.DnsEngine.Nsid
+	if udpsize == 0 {
+		udpsize = defaultEdnsUDPSize
+	}
+
 	return func(w dns.ResponseWriter, r *dns.Msg) {
+		w = newEdnsWriter(w, r, udpsize, nsid)
+		if rcode := checkQuery(r); rcode != dns.RcodeSuccess {
+			lg.Debug("DnsHandler: malformed message", "client", w.RemoteAddr(), "rcode", dns.RcodeToString[rcode])
+			m := new(dns.Msg)
+			m.SetRcode(r, rcode)
+			err := w.WriteMsg(m)
+			if err != nil {
+				lg.Warn("WriteMsg failed", "error", err)
+			}
+			return
+		}
+		if class := classify(r); !pd.Limits.Allow(class, w.RemoteAddr(), lg) {
+			// Answering spoofed UDP queries would make us a reflector.
+			if class == classQuery && isUDP(w) {
+				return
+			}
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeRefused)
+			err := w.WriteMsg(m)
+			if err != nil {
+				lg.Warn("WriteMsg failed", "error", err)
+			}
+			return
+		}
 		qname := r.Question[0].Name
 
 		switch r.Opcode {
 		case dns.OpcodeNotify:
 			ntype := r.Question[0].Qtype
-			lg.Printf("Received NOTIFY(%s) for zone '%s'", dns.TypeToString[ntype], qname)
+			lg.Info("DnsHandler: received NOTIFY", "zone", qname, "type", dns.TypeToString[ntype], "client", w.RemoteAddr())
 			// send NOERROR response
 			m := new(dns.Msg)
 			m.SetReply(r)
 			err := w.WriteMsg(m)
 			if err != nil {
-				lg.Printf("Error from WriteMsg(): %v", err)
+				lg.Warn("WriteMsg failed", "error", err)
 			}
 
-			if _, ok := pd.RpzSources[qname]; ok {
-				lg.Printf("Received Notify for known zone %s. Fetching from upstream", qname)
-				zonech <- RpzRefresh{
+			if zd, ok := pd.RpzSource(qname); ok {
+				if !pd.Limits.queueRefresh(qname) {
+					lg.Debug("DnsHandler: NOTIFY for a known zone, a refresh is already queued", "zone", qname)
+					return
+				}
+				lg.Info("DnsHandler: NOTIFY for a known zone, fetching from upstream", "zone", qname)
+				select {
+				case zonech <- RpzRefresh{
 					Name:     qname, // send zone name into RefreshEngine
-					ZoneType: pd.RpzSources[qname].ZoneType,
+					ZoneType: zd.ZoneType,
+				}:
+				default:
+					// Never block the handler; the refresh counter catches up.
+					pd.Limits.refreshDone(qname)
+					lg.Warn("DnsHandler: NOTIFY dropped, the refresh queue is full", "zone", qname)
 				}
 			}
-			lg.Printf("Notify message: %v\n", m.String())
+			lg.Debug("DnsHandler: NOTIFY response", "msg", m.String())
 
 			return
 
 		case dns.OpcodeQuery:
 			qtype := r.Question[0].Qtype
-			lg.Printf("Zone %s %s request from %s", qname, dns.TypeToString[qtype], w.RemoteAddr())
-			if qname == pd.Rpz.ZoneName {
+			lg.Debug("DnsHandler: query", "qname", qname, "qtype", dns.TypeToString[qtype], "client", w.RemoteAddr())
+			if r.Question[0].Qclass == dns.ClassCHAOS {
+				err := IdentityResponder(w, r, nsid)
+				if err != nil {
+					lg.Error("IdentityResponder failed", "error", err)
+				}
+			} else if pd.Explain.Zone != "" && dns.IsSubDomain(pd.Explain.Zone, qname) {
+				err := pd.ExplainResponder(w, r, qname, qtype, lg)
+				if err != nil {
+					lg.Error("ExplainResponder failed", "error", err)
+				}
+			} else if strings.EqualFold(qname, pd.Rpz.ZoneName) {
 				err := pd.RpzResponder(w, r, qtype, lg)
 				if err != nil {
-					lg.Printf("Error from RpzResponder(): %v", err)
+					lg.Error("RpzResponder failed", "error", err)
 				}
-			} else if zd, ok := pd.RpzSources[qname]; ok {
+			} else if zd, ok := pd.RpzSource(qname); ok {
 				// The qname is equal to the name of a zone we have
 				err := ApexResponder(w, r, zd, qname, qtype, lg)
 				if err != nil {
-					lg.Printf("Error from ApexResponder(): %v", err)
+					lg.Error("ApexResponder failed", "error", err)
 				}
 			} else {
-				lg.Printf("DnsHandler: Qname is '%s', which is not a known zone.", qname)
-				known_zones := []string{pd.Rpz.ZoneName}
-				for z := range pd.RpzSources {
-					known_zones = append(known_zones, z)
+				if lg.Enabled(context.Background(), slog.LevelDebug) {
+					lg.Debug("DnsHandler: qname is not a known zone", "qname", qname,
+						"known", append([]string{pd.Rpz.ZoneName}, pd.RpzSourceNames()...))
 				}
-				lg.Printf("DnsHandler: Known zones are: %v", known_zones)
 
 				// Let's see if we can find the zone
-				if strings.HasSuffix(qname, pd.Rpz.ZoneName) {
-					lg.Printf("Query for qname %s belongs in our own RPZ \"%s\"",
-						qname, pd.Rpz.ZoneName)
+				if dns.IsSubDomain(pd.Rpz.ZoneName, qname) {
+					lg.Debug("DnsHandler: qname is in our own RPZ", "qname", qname, "zone", pd.Rpz.ZoneName)
 					err := pd.QueryResponder(w, r, qname, qtype, lg)
 					if err != nil {
-						lg.Printf("Error from QueryResponder(): %v", err)
+						lg.Error("QueryResponder failed", "error", err)
 					}
 					return
 				}
 				zd := pd.FindZone(qname)
 				if zd == nil {
-					lg.Printf("After FindZone: zd==nil")
+					lg.Debug("DnsHandler: no zone for qname", "qname", qname)
 					m := new(dns.Msg)
 					m.SetRcode(r, dns.RcodeRefused)
 					err := w.WriteMsg(m)
 					if err != nil {
-						lg.Printf("Error from WriteMsg(): %v", err)
+						lg.Warn("WriteMsg failed", "error", err)
 					}
 					return // didn't find any zone for that qname or found zone, but it is an XFR zone only
 				}
-				lg.Printf("After FindZone: zd: zd.ZoneType: %v", zd.ZoneType)
+				lg.Debug("DnsHandler: found zone", "qname", qname, "zone", zd.ZoneName, "type", zd.ZoneType)
 				if zd.ZoneType == tapir.XfrZone {
 					m := new(dns.Msg)
 					m.SetRcode(r, dns.RcodeRefused)
 					err := w.WriteMsg(m)
 					if err != nil {
-						lg.Printf("Error from WriteMsg(): %v", err)
+						lg.Warn("WriteMsg failed", "error", err)
 					}
 					return // didn't find any zone for that qname or found zone, but it is an XFR zone only
 				}
-				lg.Printf("Found matching full zone for qname %s: %s", qname, zd.ZoneName)
 				err := QueryResponder(w, r, zd, qname, qtype, lg)
 				if err != nil {
-					lg.Printf("Error from QueryResponder(): %v", err)
+					lg.Error("QueryResponder failed", "error", err)
 				}
 				return
 			}
 			return
 
 		default:
-			lg.Printf("Error: unable to handle msgs of type %s",
-				dns.OpcodeToString[r.Opcode])
+			lg.Debug("DnsHandler: unable to handle the opcode", "opcode", dns.OpcodeToString[r.Opcode], "client", w.RemoteAddr())
 		}
 	}
 }
 
-func (pd *PopData) RpzResponder(w dns.ResponseWriter, r *dns.Msg, qtype uint16, lg *log.Logger) error {
+func (pd *PopData) RpzResponder(w dns.ResponseWriter, r *dns.Msg, qtype uint16, lg *slog.Logger) error {
 	m := new(dns.Msg)
 	m.SetReply(r)
-	m.MsgHdr.Authoritative = true
 
-	//	apex := zd.Owners[zd.OwnerIndex[zd.ZoneName]]
-	// zd.Logger.Printf("*** Ownerindex(%s)=%d apex: %v", zd.ZoneName, zd.OwnerIndex[zd.ZoneName], apex)
-	zd := pd.Rpz.Axfr.ZoneData
-	// XXX: we need this, but later var glue tapir.RRset
+	snap := pd.Rpz.Current()
 
 	downstream, _, err := net.SplitHostPort(w.RemoteAddr().String())
 	if err != nil {
-		lg.Printf("RpzResponder: Error from net.SplitHostPort(): %v", err)
+		lg.Error("RpzResponder: cannot split the client address", "error", err)
 		return nil
 	}
 
-	switch qtype {
-	case dns.TypeAXFR:
-		lg.Printf("We have the zone %s, so let's try to serve it", pd.Rpz.ZoneName)
+	if (qtype == dns.TypeAXFR || qtype == dns.TypeIXFR) && !isUDP(w) {
+		if !pd.Limits.startTransfer() {
+			lg.Warn("RpzResponder: refusing the transfer, too many transfers in progress or shutting down",
+				"type", dns.TypeToString[qtype], "zone", pd.Rpz.ZoneName, "downstream", downstream)
+			m.Rcode = dns.RcodeRefused
+			err = w.WriteMsg(m)
+			if err != nil {
+				lg.Warn("WriteMsg failed", "error", err)
+			}
+			return nil
+		}
+		defer pd.Limits.endTransfer()
+	}
+
+	switch {
+	case (qtype == dns.TypeAXFR || qtype == dns.TypeIXFR) && isUDP(w):
+		// A transfer does not fit in a datagram. For IXFR the current SOA
+		// tells the client to retry over TCP (RFC 1995, section 4); AXFR is
+		// TCP only (RFC 5936, section 4.2), so just set TC.
+		if qtype == dns.TypeIXFR {
+			soa := snap.SOA
+			m.Answer = append(m.Answer, &soa)
+		} else {
+			m.Truncated = true
+		}
+
+	case qtype == dns.TypeAXFR:
+		lg.Debug("RpzResponder: serving AXFR", "zone", pd.Rpz.ZoneName, "downstream", downstream)
 		//		log.Printf("SOA: %s", zd.SOA.String())
 		//		log.Printf("BodyRRs: %d (+ %d apex RRs)", len(zd.BodyRRs), zd.ApexLen)
 
@@ -176,48 +267,35 @@ func (pd *PopData) RpzResponder(w dns.ResponseWriter, r *dns.Msg, qtype uint16,
 
 		_, _, err := pd.RpzAxfrOut(w, r)
 		if err != nil {
-			lg.Printf("RpzResponder: error from RpzAxfrOut() serving zone %s: %v", zd.ZoneName, err)
+			lg.Error("RpzResponder: RpzAxfrOut failed", "zone", pd.Rpz.ZoneName, "downstream", downstream, "error", err)
 		}
 
 		return nil
 
-	case dns.TypeIXFR:
-		lg.Printf("RpzResponder: %s is our RPZ output", pd.Rpz.ZoneName)
+	case qtype == dns.TypeIXFR:
+		lg.Debug("RpzResponder: serving IXFR", "zone", pd.Rpz.ZoneName, "downstream", downstream)
 
 		serial, _, err := pd.RpzIxfrOut(w, r)
 		if err != nil {
-			lg.Printf("RpzResponder: error from RpzIxfrOut() serving zone %s: %v", zd.ZoneName, err)
+			lg.Error("RpzResponder: RpzIxfrOut failed", "zone", pd.Rpz.ZoneName, "downstream", downstream, "error", err)
 		}
 
 		pd.mu.Lock()
 		pd.DownstreamSerials[downstream] = serial // track the highest known serial for each downstream
 		pd.mu.Unlock()
 		return nil
-	case dns.TypeSOA:
-		// zd.Logger.Printf("There are %d SOA RRs in %s. rrset: %v", len(apex.RRtypes[dns.TypeSOA].RRs),
-		// 			   zd.ZoneName, apex.RRtypes[dns.TypeSOA])
-		//		m.Answer = append(m.Answer, dns.RR(&zd.SOA))
-		pd.Rpz.Axfr.SOA.Serial = pd.Rpz.CurrentSerial
-		m.Answer = append(m.Answer, dns.RR(&pd.Rpz.Axfr.SOA))
-		//		m.Ns = append(m.Ns, apex.RRtypes[dns.TypeNS].RRs...)
-		m.Ns = append(m.Ns, pd.Rpz.Axfr.ZoneData.NSrrs...)
-		//		glue = *zd.FindGlue(apex.RRtypes[dns.TypeNS])
-		//		m.Extra = append(m.Extra, glue.RRs...)
-
 	default:
-		// every apex query we don't want to deal with
-		m.MsgHdr.Rcode = dns.RcodeRefused
-		m.Ns = append(m.Ns, zd.NSrrs...)
+		snap.answer(m, r.Question[0].Name, qtype)
 	}
 	err = w.WriteMsg(m)
 	if err != nil {
-		lg.Printf("Error from WriteMsg(): %v", err)
+		lg.Warn("WriteMsg failed", "error", err)
 	}
 	return nil
 }
 
 func ApexResponder(w dns.ResponseWriter, r *dns.Msg, zd *tapir.ZoneData,
-	qname string, qtype uint16, lg *log.Logger) error {
+	qname string, qtype uint16, lg *slog.Logger) error {
 	m := new(dns.Msg)
 	m.SetReply(r)
 	m.MsgHdr.Authoritative = true
@@ -255,7 +333,7 @@ func ApexResponder(w dns.ResponseWriter, r *dns.Msg, zd *tapir.ZoneData,
 	}
 	err := w.WriteMsg(m)
 	if err != nil {
-		lg.Printf("Error from WriteMsg(): %v", err)
+		lg.Warn("WriteMsg failed", "error", err)
 	}
 	return nil
 }
@@ -267,7 +345,7 @@ func ApexResponder(w dns.ResponseWriter, r *dns.Msg, zd *tapir.ZoneData,
 // 4. If no CNAME match, check for wild card match
 // 5. Give up.
 
-func QueryResponder(w dns.ResponseWriter, r *dns.Msg, zd *tapir.ZoneData, qname string, qtype uint16, lg *log.Logger) error {
+func QueryResponder(w dns.ResponseWriter, r *dns.Msg, zd *tapir.ZoneData, qname string, qtype uint16, lg *slog.Logger) error {
 
 	m := new(dns.Msg)
 	m.SetReply(r)
@@ -288,7 +366,7 @@ func QueryResponder(w dns.ResponseWriter, r *dns.Msg, zd *tapir.ZoneData, qname
 		m.Ns = append(m.Ns, apex.RRtypes[dns.TypeSOA].RRs...)
 		err := w.WriteMsg(m)
 		if err != nil {
-			lg.Printf("Error from WriteMsg(): %v", err)
+			lg.Warn("WriteMsg failed", "error", err)
 		}
 	}
 
@@ -311,7 +389,7 @@ func QueryResponder(w dns.ResponseWriter, r *dns.Msg, zd *tapir.ZoneData, qname
 			m.Ns = append(m.Ns, apex.RRtypes[dns.TypeSOA].RRs...)
 			err := w.WriteMsg(m)
 			if err != nil {
-				lg.Printf("Error from WriteMsg(): %v", err)
+				lg.Warn("WriteMsg failed", "error", err)
 			}
 			return nil
 		}
@@ -329,7 +407,7 @@ func QueryResponder(w dns.ResponseWriter, r *dns.Msg, zd *tapir.ZoneData, qname
 		m.Ns = append(m.Ns, apex.RRtypes[dns.TypeSOA].RRs...)
 		err := w.WriteMsg(m)
 		if err != nil {
-			lg.Printf("Error from WriteMsg(): %v", err)
+			lg.Warn("WriteMsg failed", "error", err)
 		}
 		return nil
 	}
@@ -341,7 +419,7 @@ func QueryResponder(w dns.ResponseWriter, r *dns.Msg, zd *tapir.ZoneData, qname
 			if k == dns.TypeCNAME {
 				if len(v.RRs) > 1 {
 					// XXX: NSD will not even load a zone with multiple CNAMEs. Better to check during load...
-					log.Printf("QueryResponder: Zone %s: Illegal content: multiple CNAME RRs: %v", zd.ZoneName, v)
+					lg.Warn("QueryResponder: multiple CNAME RRs", "zone", zd.ZoneName, "rrset", v)
 				}
 				m.Answer = append(m.Answer, v.RRs...)
 				tgt := v.RRs[0].(*dns.CNAME).Target
@@ -354,7 +432,7 @@ func QueryResponder(w dns.ResponseWriter, r *dns.Msg, zd *tapir.ZoneData, qname
 					}
 					err := w.WriteMsg(m)
 					if err != nil {
-						lg.Printf("Error from WriteMsg(): %v", err)
+						lg.Warn("WriteMsg failed", "error", err)
 					}
 					return nil
 				}
@@ -365,14 +443,13 @@ func QueryResponder(w dns.ResponseWriter, r *dns.Msg, zd *tapir.ZoneData, qname
 	// 2. Check for exact match qname+qtype
 	switch qtype {
 	case dns.TypeTXT, dns.TypeMX, dns.TypeA, dns.TypeAAAA:
-		lg.Printf("Apex data[%s]:\n", zd.ZoneName)
-		for rrt, d := range apex.RRtypes {
-			lg.Printf("%s: %v", dns.TypeToString[rrt], d)
-		}
-
-		lg.Printf("Qname data[%s]:\n", qname)
-		for rrt, d := range owner.RRtypes {
-			lg.Printf("%s: %v", dns.TypeToString[rrt], d)
+		if lg.Enabled(context.Background(), slog.LevelDebug) {
+			for rrt, d := range apex.RRtypes {
+				lg.Debug("QueryResponder: apex data", "zone", zd.ZoneName, "type", dns.TypeToString[rrt], "rrset", d)
+			}
+			for rrt, d := range owner.RRtypes {
+				lg.Debug("QueryResponder: qname data", "qname", qname, "type", dns.TypeToString[rrt], "rrset", d)
+			}
 		}
 
 		if _, ok := owner.RRtypes[qtype]; ok && len(owner.RRtypes[qtype].RRs) > 0 {
@@ -385,7 +462,7 @@ func QueryResponder(w dns.ResponseWriter, r *dns.Msg, zd *tapir.ZoneData, qname
 		}
 		err := w.WriteMsg(m)
 		if err != nil {
-			lg.Printf("Error from WriteMsg(): %v", err)
+			lg.Warn("WriteMsg failed", "error", err)
 		}
 		return nil
 
@@ -397,82 +474,182 @@ func QueryResponder(w dns.ResponseWriter, r *dns.Msg, zd *tapir.ZoneData, qname
 		m.Extra = append(m.Extra, glue.RRs...)
 		err := w.WriteMsg(m)
 		if err != nil {
-			lg.Printf("Error from WriteMsg(): %v", err)
+			lg.Warn("WriteMsg failed", "error", err)
 		}
 	}
 	return nil
 }
 
-func (pd *PopData) QueryResponder(w dns.ResponseWriter, r *dns.Msg, qname string, qtype uint16, lg *log.Logger) error {
-
+func (pd *PopData) QueryResponder(w dns.ResponseWriter, r *dns.Msg, qname string, qtype uint16, lg *slog.Logger) error {
 	m := new(dns.Msg)
 	m.SetReply(r)
-	m.MsgHdr.Authoritative = true
+	pd.Rpz.Current().answer(m, qname, qtype)
+	err := w.WriteMsg(m)
+	if err != nil {
+		lg.Warn("WriteMsg failed", "error", err)
+	}
+	return nil
+}
 
-	returnNXDOMAIN := func() {
-		// return NXDOMAIN
-		m.MsgHdr.Rcode = dns.RcodeNameError
-		//		m.Ns = append(m.Ns, apex.RRtypes[dns.TypeSOA].RRs...)
-		m.Ns = append(m.Ns, dns.RR(&pd.Rpz.Axfr.SOA))
-		err := w.WriteMsg(m)
-		if err != nil {
-			lg.Printf("Error from WriteMsg(): %v", err)
+// answer fills in m as the authoritative answer from the snapshot to a query
+// for qname, which must be inside the RPZ zone. This follows RFC 1034, section
+// 4.3.2: an existing name (or empty non-terminal) without the qtype is NODATA,
+// a missing one is NXDOMAIN unless a wildcard matches (RFC 4592), and negative
+// answers carry the SOA with the negative TTL of RFC 2308, section 3.
+func (s *RpzSnapshot) answer(m *dns.Msg, qname string, qtype uint16) {
+	zone := dns.CanonicalName(s.SOA.Hdr.Name)
+	qname = dns.CanonicalName(qname)
+	if !dns.IsSubDomain(zone, qname) {
+		m.Rcode = dns.RcodeRefused
+		return
+	}
+	m.Authoritative = true
+
+	var rrs []dns.RR
+	switch {
+	case qname == zone:
+		rrs = s.apexRRset(qtype)
+		if qtype == dns.TypeNS {
+			m.Extra = append(m.Extra, s.Glue...)
+		}
+
+	case s.exists(qname, zone):
+		rrs = answerRRs(s.rrsAt(qname, zone), qtype)
+
+	default:
+		// Find the closest encloser and see if it has a wildcard child.
+		ce := qname
+		for {
+			i, _ := dns.NextLabel(ce, 0)
+			ce = ce[i:]
+			if ce == zone || s.exists(ce, zone) {
+				break
+			}
+		}
+		wild := s.rrsAt("*."+ce, zone)
+		if len(wild) == 0 {
+			m.Rcode = dns.RcodeNameError
+			m.Ns = append(m.Ns, s.negativeSOA())
+			return
+		}
+		for _, rr := range answerRRs(wild, qtype) {
+			rr = dns.Copy(rr)
+			rr.Header().Name = qname
+			rrs = append(rrs, rr)
 		}
 	}
 
-	// log.Printf("Zone %s Data: %v", zd.ZoneName, zd.Data)
+	if len(rrs) == 0 {
+		m.Ns = append(m.Ns, s.negativeSOA()) // NODATA
+		return
+	}
+	m.Answer = append(m.Answer, rrs...)
+}
 
-	//	var err error
-	var exist bool
-	var tn *tapir.RpzName
+// apexRRset returns the RRs at the apex for qtype (all of them for ANY).
+func (s *RpzSnapshot) apexRRset(qtype uint16) []dns.RR {
+	soa := s.SOA
+	all := append([]dns.RR{&soa}, s.NSrrs...)
+	all = append(all, s.apexRRs()...)
+	if qtype == dns.TypeANY {
+		return all
+	}
+	var rrs []dns.RR
+	for _, rr := range all {
+		if rr.Header().Rrtype == qtype {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
 
-	if tn, exist = pd.Rpz.Axfr.Data[qname]; exist {
-		m.MsgHdr.Rcode = dns.RcodeSuccess
-		switch qtype {
-		case dns.TypeCNAME, dns.TypeANY:
-			m.Answer = append(m.Answer, *tn.RR)
-			m.Ns = append(m.Ns, pd.Rpz.Axfr.NSrrs...)
-		default:
-			m.Ns = append(m.Ns, dns.RR(&pd.Rpz.Axfr.SOA))
+// rrsAt returns the RRs at owner below the apex: the trigger CNAME, or the
+// glue for an in-zone nameserver.
+func (s *RpzSnapshot) rrsAt(owner, zone string) []dns.RR {
+	var rrs []dns.RR
+	name := strings.TrimSuffix(owner, zone)
+	if action, exist := s.Data[name]; exist {
+		rrs = append(rrs, s.rr(name, action))
+	}
+	for _, rr := range s.Glue {
+		if rr.Header().Name == owner {
+			rrs = append(rrs, rr)
 		}
-		err := w.WriteMsg(m)
-		if err != nil {
-			lg.Printf("Error from WriteMsg(): %v", err)
+	}
+	return rrs
+}
+
+// exists reports whether owner has RRs or is an empty non-terminal, i.e. has
+// descendants that do.
+func (s *RpzSnapshot) exists(owner, zone string) bool {
+	if len(s.rrsAt(owner, zone)) > 0 {
+		return true
+	}
+	// In canonical order the descendants of a name directly follow it.
+	key := strings.TrimSuffix(owner, zone)
+	if i, _ := slices.BinarySearchFunc(s.Owners, key, canonicalCompare); i < len(s.Owners) &&
+		dns.IsSubDomain(key, s.Owners[i]) {
+		return true
+	}
+	for _, rr := range s.Glue {
+		if dns.IsSubDomain(owner, rr.Header().Name) {
+			return true
 		}
-		return nil
 	}
-	returnNXDOMAIN()
-	return nil
+	return false
+}
+
+// answerRRs picks the RRs for qtype among the RRs at a name. A CNAME answers
+// every qtype; the targets in an RPZ are never inside the zone, so there is
+// nothing to chase.
+func answerRRs(rrs []dns.RR, qtype uint16) []dns.RR {
+	var res []dns.RR
+	for _, rr := range rrs {
+		if t := rr.Header().Rrtype; t == qtype || t == dns.TypeCNAME || qtype == dns.TypeANY {
+			res = append(res, rr)
+		}
+	}
+	return res
+}
+
+// negativeSOA returns the SOA for the authority section of a negative answer,
+// with the TTL capped by the SOA minimum (RFC 2308, section 3).
+func (s *RpzSnapshot) negativeSOA() dns.RR {
+	soa := s.SOA
+	soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+	return &soa
 }
 
 func (pd *PopData) FindZone(qname string) *tapir.ZoneData {
+	lg := compLogger("dnsengine")
 	var tzone string
 	labels := strings.Split(qname, ".")
 	for i := 1; i < len(labels)-1; i++ {
 		tzone = strings.Join(labels[i:], ".")
-		log.Printf("FindZone for qname='%s': testing '%s'", qname, tzone)
-		if z, ok := pd.RpzSources[tzone]; ok {
-			log.Printf("Yes, zone=%s for qname=%s", tzone, qname)
+		lg.Debug("FindZone: testing", "qname", qname, "zone", tzone)
+		if z, ok := pd.RpzSource(tzone); ok {
+			lg.Debug("FindZone: found", "qname", qname, "zone", tzone)
 			return z
 		}
 	}
-	log.Printf("FindZone: no zone for qname=%s found", qname)
+	lg.Debug("FindZone: no zone found", "qname", qname)
 	return nil
 }
 
 func (pd *PopData) FindZoneNG(qname string) *tapir.ZoneData {
+	lg := compLogger("dnsengine")
 	i := strings.Index(qname, ".")
 	for {
 		if i == -1 {
 			break // done
 		}
-		log.Printf("FindZone for qname='%s': testing '%s'", qname, qname[i:])
-		if z, ok := pd.RpzSources[qname[i:]]; ok {
-			log.Printf("Yes, zone=%s for qname=%s", qname[i:], qname)
+		lg.Debug("FindZone: testing", "qname", qname, "zone", qname[i:])
+		if z, ok := pd.RpzSource(qname[i:]); ok {
+			lg.Debug("FindZone: found", "qname", qname, "zone", qname[i:])
 			return z
 		}
 		i = strings.Index(qname[i:], ".")
 	}
-	log.Printf("FindZone: no zone for qname=%s found", qname)
+	lg.Debug("FindZone: no zone found", "qname", qname)
 	return nil
 }
@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/miekg/dns"
+)
+
+func TestRpzAnswer(t *testing.T) {
+	rr := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatalf("NewRR(%q): %v", s, err)
+		}
+		return rr
+	}
+	data := map[string]tapir.Action{}
+	for _, trigger := range []string{"foo.example.", "*.wild.example.", "exact.wild.example."} {
+		data[trigger] = tapir.NXDOMAIN
+	}
+	s := &RpzSnapshot{
+		Serial: 7,
+		SOA:    *rr("rpz.test. 3600 IN SOA mname. hostmaster.dnstapir.se. 7 60 60 86400 60").(*dns.SOA),
+		NSrrs:  []dns.RR{rr("rpz.test. 3600 IN NS ns1.rpz.test.")},
+		Glue:   []dns.RR{rr("ns1.rpz.test. 3600 IN A 192.0.2.1")},
+		Data:   data,
+	}
+	s.seal()
+
+	cases := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		rcode     int
+		answer    []uint16 // types in the answer section
+		owner     string   // owner of the first answer RR, if not qname
+		negTTL    uint32   // TTL of the SOA in the authority section, 0 if none
+		wantExtra int
+	}{
+		{name: "apex_soa", qname: "rpz.test.", qtype: dns.TypeSOA, answer: []uint16{dns.TypeSOA}},
+		{name: "apex_ns_with_glue", qname: "rpz.test.", qtype: dns.TypeNS, answer: []uint16{dns.TypeNS}, wantExtra: 1},
+		{name: "apex_zonemd", qname: "rpz.test.", qtype: dns.TypeZONEMD, answer: []uint16{dns.TypeZONEMD}},
+		{name: "apex_any", qname: "rpz.test.", qtype: dns.TypeANY, answer: []uint16{dns.TypeSOA, dns.TypeNS, dns.TypeZONEMD}},
+		{name: "apex_nodata", qname: "rpz.test.", qtype: dns.TypeA, negTTL: 60},
+		{name: "trigger_cname", qname: "foo.example.rpz.test.", qtype: dns.TypeCNAME, answer: []uint16{dns.TypeCNAME}},
+		{name: "trigger_other_qtype", qname: "foo.example.rpz.test.", qtype: dns.TypeA, answer: []uint16{dns.TypeCNAME}},
+		{name: "trigger_case", qname: "FOO.Example.rpz.TEST.", qtype: dns.TypeCNAME, answer: []uint16{dns.TypeCNAME}, owner: "foo.example.rpz.test."},
+		{name: "empty_non_terminal", qname: "example.rpz.test.", qtype: dns.TypeCNAME, negTTL: 60},
+		{name: "nxdomain", qname: "bar.example.rpz.test.", qtype: dns.TypeCNAME, rcode: dns.RcodeNameError, negTTL: 60},
+		{name: "below_trigger", qname: "x.foo.example.rpz.test.", qtype: dns.TypeA, rcode: dns.RcodeNameError, negTTL: 60},
+		{name: "wildcard", qname: "a.b.wild.example.rpz.test.", qtype: dns.TypeA, answer: []uint16{dns.TypeCNAME}},
+		{name: "wildcard_not_over_existing", qname: "exact.wild.example.rpz.test.", qtype: dns.TypeCNAME, answer: []uint16{dns.TypeCNAME}},
+		{name: "wildcard_blocked_by_ent", qname: "x.y.exact.wild.example.rpz.test.", qtype: dns.TypeA, rcode: dns.RcodeNameError, negTTL: 60},
+		{name: "glue", qname: "ns1.rpz.test.", qtype: dns.TypeA, answer: []uint16{dns.TypeA}},
+		{name: "glue_nodata", qname: "ns1.rpz.test.", qtype: dns.TypeAAAA, negTTL: 60},
+		{name: "outside_zone", qname: "example.com.", qtype: dns.TypeA, rcode: dns.RcodeRefused},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := new(dns.Msg)
+			r.SetQuestion(c.qname, c.qtype)
+			m := new(dns.Msg)
+			m.SetReply(r)
+			s.answer(m, c.qname, c.qtype)
+
+			if m.Rcode != c.rcode {
+				t.Errorf("rcode %s, want %s", dns.RcodeToString[m.Rcode], dns.RcodeToString[c.rcode])
+			}
+			if c.rcode != dns.RcodeRefused && !m.Authoritative {
+				t.Errorf("AA not set")
+			}
+			if len(m.Answer) != len(c.answer) {
+				t.Fatalf("answer %v, want types %v", m.Answer, c.answer)
+			}
+			for i, rr := range m.Answer {
+				if rr.Header().Rrtype != c.answer[i] {
+					t.Errorf("answer[%d] is %s, want %s", i, dns.TypeToString[rr.Header().Rrtype], dns.TypeToString[c.answer[i]])
+				}
+			}
+			if len(m.Answer) > 0 && c.qtype != dns.TypeANY && c.qname != "rpz.test." {
+				owner := c.qname
+				if c.owner != "" {
+					owner = c.owner
+				}
+				if got := m.Answer[0].Header().Name; got != owner {
+					t.Errorf("answer owner %s, want %s", got, owner)
+				}
+			}
+			var negTTL uint32
+			if len(m.Ns) == 1 {
+				if soa, ok := m.Ns[0].(*dns.SOA); ok {
+					negTTL = soa.Hdr.Ttl
+				}
+			}
+			if negTTL != c.negTTL {
+				t.Errorf("negative TTL %d, want %d (authority %v)", negTTL, c.negTTL, m.Ns)
+			}
+			if len(m.Extra) != c.wantExtra {
+				t.Errorf("%d additional RRs, want %d", len(m.Extra), c.wantExtra)
+			}
+		})
+	}
+}
+
+// TestNameCase checks that names from MQTT and the API reach the lists and
+// the RPZ in lower case, so that the answers to queries in any case match.
+func TestNameCase(t *testing.T) {
+	conf, h := newAPITestConf(t)
+	pd := conf.PopData
+	pd.Lists["denylist"]["feed"].ReaperData = map[time.Time]map[string]bool{}
+	tm := tapir.TapirMsg{SrcName: "feed", ListType: "denylist", Added: []tapir.Domain{
+		{Name: "Bad.Example", TimeAdded: time.Now(), TTL: 3600},
+	}}
+	if _, err := pd.ProcessTapirUpdate(tm, "0123456789abcdef"); err != nil {
+		t.Fatalf("ProcessTapirUpdate: %v", err)
+	}
+	if code := apiDo(t, h, "POST", "/api/v2/lists/local-deny/names",
+		`{"names": [{"name": "WORSE.example."}, {"name": "Gone.Example."}]}`, nil); code != http.StatusOK {
+		t.Fatalf("POST: status %d", code)
+	}
+	if code := apiDo(t, h, "DELETE", "/api/v2/lists/local-deny/names/GONE.example.", "", nil); code != http.StatusOK {
+		t.Fatalf("DELETE: status %d", code)
+	}
+
+	snap := pd.Rpz.Current()
+	for name, want := range map[string]bool{"bad.example.": true, "worse.example.": true, "gone.example.": false,
+		"Bad.Example.": false, "WORSE.example.": false} {
+		if _, got := snap.Data[name]; got != want {
+			t.Errorf("%s in the RPZ: %t, want %t", name, got, want)
+		}
+	}
+	if _, exist := pd.Lists["denylist"]["feed"].Names.Get("bad.example."); !exist {
+		t.Errorf("bad.example. is not in the feed list")
+	}
+	m := new(dns.Msg)
+	snap.answer(m, "BAD.example.rpz.test.", dns.TypeCNAME)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+		t.Errorf("answer for BAD.example.rpz.test.: %s, %v", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// EDNS(0) (RFC 6891) in the DNS engine. Every response passes through an
+// ednsWriter, which adds an OPT record when the query had one and truncates
+// UDP responses that do not fit the negotiated size, setting TC so that the
+// client retries over TCP.
+
+// defaultEdnsUDPSize is used when dnsengine.udpsize is not set. 1232 avoids
+// IP fragmentation on practically every path (DNS Flag Day 2020).
+const defaultEdnsUDPSize = 1232
+
+// ednsWriter is the dns.ResponseWriter for one query.
+type ednsWriter struct {
+	dns.ResponseWriter
+	size uint16   // largest response that may be sent over UDP
+	opt  *dns.OPT // added to every response, nil if the query had no OPT
+}
+
+// newEdnsWriter negotiates EDNS for the query r. udpsize is our own maximum
+// UDP payload and nsid the server identity for the NSID option (RFC 5001),
+// sent only if the client asks for it. The OPT in the response echoes the
+// client's buffer size, capped by udpsize, and its DO bit (RFC 3225).
+func newEdnsWriter(w dns.ResponseWriter, r *dns.Msg, udpsize uint16, nsid string) *ednsWriter {
+	ew := &ednsWriter{ResponseWriter: w, size: dns.MinMsgSize}
+	ropt := r.IsEdns0()
+	if ropt == nil {
+		return ew
+	}
+
+	ew.size = max(min(ropt.UDPSize(), udpsize), dns.MinMsgSize)
+	ew.opt = new(dns.OPT)
+	ew.opt.Hdr.Name = "."
+	ew.opt.Hdr.Rrtype = dns.TypeOPT
+	ew.opt.SetUDPSize(ew.size)
+	ew.opt.SetDo(ropt.Do())
+	for _, o := range ropt.Option {
+		if o.Option() == dns.EDNS0NSID && nsid != "" {
+			ew.opt.Option = append(ew.opt.Option, &dns.EDNS0_NSID{
+				Code: dns.EDNS0NSID,
+				Nsid: hex.EncodeToString([]byte(nsid)),
+			})
+		}
+	}
+	return ew
+}
+
+// WriteMsg adds the OPT record and makes m fit the negotiated size, unless
+// the response goes over a stream transport.
+func (w *ednsWriter) WriteMsg(m *dns.Msg) error {
+	if w.opt != nil && m.IsEdns0() == nil {
+		m.Extra = append(m.Extra, w.opt)
+	}
+	if isUDP(w) {
+		m.Truncate(int(w.size))
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// isUDP reports whether the response to the client at w goes over UDP.
+func isUDP(w dns.ResponseWriter) bool {
+	_, udp := w.RemoteAddr().(*net.UDPAddr)
+	return udp
+}
+
+// checkQuery returns the rcode for a query or NOTIFY that cannot be handled:
+// FORMERR unless there is exactly one question and at most one OPT record,
+// BADVERS for an EDNS version other than 0. The server's MsgAcceptFunc already
+// rejects most of these, this makes sure the handler never indexes an empty
+// question section.
+func checkQuery(r *dns.Msg) int {
+	if len(r.Question) != 1 {
+		return dns.RcodeFormatError
+	}
+	opts := 0
+	for _, rr := range r.Extra {
+		if opt, ok := rr.(*dns.OPT); ok {
+			opts++
+			if opt.Hdr.Name != "." {
+				return dns.RcodeFormatError
+			}
+		}
+	}
+	switch {
+	case opts > 1:
+		return dns.RcodeFormatError
+	case opts == 1 && r.IsEdns0().Version() != 0:
+		return dns.RcodeBadVers
+	}
+	return dns.RcodeSuccess
+}
+
+// IdentityResponder answers the CHAOS TXT queries for the server identity,
+// id.server. (RFC 4892) and hostname.bind., with nsid. Everything else in
+// class CHAOS is refused, as are these when no identity is configured.
+func IdentityResponder(w dns.ResponseWriter, r *dns.Msg, nsid string) error {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	q := r.Question[0]
+	switch name := strings.ToLower(q.Name); {
+	case nsid == "" || (name != "id.server." && name != "hostname.bind."):
+		m.Rcode = dns.RcodeRefused
+	case q.Qtype == dns.TypeTXT || q.Qtype == dns.TypeANY:
+		m.Authoritative = true
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0},
+			Txt: []string{nsid},
+		})
+	default:
+		m.Authoritative = true // NODATA
+	}
+	return w.WriteMsg(m)
+}
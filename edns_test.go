@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDnsHandlerEdns(t *testing.T) {
+	pd := newXfrTestPopData()
+	// An apex NS RRset with glue that needs more than 512 but less than 1232
+	// octets.
+	snap := pd.Rpz.Current().clone()
+	snap.NSrrs, snap.Glue = nil, nil
+	for i := range 30 {
+		ns, _ := dns.NewRR(fmt.Sprintf("rpz.test. 3600 IN NS ns%02d.rpz.test.", i))
+		glue, _ := dns.NewRR(fmt.Sprintf("ns%02d.rpz.test. 3600 IN A 192.0.2.%d", i, i+1))
+		snap.NSrrs, snap.Glue = append(snap.NSrrs, ns), append(snap.Glue, glue)
+	}
+	pd.Rpz.publish(snap)
+
+	conf := &Config{PopData: pd, DnsEngine: DnsengineConf{UdpSize: 1232, Nsid: "pop-test"}}
+	handler := createHandler(conf)
+
+	udp := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5300}
+	tcp := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5300}
+	query := func(qname string, qtype uint16, bufsize uint16, opts ...dns.EDNS0) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion(qname, qtype)
+		if bufsize > 0 {
+			r.SetEdns0(bufsize, true)
+			r.IsEdns0().Option = opts
+		}
+		return r
+	}
+	badvers := query("rpz.test.", dns.TypeSOA, 1232)
+	badvers.IsEdns0().SetVersion(1)
+	noquestion := query("rpz.test.", dns.TypeSOA, 0)
+	noquestion.Question = nil
+
+	cases := []struct {
+		name     string
+		r        *dns.Msg
+		remote   net.Addr
+		rcode    int
+		tc       bool
+		answers  int
+		bufsize  uint16 // in the OPT of the response, 0: no OPT
+		wantNsid string
+	}{
+		{name: "no_edns_truncated", r: query("rpz.test.", dns.TypeNS, 0), remote: udp, tc: true},
+		{name: "edns_fits", r: query("rpz.test.", dns.TypeNS, 1232), remote: udp, answers: 30, bufsize: 1232},
+		{name: "edns_capped", r: query("rpz.test.", dns.TypeNS, 4096), remote: udp, answers: 30, bufsize: 1232},
+		{name: "edns_small_buffer", r: query("rpz.test.", dns.TypeNS, 100), remote: udp, tc: true, bufsize: 512},
+		{name: "tcp_not_truncated", r: query("rpz.test.", dns.TypeNS, 0), remote: tcp, answers: 30},
+		{name: "nsid", r: query("rpz.test.", dns.TypeSOA, 1232, &dns.EDNS0_NSID{Code: dns.EDNS0NSID}), remote: udp,
+			answers: 1, bufsize: 1232, wantNsid: "pop-test"},
+		{name: "badvers", r: badvers, remote: udp, rcode: dns.RcodeBadVers, bufsize: 1232},
+		{name: "no_question", r: noquestion, remote: udp, rcode: dns.RcodeFormatError},
+		{name: "ixfr_over_udp", r: query("rpz.test.", dns.TypeIXFR, 1232), remote: udp, answers: 1, bufsize: 1232},
+		{name: "axfr_over_udp", r: query("rpz.test.", dns.TypeAXFR, 1232), remote: udp, tc: true, bufsize: 1232},
+		{name: "chaos_id_server", r: func() *dns.Msg {
+			r := query("id.server.", dns.TypeTXT, 0)
+			r.Question[0].Qclass = dns.ClassCHAOS
+			return r
+		}(), remote: udp, answers: 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := &xfrRecorder{remote: c.remote}
+			handler(w, c.r)
+			if len(w.msgs) != 1 {
+				t.Fatalf("%d responses, want 1", len(w.msgs))
+			}
+			// What the client would see.
+			buf, err := w.msgs[0].Pack()
+			if err != nil {
+				t.Fatalf("Pack: %v", err)
+			}
+			if _, ok := c.remote.(*net.UDPAddr); ok && len(buf) > 1232 {
+				t.Errorf("UDP response of %d octets", len(buf))
+			}
+			m := new(dns.Msg)
+			if err := m.Unpack(buf); err != nil {
+				t.Fatalf("Unpack: %v", err)
+			}
+
+			if m.Rcode != c.rcode {
+				t.Errorf("rcode %s, want %s", dns.RcodeToString[m.Rcode], dns.RcodeToString[c.rcode])
+			}
+			if m.Truncated != c.tc {
+				t.Errorf("TC %v, want %v", m.Truncated, c.tc)
+			}
+			if !c.tc && len(m.Answer) != c.answers {
+				t.Errorf("%d answers, want %d", len(m.Answer), c.answers)
+			}
+			opt := m.IsEdns0()
+			switch {
+			case c.bufsize == 0 && opt != nil:
+				t.Errorf("unexpected OPT in response: %v", opt)
+			case c.bufsize == 0:
+			case opt == nil:
+				t.Errorf("no OPT in response")
+			case opt.UDPSize() != c.bufsize || !opt.Do():
+				t.Errorf("OPT with buffer size %d, DO %v; want %d, true", opt.UDPSize(), opt.Do(), c.bufsize)
+			}
+
+			var nsid string
+			if opt != nil {
+				for _, o := range opt.Option {
+					if o, ok := o.(*dns.EDNS0_NSID); ok {
+						b, _ := hex.DecodeString(o.Nsid)
+						nsid = string(b)
+					}
+				}
+			}
+			if nsid != c.wantNsid {
+				t.Errorf("NSID %q, want %q", nsid, c.wantNsid)
+			}
+		})
+	}
+}
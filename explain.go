@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// The explain zone: a TXT query for <name>.explain.<rpzzone> returns what
+// decide() says about <name>, i.e. the same as the rpz-lookup API command,
+// so a blocked name can be investigated with dig from anywhere the ACL
+// (dnsengine.explain.acl) allows. The zone is synthesized on the fly and is
+// not part of the RPZ output.
+
+const explainLabel = "explain"
+
+// defaultExplainACL is used when dnsengine.explain.acl is not set.
+var defaultExplainACL = []string{"127.0.0.0/8", "::1/128"}
+
+type ExplainConf struct {
+	Zone string         // explain.<rpzzone>, empty if not active
+	ACL  []netip.Prefix // clients allowed to query the explain zone
+}
+
+// NewExplainConf reads dnsengine.explain. Entries in the ACL are prefixes or
+// single addresses.
+func NewExplainConf(rpzzone string) (ExplainConf, error) {
+	if !viper.GetBool("dnsengine.explain.active") {
+		return ExplainConf{}, nil
+	}
+	acl := viper.GetStringSlice("dnsengine.explain.acl")
+	if len(acl) == 0 {
+		acl = defaultExplainACL
+	}
+	prefixes, err := parsePrefixes(acl)
+	if err != nil {
+		return ExplainConf{}, fmt.Errorf("dnsengine.explain.acl: %v", err)
+	}
+	return ExplainConf{Zone: dns.CanonicalName(explainLabel + "." + rpzzone), ACL: prefixes}, nil
+}
+
+// Allowed reports whether the client at addr (host:port) may use the zone.
+func (ec ExplainConf) Allowed(addr net.Addr) bool {
+	ip, ok := clientAddr(addr)
+	return ok && prefixesContain(ec.ACL, ip)
+}
+
+// parsePrefixes parses a configured list of prefixes or single addresses.
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range list {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, err2 := netip.ParseAddr(s)
+			if err2 != nil {
+				return nil, fmt.Errorf("%q is neither a prefix nor an address", s)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// clientAddr returns the address of the client at addr (host:port), with
+// IPv4-mapped IPv6 addresses unmapped.
+func clientAddr(addr net.Addr) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap(), true
+}
+
+func prefixesContain(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExplainResponder answers a query in the explain zone. Only TXT (and ANY)
+// below the zone apex have data; clients outside the ACL are refused.
+func (pd *PopData) ExplainResponder(w dns.ResponseWriter, r *dns.Msg, qname string, qtype uint16, lg *slog.Logger) error {
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	qname = dns.CanonicalName(qname)
+	name := strings.TrimSuffix(qname, pd.Explain.Zone) // keeps the trailing dot
+	switch {
+	case !pd.Explain.Allowed(w.RemoteAddr()):
+		lg.Debug("ExplainResponder: refusing the query, the client is not in the ACL", "qname", qname, "client", w.RemoteAddr())
+		m.Rcode = dns.RcodeRefused
+
+	case qname == pd.Explain.Zone || (qtype != dns.TypeTXT && qtype != dns.TypeANY):
+		m.Authoritative = true
+		m.Ns = append(m.Ns, pd.Rpz.Current().negativeSOA()) // NODATA
+
+	default:
+		m.Authoritative = true
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0},
+			Txt: pd.explainTXT(name),
+		})
+	}
+
+	err := w.WriteMsg(m)
+	if err != nil {
+		lg.Warn("WriteMsg failed", "error", err)
+	}
+	return nil
+}
+
+// explainTXT returns the decision for name as TXT strings of key=value pairs:
+// the action and stage, the sources, every doubtlist rule that fired and
+// whether the name is in the currently served RPZ serial.
+func (pd *PopData) explainTXT(name string) []string {
+	pd.mu.RLock()
+	action, reason := pd.decide(name)
+	pd.mu.RUnlock()
+
+	txt := []string{
+		fmt.Sprintf("action=%s stage=%s", tapir.ActionToString[action], reason.Stage),
+	}
+	// A TXT string holds at most 255 octets, so the sources go one per string.
+	for _, hit := range reason.Sources {
+		txt = append(txt, "source="+hit.Source)
+	}
+	for _, rr := range reason.Fired {
+		txt = append(txt, truncateTXT(fmt.Sprintf("rule=%s action=%s detail=%s",
+			rr.Rule, tapir.ActionToString[rr.Action], rr.Detail)))
+	}
+
+	if first, last, exist := pd.Seen.Get(name); exist {
+		txt = append(txt, fmt.Sprintf("firstseen=%s lastseen=%s age=%s",
+			first.UTC().Format(time.RFC3339), last.UTC().Format(time.RFC3339),
+			time.Since(first).Round(time.Second)))
+	}
+
+	snap := pd.Rpz.Current()
+	served := "no"
+	if action, exist := snap.Data[name]; exist {
+		served = tapir.ActionToString[action]
+	}
+	txt = append(txt, fmt.Sprintf("serial=%d served=%s", snap.Serial, served))
+	return txt
+}
+
+func truncateTXT(s string) string {
+	if len(s) > 255 {
+		return s[:255]
+	}
+	return s
+}
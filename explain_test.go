@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/dnstapir/tapir"
+	"github.com/miekg/dns"
+)
+
+func TestExplainResponder(t *testing.T) {
+	pd := newXfrTestPopData()
+	pd.Explain = ExplainConf{
+		Zone: "explain.rpz.test.",
+		ACL:  []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+	}
+	feed := pd.Lists["denylist"]["feed"]
+	feed.Names.Put(tapir.TapirName{Name: "bad.example."})
+	if _, err := pd.UpdateRpz(&tapir.TapirMsg{Added: []tapir.Domain{{Name: "bad.example."}}}, AuditCause{}); err != nil {
+		t.Fatalf("UpdateRpz: %v", err)
+	}
+
+	cases := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		client  net.IP
+		rcode   int
+		wantTXT []string // nil: no answer
+	}{
+		{
+			name:   "denylisted",
+			qname:  "bad.example.explain.rpz.test.",
+			qtype:  dns.TypeTXT,
+			client: net.IPv4(192, 0, 2, 1),
+			wantTXT: []string{
+				"action=NODATA stage=denylist",
+				"source=feed",
+				"serial=2 served=NODATA",
+			},
+		},
+		{
+			name:    "not_listed",
+			qname:   "Good.Example.explain.rpz.test.",
+			qtype:   dns.TypeTXT,
+			client:  net.IPv4(192, 0, 2, 1),
+			wantTXT: []string{"action=ALLOWLIST stage=none", "serial=2 served=no"},
+		},
+		{
+			name:   "other_qtype_is_nodata",
+			qname:  "bad.example.explain.rpz.test.",
+			qtype:  dns.TypeA,
+			client: net.IPv4(192, 0, 2, 1),
+		},
+		{
+			name:   "outside_acl",
+			qname:  "bad.example.explain.rpz.test.",
+			qtype:  dns.TypeTXT,
+			client: net.IPv4(198, 51, 100, 1),
+			rcode:  dns.RcodeRefused,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := new(dns.Msg)
+			r.SetQuestion(c.qname, c.qtype)
+			w := &xfrRecorder{remote: &net.UDPAddr{IP: c.client, Port: 5300}}
+			if err := pd.ExplainResponder(w, r, c.qname, c.qtype, compLogger("dnsengine")); err != nil {
+				t.Fatalf("ExplainResponder: %v", err)
+			}
+			m := w.msgs[0]
+			if m.Rcode != c.rcode {
+				t.Errorf("rcode %s, want %s", dns.RcodeToString[m.Rcode], dns.RcodeToString[c.rcode])
+			}
+			var got []string
+			for _, rr := range m.Answer {
+				got = append(got, rr.(*dns.TXT).Txt...)
+			}
+			if !slices.Equal(got, c.wantTXT) {
+				t.Errorf("TXT %q, want %q", got, c.wantTXT)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/spf13/viper"
+)
+
+// Health and readiness, for container orchestration and load balancers.
+// GET /healthz says whether the POP is alive, i.e. whether the RefreshEngine
+// loop is ticking or transferring a zone. GET /readyz says whether it is ready to serve: all active
+// sources loaded at least once, MQTT connected if any source uses it, the RPZ
+// generated and no component failing repeatedly. Both are unauthenticated
+// and answer 200 or 503 with the result of each check.
+
+// healthMaxTickAge is how long the RefreshEngine may go without a tick (once
+// a second) before the POP is considered hung.
+const healthMaxTickAge = 30 * time.Second
+
+// defaultHealthMaxFails is the default for services.health.maxfails.
+const defaultHealthMaxFails = 3
+
+type sourceHealth struct {
+	zone   string // upstream zone of an xfr source
+	loaded bool
+}
+
+// Health is usable as its zero value.
+type Health struct {
+	tick      atomic.Int64 // time of the last RefreshEngine tick, in unix nanoseconds
+	transfers atomic.Int32 // upstream zone transfers in progress
+	rpz       atomic.Bool  // the RPZ has been generated
+
+	mu      sync.Mutex
+	mqtt    bool                     // some active source is fed over MQTT
+	sources map[string]*sourceHealth // the active sources
+	fails   map[string]int           // consecutive StatusFail reports per component
+}
+
+// Tick records that the RefreshEngine loop is running.
+func (h *Health) Tick(now time.Time) { h.tick.Store(now.UnixNano()) }
+
+// Transfer records that the RefreshEngine is transferring an upstream zone,
+// until done is called. The loop does not tick during a transfer, which may
+// take minutes for a large zone.
+func (h *Health) Transfer() (done func()) {
+	h.transfers.Add(1)
+	return func() { h.transfers.Add(-1) }
+}
+
+// Running reports whether the RefreshEngine loop has ticked within maxAge
+// before now, or is transferring a zone.
+func (h *Health) Running(now time.Time, maxAge time.Duration) bool {
+	last := h.tick.Load()
+	return last != 0 && (now.Sub(time.Unix(0, last)) <= maxAge || h.transfers.Load() > 0)
+}
+
+// RpzGenerated records that the RPZ output has been generated.
+func (h *Health) RpzGenerated() { h.rpz.Store(true) }
+
+// ExpectSource registers an active source that must be loaded before the POP
+// is ready. zone is the upstream zone for xfr sources, otherwise empty.
+func (h *Health) ExpectSource(name, source, zone string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sources == nil {
+		h.sources = map[string]*sourceHealth{}
+	}
+	h.sources[name] = &sourceHealth{zone: zone}
+	if source == "mqtt" {
+		h.mqtt = true
+	}
+}
+
+// SourceLoaded records that the source has been loaded.
+func (h *Health) SourceLoaded(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if sh, exist := h.sources[name]; exist {
+		sh.loaded = true
+	}
+}
+
+// ZoneLoaded records that the upstream zone of an xfr source has been
+// transferred, which may happen long after startup.
+func (h *Health) ZoneLoaded(zone string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, sh := range h.sources {
+		if sh.zone == zone {
+			sh.loaded = true
+		}
+	}
+}
+
+// ComponentStatus counts consecutive failures per component, from the
+// updates seen by the StatusUpdater.
+func (h *Health) ComponentStatus(csu tapir.ComponentStatusUpdate) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch csu.Status {
+	case tapir.StatusFail:
+		if h.fails == nil {
+			h.fails = map[string]int{}
+		}
+		h.fails[csu.Component]++
+	case tapir.StatusOK:
+		delete(h.fails, csu.Component)
+	}
+}
+
+type HealthCheck struct {
+	Name   string `json:"name"`
+	Ok     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type HealthResponse struct {
+	Status string        `json:"status"` // "ok" or "fail"
+	Checks []HealthCheck `json:"checks"`
+}
+
+// Liveness returns the checks for /healthz.
+func (h *Health) Liveness(now time.Time) []HealthCheck {
+	last := h.tick.Load()
+	check := HealthCheck{Name: "refreshengine"}
+	switch age := now.Sub(time.Unix(0, last)); {
+	case last == 0:
+		check.Detail = "RefreshEngine has not started"
+	case age > healthMaxTickAge && h.transfers.Load() > 0:
+		check.Ok = true
+		check.Detail = fmt.Sprintf("RefreshEngine is transferring a zone, last ticked %v ago", age.Truncate(time.Second))
+	case age > healthMaxTickAge:
+		check.Detail = fmt.Sprintf("RefreshEngine last ticked %v ago", age.Truncate(time.Second))
+	default:
+		check.Ok = true
+	}
+	return []HealthCheck{check}
+}
+
+// Readiness returns the checks for /readyz. mqttUp reports whether the MQTT
+// engine is connected; it is only called if some source uses MQTT.
+func (h *Health) Readiness(now time.Time, maxfails int, mqttUp func() bool) []HealthCheck {
+	checks := h.Liveness(now)
+
+	h.mu.Lock()
+	var missing, failing []string
+	for name, sh := range h.sources {
+		if !sh.loaded {
+			missing = append(missing, name)
+		}
+	}
+	for comp, n := range h.fails {
+		if n >= maxfails {
+			failing = append(failing, fmt.Sprintf("%s (%d failures)", comp, n))
+		}
+	}
+	mqtt := h.mqtt
+	h.mu.Unlock()
+	slices.Sort(missing)
+	slices.Sort(failing)
+
+	sources := HealthCheck{Name: "sources", Ok: len(missing) == 0}
+	if !sources.Ok {
+		sources.Detail = fmt.Sprintf("not loaded yet: %v", missing)
+	}
+	checks = append(checks, sources)
+
+	if mqtt {
+		check := HealthCheck{Name: "mqtt", Ok: mqttUp()}
+		if !check.Ok {
+			check.Detail = "MQTT engine not connected"
+		}
+		checks = append(checks, check)
+	}
+
+	rpz := HealthCheck{Name: "rpz", Ok: h.rpz.Load()}
+	if !rpz.Ok {
+		rpz.Detail = "RPZ not generated yet"
+	}
+	checks = append(checks, rpz)
+
+	components := HealthCheck{Name: "components", Ok: len(failing) == 0}
+	if !components.Ok {
+		components.Detail = fmt.Sprintf("failing: %v", failing)
+	}
+	return append(checks, components)
+}
+
+// mqttConnected reports whether the MQTT engine has a connection up.
+func (pd *PopData) mqttConnected() bool {
+	me := pd.MqttEngine
+	if me == nil || me.ConnectionManager == nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	return me.ConnectionManager.AwaitConnection(ctx) == nil
+}
+
+func writeHealth(w http.ResponseWriter, checks []HealthCheck) {
+	resp := HealthResponse{Status: "ok", Checks: checks}
+	code := http.StatusOK
+	for _, c := range checks {
+		if !c.Ok {
+			resp.Status = "fail"
+			code = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("writeHealth: Error from json encoder: %v", err)
+	}
+}
+
+func APIhealthz(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, conf.PopData.Health.Liveness(time.Now()))
+	}
+}
+
+func APIreadyz(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		maxfails := defaultHealthMaxFails
+		if viper.IsSet("services.health.maxfails") {
+			maxfails = viper.GetInt("services.health.maxfails")
+		}
+		pd := conf.PopData
+		writeHealth(w, pd.Health.Readiness(time.Now(), maxfails, pd.mqttConnected))
+	}
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/tapir"
+)
+
+func TestHealthChecks(t *testing.T) {
+	t0 := time.Now()
+	fail := tapir.ComponentStatusUpdate{Component: "rpz-ixfr", Status: tapir.StatusFail}
+	ok := tapir.ComponentStatusUpdate{Component: "rpz-ixfr", Status: tapir.StatusOK}
+
+	cases := []struct {
+		name   string
+		setup  func(h *Health)
+		now    time.Time
+		mqttUp bool
+		live   bool
+		failed []string // failing readiness checks
+	}{
+		{name: "not_started", setup: func(h *Health) {},
+			failed: []string{"refreshengine", "rpz"}},
+		{name: "ready", setup: func(h *Health) {
+			h.Tick(t0)
+			h.ExpectSource("feed", "file", "")
+			h.SourceLoaded("feed")
+			h.RpzGenerated()
+		}, live: true},
+		{name: "hung", setup: func(h *Health) {
+			h.Tick(t0.Add(-time.Minute))
+			h.RpzGenerated()
+		}, failed: []string{"refreshengine"}},
+		{name: "transferring", setup: func(h *Health) {
+			h.Tick(t0.Add(-time.Minute))
+			h.Transfer()
+			h.RpzGenerated()
+		}, live: true},
+		{name: "transfer_done", setup: func(h *Health) {
+			h.Tick(t0.Add(-time.Minute))
+			h.Transfer()()
+			h.RpzGenerated()
+		}, failed: []string{"refreshengine"}},
+		{name: "source_missing", setup: func(h *Health) {
+			h.Tick(t0)
+			h.ExpectSource("feed", "file", "")
+			h.ExpectSource("upstream", "xfr", "rpz.upstream.")
+			h.SourceLoaded("feed")
+			h.RpzGenerated()
+		}, live: true, failed: []string{"sources"}},
+		{name: "zone_loaded_later", setup: func(h *Health) {
+			h.Tick(t0)
+			h.ExpectSource("upstream", "xfr", "rpz.upstream.")
+			h.ZoneLoaded("rpz.upstream.")
+			h.RpzGenerated()
+		}, live: true},
+		{name: "mqtt_down", setup: func(h *Health) {
+			h.Tick(t0)
+			h.ExpectSource("observations", "mqtt", "")
+			h.SourceLoaded("observations")
+			h.RpzGenerated()
+		}, live: true, failed: []string{"mqtt"}},
+		{name: "mqtt_up", setup: func(h *Health) {
+			h.Tick(t0)
+			h.ExpectSource("observations", "mqtt", "")
+			h.SourceLoaded("observations")
+			h.RpzGenerated()
+		}, mqttUp: true, live: true},
+		{name: "component_failing", setup: func(h *Health) {
+			h.Tick(t0)
+			h.RpzGenerated()
+			for range 3 {
+				h.ComponentStatus(fail)
+			}
+		}, live: true, failed: []string{"components"}},
+		{name: "component_recovered", setup: func(h *Health) {
+			h.Tick(t0)
+			h.RpzGenerated()
+			for range 3 {
+				h.ComponentStatus(fail)
+			}
+			h.ComponentStatus(ok)
+			h.ComponentStatus(fail)
+		}, live: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var h Health
+			c.setup(&h)
+			if live := h.Liveness(t0)[0].Ok; live != c.live {
+				t.Errorf("live = %v, want %v", live, c.live)
+			}
+			var failed []string
+			for _, check := range h.Readiness(t0, defaultHealthMaxFails, func() bool { return c.mqttUp }) {
+				if !check.Ok {
+					if check.Detail == "" {
+						t.Errorf("check %s failed without detail", check.Name)
+					}
+					failed = append(failed, check.Name)
+				}
+			}
+			if strings.Join(failed, ",") != strings.Join(c.failed, ",") {
+				t.Errorf("failed checks %v, want %v", failed, c.failed)
+			}
+		})
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	pd := newXfrTestPopData()
+	conf := &Config{PopData: pd}
+	pd.Health.Tick(time.Now())
+
+	get := func(handler http.HandlerFunc) (int, HealthResponse) {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/readyz", nil))
+		var resp HealthResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+		return rec.Code, resp
+	}
+
+	if code, resp := get(APIhealthz(conf)); code != http.StatusOK || resp.Status != "ok" {
+		t.Errorf("/healthz: %d %+v", code, resp)
+	}
+
+	code, resp := get(APIreadyz(conf))
+	if code != http.StatusServiceUnavailable || resp.Status != "fail" {
+		t.Fatalf("/readyz before the RPZ is generated: %d %+v", code, resp)
+	}
+	for _, check := range resp.Checks {
+		if check.Ok == (check.Name == "rpz") {
+			t.Errorf("/readyz check %+v", check)
+		}
+	}
+
+	if err := pd.GenerateRpzAxfr(); err != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+	if code, resp := get(APIreadyz(conf)); code != http.StatusOK {
+		t.Errorf("/readyz after the RPZ is generated: %d %+v", code, resp)
+	}
+}
@@ -7,6 +7,7 @@ package main
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/dnstapir/tapir"
 	"github.com/miekg/dns"
@@ -28,11 +29,18 @@ func (pd *PopData) Doubtlisted(name string) bool { return len(pd.listOf("doubtli
 // rules fired. This is the minimal unification; the richer structured output
 // for the "filter reason" CLI command (task a) is built on the same Reason.
 func (pd *PopData) LookupReport(name string) string {
-	action, reason := pd.decide(name)
-	fqdn := dns.Fqdn(name)
+	fqdn := dns.CanonicalName(name)
+	action, reason := pd.decide(fqdn)
 
 	var b strings.Builder
 	switch reason.Stage {
+	case StageOverride:
+		if action == tapir.ALLOWLIST {
+			fmt.Fprintf(&b, "Domain name %q has an override %s; not filtered.\n", fqdn, reason.Winner.Detail)
+		} else {
+			fmt.Fprintf(&b, "Domain name %q has an override %s; served as %s.\n",
+				fqdn, reason.Winner.Detail, tapir.ActionToString[action])
+		}
 	case StageAllowlist:
 		fmt.Fprintf(&b, "Domain name %q is allowlisted (sources: %s); not filtered.\n",
 			fqdn, sourceNames(reason.Sources))
@@ -54,6 +62,13 @@ func (pd *PopData) LookupReport(name string) string {
 	default: // StageNone
 		fmt.Fprintf(&b, "Domain name %q is not present in any list; not filtered.\n", fqdn)
 	}
+	if o, exist := pd.Overrides.Get(fqdn); exist && reason.Stage != StageOverride {
+		fmt.Fprintf(&b, "  override %s from %s %s (not active)\n", tapir.ActionToString[o.Action],
+			o.NotBefore.UTC().Format(time.RFC3339), o.detail())
+	}
+	if age, exist := pd.Seen.age(fqdn, time.Now()); exist {
+		fmt.Fprintf(&b, "  %s\n", age)
+	}
 	return b.String()
 }
 
@@ -74,3 +89,62 @@ func (pd *PopData) DoubtlistAdd(name, policy, source string) (string, error) {
 	msg := fmt.Sprintf("Domain name \"%s\" added to RPZ source %s with policy %s", name, source, policy)
 	return msg, nil
 }
+
+// UpdateLocalList adds and removes names in a list that is managed through
+// the API (source "api"), and updates the RPZ output to match. Added names
+// with a TTL are removed again by the Reaper when it runs out; names without
+// one stay until they are removed. caller is the API identity that made the
+// change, for the audit log.
+func (pd *PopData) UpdateLocalList(tm *tapir.TapirMsg, caller string) (RpzIxfr, error) {
+	pd.mu.Lock()
+	wbgl, exist := pd.Lists[tm.ListType][tm.SrcName]
+	if !exist {
+		pd.mu.Unlock()
+		return RpzIxfr{}, fmt.Errorf("list [%s][%s] does not exist", tm.ListType, tm.SrcName)
+	}
+	if wbgl.Datasource != "api" {
+		pd.mu.Unlock()
+		return RpzIxfr{}, fmt.Errorf("list [%s][%s] is fed from %s and cannot be changed through the API",
+			tm.ListType, tm.SrcName, wbgl.Datasource)
+	}
+
+	for i, d := range tm.Added {
+		name := dns.CanonicalName(d.Name)
+		tm.Added[i].Name = name
+		tn := tapir.TapirName{
+			Name:      name,
+			TimeAdded: d.TimeAdded,
+			TTL:       time.Duration(d.TTL) * time.Second,
+			TagMask:   d.TagMask,
+			NumTags:   uint8(d.TagMask.NumTags()),
+		}
+		if err := wbgl.Names.Put(tn); err != nil {
+			pd.mu.Unlock()
+			return RpzIxfr{}, err
+		}
+		pd.observe(tn)
+		if tn.TTL > 0 {
+			pd.scheduleReaping(wbgl, name, tn.TimeAdded.Add(tn.TTL))
+		} else {
+			for reaperTime, names := range wbgl.ReaperData {
+				delete(names, name)
+				if len(names) == 0 {
+					delete(wbgl.ReaperData, reaperTime)
+				}
+			}
+		}
+	}
+	for i, d := range tm.Removed {
+		name := dns.CanonicalName(d.Name)
+		tm.Removed[i].Name = name
+		if err := wbgl.Names.Delete(name); err != nil {
+			pd.mu.Unlock()
+			return RpzIxfr{}, err
+		}
+	}
+	pd.mu.Unlock()
+
+	pd.Logger.Printf("UpdateLocalList: list [%s][%s]: %d names added, %d removed",
+		tm.ListType, tm.SrcName, len(tm.Added), len(tm.Removed))
+	return pd.UpdateRpz(tm, AuditCause{Trigger: "api", Source: tm.SrcName, Caller: caller})
+}
@@ -0,0 +1,387 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/spf13/viper"
+)
+
+// The list store keeps snapshots of the MQTT-fed lists on local disk, so that
+// a restarted POP does not depend on a bootstrap server to get its lists back.
+// A snapshot has the names with their TimeAdded and TTL and the reaper
+// schedule. It is written periodically and at shutdown, and loaded at startup
+// before the bootstrap. The seen table is saved with the lists, and the
+// overrides at every change. When the bootstrap data arrives, at startup or
+// later, it is reconciled with what was loaded.
+
+type ListStore struct {
+	dir      string
+	interval time.Duration
+	mu       sync.Mutex // serializes the writers
+}
+
+// ListSnapshot is the stored form of one list.
+type ListSnapshot struct {
+	Name       string
+	Type       string
+	Saved      time.Time
+	Names      map[string]tapir.TapirName
+	ReaperData map[time.Time]map[string]bool
+}
+
+// SeenSnapshot is the stored form of the seen table.
+type SeenSnapshot struct {
+	Saved time.Time
+	Names map[string][2]uint32 // first and last seen, in Unix seconds
+}
+
+// NewListStore returns the store in services.liststore.dir. It returns nil if
+// there is none; a nil ListStore saves nothing and has nothing to load.
+func NewListStore() (*ListStore, error) {
+	dir := viper.GetString("services.liststore.dir")
+	if dir == "" {
+		return nil, nil
+	}
+	interval := viper.GetInt("services.liststore.interval")
+	if interval < 0 {
+		return nil, fmt.Errorf("services.liststore.interval must not be negative")
+	}
+	if interval == 0 {
+		interval = 300
+	}
+	dir = filepath.Clean(dir)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("error creating list store %s: %v", dir, err)
+	}
+	return &ListStore{dir: dir, interval: time.Duration(interval) * time.Second}, nil
+}
+
+func (ls *ListStore) path(listtype, name string) string {
+	return filepath.Join(ls.dir, listtype+"-"+name+".json")
+}
+
+// seenPath does not clash with path, as the list types have no dash.
+func (ls *ListStore) seenPath() string { return filepath.Join(ls.dir, "seen.json") }
+
+func (ls *ListStore) overridesPath() string { return filepath.Join(ls.dir, "overrides.json") }
+
+// Save writes a snapshot of every MQTT-fed list, and of the seen table. The
+// lists are copied under pd.mu and written after it is released.
+func (ls *ListStore) Save(pd *PopData) error {
+	if ls == nil {
+		return nil
+	}
+	now := time.Now()
+	var snaps []ListSnapshot
+	pd.mu.RLock()
+	for listtype, lists := range pd.Lists {
+		for _, wbgl := range lists {
+			if wbgl.Datasource != "mqtt" {
+				continue
+			}
+			snap := ListSnapshot{
+				Name:       wbgl.Name,
+				Type:       listtype,
+				Saved:      now,
+				Names:      wbgl.nameMap(),
+				ReaperData: make(map[time.Time]map[string]bool, len(wbgl.ReaperData)),
+			}
+			for t, names := range wbgl.ReaperData {
+				snap.ReaperData[t] = maps.Clone(names)
+			}
+			snaps = append(snaps, snap)
+		}
+	}
+	pd.mu.RUnlock()
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	var errs []error
+	for _, snap := range snaps {
+		if err := ls.write(ls.path(snap.Type, snap.Name), snap); err != nil {
+			errs = append(errs, fmt.Errorf("error saving list [%s][%s]: %v", snap.Type, snap.Name, err))
+		}
+	}
+	if pd.Seen != nil {
+		if err := ls.write(ls.seenPath(), pd.Seen.snapshot(now)); err != nil {
+			errs = append(errs, fmt.Errorf("error saving the seen table: %v", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// write replaces the file at path with v, through a temporary file so that a
+// crash never leaves half a snapshot behind.
+func (ls *ListStore) write(path string, v any) error {
+	tmp, err := os.CreateTemp(ls.dir, filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails once it has been renamed
+	err = json.NewEncoder(tmp).Encode(v)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	return err
+}
+
+// SaveOverrides writes the overrides in ot. They are copied under the lock of
+// the store, so that concurrent saves cannot write an older table last.
+func (ls *ListStore) SaveOverrides(ot *OverrideTable) error {
+	if ls == nil {
+		return nil
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.write(ls.overridesPath(), ot.All())
+}
+
+// Load returns the snapshot of a list, or nil if there is none.
+func (ls *ListStore) Load(listtype, name string) (*ListSnapshot, error) {
+	if ls == nil {
+		return nil, nil
+	}
+	data, err := os.ReadFile(ls.path(listtype, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading list [%s][%s]: %v", listtype, name, err)
+	}
+	var snap ListSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("error loading list [%s][%s]: %v", listtype, name, err)
+	}
+	return &snap, nil
+}
+
+// LoadSeen returns the saved seen table, or nil if there is none.
+func (ls *ListStore) LoadSeen() (*SeenSnapshot, error) {
+	if ls == nil {
+		return nil, nil
+	}
+	data, err := os.ReadFile(ls.seenPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading the seen table: %v", err)
+	}
+	var snap SeenSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("error loading the seen table: %v", err)
+	}
+	return &snap, nil
+}
+
+// LoadOverrides returns the saved overrides, or nil if there are none.
+func (ls *ListStore) LoadOverrides() ([]Override, error) {
+	if ls == nil {
+		return nil, nil
+	}
+	data, err := os.ReadFile(ls.overridesPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading the overrides: %v", err)
+	}
+	var overrides []Override
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return nil, fmt.Errorf("error loading the overrides: %v", err)
+	}
+	return overrides, nil
+}
+
+// ListSaver saves the lists every services.liststore.interval until stopch is
+// closed. The final save is a shutdown hook.
+func (pd *PopData) ListSaver(stopch chan struct{}) {
+	if pd.ListStore == nil {
+		return
+	}
+	ticker := time.NewTicker(pd.ListStore.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := pd.ListStore.Save(pd); err != nil {
+				pd.Logger.Printf("ListSaver: Error: %v", err)
+			}
+		case <-stopch:
+			return
+		}
+	}
+}
+
+// restoreList fills wbgl from a snapshot. The names that expired while the
+// POP was down are left out, as the Reaper would have removed them, and so
+// are the reaper schedules that have passed. It returns the number of names
+// left out. The caller must hold pd.mu, or own wbgl.
+func (pd *PopData) restoreList(wbgl *PopList, snap *ListSnapshot, now time.Time) (int, error) {
+	reaped := map[string]bool{}
+	for name, tn := range snap.Names {
+		if tn.TTL > 0 && !tn.TimeAdded.Add(tn.TTL).After(now) {
+			reaped[name] = true
+		}
+	}
+	wbgl.ReaperData = map[time.Time]map[string]bool{}
+	for t, names := range snap.ReaperData {
+		if !t.After(now) {
+			for name := range names {
+				reaped[name] = true
+			}
+			continue
+		}
+		wbgl.ReaperData[t] = maps.Clone(names)
+	}
+	kept := make(map[string]tapir.TapirName, len(snap.Names))
+	for name, tn := range snap.Names {
+		if !reaped[name] {
+			kept[name] = tn
+		}
+	}
+	if err := wbgl.setNames(kept); err != nil {
+		return 0, err
+	}
+	pd.observe(slices.Collect(maps.Values(kept))...)
+	for t, names := range wbgl.ReaperData {
+		for name := range names {
+			if reaped[name] {
+				delete(names, name)
+			}
+		}
+		if len(names) == 0 {
+			delete(wbgl.ReaperData, t)
+		}
+	}
+	return len(snap.Names) - len(kept), nil
+}
+
+// reconcileList merges a bootstrapped list into wbgl. The bootstrap server has
+// the complete list, so a name that only wbgl has is removed, unless it was
+// added after the bootstrap was requested at since (then it came over MQTT
+// while we waited). For a name that both have, the one added last wins. The
+// reaper schedule is rebuilt from the resulting names. It returns the changes
+// as a TapirMsg for UpdateRpz. The caller must hold pd.mu, or own wbgl.
+func (pd *PopData) reconcileList(wbgl *PopList, boot *tapir.WBGlist, since time.Time) (tapir.TapirMsg, error) {
+	tm := tapir.TapirMsg{SrcName: wbgl.Name, ListType: wbgl.Type}
+	bootNames := canonNames(boot.Names)
+	var removed []string
+	wbgl.Names.Range(func(tn tapir.TapirName) bool {
+		if _, exist := bootNames[tn.Name]; !exist && !tn.TimeAdded.After(since) {
+			removed = append(removed, tn.Name)
+			tm.Removed = append(tm.Removed, tapir.Domain{Name: tn.Name})
+		}
+		return true
+	})
+	if err := wbgl.Names.Delete(removed...); err != nil {
+		return tm, err
+	}
+	var added []tapir.TapirName
+	for name, tn := range bootNames {
+		if cur, exist := wbgl.Names.Get(name); exist && !tn.TimeAdded.After(cur.TimeAdded) {
+			continue
+		}
+		added = append(added, tn)
+		tm.Added = append(tm.Added, tapir.Domain{Name: name, TimeAdded: tn.TimeAdded,
+			TTL: int(tn.TTL / time.Second), TagMask: tn.TagMask})
+	}
+	if err := wbgl.Names.Put(added...); err != nil {
+		return tm, err
+	}
+	pd.observe(added...)
+	wbgl.ReaperData = map[time.Time]map[string]bool{}
+	err := wbgl.Names.Range(func(tn tapir.TapirName) bool {
+		if tn.TTL > 0 {
+			pd.scheduleReaping(wbgl, tn.Name, tn.TimeAdded.Add(tn.TTL))
+		}
+		return true
+	})
+	return tm, err
+}
+
+// retryBootstrap bootstraps an MQTT source that could not be bootstrapped at
+// startup, with a growing delay between the attempts, and hands the result to
+// RefreshEngine. It gives up when the POP shuts down.
+func (pd *PopData) retryBootstrap(src SourceConf) {
+	ctx := context.Background()
+	if Gconfig.Internal.Shutdown != nil {
+		ctx = Gconfig.Internal.Shutdown.Context()
+	}
+	delay := 30 * time.Second
+	for {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		since := time.Now()
+		boot, err := pd.BootstrapMqttSource(src)
+		if err != nil {
+			delay = min(2*delay, 10*time.Minute)
+			pd.Logger.Printf("retryBootstrap: Error bootstrapping MQTT source %s, next attempt in %v: %v", src.Name, delay, err)
+			continue
+		}
+		cmd := RpzCmdData{
+			Command:   "LIST-BOOTSTRAP",
+			ListType:  "doubtlist",
+			RpzSource: src.Name,
+			Bootstrap: boot,
+			Since:     since,
+			Result:    make(chan RpzCmdResponse, 1),
+		}
+		select {
+		case pd.RpzCommandCh <- cmd:
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case resp := <-cmd.Result:
+			if resp.Error {
+				pd.Logger.Printf("retryBootstrap: MQTT source %s: %s", src.Name, resp.ErrorMsg)
+			}
+		case <-ctx.Done():
+		}
+		return
+	}
+}
+
+// BootstrapList reconciles a list with the bootstrapped data that
+// retryBootstrap got for it and updates the RPZ with the differences.
+func (pd *PopData) BootstrapList(listtype, name string, boot *tapir.WBGlist, since time.Time) (RpzIxfr, error) {
+	pd.mu.Lock()
+	wbgl, exist := pd.Lists[listtype][name]
+	if !exist {
+		pd.mu.Unlock()
+		return RpzIxfr{}, fmt.Errorf("list [%s][%s] does not exist", listtype, name)
+	}
+	tm, err := pd.reconcileList(wbgl, boot, since)
+	pd.mu.Unlock()
+	if err != nil {
+		return RpzIxfr{}, err
+	}
+	pd.Logger.Printf("BootstrapList: list [%s][%s] bootstrapped: %d names added or updated, %d removed",
+		listtype, name, len(tm.Added), len(tm.Removed))
+	pd.Health.SourceLoaded(name)
+	return pd.UpdateRpz(&tm, AuditCause{Trigger: "bootstrap", Source: name})
+}
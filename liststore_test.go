@@ -0,0 +1,213 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"slices"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/spf13/viper"
+)
+
+func TestListStore(t *testing.T) {
+	viper.Set("services.liststore.dir", t.TempDir())
+	defer viper.Set("services.liststore.dir", "")
+	ls, err := NewListStore()
+	if err != nil {
+		t.Fatalf("NewListStore: %v", err)
+	}
+
+	now := time.Now()
+	pd := newXfrTestPopData()
+	pd.ReaperInterval = time.Minute
+	feed := pd.Lists["denylist"]["feed"]
+	feed.Datasource = "mqtt"
+	feed.ReaperData = map[time.Time]map[string]bool{}
+	for _, tn := range []tapir.TapirName{
+		{Name: "hour.example.", TimeAdded: now, TTL: time.Hour},
+		{Name: "minutes.example.", TimeAdded: now, TTL: 10 * time.Minute},
+		{Name: "forever.example.", TimeAdded: now},
+	} {
+		feed.Names.Put(tn)
+		if tn.TTL > 0 {
+			pd.scheduleReaping(feed, tn.Name, tn.TimeAdded.Add(tn.TTL))
+		}
+	}
+	pd.Lists["allowlist"]["local"] = &PopList{WBGlist: &tapir.WBGlist{Name: "local", Datasource: "file"}, Names: newMemNames("local")}
+	pd.Lists["allowlist"]["local"].Names.Put(tapir.TapirName{Name: "local.example."})
+	if err := ls.Save(pd); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	if snap, err := ls.Load("allowlist", "local"); snap != nil || err != nil {
+		t.Errorf("Load of a list that is not fed over MQTT: %v, %v", snap, err)
+	}
+	snap, err := ls.Load("denylist", "feed")
+	if err != nil || snap == nil {
+		t.Fatalf("Load: %v, %v", snap, err)
+	}
+
+	// Restarted after 5, 30 and 90 minutes.
+	cases := []struct {
+		down    time.Duration
+		names   []string
+		buckets int
+	}{
+		{down: 5 * time.Minute, names: []string{"forever.example.", "hour.example.", "minutes.example."}, buckets: 2},
+		{down: 30 * time.Minute, names: []string{"forever.example.", "hour.example."}, buckets: 1},
+		{down: 90 * time.Minute, names: []string{"forever.example."}, buckets: 0},
+	}
+	for _, c := range cases {
+		wbgl := &PopList{WBGlist: &tapir.WBGlist{Name: "feed"}, Names: newMemNames("feed")}
+		reaped, err := pd.restoreList(wbgl, snap, now.Add(c.down))
+		if err != nil {
+			t.Fatalf("restoreList: %v", err)
+		}
+		var names []string
+		wbgl.Names.Range(func(tn tapir.TapirName) bool {
+			names = append(names, tn.Name)
+			return true
+		})
+		sort.Strings(names)
+		if !slices.Equal(names, c.names) || reaped != 3-len(c.names) || len(wbgl.ReaperData) != c.buckets {
+			t.Errorf("after %v: names %v, %d reaped, %d reaper buckets; want %v, %d buckets",
+				c.down, names, reaped, len(wbgl.ReaperData), c.names, c.buckets)
+		}
+		if tn, _ := wbgl.Names.Get("hour.example."); c.down < time.Hour && !tn.TimeAdded.Equal(now) {
+			t.Errorf("after %v: TimeAdded %v, want %v", c.down, tn.TimeAdded, now)
+		}
+	}
+}
+
+func TestReconcileList(t *testing.T) {
+	since := time.Now()
+	before, after := since.Add(-time.Hour), since.Add(time.Minute)
+	tn := func(name string, added time.Time) tapir.TapirName {
+		return tapir.TapirName{Name: name, TimeAdded: added, TTL: 2 * time.Hour}
+	}
+
+	cases := []struct {
+		name    string
+		cur     []tapir.TapirName
+		boot    []tapir.TapirName
+		want    map[string]time.Time
+		added   []string
+		removed []string
+	}{
+		{
+			name:  "empty",
+			boot:  []tapir.TapirName{tn("a.example.", before)},
+			want:  map[string]time.Time{"a.example.": before},
+			added: []string{"a.example."},
+		},
+		{
+			name: "same",
+			cur:  []tapir.TapirName{tn("a.example.", before)},
+			boot: []tapir.TapirName{tn("a.example.", before)},
+			want: map[string]time.Time{"a.example.": before},
+		},
+		{
+			name:  "newer_in_bootstrap",
+			cur:   []tapir.TapirName{tn("a.example.", before)},
+			boot:  []tapir.TapirName{tn("a.example.", since)},
+			want:  map[string]time.Time{"a.example.": since},
+			added: []string{"a.example."},
+		},
+		{
+			name: "newer_over_mqtt",
+			cur:  []tapir.TapirName{tn("a.example.", after)},
+			boot: []tapir.TapirName{tn("a.example.", before)},
+			want: map[string]time.Time{"a.example.": after},
+		},
+		{
+			name:    "gone_from_bootstrap",
+			cur:     []tapir.TapirName{tn("a.example.", before), tn("b.example.", after)},
+			want:    map[string]time.Time{"b.example.": after},
+			removed: []string{"a.example."},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pd := newXfrTestPopData()
+			pd.ReaperInterval = time.Minute
+			wbgl := &PopList{WBGlist: &tapir.WBGlist{Name: "feed", Type: "doubtlist"}, Names: newMemNames("feed")}
+			wbgl.Names.Put(c.cur...)
+			boot := &tapir.WBGlist{Names: map[string]tapir.TapirName{}}
+			for _, n := range c.boot {
+				boot.Names[n.Name] = n
+			}
+			tm, err := pd.reconcileList(wbgl, boot, since)
+			if err != nil {
+				t.Fatalf("reconcileList: %v", err)
+			}
+
+			got := map[string]time.Time{}
+			wbgl.Names.Range(func(n tapir.TapirName) bool {
+				got[n.Name] = n.TimeAdded
+				return true
+			})
+			if len(got) != len(c.want) {
+				t.Errorf("names %v, want %v", got, c.want)
+			}
+			for name, added := range c.want {
+				if !got[name].Equal(added) {
+					t.Errorf("%s: TimeAdded %v, want %v", name, got[name], added)
+				}
+			}
+			domains := func(ds []tapir.Domain) []string {
+				var names []string
+				for _, d := range ds {
+					names = append(names, d.Name)
+				}
+				return names
+			}
+			if !slices.Equal(domains(tm.Added), c.added) || !slices.Equal(domains(tm.Removed), c.removed) {
+				t.Errorf("added %v, removed %v; want %v, %v", domains(tm.Added), domains(tm.Removed), c.added, c.removed)
+			}
+			scheduled := 0
+			for _, names := range wbgl.ReaperData {
+				scheduled += len(names)
+			}
+			if scheduled != len(c.want) {
+				t.Errorf("%d names scheduled for reaping, want %d", scheduled, len(c.want))
+			}
+		})
+	}
+}
+
+func TestBootstrapList(t *testing.T) {
+	pd := newRunningTestPopData(t)
+	now := time.Now()
+	feed := pd.Lists["denylist"]["feed"]
+	feed.Names.Put(tapir.TapirName{Name: "saved.example.", TimeAdded: now.Add(-time.Hour), TTL: 2 * time.Hour})
+	if err := pd.GenerateRpzAxfr(); err != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+	serial := pd.Rpz.Current().Serial
+
+	boot := &tapir.WBGlist{Names: map[string]tapir.TapirName{
+		"booted.example.": {Name: "booted.example.", TimeAdded: now, TTL: time.Hour},
+	}}
+	ixfr, err := pd.BootstrapList("denylist", "feed", boot, now)
+	if err != nil {
+		t.Fatalf("BootstrapList: %v", err)
+	}
+	snap := pd.Rpz.Current()
+	if ixfr.ToSerial != serial+1 || snap.Serial != serial+1 {
+		t.Errorf("serial %d (IXFR to %d), want %d", snap.Serial, ixfr.ToSerial, serial+1)
+	}
+	if _, exist := snap.Data["saved.example."]; exist {
+		t.Errorf("saved.example. is still in the RPZ")
+	}
+	if _, exist := snap.Data["booted.example."]; !exist {
+		t.Errorf("booted.example. is not in the RPZ")
+	}
+	if _, err := pd.BootstrapList("denylist", "nosuch", boot, now); err == nil {
+		t.Errorf("BootstrapList of a list that does not exist succeeded")
+	}
+}
@@ -5,108 +5,301 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/dnstapir/tapir"
 	"github.com/spf13/viper"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-func SetupLogging(conf *Config) {
-	logfile := viper.GetString("log.file")
+// Logging is done with log/slog. Every record carries the component that
+// logged it, and each component has its own level, which can be changed at
+// runtime through the API. The records go to a rotated file, to stderr or to
+// journald, as text or JSON.
+//
+// The Printf-style loggers (log.Printf, pd.Logger, conf.Loggers.*) write to
+// the same place: each line becomes an info record of the component. Code
+// that needs another level logs through compLogger.
+
+type logComponent struct {
+	level  slog.LevelVar
+	logger atomic.Pointer[slog.Logger]
+}
+
+// logComponents are the components that log, by name.
+var logComponents = map[string]*logComponent{
+	"main":      {}, // everything that is not one of the others
+	"policy":    {}, // policy decisions and the RPZ output
+	"sources":   {}, // loading and refreshing the sources
+	"xfr":       {}, // zone transfers to downstreams
+	"dnsengine": {},
+	"mqtt":      {},
+	"api":       {},
+}
 
-	debug := viper.GetString("log.mode") == "debug"
-	logoptions := log.Ldate | log.Ltime
-	if debug {
-		log.Println("Logging in debug mode (showing file and line number)")
-		logoptions |= log.Lshortfile
+// compLogger returns the logger of a component. Before SetupLogging it logs
+// through the default logger.
+func compLogger(component string) *slog.Logger {
+	c, exist := logComponents[component]
+	if !exist {
+		c = logComponents["main"]
 	}
+	if l := c.logger.Load(); l != nil {
+		return l
+	}
+	l := slog.New(&levelHandler{inner: slog.Default().Handler(), level: &c.level}).With("component", component)
+	c.logger.CompareAndSwap(nil, l)
+	return c.logger.Load()
+}
 
-	prefix := ""
+// logComponentNames returns the names of the components, sorted.
+func logComponentNames() []string {
+	var names []string
+	for name := range logComponents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
 
-	if logfile != "" {
-		log.SetOutput(&lumberjack.Logger{
-			Filename:   logfile,
-			MaxSize:    20,
-			MaxBackups: 3,
-			MaxAge:     14,
-		})
-		fmt.Printf("TAPIR-POP standard logging to: %s\n", logfile)
-	} else {
-		POPExiter("Error: standard log (key log.file) not specified")
+// SetLogLevel changes the level of a component.
+func SetLogLevel(component, level string) error {
+	c, exist := logComponents[component]
+	if !exist {
+		return fmt.Errorf("unknown log component %q (valid: %s)", component, strings.Join(logComponentNames(), ", "))
+	}
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unknown log level %q (valid: debug, info, warn, error)", level)
 	}
+	c.level.Set(l)
+	return nil
+}
 
-	logfile = viper.GetString("policy.logfile")
-	if logfile != "" {
-		logfile = filepath.Clean(logfile)
-		f, err := os.OpenFile(logfile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644) // #nosec G302
-		if err != nil {
-			POPExiter("error opening TAPIR-POP policy logfile '%s': %v", logfile, err)
-		}
+// LogLevel returns the level of a component.
+func LogLevel(component string) (slog.Level, bool) {
+	c, exist := logComponents[component]
+	if !exist {
+		return 0, false
+	}
+	return c.level.Level(), true
+}
+
+// levelHandler filters the records of a component on its level.
+type levelHandler struct {
+	inner slog.Handler
+	level *slog.LevelVar
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level() && h.inner.Enabled(ctx, level)
+}
+
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.inner.Handle(ctx, r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{inner: h.inner.WithAttrs(attrs), level: h.level}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{inner: h.inner.WithGroup(name), level: h.level}
+}
 
-		if debug {
-			prefix = "policy: "
+// legacyWriter turns the lines from a Printf-style *log.Logger into info
+// records of a component.
+type legacyWriter struct {
+	component string
+}
+
+func (lw legacyWriter) Write(p []byte) (int, error) {
+	l := compLogger(lw.component)
+	ctx := context.Background()
+	if !l.Enabled(ctx, slog.LevelInfo) {
+		return len(p), nil
+	}
+	// Callers, Write, log.(*Logger).output and log.(*Logger).Printf (or
+	// log.Printf) are above the code that logged the line.
+	var pcs [1]uintptr
+	runtime.Callers(4, pcs[:])
+	r := slog.NewRecord(time.Now(), slog.LevelInfo, strings.TrimSuffix(string(p), "\n"), pcs[0])
+	return len(p), l.Handler().Handle(ctx, r)
+}
+
+// newLegacyLogger returns a Printf-style logger for a component.
+func newLegacyLogger(component string) *log.Logger {
+	return log.New(legacyWriter{component: component}, "", 0)
+}
+
+// lockedWriter serializes the writes of the handlers that share a file.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
+
+// logSinks makes the handlers for log files and the other outputs, one per
+// destination.
+type logSinks struct {
+	format     string
+	addSource  bool
+	maxsize    int // the rotation settings, as in lumberjack.Logger
+	maxbackups int
+	maxage     int
+	compress   bool
+	handlers   map[string]slog.Handler
+}
+
+func (ls *logSinks) writerHandler(w io.Writer) slog.Handler {
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug, AddSource: ls.addSource}
+	if ls.format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// file returns the handler for a rotated log file.
+func (ls *logSinks) file(logfile string) slog.Handler {
+	logfile = filepath.Clean(logfile)
+	if h, exist := ls.handlers[logfile]; exist {
+		return h
+	}
+	out := &lumberjack.Logger{
+		Filename:   logfile,
+		MaxSize:    ls.maxsize,
+		MaxBackups: ls.maxbackups,
+		MaxAge:     ls.maxage,
+		Compress:   ls.compress,
+	}
+	// Open it now, so that a bad path is found at startup.
+	if _, err := out.Write(nil); err != nil {
+		POPExiter("error opening TAPIR-POP logfile '%s': %v", logfile, err)
+	}
+	h := ls.writerHandler(&lockedWriter{w: out})
+	ls.handlers[logfile] = h
+	return h
+}
+
+func SetupLogging(conf *Config) {
+	sinks := &logSinks{
+		format:     viper.GetString("log.format"),
+		addSource:  viper.GetString("log.mode") == "debug",
+		maxsize:    viper.GetInt("log.maxsize"),
+		maxbackups: viper.GetInt("log.maxbackups"),
+		maxage:     viper.GetInt("log.maxage"),
+		compress:   viper.GetBool("log.compress"),
+		handlers:   map[string]slog.Handler{},
+	}
+	switch sinks.format {
+	case "":
+		sinks.format = "text"
+	case "text", "json":
+	default:
+		POPExiter("Error: log.format must be text or json, not %q", sinks.format)
+	}
+	if sinks.maxsize == 0 {
+		sinks.maxsize = 20
+	}
+	if sinks.maxbackups == 0 {
+		sinks.maxbackups = 3
+	}
+	if sinks.maxage == 0 {
+		sinks.maxage = 14
+	}
+
+	var main slog.Handler
+	output := viper.GetString("log.output")
+	switch output {
+	case "", "file":
+		logfile := viper.GetString("log.file")
+		if logfile == "" {
+			POPExiter("Error: standard log (key log.file) not specified")
 		}
-		conf.Loggers.Policy = log.New(f, prefix, logoptions)
-		conf.Loggers.Policy.SetOutput(&lumberjack.Logger{
-			Filename:   logfile,
-			MaxSize:    20,
-			MaxBackups: 3,
-			MaxAge:     14,
-		})
-		fmt.Printf("TAPIR-POP policy logging to: %s\n", logfile)
-	} else {
-		log.Println("No policy logfile specified, using default")
-		conf.Loggers.Policy = log.Default()
-	}
-
-	logfile = viper.GetString("dnsengine.logfile")
-	if logfile != "" {
-		logfile = filepath.Clean(logfile)
-		f, err := os.OpenFile(logfile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644) // #nosec G302
+		main = sinks.file(logfile)
+		fmt.Printf("TAPIR-POP standard logging to: %s\n", logfile)
+	case "stderr":
+		main = sinks.writerHandler(&lockedWriter{w: os.Stderr})
+	case "journald":
+		jh, err := newJournalHandler(sinks.addSource)
 		if err != nil {
-			POPExiter("error opening TAPIR-POP dnsengine logfile '%s': %v", logfile, err)
+			POPExiter("Error: log.output journald: %v", err)
 		}
+		main = jh
+	default:
+		POPExiter("Error: log.output must be file, stderr or journald, not %q", output)
+	}
 
-		if debug {
-			prefix = "dnsengine: "
-		}
-		conf.Loggers.Dnsengine = log.New(f, prefix, logoptions)
-		conf.Loggers.Dnsengine.SetOutput(&lumberjack.Logger{
-			Filename:   logfile,
-			MaxSize:    20,
-			MaxBackups: 3,
-			MaxAge:     14,
-		})
-		fmt.Printf("TAPIR-POP dnsengine logging to: %s\n", logfile)
-	} else {
-		log.Println("No dnsengine logfile specified, using default")
-		conf.Loggers.Dnsengine = log.Default()
-	}
-
-	logfile = viper.GetString("tapir.mqtt.logfile")
-	if logfile != "" {
-		logfile = filepath.Clean(logfile)
-		f, err := os.OpenFile(logfile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644) // #nosec G302
-		if err != nil {
-			POPExiter("error opening TAPIR-POP MQTT logfile '%s': %v", logfile, err)
+	// With a log file, some components may have their own. Otherwise all of
+	// them go to stderr or journald.
+	handlers := map[string]slog.Handler{}
+	if output == "" || output == "file" {
+		for component, key := range map[string]string{
+			"policy":    "policy.logfile",
+			"dnsengine": "dnsengine.logfile",
+			"mqtt":      "tapir.mqtt.logfile",
+		} {
+			if logfile := viper.GetString(key); logfile != "" {
+				handlers[component] = sinks.file(logfile)
+				fmt.Printf("TAPIR-POP %s logging to: %s\n", component, logfile)
+			}
 		}
+	}
 
-		if debug {
-			prefix = "mqtt: "
+	level := viper.GetString("log.level")
+	if level == "" {
+		level = "info"
+		if viper.GetBool("log.debug") || tapir.GlobalCF.Debug {
+			level = "debug"
 		}
-		conf.Loggers.Mqtt = log.New(f, prefix, logoptions)
-		conf.Loggers.Mqtt.SetOutput(&lumberjack.Logger{
-			Filename:   logfile,
-			MaxSize:    20,
-			MaxBackups: 3,
-			MaxAge:     14,
-		})
-		fmt.Printf("TAPIR-POP MQTT logging to: %s\n", logfile)
-	} else {
-		log.Println("No MQTT logfile specified, using default")
-		conf.Loggers.Mqtt = log.Default()
 	}
+	levels := viper.GetStringMapString("log.levels")
+	for name, c := range logComponents {
+		if err := SetLogLevel(name, level); err != nil {
+			POPExiter("Error: log.level: %v", err)
+		}
+		if l, exist := levels[name]; exist {
+			if err := SetLogLevel(name, l); err != nil {
+				POPExiter("Error: log.levels: %v", err)
+			}
+		}
+		h, exist := handlers[name]
+		if !exist {
+			h = main
+		}
+		c.logger.Store(slog.New(&levelHandler{inner: h, level: &c.level}).With("component", name))
+	}
+	for name := range levels {
+		if _, exist := logComponents[name]; !exist {
+			POPExiter("Error: log.levels: unknown log component %q (valid: %s)", name, strings.Join(logComponentNames(), ", "))
+		}
+	}
+
+	// slog.SetDefault also redirects the log package, so that must be
+	// undone afterwards to give its lines a level.
+	slog.SetDefault(compLogger("main"))
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(legacyWriter{component: "main"})
+
+	conf.Loggers.Policy = newLegacyLogger("policy")
+	conf.Loggers.Dnsengine = newLegacyLogger("dnsengine")
+	conf.Loggers.Mqtt = newLegacyLogger("mqtt")
 }
@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLogs sends the records of component to a buffer, as JSON, for the
+// rest of the test.
+func captureLogs(t *testing.T, component string) *bytes.Buffer {
+	t.Helper()
+	c := logComponents[component]
+	var buf bytes.Buffer
+	h := slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug, AddSource: true})
+	old, level := c.logger.Load(), c.level.Level()
+	c.logger.Store(slog.New(&levelHandler{inner: h, level: &c.level}).With("component", component))
+	t.Cleanup(func() {
+		c.logger.Store(old)
+		c.level.Set(level)
+	})
+	return &buf
+}
+
+func TestComponentLevels(t *testing.T) {
+	buf := captureLogs(t, "policy")
+	legacy := newLegacyLogger("policy")
+
+	cases := []struct {
+		level  string
+		printf string // through the Printf-style logger
+		debug  bool   // a Debug record through the slog logger
+		want   []string
+	}{
+		{level: "info", printf: "GenerateRpzIxfr: 1 added names", want: []string{"INFO"}},
+		{level: "info", printf: "Error from NotifyDownstreams(): timeout", want: []string{"INFO"}},
+		{level: "info", debug: true},
+		{level: "debug", debug: true, want: []string{"DEBUG"}},
+		{level: "warn", printf: "GenerateRpzIxfr: 1 added names"},
+		{level: "warn", printf: "Error from NotifyDownstreams(): timeout"},
+	}
+	for _, c := range cases {
+		buf.Reset()
+		if err := SetLogLevel("policy", c.level); err != nil {
+			t.Fatal(err)
+		}
+		if c.printf != "" {
+			legacy.Printf("%s", c.printf)
+		}
+		if c.debug {
+			compLogger("policy").Debug("GenerateRpzIxfr: added name", "name", "a.example.")
+		}
+		var got []string
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			if line == "" {
+				continue
+			}
+			var rec struct {
+				Level     string
+				Component string
+				Source    struct{ File string }
+			}
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatalf("%s: %v", line, err)
+			}
+			if rec.Component != "policy" || filepath.Base(rec.Source.File) != "logging_test.go" {
+				t.Errorf("record %s: wrong component or source", line)
+			}
+			got = append(got, rec.Level)
+		}
+		if strings.Join(got, ",") != strings.Join(c.want, ",") {
+			t.Errorf("level %s, %q/%v: got %v, want %v", c.level, c.printf, c.debug, got, c.want)
+		}
+	}
+
+	if err := SetLogLevel("policy", "verbose"); err == nil {
+		t.Errorf("SetLogLevel accepted level verbose")
+	}
+	if err := SetLogLevel("nosuch", "debug"); err == nil {
+		t.Errorf("SetLogLevel accepted component nosuch")
+	}
+}
+
+func TestJournalHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	old := journalSocket
+	journalSocket = path
+	defer func() { journalSocket = old }()
+
+	jh, err := newJournalHandler(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lg := slog.New(jh).With("component", "xfr").WithGroup("ixfr")
+	lg.Warn("two\nlines", "from", 1, "to", 2)
+
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := map[string]string{}
+	for msg := buf[:n]; len(msg) > 0; {
+		line, rest, _ := bytes.Cut(msg, []byte("\n"))
+		if name, value, found := bytes.Cut(line, []byte("=")); found {
+			fields[string(name)] = string(value)
+			msg = rest
+			continue
+		}
+		size := binary.LittleEndian.Uint64(rest)
+		fields[string(line)] = string(rest[8 : 8+size])
+		msg = rest[8+size+1:]
+	}
+	want := map[string]string{
+		"MESSAGE": "two\nlines", "PRIORITY": "4", "SYSLOG_IDENTIFIER": "tapir-pop",
+		"COMPONENT": "xfr", "IXFR_FROM": "1", "IXFR_TO": "2",
+	}
+	for name, value := range want {
+		if fields[name] != value {
+			t.Errorf("%s=%q, want %q", name, fields[name], value)
+		}
+	}
+	if filepath.Base(fields["CODE_FILE"]) != "logging_test.go" {
+		t.Errorf("CODE_FILE=%q", fields["CODE_FILE"])
+	}
+}
+
+func TestAPIv2LogLevels(t *testing.T) {
+	_, h := newAPITestConf(t)
+	captureLogs(t, "mqtt") // restores the level
+
+	cases := []struct {
+		path string
+		body string
+		code int
+	}{
+		{path: "/api/v2/logging/mqtt", body: `{"level": "debug"}`, code: http.StatusOK},
+		{path: "/api/v2/logging/mqtt", body: `{"level": "chatty"}`, code: http.StatusBadRequest},
+		{path: "/api/v2/logging/nosuch", body: `{"level": "debug"}`, code: http.StatusNotFound},
+	}
+	for _, c := range cases {
+		if code := apiDo(t, h, "PUT", c.path, c.body, &map[string]any{}); code != c.code {
+			t.Errorf("PUT %s %s: status %d, want %d", c.path, c.body, code, c.code)
+		}
+	}
+
+	var levels []LogLevelInfo
+	if code := apiDo(t, h, "GET", "/api/v2/logging", "", &levels); code != http.StatusOK {
+		t.Fatalf("GET: status %d", code)
+	}
+	got := map[string]string{}
+	for _, l := range levels {
+		got[l.Component] = l.Level
+	}
+	if len(got) != len(logComponents) || got["mqtt"] != "DEBUG" {
+		t.Errorf("GET: %v", levels)
+	}
+}
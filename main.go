@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 
@@ -27,9 +28,34 @@ var name = "BAD-BUILD"
 var version = "BAD-BUILD"
 var commit = "BAD-BUILD"
 
+// The sources and outputs config files, which the tests replace with their own.
+var (
+	sourcesCfgFile = tapir.PopSourcesCfgFile
+	outputsCfgFile = tapir.PopOutputsCfgFile
+)
+
+// POPExiter is the exit for fatal errors. It runs the same shutdown as a
+// SIGTERM, as far as the POP has come, and exits with status 1.
 var POPExiter = func(args ...interface{}) {
-	log.Printf("POPExiter: [placeholderfunction w/o real cleanup]")
-	log.Printf("POPExiter: Exit message: %s", fmt.Sprintf(args[0].(string), args[1:]...))
+	var msg string
+	switch args[0].(type) {
+	case string:
+		msg = fmt.Sprintf("POPExiter: Exit message: %s",
+			fmt.Sprintf(args[0].(string), args[1:]...))
+	case error:
+		msg = fmt.Sprintf("POPExiter: Error message: %s", args[0].(error).Error())
+
+	default:
+		msg = fmt.Sprintf("POPExiter: Exit message: %v", args[0])
+	}
+
+	fmt.Println(msg)
+	log.Println(msg)
+
+	if Gconfig.Internal.Shutdown != nil {
+		log.Printf("POPExiter: will try to clean up.")
+		Gconfig.Internal.Shutdown.Run("fatal error")
+	}
 	os.Exit(1)
 }
 
@@ -41,12 +67,13 @@ func (pd *PopData) SaveRpzSerial() error {
 	}
 	// serialData := []byte(fmt.Sprintf("%d", pd.Rpz.CurrentSerial))
 	// err := os.WriteFile(serialFile, serialData, 0644)
-	serialYaml := fmt.Sprintf("current_serial: %d\n", pd.Rpz.CurrentSerial)
+	serial := pd.Rpz.Current().Serial
+	serialYaml := fmt.Sprintf("current_serial: %d\n", serial)
 	err := os.WriteFile(serialFile, []byte(serialYaml), 0644) // #nosec G306
 	if err != nil {
 		log.Printf("Error writing YAML serial to file: %v", err)
 	} else {
-		log.Printf("Saved current serial %d to file %s", pd.Rpz.CurrentSerial, serialFile)
+		log.Printf("Saved current serial %d to file %s", serial, serialFile)
 	}
 	return err
 }
@@ -58,31 +85,11 @@ func mainloop(conf *Config, configfile *string, pd *PopData) {
 	hupper := make(chan os.Signal, 1)
 	signal.Notify(hupper, syscall.SIGHUP)
 
-	POPExiter = func(args ...interface{}) {
-		var msg string
-		log.Printf("POPExiter: will try to clean up.")
-
-		err := pd.SaveRpzSerial()
-		if err != nil {
-			log.Printf("Error saving RPZ serial: %v", err)
-		}
-
-		switch args[0].(type) {
-		case string:
-			msg = fmt.Sprintf("POPExiter: Exit message: %s",
-				fmt.Sprintf(args[0].(string), args[1:]...))
-		case error:
-			msg = fmt.Sprintf("POPExiter: Error message: %s", args[0].(error).Error())
-
-		default:
-			msg = fmt.Sprintf("POPExiter: Exit message: %v", args[0])
-		}
-
-		fmt.Println(msg)
-		log.Println(msg)
-
-		os.Exit(1)
-	}
+	// Only save the serial once startup is complete, or the cache could be
+	// overwritten with the serial of a half-loaded RPZ.
+	conf.Internal.Shutdown.OnShutdown(shutdownState, "RPZ serial", func(ctx context.Context) error {
+		return pd.SaveRpzSerial()
+	})
 
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -91,14 +98,11 @@ func mainloop(conf *Config, configfile *string, pd *PopData) {
 		for {
 			// log.Println("mainloop: signal dispatcher")
 			select {
-			case <-exit:
+			case sig := <-exit:
 				log.Println("mainloop: Exit signal received. Cleaning up.")
-				err := pd.SaveRpzSerial()
-				if err != nil {
-					log.Printf("Error saving RPZ serial: %v", err)
-				}
-				// do whatever we need to do to wrap up nicely
+				conf.Internal.Shutdown.Run(fmt.Sprintf("signal %v", sig))
 				wg.Done()
+				return
 			case <-hupper:
 				// config file to use has already been set in main()
 				if err := viper.ReadInConfig(); err == nil {
@@ -107,16 +111,19 @@ func mainloop(conf *Config, configfile *string, pd *PopData) {
 					POPExiter("Could not load config %s: Error: %v", *configfile, err)
 				}
 
+				// The RPZ apex may have changed; an invalid apex is logged and ignored.
+				if err := pd.ReloadRpzApex(conf.Internal.CfgFile); err != nil {
+					log.Printf("mainloop: Error reloading the RPZ apex from %s: %v", conf.Internal.CfgFile, err)
+				}
+
 				log.Println("mainloop: SIGHUP received. Forcing refresh of all configured zones.")
 				log.Printf("mainloop: Requesting refresh of all RPZ zones")
 				conf.PopData.RpzRefreshCh <- RpzRefresh{Name: ""}
 			case <-conf.Internal.APIStopCh:
 				log.Printf("mainloop: API instruction to stop\n")
-				err := pd.SaveRpzSerial()
-				if err != nil {
-					log.Printf("Error saving RPZ serial: %v", err)
-				}
+				conf.Internal.Shutdown.Run("API instruction to stop")
 				wg.Done()
+				return
 			}
 		}
 	}()
@@ -156,19 +163,20 @@ func main() {
 	} else {
 		POPExiter("Could not load config %s: Error: %v", tapir.DefaultPopCfgFile, err)
 	}
-	viper.SetConfigFile(tapir.PopSourcesCfgFile)
+	mainCfgFile := cfgFileUsed
+	viper.SetConfigFile(sourcesCfgFile)
 	if err := viper.MergeInConfig(); err == nil {
 		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
 		cfgFileUsed = viper.ConfigFileUsed()
 	} else {
-		POPExiter("Could not load config %s: Error: %v", tapir.PopSourcesCfgFile, err)
+		POPExiter("Could not load config %s: Error: %v", sourcesCfgFile, err)
 	}
-	viper.SetConfigFile(tapir.PopOutputsCfgFile)
+	viper.SetConfigFile(outputsCfgFile)
 	if err := viper.MergeInConfig(); err == nil {
 		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
 		cfgFileUsed = viper.ConfigFileUsed()
 	} else {
-		POPExiter("Could not load config %s: Error: %v", tapir.PopOutputsCfgFile, err)
+		POPExiter("Could not load config %s: Error: %v", outputsCfgFile, err)
 	}
 	viper.SetConfigFile(tapir.PopPolicyCfgFile)
 	if err := viper.MergeInConfig(); err == nil {
@@ -191,6 +199,11 @@ func main() {
 	}
 
 	var stopch = make(chan struct{}, 10)
+	Gconfig.Internal.Shutdown = NewShutdown()
+	Gconfig.Internal.CfgFile = mainCfgFile
+	if err := sdListenFds(); err != nil {
+		POPExiter("Error from sdListenFds: %v", err)
+	}
 
 	statusch := make(chan tapir.ComponentStatusUpdate, 10)
 	Gconfig.Internal.ComponentStatusCh = statusch
@@ -200,6 +213,18 @@ func main() {
 		POPExiter("Error from NewPopData: %v", err)
 	}
 
+	Gconfig.Internal.Shutdown.OnShutdown(shutdownDrain, "zone transfers", pd.Limits.drain)
+	Gconfig.Internal.Shutdown.OnShutdown(shutdownState, "audit log", func(ctx context.Context) error {
+		return pd.Audit.Close()
+	})
+	// After the engines, so that the lists no longer change.
+	Gconfig.Internal.Shutdown.OnShutdown(shutdownState, "list store", func(ctx context.Context) error {
+		return untilDone(ctx, func() error { return pd.ListStore.Save(pd) })
+	})
+	Gconfig.Internal.Shutdown.OnShutdown(shutdownState, "name stores", func(ctx context.Context) error {
+		return pd.closeNameStores()
+	})
+
 	if pd.MqttEngine == nil {
 		pd.mu.Lock()
 		err := pd.CreateMqttEngine(mqttclientid, statusch, pd.MqttLogger)
@@ -213,10 +238,23 @@ func main() {
 		}
 	}
 
+	Gconfig.Internal.Shutdown.OnShutdown(shutdownEngines, "MQTT engine", func(ctx context.Context) error {
+		return untilDone(ctx, func() error {
+			_, err := pd.MqttEngine.StopEngine()
+			return err
+		})
+	})
+	Gconfig.Internal.Shutdown.OnShutdown(shutdownEngines, "internal engines", func(ctx context.Context) error {
+		close(stopch)
+		return nil
+	})
+
 	go pd.ConfigUpdater(&Gconfig, stopch) // Note that ConfigUpdater must as early as possible
 	go pd.StatusUpdater(&Gconfig, stopch) // Note that StatusUpdater must as early as possible
 	go pd.RefreshEngine(&Gconfig, stopch)
+	go pd.ListSaver(stopch)
 
+	sdStatus("Loading sources")
 	log.Println("*** main: Calling ParseSourcesNG()")
 	// ParseSourcesNG has a two-tier error contract:
 	//   - Failure of an INDIVIDUAL source (one bad/unreachable feed) is logged
@@ -231,11 +269,6 @@ func main() {
 	}
 	log.Println("*** main: Returned from ParseSourcesNG()")
 
-	err = pd.ParseOutputs()
-	if err != nil {
-		POPExiter("Error from ParseOutputs: %v", err)
-	}
-
 	apistopper := make(chan struct{}) //
 	Gconfig.Internal.APIStopCh = apistopper
 	go APIhandler(&Gconfig, apistopper)
@@ -248,6 +281,11 @@ func main() {
 	}()
 	Gconfig.BootTime = time.Now()
 
+	// The sources are loaded and the first RPZ is generated.
+	if err := sdNotify("READY=1\nSTATUS=" + pd.statusLine()); err != nil {
+		log.Printf("main: %v", err)
+	}
+
 	statusch <- tapir.ComponentStatusUpdate{
 		Component: "main-boot",
 		Status:    tapir.StatusOK,
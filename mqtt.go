@@ -5,8 +5,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"log/slog"
 	"time"
 
 	"github.com/dnstapir/tapir"
@@ -18,7 +20,7 @@ func (pd *PopData) CreateMqttEngine(clientid string, statusch chan tapir.Compone
 		POPExiter("Error starting MQTT Engine: clientid not specified in config")
 	}
 	var err error
-	pd.Logger.Printf("Creating MQTT Engine with clientid %s", clientid)
+	compLogger("mqtt").Info("CreateMqttEngine: creating the MQTT engine", "clientid", clientid)
 	pd.MqttEngine, err = tapir.NewMqttEngine("tapir-pop", clientid, tapir.TapirSub, statusch, lg) // sub, but no pub
 	if err != nil {
 		POPExiter("Error from NewMqttEngine: %v\n", err)
@@ -33,7 +35,7 @@ func (pd *PopData) StartMqttEngine(meng *tapir.MqttEngine) error {
 
 	cmnder, outbox, inbox, err := meng.StartEngine()
 	if err != nil {
-		log.Fatalf("Error from StartEngine(): %v", err)
+		POPExiter("Error from StartEngine(): %v", err)
 	}
 	pd.TapirMqttCmdCh = cmnder
 	pd.TapirMqttPubCh = outbox
@@ -54,7 +56,7 @@ func (pd *PopData) StartMqttEngine(meng *tapir.MqttEngine) error {
 //
 
 // func (pd *PopData) ProcessTapirUpdate(tpkg tapir.MqttPkgIn) (bool, error) {
-func (pd *PopData) ProcessTapirUpdate(tm tapir.TapirMsg) (bool, error) {
+func (pd *PopData) ProcessTapirUpdate(tm tapir.TapirMsg, msgid string) (bool, error) {
 	//	tm := tapir.TapirMsg{}
 	//	err := json.Unmarshal(tpkg.Payload, &tm)
 	//	if err != nil {
@@ -62,112 +64,129 @@ func (pd *PopData) ProcessTapirUpdate(tm tapir.TapirMsg) (bool, error) {
 	//		return false, fmt.Errorf("MQTT: failed to decode json: %v", err)
 	//	}
 
-	if pd.Debug {
-		pd.Logger.Printf("ProcessTapirUpdate: update of MQTT source %s contains %d adds and %d removes",
-			tm.SrcName, len(tm.Added), len(tm.Removed))
-		tapir.PrintTapirMsg(tm, pd.Logger)
+	lg := compLogger("mqtt")
+	lg.Debug("ProcessTapirUpdate: update of MQTT source",
+		"source", tm.SrcName, "added", len(tm.Added), "removed", len(tm.Removed))
+	if lg.Enabled(context.Background(), slog.LevelDebug) {
+		tapir.PrintTapirMsg(tm, slog.NewLogLogger(lg.Handler(), slog.LevelDebug))
 	}
 
-	var wbgl *tapir.WBGlist
+	// The lists keep the names in lower case.
+	for i := range tm.Added {
+		tm.Added[i].Name = dns.CanonicalName(tm.Added[i].Name)
+	}
+	for i := range tm.Removed {
+		tm.Removed[i].Name = dns.CanonicalName(tm.Removed[i].Name)
+	}
+
+	var wbgl *PopList
 	var exists bool
 
-	pd.Logger.Printf("ProcessTapirUpdate: looking up list [%s][%s]", tm.ListType, tm.SrcName)
+	lg.Debug("ProcessTapirUpdate: looking up list", "listtype", tm.ListType, "source", tm.SrcName)
 
+	pd.mu.Lock()
 	switch tm.ListType {
 	case "allowlist", "doubtlist", "denylist":
 		wbgl, exists = pd.Lists[tm.ListType][tm.SrcName]
 	default:
-		pd.Logger.Printf("TapirUpdate for unknown listtype from source \"%s\" rejected.", tm.SrcName)
+		pd.mu.Unlock()
+		lg.Warn("ProcessTapirUpdate: unknown list type, update rejected", "listtype", tm.ListType, "source", tm.SrcName)
 		return false, fmt.Errorf("MQTT ListType %s is unknown, update rejected", tm.ListType)
 	}
 
 	if !exists {
-		pd.Logger.Printf("TapirUpdate for unknown source \"%s\" rejected.", tm.SrcName)
+		pd.mu.Unlock()
+		lg.Warn("ProcessTapirUpdate: unknown source, update rejected", "listtype", tm.ListType, "source", tm.SrcName)
 		return false, fmt.Errorf("MQTT Source %s is unknown, update rejected", tm.SrcName)
 	}
 
 	for _, tname := range tm.Added {
 		ttl := time.Duration(tname.TTL) * time.Second
 		tmp := tapir.TapirName{
-			Name:      dns.Fqdn(tname.Name),
+			Name:      tname.Name,
 			TimeAdded: tname.TimeAdded,
 			TTL:       ttl,
 			TagMask:   tname.TagMask,
 		}
-		wbgl.Names[tname.Name] = tmp
-
-		pd.Logger.Printf("ProcessTapirUpdate: adding name %s to %s (TimeAdded: %s ttl: %v)",
-			tname.Name, wbgl.Name, tname.TimeAdded.Format(tapir.TimeLayout), tname.TTL)
-
-		// Time that the name will be removed from the list
-		// must ensure that reapertime is at least ReaperInterval into the future
-		reptime := tname.TimeAdded.Add(ttl).Truncate(pd.ReaperInterval).Add(pd.ReaperInterval)
-
-		// Ensure that there are no prior removal events for this name
-		for reaperTime, namesMap := range wbgl.ReaperData {
-			if reaperTime.Before(reptime) {
-				if _, exists := namesMap[tname.Name]; exists {
-					delete(namesMap, tname.Name)
-					if len(namesMap) == 0 {
-						delete(wbgl.ReaperData, reaperTime)
-					}
-				}
-			}
+		if err := wbgl.Names.Put(tmp); err != nil {
+			pd.mu.Unlock()
+			return false, err
 		}
+		pd.observe(tmp)
 
-		// Add the name to the removal list for the time it will be removed
-		if wbgl.ReaperData[reptime] == nil {
-			wbgl.ReaperData[reptime] = make(map[string]bool)
-		}
-		wbgl.ReaperData[reptime][tname.Name] = true
+		lg.Debug("ProcessTapirUpdate: adding name", "name", tname.Name, "list", wbgl.Name,
+			"added", tname.TimeAdded.Format(tapir.TimeLayout), "ttl", ttl)
+
+		pd.scheduleReaping(wbgl, tname.Name, tname.TimeAdded.Add(ttl))
 	}
 
-	pd.Logger.Printf("ProcessTapirUpdate: current state of %s %s ReaperData:", tm.ListType, wbgl.Name)
 	for t, v := range wbgl.ReaperData {
 		if len(v) > 0 {
-			pd.Logger.Printf("== At time %s the following names will be removed from the dns-tapir list:", t.Format(tapir.TimeLayout))
-			for name := range v {
-				pd.Logger.Printf("  %s", name)
-			}
+			lg.Debug("ProcessTapirUpdate: names to be reaped", "list", wbgl.Name,
+				"time", t.Format(tapir.TimeLayout), "names", len(v))
 		} else {
-			pd.Logger.Printf("ReaperData: timekey %s is empty, deleting", t.Format(tapir.TimeLayout))
+			lg.Debug("ProcessTapirUpdate: empty reaper time slot, deleting", "list", wbgl.Name,
+				"time", t.Format(tapir.TimeLayout))
 			delete(wbgl.ReaperData, t)
 		}
 	}
 
 	for _, tname := range tm.Removed {
-		delete(wbgl.Names, dns.Fqdn(tname.Name))
+		if err := wbgl.Names.Delete(tname.Name); err != nil {
+			pd.mu.Unlock()
+			return false, err
+		}
 	}
+	pd.mu.Unlock()
 
-	ixfr, err := pd.GenerateRpzIxfr(&tm)
-	if err != nil {
-		return false, err
-	}
-	err = pd.ProcessIxfrIntoAxfr(ixfr)
+	_, err := pd.UpdateRpz(&tm, AuditCause{Trigger: "mqtt", Source: tm.SrcName, MsgId: msgid})
 	return true, err // return to RefreshEngine
 }
 
+// ProcessIxfrIntoAxfr applies the IXFR to a copy of the current snapshot and
+// publishes the result as the next serial. The caller must hold pd.Rpz.wmu;
+// normally that is UpdateRpz.
 func (pd *PopData) ProcessIxfrIntoAxfr(ixfr RpzIxfr) error {
+	if len(ixfr.Removed) == 0 && len(ixfr.Added) == 0 {
+		return nil // no change in the output, so no new serial
+	}
+	cur := pd.Rpz.Current()
+	if ixfr.FromSerial != cur.Serial {
+		return fmt.Errorf("ProcessIxfrIntoAxfr: IXFR is from serial %d, but the current serial is %d",
+			ixfr.FromSerial, cur.Serial)
+	}
+
+	lg := compLogger("policy")
+	next := cur.clone()
 	for _, tn := range ixfr.Removed {
-		delete(pd.Rpz.Axfr.Data, tn.Name)
-		if pd.Debug {
-			pd.Logger.Printf("PIIA: Deleting domain %s", tn.Name)
-		}
+		delete(next.Data, tn.Name)
+		lg.Debug("ProcessIxfrIntoAxfr: deleting name", "name", tn.Name)
 	}
 	for _, tn := range ixfr.Added {
-		if _, exist := pd.Rpz.Axfr.Data[tn.Name]; exist {
+		if _, exist := next.Data[tn.Name]; exist {
 			// XXX: this should not happen.
-			pd.Logger.Printf("Error: ProcessIxfrIntoAxfr: domain %s already exists. This should not happen.",
-				tn.Name)
+			lg.Error("ProcessIxfrIntoAxfr: the name already exists, this should not happen", "name", tn.Name)
 		} else {
-			pd.Rpz.Axfr.Data[tn.Name] = tn
-			if pd.Debug {
-				pd.Logger.Printf("PIIA: Adding domain %s", tn.Name)
-			}
+			next.Data[tn.Name] = tn.Action
+			lg.Debug("ProcessIxfrIntoAxfr: adding name", "name", tn.Name)
 		}
 	}
+	pd.publishIxfr(cur, next, ixfr)
+
+	lg.Debug("ProcessIxfrIntoAxfr: published", "serial", next.Serial, "ixfrs", len(next.IxfrChain))
+	return nil
+}
 
-	//	pd.Logger.Printf("PIIA Notifying %d downstreams for RPZ zone %s", len(pd.RpzDownstreams), pd.Rpz.ZoneName)
-	err := pd.NotifyDownstreams()
-	return err
+// publishIxfr publishes next, which is cur with the names changed as in ixfr,
+// as the serial that ixfr goes to, and adds ixfr to the IXFR chain. The caller
+// must hold pd.Rpz.wmu.
+func (pd *PopData) publishIxfr(cur, next *RpzSnapshot, ixfr RpzIxfr) {
+	next.Serial = ixfr.ToSerial
+	next.Owners = mergeOwners(cur.Owners, next.Data, ixfr)
+	next.seal()
+	// Every serial has its own ZONEMD, so the IXFR replaces it.
+	ixfr.FromSOA, ixfr.ToSOA = cur.SOA, next.SOA
+	ixfr.ApexRemoved, ixfr.ApexAdded = cur.apexRRs(), next.apexRRs()
+	next.IxfrChain = append(next.IxfrChain, ixfr)
+	pd.Rpz.publish(next)
 }
@@ -0,0 +1,644 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The names of a list are kept in a NameStore. The default is a map in
+// memory. With "store: disk" in the source config the names are kept in a
+// bbolt file instead, so that a feed with millions of names does not have to
+// fit in the heap. The file is only a cache: it is emptied when it is opened
+// and filled from the source like the map would be.
+//
+// The same name is often in several lists and in the RPZ output. The names
+// of the in-memory lists are interned in one name table, so a name is kept
+// once however many lists have it. A list keeps the id of the name with a
+// compact nameEntry instead of the TapirName. The RPZ output and the other
+// tables keyed on names share the copy in the table, see intern.
+
+// PopList is a list of names from one source. Its names are in Names, which
+// hides the map in WBGlist.Names; that one is not used.
+type PopList struct {
+	*tapir.WBGlist
+	Names NameStore
+}
+
+// NameStore holds the names of a list, keyed on the name. The callers
+// serialize the writes with pd.mu, like they did for the map.
+type NameStore interface {
+	Get(name string) (tapir.TapirName, bool)
+	Put(names ...tapir.TapirName) error
+	Delete(names ...string) error
+	Len() int
+	// Range calls fn for every name until it returns false. fn must not
+	// change the store.
+	Range(fn func(tapir.TapirName) bool) error
+	// Ascend calls fn for the names from from on, in order of name, until it
+	// returns false. fn must not change the store.
+	Ascend(from string, fn func(tapir.TapirName) bool) error
+	Close() error
+}
+
+// newPopList returns wbgl with its names in a new store of the given kind,
+// "memory" (or "") or "disk". The names in wbgl.Names are moved to it.
+func newPopList(wbgl *tapir.WBGlist, store string) (*PopList, error) {
+	var ns NameStore
+	switch store {
+	case "", "memory":
+		ns = newMemNames(wbgl.Name)
+	case "disk":
+		dir := viper.GetString("services.namestore.dir")
+		if dir == "" {
+			return nil, fmt.Errorf("list [%s][%s]: store disk needs services.namestore.dir", wbgl.Type, wbgl.Name)
+		}
+		var err error
+		ns, err = openBoltNames(filepath.Join(filepath.Clean(dir), wbgl.Type+"-"+wbgl.Name+".db"))
+		if err != nil {
+			return nil, fmt.Errorf("list [%s][%s]: %v", wbgl.Type, wbgl.Name, err)
+		}
+	default:
+		return nil, fmt.Errorf("list [%s][%s]: unknown store %q (valid: memory, disk)", wbgl.Type, wbgl.Name, store)
+	}
+	pl := &PopList{WBGlist: wbgl, Names: ns}
+	if err := pl.setNames(wbgl.Names); err != nil {
+		ns.Close()
+		return nil, err
+	}
+	return pl, nil
+}
+
+// setNames replaces the names of the list with those in names. The caller
+// must hold pd.mu, or own the list.
+func (pl *PopList) setNames(names map[string]tapir.TapirName) error {
+	pl.WBGlist.Names = nil
+	if m, ok := pl.Names.(*memNames); ok {
+		m.clear()
+	} else {
+		var old []string
+		pl.Names.Range(func(tn tapir.TapirName) bool {
+			old = append(old, tn.Name)
+			return true
+		})
+		if err := pl.Names.Delete(old...); err != nil {
+			return err
+		}
+	}
+	tns := make([]tapir.TapirName, 0, len(names))
+	for _, tn := range canonNames(names) {
+		tns = append(tns, tn)
+	}
+	return pl.Names.Put(tns...)
+}
+
+// canonNames returns names with every name in lower case, as the lists keep
+// them, both in the key and in the TapirName.
+func canonNames(names map[string]tapir.TapirName) map[string]tapir.TapirName {
+	canon := make(map[string]tapir.TapirName, len(names))
+	for name, tn := range names {
+		tn.Name = dns.CanonicalName(name)
+		canon[tn.Name] = tn
+	}
+	return canon
+}
+
+// nameMap returns a copy of the names of the list as a map, as in
+// WBGlist.Names.
+func (pl *PopList) nameMap() map[string]tapir.TapirName {
+	names := make(map[string]tapir.TapirName, pl.Names.Len())
+	pl.Names.Range(func(tn tapir.TapirName) bool {
+		names[tn.Name] = tn
+		return true
+	})
+	return names
+}
+
+// closeNameStores closes the name stores of all lists, at shutdown.
+func (pd *PopData) closeNameStores() error {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	var errs []error
+	for _, lists := range pd.Lists {
+		for _, wbgl := range lists {
+			if err := wbgl.Names.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("list [%s][%s]: %v", wbgl.Type, wbgl.Name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// nameTable interns the names of the in-memory lists. Every distinct name is
+// kept once, and the lists refer to it by its id. A name is dropped when the
+// last list lets go of it, and its id is then reused.
+//
+// The table is also the index of the lists: a store gets one of 64 slots, and
+// every name has a bit for each slot whose store has it, so that the policy
+// finds the lists of a name without asking every list. A store that finds no
+// free slot still interns its names but is not indexed, and is asked like a
+// list on disk.
+type nameTable struct {
+	mu    sync.RWMutex
+	ids   map[string]uint32
+	names []string // indexed by id, "" for a free id
+	refs  []uint32 // the number of stores that have names[id]
+	in    []uint64 // the slots of the stores that have names[id]
+	slots [64]*memNames
+	free  []uint32
+}
+
+var nameTab = &nameTable{ids: map[string]uint32{}}
+
+func (nt *nameTable) id(name string) (uint32, bool) {
+	nt.mu.RLock()
+	defer nt.mu.RUnlock()
+	id, exist := nt.ids[name]
+	return id, exist
+}
+
+func (nt *nameTable) name(id uint32) string {
+	nt.mu.RLock()
+	defer nt.mu.RUnlock()
+	return nt.names[id]
+}
+
+// ref returns the id of name, adding it if it is new, and records that m has
+// it.
+func (nt *nameTable) ref(name string, m *memNames) uint32 {
+	nt.mu.Lock()
+	defer nt.mu.Unlock()
+	id, exist := nt.ids[name]
+	if !exist {
+		// The name may be a slice of a larger buffer, like a whole list file.
+		name = strings.Clone(name)
+		if n := len(nt.free); n > 0 {
+			id, nt.free = nt.free[n-1], nt.free[:n-1]
+			nt.names[id] = name
+		} else {
+			id = uint32(len(nt.names))
+			nt.names, nt.refs, nt.in = append(nt.names, name), append(nt.refs, 0), append(nt.in, 0)
+		}
+		nt.ids[name] = id
+	}
+	nt.refs[id]++
+	if m.slot >= 0 {
+		nt.in[id] |= 1 << m.slot
+	}
+	return id
+}
+
+// unref records that m no longer has the name with id.
+func (nt *nameTable) unref(id uint32, m *memNames) {
+	nt.mu.Lock()
+	defer nt.mu.Unlock()
+	if m.slot >= 0 {
+		nt.in[id] &^= 1 << m.slot
+	}
+	if nt.refs[id]--; nt.refs[id] == 0 {
+		delete(nt.ids, nt.names[id])
+		nt.names[id], nt.in[id] = "", 0
+		nt.free = append(nt.free, id)
+	}
+}
+
+// register gives m a free slot, if there is one. Without one the policy has
+// to ask m for every name it decides, which is worth a warning.
+func (nt *nameTable) register(m *memNames) {
+	nt.mu.Lock()
+	m.slot = -1
+	for i, s := range nt.slots {
+		if s == nil {
+			nt.slots[i], m.slot = m, i
+			nt.mu.Unlock()
+			return
+		}
+	}
+	nt.mu.Unlock()
+	compLogger("sources").Warn("nameTable: no free slot, the list is asked for every name the policy decides",
+		"list", m.source, "slots", len(nt.slots))
+}
+
+// release frees the slot of m, which must not have any names.
+func (nt *nameTable) release(m *memNames) {
+	nt.mu.Lock()
+	defer nt.mu.Unlock()
+	if m.slot >= 0 {
+		nt.slots[m.slot], m.slot = nil, -1
+	}
+}
+
+// each calls fn for every indexed store that has name, with the interned
+// name and its id. fn runs with the table read-locked, so it must not change
+// a store.
+func (nt *nameTable) each(name string, fn func(m *memNames, name string, id uint32)) {
+	nt.mu.RLock()
+	defer nt.mu.RUnlock()
+	id, exist := nt.ids[name]
+	if !exist {
+		return
+	}
+	for in := nt.in[id]; in != 0; in &= in - 1 {
+		fn(nt.slots[bits.TrailingZeros64(in)], nt.names[id], id)
+	}
+}
+
+// intern returns the copy of name in the name table, or name itself if no
+// list has it. The RPZ output and the other tables keyed on the names from
+// the lists keep that copy rather than their own.
+func intern(name string) string {
+	nameTab.mu.RLock()
+	defer nameTab.mu.RUnlock()
+	if id, exist := nameTab.ids[name]; exist {
+		return nameTab.names[id]
+	}
+	return name
+}
+
+// nameEntry is what the in-memory store keeps for a name: the TapirName
+// without the name, which is in the name table, in a third of the size.
+type nameEntry struct {
+	added   int64  // TimeAdded in Unix nanoseconds, 0 if unset
+	ttl     uint32 // in seconds
+	tags    tapir.TagMask
+	numTags uint8
+	action  tapir.Action
+}
+
+func newNameEntry(tn tapir.TapirName) nameEntry {
+	e := nameEntry{ttl: uint32(tn.TTL / time.Second), tags: tn.TagMask, numTags: tn.NumTags, action: tn.Action}
+	if !tn.TimeAdded.IsZero() {
+		e.added = tn.TimeAdded.UnixNano()
+	}
+	return e
+}
+
+func (e nameEntry) tapirName(name string) tapir.TapirName {
+	tn := tapir.TapirName{Name: name, TTL: time.Duration(e.ttl) * time.Second,
+		TagMask: e.tags, NumTags: e.numTags, Action: e.action}
+	if e.added != 0 {
+		tn.TimeAdded = time.Unix(0, e.added)
+	}
+	return tn
+}
+
+// memNames is the in-memory NameStore. The names are in nameTab, which
+// indexes them under the name of the list. The ids in order of name are
+// sorted when Ascend first needs them after a name was added or deleted, so
+// paging through a list that does not change costs only the page.
+type memNames struct {
+	source string               // the name of the list
+	slot   int                  // in nameTab, -1 if it is not indexed
+	names  map[uint32]nameEntry // keyed on the id in nameTab
+
+	omu   sync.Mutex // Ascend is called by concurrent readers
+	order []uint32   // the ids in order of name, nil if it must be sorted again
+}
+
+func newMemNames(source string) *memNames {
+	m := &memNames{source: source, names: map[uint32]nameEntry{}}
+	nameTab.register(m)
+	return m
+}
+
+func (m *memNames) Get(name string) (tapir.TapirName, bool) {
+	id, exist := nameTab.id(name)
+	if !exist {
+		return tapir.TapirName{}, false
+	}
+	e, exist := m.names[id]
+	if !exist {
+		return tapir.TapirName{}, false
+	}
+	return e.tapirName(nameTab.name(id)), true
+}
+
+func (m *memNames) Put(names ...tapir.TapirName) error {
+	added := false
+	for _, tn := range names {
+		// A name that the list has is already in the index.
+		if id, exist := nameTab.id(tn.Name); exist {
+			if _, member := m.names[id]; member {
+				m.names[id] = newNameEntry(tn)
+				continue
+			}
+		}
+		m.names[nameTab.ref(tn.Name, m)] = newNameEntry(tn)
+		added = true
+	}
+	if added {
+		m.unorder()
+	}
+	return nil
+}
+
+func (m *memNames) Delete(names ...string) error {
+	deleted := false
+	for _, name := range names {
+		if id, exist := nameTab.id(name); exist {
+			if _, member := m.names[id]; member {
+				delete(m.names, id)
+				nameTab.unref(id, m)
+				deleted = true
+			}
+		}
+	}
+	if deleted {
+		m.unorder()
+	}
+	return nil
+}
+
+func (m *memNames) Len() int { return len(m.names) }
+
+func (m *memNames) Range(fn func(tapir.TapirName) bool) error {
+	for id, e := range m.names {
+		if !fn(e.tapirName(nameTab.name(id))) {
+			break
+		}
+	}
+	return nil
+}
+
+func (m *memNames) Ascend(from string, fn func(tapir.TapirName) bool) error {
+	m.omu.Lock()
+	if m.order == nil {
+		order := make([]uint32, 0, len(m.names))
+		for id := range m.names {
+			order = append(order, id)
+		}
+		nameTab.mu.RLock()
+		slices.SortFunc(order, func(a, b uint32) int {
+			return strings.Compare(nameTab.names[a], nameTab.names[b])
+		})
+		nameTab.mu.RUnlock()
+		m.order = order
+	}
+	order := m.order
+	m.omu.Unlock()
+
+	nameTab.mu.RLock()
+	start := sort.Search(len(order), func(i int) bool { return nameTab.names[order[i]] >= from })
+	nameTab.mu.RUnlock()
+	for _, id := range order[start:] {
+		if !fn(m.names[id].tapirName(nameTab.name(id))) {
+			break
+		}
+	}
+	return nil
+}
+
+// unorder drops the ids in order of name after a name was added or deleted.
+func (m *memNames) unorder() {
+	m.omu.Lock()
+	m.order = nil
+	m.omu.Unlock()
+}
+
+// clear lets go of the names.
+func (m *memNames) clear() {
+	for id := range m.names {
+		nameTab.unref(id, m)
+	}
+	clear(m.names)
+	m.unorder()
+}
+
+// Close lets go of the names and of the slot in the index. The store can
+// still be used, but it is no longer indexed.
+func (m *memNames) Close() error {
+	m.clear()
+	nameTab.release(m)
+	return nil
+}
+
+var boltBucket = []byte("names")
+
+// boltFlush is the number of pending writes that are committed together.
+const boltFlush = 10000
+
+// boltNames is the on-disk NameStore. Writes are collected and committed in
+// batches, as a transfer of an upstream RPZ puts one name at a time; Get
+// looks at the pending writes first.
+type boltNames struct {
+	db      *bolt.DB
+	mu      sync.RWMutex
+	pending map[string]*tapir.TapirName // nil for a pending delete
+	count   int                         // names in the file
+}
+
+func openBoltNames(path string) (*boltNames, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, err
+	}
+	// The file is only a cache, so it is started afresh and never synced. A
+	// file kept from the last run is not trusted to match the source: the
+	// list is loaded from its source at every start, as it is in memory.
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second, NoSync: true, NoFreelistSync: true})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltNames{db: db, pending: map[string]*tapir.TapirName{}}, nil
+}
+
+func (b *boltNames) Get(name string) (tapir.TapirName, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if tn, exist := b.pending[name]; exist {
+		if tn == nil {
+			return tapir.TapirName{}, false
+		}
+		return *tn, true
+	}
+	var tn tapir.TapirName
+	var found bool
+	b.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltBucket).Get([]byte(name)); v != nil {
+			tn, found = decodeTapirName(name, v), true
+		}
+		return nil
+	})
+	return tn, found
+}
+
+func (b *boltNames) Put(names ...tapir.TapirName) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, tn := range names {
+		b.pending[tn.Name] = &tn
+		if len(b.pending) >= boltFlush {
+			if err := b.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *boltNames) Delete(names ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, name := range names {
+		b.pending[name] = nil
+		if len(b.pending) >= boltFlush {
+			if err := b.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// flush commits the pending writes. The caller must hold b.mu.
+func (b *boltNames) flush() error {
+	if len(b.pending) == 0 {
+		return nil
+	}
+	// In key order, which is the cheapest for the B+tree.
+	keys := make([]string, 0, len(b.pending))
+	for name := range b.pending {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	count := b.count
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		for _, name := range keys {
+			tn, key := b.pending[name], []byte(name)
+			exist := bucket.Get(key) != nil
+			if tn == nil {
+				if exist {
+					count--
+					if err := bucket.Delete(key); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if !exist {
+				count++
+			}
+			if err := bucket.Put(key, encodeTapirName(*tn)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error writing %s: %v", b.db.Path(), err)
+	}
+	b.count = count
+	clear(b.pending)
+	return nil
+}
+
+func (b *boltNames) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flush()
+	return b.count
+}
+
+func (b *boltNames) Range(fn func(tapir.TapirName) bool) error {
+	b.mu.Lock()
+	err := b.flush()
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if !fn(decodeTapirName(string(k), v)) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+func (b *boltNames) Ascend(from string, fn func(tapir.TapirName) bool) error {
+	b.mu.Lock()
+	err := b.flush()
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, v := c.Seek([]byte(from)); k != nil; k, v = c.Next() {
+			if !fn(decodeTapirName(string(k), v)) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// Close closes and removes the file.
+func (b *boltNames) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	path := b.db.Path()
+	if err := b.db.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// encodeTapirName packs the fields of a TapirName, without the name, which is
+// the key. A zero TimeAdded is stored as 0.
+func encodeTapirName(tn tapir.TapirName) []byte {
+	v := make([]byte, 22)
+	if !tn.TimeAdded.IsZero() {
+		binary.BigEndian.PutUint64(v[0:], uint64(tn.TimeAdded.UnixNano()))
+	}
+	binary.BigEndian.PutUint64(v[8:], uint64(tn.TTL))
+	binary.BigEndian.PutUint32(v[16:], uint32(tn.TagMask))
+	v[20] = tn.NumTags
+	v[21] = uint8(tn.Action)
+	return v
+}
+
+func decodeTapirName(name string, v []byte) tapir.TapirName {
+	tn := tapir.TapirName{Name: name}
+	if len(v) < 22 {
+		return tn
+	}
+	if ns := int64(binary.BigEndian.Uint64(v[0:])); ns != 0 {
+		tn.TimeAdded = time.Unix(0, ns)
+	}
+	tn.TTL = time.Duration(binary.BigEndian.Uint64(v[8:]))
+	tn.TagMask = tapir.TagMask(binary.BigEndian.Uint32(v[16:]))
+	tn.NumTags = v[20]
+	tn.Action = tapir.Action(v[21])
+	return tn
+}
@@ -0,0 +1,228 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/dnstapir/tapir"
+	"github.com/spf13/viper"
+)
+
+func TestNameStores(t *testing.T) {
+	viper.Set("services.namestore.dir", t.TempDir())
+	defer viper.Set("services.namestore.dir", "")
+	added := time.Unix(1700000000, 123)
+
+	for _, store := range []string{"memory", "disk"} {
+		t.Run(store, func(t *testing.T) {
+			pl, err := newPopList(&tapir.WBGlist{Name: "feed", Type: "denylist", Names: map[string]tapir.TapirName{
+				"old.example.": {Name: "old.example."},
+			}}, store)
+			if err != nil {
+				t.Fatalf("newPopList: %v", err)
+			}
+			defer pl.Names.Close()
+			if pl.WBGlist.Names != nil {
+				t.Errorf("WBGlist.Names is still set")
+			}
+
+			// More names than are committed at once.
+			var tns []tapir.TapirName
+			for i := range boltFlush + 10 {
+				tns = append(tns, tapir.TapirName{Name: fmt.Sprintf("n%d.example.", i)})
+			}
+			full := tapir.TapirName{Name: "full.example.", TimeAdded: added, TTL: time.Hour,
+				TagMask: 5, NumTags: 2, Action: tapir.NXDOMAIN}
+			if err := pl.Names.Put(append(tns, full)...); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+			if err := pl.Names.Delete("n0.example.", "n1.example.", "nosuch.example."); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			pl.Names.Put(tapir.TapirName{Name: "n1.example."})
+
+			cases := []struct {
+				name  string
+				exist bool
+			}{
+				{name: "old.example.", exist: true},
+				{name: "n0.example."},
+				{name: "n1.example.", exist: true},
+				{name: fmt.Sprintf("n%d.example.", boltFlush+9), exist: true},
+				{name: "nosuch.example."},
+			}
+			for _, c := range cases {
+				if _, exist := pl.Names.Get(c.name); exist != c.exist {
+					t.Errorf("Get(%s): %v, want %v", c.name, exist, c.exist)
+				}
+			}
+			if got, exist := pl.Names.Get("full.example."); !exist || got.TimeAdded.UnixNano() != added.UnixNano() ||
+				got.TTL != full.TTL || got.TagMask != full.TagMask || got.NumTags != full.NumTags || got.Action != full.Action {
+				t.Errorf("Get(full.example.): %+v, want %+v", got, full)
+			}
+			want := boltFlush + 10 + 1 // n0 is gone, and old and full were added
+			if n := pl.Names.Len(); n != want {
+				t.Errorf("Len: %d, want %d", n, want)
+			}
+			n := 0
+			pl.Names.Range(func(tapir.TapirName) bool {
+				n++
+				return true
+			})
+			if n != want {
+				t.Errorf("Range: %d names, want %d", n, want)
+			}
+			var names []string
+			pl.Names.Ascend("", func(tn tapir.TapirName) bool {
+				names = append(names, tn.Name)
+				return true
+			})
+			if len(names) != want || !slices.IsSorted(names) {
+				t.Errorf("Ascend: %d names, sorted: %v, want %d sorted", len(names), slices.IsSorted(names), want)
+			}
+			pl.Names.Delete("n2.example.")
+			var first string
+			pl.Names.Ascend("n2.example.", func(tn tapir.TapirName) bool {
+				first = tn.Name
+				return false
+			})
+			if first != "n20.example." {
+				t.Errorf("Ascend after a delete starts at %s, want n20.example.", first)
+			}
+
+			if err := pl.setNames(map[string]tapir.TapirName{"new.example.": {Name: "new.example."}}); err != nil {
+				t.Fatalf("setNames: %v", err)
+			}
+			if _, exist := pl.Names.Get("old.example."); exist || pl.Names.Len() != 1 {
+				t.Errorf("setNames: %d names, old.example. kept: %v", pl.Names.Len(), exist)
+			}
+		})
+	}
+
+	if _, err := newPopList(&tapir.WBGlist{Name: "feed", Type: "denylist"}, "tape"); err == nil {
+		t.Errorf("newPopList accepted store tape")
+	}
+}
+
+// TestNameTable checks that lists share the interned copy of a name and that
+// the name is dropped from the table when the last list lets go of it.
+// newNameTable gives the test a name table of its own, with all slots of the
+// index free: the other tests do not close their lists.
+func newNameTable(t *testing.T) {
+	old := nameTab
+	nameTab = &nameTable{ids: map[string]uint32{}}
+	t.Cleanup(func() { nameTab = old })
+}
+
+func TestNameTable(t *testing.T) {
+	const name = "shared.example."
+	newNameTable(t)
+	a, b := newMemNames("a"), newMemNames("b")
+	a.Put(tapir.TapirName{Name: strings.Clone(name)})
+	b.Put(tapir.TapirName{Name: strings.Clone(name), TagMask: 3})
+	b.Put(tapir.TapirName{Name: strings.Clone(name), TagMask: 5}) // again, without another reference
+
+	id, exist := nameTab.id(name)
+	if !exist || nameTab.refs[id] != 2 || bits.OnesCount64(nameTab.in[id]) != 2 {
+		t.Fatalf("id(%s): %v, %v; want it in 2 stores", name, id, exist)
+	}
+	tna, _ := a.Get(name)
+	tnb, _ := b.Get(name)
+	if unsafe.StringData(tna.Name) != unsafe.StringData(tnb.Name) ||
+		unsafe.StringData(intern(strings.Clone(name))) != unsafe.StringData(tna.Name) {
+		t.Errorf("the lists do not share the copy of %s", name)
+	}
+	if tnb.TagMask != 5 {
+		t.Errorf("TagMask %d, want 5", tnb.TagMask)
+	}
+
+	a.Delete(name, "nosuch.example.")
+	if _, exist := nameTab.id(name); !exist {
+		t.Fatalf("%s was dropped while b has it", name)
+	}
+	pl := &PopList{WBGlist: &tapir.WBGlist{Name: "b"}, Names: b}
+	pl.setNames(map[string]tapir.TapirName{"other.example.": {Name: "other.example."}})
+	if _, exist := nameTab.id(name); exist {
+		t.Errorf("%s is still in the table", name)
+	}
+	if _, exist := b.Get("other.example."); !exist || b.Len() != 1 {
+		t.Errorf("setNames: %d names", b.Len())
+	}
+	b.Close()
+	if _, exist := nameTab.id("other.example."); exist {
+		t.Errorf("other.example. is still in the table after Close")
+	}
+}
+
+// TestNameTableFull checks that a list that gets no slot in the index is
+// logged.
+func TestNameTableFull(t *testing.T) {
+	newNameTable(t)
+	buf := captureLogs(t, "sources")
+	for i := range len(nameTab.slots) {
+		newMemNames(fmt.Sprintf("list%d", i))
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("warning while there were free slots: %s", buf)
+	}
+	m := newMemNames("extra")
+	if m.slot != -1 || !strings.Contains(buf.String(), `"list":"extra"`) {
+		t.Errorf("slot %d, log %q; want no slot and a warning for extra", m.slot, buf)
+	}
+}
+
+// TestDiskListPolicy checks that the policy sees the names of a list on disk
+// like those of one in memory, and that the file is removed at shutdown.
+func TestDiskListPolicy(t *testing.T) {
+	dir := t.TempDir()
+	viper.Set("services.namestore.dir", dir)
+	defer viper.Set("services.namestore.dir", "")
+
+	pd := newRunningTestPopData(t)
+	disk, err := newPopList(&tapir.WBGlist{Name: "big", Type: "denylist", Format: "map", Names: map[string]tapir.TapirName{
+		"big.example.": {Name: "big.example."},
+	}}, "disk")
+	if err != nil {
+		t.Fatalf("newPopList: %v", err)
+	}
+	pd.Lists["denylist"]["big"] = disk
+	if err := pd.GenerateRpzAxfr(); err != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+	if _, exist := pd.Rpz.Current().Data["big.example."]; !exist {
+		t.Errorf("big.example. is not in the RPZ")
+	}
+	if action, reason := pd.decide("big.example."); action != pd.Policy.DenylistAction || len(reason.Sources) != 1 || reason.Sources[0].Source != "big" {
+		t.Errorf("decide: %v, %+v", tapir.ActionToString[action], reason)
+	}
+
+	pd.ReaperInterval = time.Minute
+	disk.ReaperData = map[time.Time]map[string]bool{}
+	pd.mu.Lock()
+	pd.scheduleReaping(disk, "big.example.", time.Now().Add(-time.Hour))
+	pd.mu.Unlock()
+	if err := pd.Reaper(false); err != nil {
+		t.Fatalf("Reaper: %v", err)
+	}
+	if _, exist := pd.Rpz.Current().Data["big.example."]; exist {
+		t.Errorf("big.example. was not reaped")
+	}
+
+	if err := pd.closeNameStores(); err != nil {
+		t.Fatalf("closeNameStores: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "denylist-big.db")); !os.IsNotExist(err) {
+		t.Errorf("the file of the list is still there: %v", err)
+	}
+}
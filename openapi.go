@@ -0,0 +1,296 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The OpenAPI document for /api/v2 is generated from the router: every named
+// route that has an entry in apiv2Routes() is described, with its JSON
+// schemas derived from the Go types of the request and response bodies.
+
+const jsonSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// schemaGen derives JSON schemas from Go types, as encoding/json would
+// marshal them. Named struct types become definitions that are referred to
+// with refPrefix + name.
+type schemaGen struct {
+	refPrefix string
+	defs      map[string]map[string]any
+}
+
+func newSchemaGen(refPrefix string) *schemaGen {
+	return &schemaGen{refPrefix: refPrefix, defs: map[string]map[string]any{}}
+}
+
+// schemaName is the definition name of a named type: Page[main.SourceInfo]
+// becomes PageSourceInfo.
+func schemaName(t reflect.Type) string {
+	name, args, generic := strings.Cut(t.Name(), "[")
+	if !generic {
+		return name
+	}
+	for _, arg := range strings.Split(strings.TrimSuffix(args, "]"), ",") {
+		if i := strings.LastIndex(arg, "."); i >= 0 {
+			arg = arg[i+1:]
+		}
+		name += arg
+	}
+	return name
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (g *schemaGen) schema(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t == timeType {
+			return map[string]any{"type": "string", "format": "date-time"}
+		}
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		name := schemaName(t)
+		if _, exist := g.defs[name]; !exist {
+			g.defs[name] = nil // placeholder, for recursive types
+			g.defs[name] = g.object(t)
+		}
+		return map[string]any{"$ref": g.refPrefix + name}
+	default:
+		return map[string]any{}
+	}
+}
+
+// object is the schema of a struct. Fields without omitempty or omitzero are
+// required. A doc tag becomes the description of the field.
+func (g *schemaGen) object(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		prop := g.schema(f.Type)
+		if doc := f.Tag.Get("doc"); doc != "" {
+			if _, isref := prop["$ref"]; isref {
+				prop = map[string]any{"allOf": []any{prop}}
+			}
+			prop["description"] = doc
+		}
+		props[name] = prop
+		if !strings.Contains(opts, "omitempty") && !strings.Contains(opts, "omitzero") {
+			required = append(required, name)
+		}
+	}
+	return map[string]any{
+		"type":                 "object",
+		"properties":           props,
+		"required":             required,
+		"additionalProperties": false,
+	}
+}
+
+// apiSchemas returns the JSON schemas of all request and response bodies of
+// the v2 API, with references relative to refPrefix.
+func apiSchemas(refPrefix string) map[string]map[string]any {
+	g := newSchemaGen(refPrefix)
+	g.schema(reflect.TypeOf(ApiError{}))
+	for _, rt := range apiv2Routes() {
+		if rt.Request != nil {
+			g.schema(reflect.TypeOf(rt.Request))
+		}
+		if rt.Response != nil {
+			g.schema(reflect.TypeOf(rt.Response))
+		}
+	}
+	return g.defs
+}
+
+// routeVarRe matches a variable in a gorilla/mux path template, with its
+// optional pattern.
+var routeVarRe = regexp.MustCompile(`\{([^}:]+)(?::([^}]+))?\}`)
+
+// enumRe matches a route variable pattern that is a plain list of choices.
+var enumRe = regexp.MustCompile(`^[A-Za-z0-9_-]+(\|[A-Za-z0-9_-]+)*$`)
+
+// GenerateOpenAPI walks router and describes the routes it knows about.
+func GenerateOpenAPI(router *mux.Router) (map[string]any, error) {
+	routes := map[string]apiRoute{}
+	for _, rt := range apiv2Routes() {
+		routes[rt.Name] = rt
+	}
+	g := newSchemaGen("#/components/schemas/")
+	errorResponse := map[string]any{
+		"description": "Error",
+		"content": map[string]any{
+			"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(ApiError{}))},
+		},
+	}
+
+	paths := map[string]map[string]any{}
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		rt, documented := routes[route.GetName()]
+		if !documented {
+			return nil
+		}
+		tpl, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return err
+		}
+
+		var params []any
+		for _, m := range routeVarRe.FindAllStringSubmatch(tpl, -1) {
+			schema := map[string]any{"type": "string"}
+			if enumRe.MatchString(m[2]) {
+				schema["enum"] = strings.Split(m[2], "|")
+			}
+			params = append(params, map[string]any{
+				"name": m[1], "in": "path", "required": true, "schema": schema,
+			})
+		}
+		for _, q := range rt.Query {
+			params = append(params, map[string]any{
+				"name": q.Name, "in": "query", "description": q.Description,
+				"schema": map[string]any{"type": "string"},
+			})
+		}
+		path := routeVarRe.ReplaceAllString(tpl, "{$1}")
+
+		op := map[string]any{
+			"operationId":     rt.Name,
+			"summary":         rt.Summary,
+			"x-required-role": rt.role().String(),
+			"responses": map[string]any{
+				"default": errorResponse,
+			},
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		if rt.Request != nil {
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(rt.Request))},
+				},
+			}
+		}
+		ok := map[string]any{"description": "OK"}
+		if rt.Response != nil {
+			ok["content"] = map[string]any{
+				"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(rt.Response))},
+			}
+		}
+		if rt.Export != nil {
+			content := ok["content"].(map[string]any)
+			content["text/csv"] = map[string]any{"schema": map[string]any{"type": "string"}}
+			// The schema is that of each line.
+			content["application/x-ndjson"] = map[string]any{"schema": g.schema(reflect.TypeOf(rt.Export))}
+		}
+		op["responses"].(map[string]any)["200"] = ok
+
+		if paths[path] == nil {
+			paths[path] = map[string]any{}
+		}
+		for _, method := range methods {
+			paths[path][strings.ToLower(method)] = op
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]any{
+		"openapi":           "3.1.0",
+		"jsonSchemaDialect": jsonSchemaDialect,
+		"info": map[string]any{
+			"title":   "TAPIR-POP API",
+			"version": "2",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": g.defs,
+			"securitySchemes": map[string]any{
+				"apiKey":     map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"clientCert": map[string]any{"type": "mutualTLS"},
+			},
+		},
+		"security": []any{map[string]any{"apiKey": []any{}}, map[string]any{"clientCert": []any{}}},
+	}, nil
+}
+
+func APIv2openapi(router *mux.Router) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		doc, err := GenerateOpenAPI(router)
+		if err != nil {
+			apiError(w, http.StatusInternalServerError, "error generating the OpenAPI document: %v", err)
+			return
+		}
+		apiWriteJSON(w, http.StatusOK, doc)
+	}
+}
+
+func APIv2schemas(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apiWriteJSON(w, http.StatusOK, apiSchemas(""))
+	}
+}
+
+// APIv2schema returns one schema as a standalone JSON schema. Its references
+// are relative, so they resolve to the neighbouring /api/v2/schemas/{name}.
+func APIv2schema(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		schema, exist := apiSchemas("")[name]
+		if !exist {
+			apiError(w, http.StatusNotFound, "schema %q does not exist", name)
+			return
+		}
+		doc := map[string]any{"$schema": jsonSchemaDialect, "$id": name, "title": name}
+		for k, v := range schema {
+			doc[k] = v
+		}
+		apiWriteJSON(w, http.StatusOK, doc)
+	}
+}
@@ -0,0 +1,214 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/miekg/dns"
+)
+
+// Overrides are operator decisions for single names that come before all the
+// lists, for a limited time: "block this name for the next 4 hours", or
+// "allowlist this domain during the maintenance window". An override is
+// active from NotBefore until NotAfter. The Reaper decides the name again when
+// the override starts and when it ends, so that both reach the downstreams as
+// IXFRs, and forgets the overrides that have ended. The overrides are saved in
+// the list store at every change.
+
+type Override struct {
+	Name      string
+	Action    tapir.Action
+	NotBefore time.Time
+	NotAfter  time.Time
+	Comment   string
+	Caller    string // the API identity that made it
+	Created   time.Time
+}
+
+func (o Override) active(t time.Time) bool {
+	return !t.Before(o.NotBefore) && t.Before(o.NotAfter)
+}
+
+// detail describes the override for the rule that decide() reports.
+func (o Override) detail() string {
+	s := fmt.Sprintf("until %s", o.NotAfter.UTC().Format(time.RFC3339))
+	if o.Caller != "" {
+		s += ", set by " + o.Caller
+	}
+	if o.Comment != "" {
+		s += ": " + o.Comment
+	}
+	return s
+}
+
+type OverrideTable struct {
+	mu       sync.RWMutex
+	names    map[string]Override
+	schedule map[time.Time][]string // names whose override starts or ends, by reaper time slot
+	count    atomic.Int64           // len(names), so that decide() skips an empty table without the lock
+}
+
+func NewOverrideTable() *OverrideTable {
+	return &OverrideTable{
+		names:    map[string]Override{},
+		schedule: map[time.Time][]string{},
+	}
+}
+
+// Get returns the override for name, active or not. A nil table has none.
+func (ot *OverrideTable) Get(name string) (Override, bool) {
+	if ot == nil || ot.count.Load() == 0 {
+		return Override{}, false
+	}
+	ot.mu.RLock()
+	o, exist := ot.names[name]
+	ot.mu.RUnlock()
+	return o, exist
+}
+
+// active returns the override for name if it is active now.
+func (ot *OverrideTable) active(name string) (Override, bool) {
+	o, exist := ot.Get(name)
+	return o, exist && o.active(time.Now())
+}
+
+// All returns the overrides in order of name.
+func (ot *OverrideTable) All() []Override {
+	if ot == nil {
+		return nil
+	}
+	ot.mu.RLock()
+	defer ot.mu.RUnlock()
+	return slices.SortedFunc(maps.Values(ot.names), func(a, b Override) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+}
+
+// Names returns the names that have an override, in no particular order.
+func (ot *OverrideTable) Names() []string {
+	if ot == nil {
+		return nil
+	}
+	ot.mu.RLock()
+	defer ot.mu.RUnlock()
+	return slices.Collect(maps.Keys(ot.names))
+}
+
+func (ot *OverrideTable) set(o Override, slots ...time.Time) {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+	ot.names[o.Name] = o
+	ot.count.Store(int64(len(ot.names)))
+	for _, slot := range slots {
+		ot.schedule[slot] = append(ot.schedule[slot], o.Name)
+	}
+}
+
+func (ot *OverrideTable) remove(name string) bool {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+	_, exist := ot.names[name]
+	delete(ot.names, name)
+	ot.count.Store(int64(len(ot.names)))
+	return exist
+}
+
+// due returns the names whose override starts or ends at the reaper time
+// slot, or at a slot that has passed, and forgets the overrides that have
+// ended by now. A name may be returned that no longer has an override, or has
+// another one; deciding it again does no harm.
+func (ot *OverrideTable) due(slot, now time.Time) (names []string, ended int) {
+	if ot == nil {
+		return nil, 0
+	}
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+	for t, scheduled := range ot.schedule {
+		if t.After(slot) {
+			continue
+		}
+		for _, name := range scheduled {
+			if o, exist := ot.names[name]; exist && !o.NotAfter.After(now) {
+				delete(ot.names, name)
+				ended++
+			}
+		}
+		names = append(names, scheduled...)
+		delete(ot.schedule, t)
+	}
+	ot.count.Store(int64(len(ot.names)))
+	return names, ended
+}
+
+// addOverride puts o in the table, with the Reaper slots for when it starts,
+// if that is still to come, and ends.
+func (pd *PopData) addOverride(o Override, now time.Time) {
+	slots := []time.Time{pd.reaperSlot(o.NotAfter)}
+	if o.NotBefore.After(now) {
+		slots = append(slots, pd.reaperSlot(o.NotBefore))
+	}
+	pd.Overrides.set(o, slots...)
+}
+
+// SetOverride adds or replaces the override for o.Name and updates the RPZ
+// output to match. caller is the API identity that made the change, for the
+// audit log.
+func (pd *PopData) SetOverride(o Override, caller string) (RpzIxfr, error) {
+	now := time.Now()
+	o.Name = intern(dns.CanonicalName(o.Name))
+	if !o.NotAfter.After(now) || !o.NotAfter.After(o.NotBefore) {
+		return RpzIxfr{}, fmt.Errorf("override for %s: it ends before it starts, or has ended already", o.Name)
+	}
+	o.Caller, o.Created = caller, now
+	pd.addOverride(o, now)
+	pd.saveOverrides()
+
+	pd.Logger.Printf("SetOverride: %s is %s from %s until %s", o.Name, tapir.ActionToString[o.Action],
+		o.NotBefore.Format(tapir.TimeLayout), o.NotAfter.Format(tapir.TimeLayout))
+	tm := tapir.TapirMsg{Added: []tapir.Domain{{Name: o.Name}}}
+	return pd.UpdateRpz(&tm, AuditCause{Trigger: "override", Caller: caller})
+}
+
+// RemoveOverride removes the override for name before it ends and updates the
+// RPZ output to match.
+func (pd *PopData) RemoveOverride(name, caller string) (RpzIxfr, error) {
+	name = dns.CanonicalName(name)
+	if !pd.Overrides.remove(name) {
+		return RpzIxfr{}, fmt.Errorf("there is no override for %s", name)
+	}
+	pd.saveOverrides()
+
+	pd.Logger.Printf("RemoveOverride: removed the override for %s", name)
+	tm := tapir.TapirMsg{Added: []tapir.Domain{{Name: name}}}
+	return pd.UpdateRpz(&tm, AuditCause{Trigger: "override", Caller: caller})
+}
+
+func (pd *PopData) saveOverrides() {
+	if err := pd.ListStore.SaveOverrides(pd.Overrides); err != nil {
+		pd.Logger.Printf("Error saving the overrides: %v", err)
+	}
+}
+
+// restoreOverrides fills the override table from the list store, without the
+// overrides that ended while the POP was down.
+func (pd *PopData) restoreOverrides(saved []Override, now time.Time) int {
+	var n int
+	for _, o := range saved {
+		if o.NotAfter.After(now) {
+			o.Name = intern(o.Name)
+			pd.addOverride(o, now)
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/spf13/viper"
+)
+
+// newOverrideTestPopData returns a PopData with allowed.example. in the
+// allowlist and denied.example. in the denylist.
+func newOverrideTestPopData(t *testing.T) *PopData {
+	t.Helper()
+	pd := newRunningTestPopData(t)
+	pd.Lists["allowlist"]["local"] = &PopList{
+		WBGlist: &tapir.WBGlist{Name: "local", Type: "allowlist", Format: "map"},
+		Names:   newMemNames("local"),
+	}
+	pd.Lists["allowlist"]["local"].Names.Put(tapir.TapirName{Name: "allowed.example."})
+	pd.Lists["denylist"]["feed"].Names.Put(tapir.TapirName{Name: "denied.example."})
+	if err := pd.GenerateRpzAxfr(); err != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+	return pd
+}
+
+func TestOverride(t *testing.T) {
+	pd := newOverrideTestPopData(t)
+	now := time.Now()
+	for _, o := range []Override{
+		{Name: "allowed.example.", Action: tapir.NXDOMAIN, NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour)},
+		{Name: "denied.example.", Action: tapir.ALLOWLIST, NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour)},
+		{Name: "later.example.", Action: tapir.DROP, NotBefore: now.Add(time.Hour), NotAfter: now.Add(2 * time.Hour)},
+		{Name: "ended.example.", Action: tapir.DROP, NotBefore: now.Add(-2 * time.Hour), NotAfter: now.Add(-time.Hour)},
+		{Name: "unlisted.example.", Action: tapir.DROP, NotBefore: now, NotAfter: now.Add(time.Hour)},
+	} {
+		pd.addOverride(o, now)
+	}
+
+	cases := []struct {
+		name  string
+		want  tapir.Action
+		stage Stage
+	}{
+		// An override comes before the allowlist and the denylist.
+		{name: "allowed.example.", want: tapir.NXDOMAIN, stage: StageOverride},
+		{name: "denied.example.", want: tapir.ALLOWLIST, stage: StageOverride},
+		// Only while it is active.
+		{name: "later.example.", want: tapir.ALLOWLIST, stage: StageNone},
+		{name: "ended.example.", want: tapir.ALLOWLIST, stage: StageNone},
+		{name: "unlisted.example.", want: tapir.DROP, stage: StageOverride},
+	}
+	for _, c := range cases {
+		action, reason := pd.decide(c.name)
+		if action != c.want || reason.Stage != c.stage {
+			t.Errorf("%s: %s at stage %s, want %s at stage %s", c.name, tapir.ActionToString[action], reason.Stage,
+				tapir.ActionToString[c.want], c.stage)
+		}
+		if c.stage == StageOverride && (reason.Winner == nil || reason.Winner.Rule != "override") {
+			t.Errorf("%s: rules %+v", c.name, reason.Fired)
+		}
+	}
+	if report := pd.LookupReport("later.example."); !strings.Contains(report, "override DROP from") {
+		t.Errorf("LookupReport: %s", report)
+	}
+
+	// A regeneration finds the names that are only in an override.
+	if err := pd.GenerateRpzAxfr(); err != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+	snap := pd.Rpz.Current()
+	if snap.Data["unlisted.example."] != tapir.DROP || snap.Data["allowed.example."] != tapir.NXDOMAIN {
+		t.Errorf("RPZ: %v", snap.Data)
+	}
+	if _, exist := snap.Data["denied.example."]; exist {
+		t.Errorf("RPZ: denied.example. is allowlisted by an override: %v", snap.Data)
+	}
+}
+
+// TestOverrideSchedule checks that the RPZ changes, in an IXFR, when the
+// Reaper finds that an override has started or ended.
+func TestOverrideSchedule(t *testing.T) {
+	pd := newOverrideTestPopData(t)
+	now := time.Now()
+	o := Override{Name: "new.example", Action: tapir.DROP, NotBefore: now.Add(time.Hour), NotAfter: now.Add(2 * time.Hour)}
+	if _, err := pd.SetOverride(o, "test"); err != nil {
+		t.Fatalf("SetOverride: %v", err)
+	}
+	serial := pd.Rpz.Current().Serial
+	if len(pd.Overrides.schedule) != 2 {
+		t.Fatalf("schedule: %v", pd.Overrides.schedule)
+	}
+
+	// reap moves the override and its schedule back by d, as if d has
+	// passed, and runs the Reaper.
+	reap := func(d time.Duration) *RpzSnapshot {
+		pd.Overrides.mu.Lock()
+		o := pd.Overrides.names["new.example."]
+		o.NotBefore, o.NotAfter = o.NotBefore.Add(-d), o.NotAfter.Add(-d)
+		pd.Overrides.names["new.example."] = o
+		schedule := map[time.Time][]string{}
+		for slot, names := range pd.Overrides.schedule {
+			schedule[slot.Add(-d)] = names
+		}
+		pd.Overrides.schedule = schedule
+		pd.Overrides.mu.Unlock()
+		if err := pd.Reaper(false); err != nil {
+			t.Fatalf("Reaper: %v", err)
+		}
+		return pd.Rpz.Current()
+	}
+
+	snap := reap(time.Hour + time.Minute)
+	if snap.Data["new.example."] != tapir.DROP || snap.Serial != serial+1 ||
+		len(snap.IxfrChain[len(snap.IxfrChain)-1].Added) != 1 {
+		t.Fatalf("after the start: serial %d, %v", snap.Serial, snap.Data)
+	}
+	snap = reap(time.Hour)
+	if _, exist := snap.Data["new.example."]; exist || snap.Serial != serial+2 ||
+		len(snap.IxfrChain[len(snap.IxfrChain)-1].Removed) != 1 {
+		t.Errorf("after the end: serial %d, %v", snap.Serial, snap.Data)
+	}
+	if _, exist := pd.Overrides.Get("new.example."); exist || len(pd.Overrides.schedule) != 0 {
+		t.Errorf("the override was not forgotten: %v", pd.Overrides.schedule)
+	}
+}
+
+func TestOverrideStore(t *testing.T) {
+	viper.Set("services.liststore.dir", t.TempDir())
+	defer viper.Set("services.liststore.dir", "")
+	ls, err := NewListStore()
+	if err != nil {
+		t.Fatalf("NewListStore: %v", err)
+	}
+	if saved, err := ls.LoadOverrides(); saved != nil || err != nil {
+		t.Fatalf("LoadOverrides before saving: %v, %v", saved, err)
+	}
+
+	pd := newOverrideTestPopData(t)
+	pd.ListStore = ls
+	now := time.Now()
+	if _, err := pd.SetOverride(Override{Name: "kept.example.", Action: tapir.DROP, NotBefore: now,
+		NotAfter: now.Add(time.Hour), Comment: "maintenance"}, "test"); err != nil {
+		t.Fatalf("SetOverride: %v", err)
+	}
+	pd.addOverride(Override{Name: "ending.example.", Action: tapir.DROP, NotBefore: now,
+		NotAfter: now.Add(time.Minute)}, now)
+	if err := ls.SaveOverrides(pd.Overrides); err != nil {
+		t.Fatalf("SaveOverrides: %v", err)
+	}
+
+	saved, err := ls.LoadOverrides()
+	if err != nil || len(saved) != 2 {
+		t.Fatalf("LoadOverrides: %v, %v", saved, err)
+	}
+	restored := newOverrideTestPopData(t)
+	if n := restored.restoreOverrides(saved, now.Add(10*time.Minute)); n != 1 {
+		t.Errorf("restored %d overrides, want 1", n)
+	}
+	if o, exist := restored.Overrides.Get("kept.example."); !exist || o.Comment != "maintenance" ||
+		o.Caller != "test" || !o.NotAfter.Equal(now.Add(time.Hour)) {
+		t.Errorf("restored override: %+v", o)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dnstapir/tapir"
 	"github.com/spf13/viper"
@@ -33,10 +34,10 @@ type PopOutputs struct {
 }
 
 func (pd *PopData) ParseOutputs() error {
-	pd.Logger.Printf("ParseOutputs: reading outputs from %s", tapir.PopOutputsCfgFile)
-	cfgdata, err := os.ReadFile(tapir.PopOutputsCfgFile)
+	pd.Logger.Printf("ParseOutputs: reading outputs from %s", outputsCfgFile)
+	cfgdata, err := os.ReadFile(outputsCfgFile)
 	if err != nil {
-		log.Fatalf("Error from ReadFile(%s): %v", tapir.PopOutputsCfgFile, err)
+		log.Fatalf("Error from ReadFile(%s): %v", outputsCfgFile, err)
 	}
 
 	var oconf = PopOutputs{
@@ -49,6 +50,7 @@ func (pd *PopData) ParseOutputs() error {
 		log.Fatalf("Error from yaml.Unmarshal(OutputsConfig): %v", err)
 	}
 
+	pd.Outputs = oconf.Outputs
 	pd.Logger.Printf("ParseOutputs: found %d outputs", len(oconf.Outputs))
 	for name, v := range oconf.Outputs {
 		pd.Logger.Printf("ParseOutputs: output %s: type %s, format %s, downstream %s",
@@ -75,15 +77,20 @@ func (pd *PopData) ParseOutputs() error {
 			pd.Downstreams[addr] = RpzDownstream{Address: addr, Port: portInt}
 		}
 	}
-	// Read the current value of pd.Downstreams.Serial from a text file
+	return nil
+}
+
+// cachedSerial returns the RPZ serial saved in services.rpz.serialcache, or 1
+// if there is none.
+func (pd *PopData) cachedSerial() uint32 {
 	serialFile := viper.GetString("services.rpz.serialcache")
+	var serial uint32 = 1
 
 	if serialFile != "" {
 		serialFile = filepath.Clean(serialFile)
 		serialData, err := os.ReadFile(serialFile)
 		if err != nil {
 			pd.Logger.Printf("Error reading serial from file %s: %v", serialFile, err)
-			pd.Rpz.CurrentSerial = 1
 		} else {
 			var serialYaml struct {
 				CurrentSerial uint32 `yaml:"current_serial"`
@@ -91,18 +98,15 @@ func (pd *PopData) ParseOutputs() error {
 			err = yaml.Unmarshal(serialData, &serialYaml)
 			if err != nil {
 				pd.Logger.Printf("Error unmarshalling YAML serial data: %v", err)
-				pd.Rpz.CurrentSerial = 1
 			} else {
-				pd.Rpz.CurrentSerial = serialYaml.CurrentSerial
-				pd.Logger.Printf("Loaded serial %d from file %s", pd.Rpz.CurrentSerial, serialFile)
+				serial = serialYaml.CurrentSerial
+				pd.Logger.Printf("Loaded serial %d from file %s", serial, serialFile)
 			}
 		}
 	} else {
 		pd.Logger.Printf("No serial cache file specified, starting serial at 1")
-		pd.Rpz.CurrentSerial = 1
 	}
-	// pd.Rpz.CurrentSerial = pd.Downstreams.Serial
-	return nil
+	return serial
 }
 
 // ---------------------------------------------------------------------------
@@ -116,6 +120,8 @@ func (pd *PopData) ParseOutputs() error {
 //
 // Invariants (objectives a + b in the design doc; these are NOT provisional):
 //   1. Allowlist is absolute: a name on any allowlist is never in the output.
+//      Only an operator override (override.go), which comes before all the
+//      lists, can say otherwise.
 //   2. Order independence: source declaration / map iteration order must not
 //      affect the result.
 //   3. Determinism: same inputs -> same (Action, Reason).
@@ -130,6 +136,7 @@ type Stage int
 
 const (
 	StageNone Stage = iota // not in any list
+	StageOverride
 	StageAllowlist
 	StageDenylist
 	StageDoubtlist
@@ -137,6 +144,8 @@ const (
 
 func (s Stage) String() string {
 	switch s {
+	case StageOverride:
+		return "override"
 	case StageAllowlist:
 		return "allowlist"
 	case StageDenylist:
@@ -158,7 +167,7 @@ type ListHit struct {
 
 // RuleResult is the outcome of evaluating one doubtlist rule.
 type RuleResult struct {
-	Rule   string // "numsources" | "numtapirtags" | "denytapir"
+	Rule   string // "numsources" | "numtapirtags" | "denytapir" | "firstseen", or "override"
 	Fired  bool
 	Action tapir.Action
 	Detail string // human-readable explanation, e.g. "in 3 sources (limit 2)"
@@ -169,7 +178,7 @@ type Reason struct {
 	Action  tapir.Action
 	Stage   Stage
 	Sources []ListHit    // sources (of the deciding stage) that contained the name
-	Fired   []RuleResult // doubt rules that fired (only when Stage == StageDoubtlist)
+	Fired   []RuleResult // doubt rules that fired (StageDoubtlist), or the override (StageOverride)
 	Winner  *RuleResult  // the fired rule whose action was emitted (nil if none fired)
 }
 
@@ -189,25 +198,30 @@ var actionSeverity = map[tapir.Action]int{
 
 // listOf returns every source in the given class that contains name. This is
 // the single membership-lookup helper that replaces the former
-// Allowlisted/Denylisted/Doubtlisted trio. Order-independent: it scans all
-// sources and the caller does not rely on iteration order.
+// Allowlisted/Denylisted/Doubtlisted trio. Order-independent: the caller does
+// not rely on the order of the sources.
+//
+// The in-memory lists are found through the index in nameTab, so a name
+// costs the same however many sources there are. A store in the index only
+// counts while it is still the store of its list in this class: a list that
+// was replaced or removed may not have let go of its names yet. The lists
+// that are not in the index (dawg files, lists on disk, and in-memory lists
+// beyond the 64 slots of the index) are asked one by one.
 func (pd *PopData) listOf(class, name string) []ListHit {
 	var hits []ListHit
-	for src, list := range pd.Lists[class] {
-		switch list.Format {
-		case "dawg":
-			if list.Dawgf.IndexOf(name) != -1 {
-				hits = append(hits, ListHit{Source: src})
-			}
-		case "map":
-			if e, ok := list.Names[name]; ok {
-				e := e // copy; don't alias the map value
-				hits = append(hits, ListHit{Source: src, Entry: &e})
-			}
-		default:
-			// Degrade, never crash a long-running daemon on a bad list format
-			// (was log.Fatalf in the old Doubtlisted()). See issue #6.
-			pd.Logger.Printf("listOf: skipping source %q: unknown format %q", src, list.Format)
+	lists := pd.Lists[class]
+	nameTab.each(name, func(m *memNames, name string, id uint32) {
+		if list := lists[m.source]; list != nil && list.Format == "map" && list.Names == NameStore(m) {
+			e := m.names[id].tapirName(name)
+			hits = append(hits, ListHit{Source: m.source, Entry: &e})
+		}
+	})
+	for src, list := range lists {
+		if m, indexed := list.Names.(*memNames); indexed && m.slot >= 0 && m.source == src && list.Format == "map" {
+			continue
+		}
+		if hit, ok := pd.scanList(src, list, name); ok {
+			hits = append(hits, hit)
 		}
 	}
 	// Sort by source name so the result (and therefore Reason.Sources) is
@@ -217,34 +231,60 @@ func (pd *PopData) listOf(class, name string) []ListHit {
 	return hits
 }
 
+// scanList looks name up in one list, without the index.
+func (pd *PopData) scanList(src string, list *PopList, name string) (ListHit, bool) {
+	switch list.Format {
+	case "dawg":
+		if list.Dawgf.IndexOf(name) != -1 {
+			return ListHit{Source: src}, true
+		}
+	case "map":
+		if e, ok := list.Names.Get(name); ok {
+			return ListHit{Source: src, Entry: &e}, true
+		}
+	default:
+		// Degrade, never crash a long-running daemon on a bad list format
+		// (was log.Fatalf in the old Doubtlisted()). See issue #6.
+		pd.Logger.Printf("listOf: skipping source %q: unknown format %q", src, list.Format)
+	}
+	return ListHit{}, false
+}
+
+// doubtInput is what the doubtlist rules know about a name.
+type doubtInput struct {
+	hits      []ListHit // the doubtlists that have the name
+	firstSeen time.Time // zero if unknown, or if no rule needs it
+	now       time.Time
+}
+
 // doubtRule is a single pluggable doubtlist rule.
 type doubtRule struct {
 	name string
-	eval func(hits []ListHit, p DoubtlistPolicy) RuleResult
+	eval func(in doubtInput, p DoubtlistPolicy) RuleResult
 }
 
 // doubtRules is the ordered set of rules evaluated for a doubtlisted name.
-// This release ships exactly the three knobs documented in pop-policy.yaml.
+// This release ships exactly the four knobs documented in pop-policy.yaml.
 // To add a future knob, append a rule here and a test row in policy_test.go.
 var doubtRules = []doubtRule{
 	{
 		name: "numsources",
-		eval: func(hits []ListHit, p DoubtlistPolicy) RuleResult {
+		eval: func(in doubtInput, p DoubtlistPolicy) RuleResult {
 			r := RuleResult{Rule: "numsources"}
-			if len(hits) >= p.NumSources {
+			if len(in.hits) >= p.NumSources {
 				r.Fired, r.Action = true, p.NumSourcesAction
-				r.Detail = fmt.Sprintf("in %d sources (limit %d)", len(hits), p.NumSources)
+				r.Detail = fmt.Sprintf("in %d sources (limit %d)", len(in.hits), p.NumSources)
 			}
 			return r
 		},
 	},
 	{
 		name: "numtapirtags",
-		eval: func(hits []ListHit, p DoubtlistPolicy) RuleResult {
+		eval: func(in doubtInput, p DoubtlistPolicy) RuleResult {
 			// Counts tags on the dns-tapir source's entry ONLY (Q2). A future
 			// "numtags" rule could count the merged tag set across sources.
 			r := RuleResult{Rule: "numtapirtags"}
-			if e := dnsTapirEntry(hits); e != nil {
+			if e := dnsTapirEntry(in.hits); e != nil {
 				if n := e.TagMask.NumTags(); n >= p.NumTapirTags {
 					r.Fired, r.Action = true, p.NumTapirTagsAction
 					r.Detail = fmt.Sprintf("dns-tapir entry has %d tags (limit %d)", n, p.NumTapirTags)
@@ -255,7 +295,7 @@ var doubtRules = []doubtRule{
 	},
 	{
 		name: "denytapir",
-		eval: func(hits []ListHit, p DoubtlistPolicy) RuleResult {
+		eval: func(in doubtInput, p DoubtlistPolicy) RuleResult {
 			// Fires when the dns-tapir entry carries any tag in DenyTapirTags.
 			// Newly wired in: parsed from config today but never consulted.
 			// Default DenyTapirTags is empty, so this is a no-op until set.
@@ -263,13 +303,32 @@ var doubtRules = []doubtRule{
 			if p.DenyTapirTags == 0 {
 				return r
 			}
-			if e := dnsTapirEntry(hits); e != nil && e.TagMask&p.DenyTapirTags != 0 {
+			if e := dnsTapirEntry(in.hits); e != nil && e.TagMask&p.DenyTapirTags != 0 {
 				r.Fired, r.Action = true, p.DenyTapirAction
 				r.Detail = "dns-tapir entry carries a denytapir tag"
 			}
 			return r
 		},
 	},
+	{
+		name: "firstseen",
+		eval: func(in doubtInput, p DoubtlistPolicy) RuleResult {
+			// Fires while the name is new: first seen, in any list, less than
+			// FirstSeenAge ago. A name without a first-seen time (only in
+			// files and zone transfers) has no age and never fires. The
+			// Reaper decides the name again when it is no longer new.
+			r := RuleResult{Rule: "firstseen"}
+			if p.FirstSeenAge == 0 || in.firstSeen.IsZero() {
+				return r
+			}
+			if in.now.Sub(in.firstSeen) < p.FirstSeenAge {
+				r.Fired, r.Action = true, p.FirstSeenAction
+				r.Detail = fmt.Sprintf("first seen %s, less than %s ago",
+					in.firstSeen.UTC().Format(time.RFC3339), p.FirstSeenAge)
+			}
+			return r
+		},
+	},
 }
 
 // dnsTapirEntry returns the TapirName from the special "dns-tapir" source among
@@ -286,7 +345,15 @@ func dnsTapirEntry(hits []ListHit) *tapir.TapirName {
 
 // decide is the single source of truth for the policy decision on a name.
 func (pd *PopData) decide(name string) (tapir.Action, Reason) {
-	// Stage 1: allowlist is absolute (invariant 1).
+	// Stage 0: an active operator override comes before all the lists.
+	if o, active := pd.Overrides.active(name); active {
+		fired := []RuleResult{{Rule: "override", Fired: true, Action: o.Action, Detail: o.detail()}}
+		return o.Action, Reason{
+			Action: o.Action, Stage: StageOverride, Fired: fired, Winner: &fired[0],
+		}
+	}
+
+	// Stage 1: allowlist is absolute among the lists (invariant 1).
 	if hits := pd.listOf("allowlist", name); len(hits) > 0 {
 		return pd.Policy.AllowlistAction, Reason{
 			Action: pd.Policy.AllowlistAction, Stage: StageAllowlist, Sources: hits,
@@ -306,9 +373,14 @@ func (pd *PopData) decide(name string) (tapir.Action, Reason) {
 		return tapir.ALLOWLIST, Reason{Action: tapir.ALLOWLIST, Stage: StageNone}
 	}
 
+	in := doubtInput{hits: hits}
+	if pd.Policy.Doubtlist.FirstSeenAge > 0 {
+		in.firstSeen, _, _ = pd.Seen.Get(name)
+		in.now = time.Now()
+	}
 	var fired []RuleResult
 	for _, rule := range doubtRules {
-		if r := rule.eval(hits, pd.Policy.Doubtlist); r.Fired {
+		if r := rule.eval(in, pd.Policy.Doubtlist); r.Fired {
 			fired = append(fired, r)
 		}
 	}
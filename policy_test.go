@@ -28,7 +28,11 @@ package main
 // just "given these lists and this policy, expect this action".
 
 import (
+	"fmt"
 	"log"
+	"math/rand/v2"
+	"reflect"
+	"sort"
 	"strings"
 	"testing"
 
@@ -56,12 +60,12 @@ type listFixture struct {
 // fixtures. The policy mirrors the documented pop-policy.yaml template.
 func newTestPopData(policy DoubtlistPolicy, fixtures ...listFixture) *PopData {
 	pd := &PopData{
-		Lists:  map[string]map[string]*tapir.WBGlist{},
+		Lists:  map[string]map[string]*PopList{},
 		Logger: log.Default(),
 	}
-	pd.Lists["allowlist"] = map[string]*tapir.WBGlist{}
-	pd.Lists["denylist"] = map[string]*tapir.WBGlist{}
-	pd.Lists["doubtlist"] = map[string]*tapir.WBGlist{}
+	pd.Lists["allowlist"] = map[string]*PopList{}
+	pd.Lists["denylist"] = map[string]*PopList{}
+	pd.Lists["doubtlist"] = map[string]*PopList{}
 
 	pd.Policy = PopPolicy{
 		Logger:          log.Default(),
@@ -71,15 +75,15 @@ func newTestPopData(policy DoubtlistPolicy, fixtures ...listFixture) *PopData {
 	}
 
 	for _, f := range fixtures {
-		names := map[string]tapir.TapirName{}
-		for _, n := range f.names {
-			names[n.Name] = n
-		}
-		pd.Lists[f.class][f.source] = &tapir.WBGlist{
-			Name:   f.source,
-			Type:   f.class,
-			Format: "map",
-			Names:  names,
+		names := newMemNames(f.source)
+		names.Put(f.names...)
+		pd.Lists[f.class][f.source] = &PopList{
+			WBGlist: &tapir.WBGlist{
+				Name:   f.source,
+				Type:   f.class,
+				Format: "map",
+			},
+			Names: names,
 		}
 	}
 	return pd
@@ -315,3 +319,131 @@ func TestDecideDeterminism(t *testing.T) {
 		}
 	}
 }
+
+// --- TestListIndex ---------------------------------------------------------
+//
+// listOf finds the in-memory lists of a name through the index in nameTab.
+// This test changes the lists at random in every way the POP does (updates,
+// deletes, reloads, lists replaced or removed, with or without letting go of
+// their names) and checks after every step that the index gives exactly what
+// asking every list gives.
+
+// scanListOf is listOf without the index.
+func scanListOf(pd *PopData, class, name string) []ListHit {
+	var hits []ListHit
+	for src, list := range pd.Lists[class] {
+		if hit, ok := pd.scanList(src, list, name); ok {
+			hits = append(hits, hit)
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].Source < hits[j].Source })
+	return hits
+}
+
+func TestListIndex(t *testing.T) {
+	newNameTable(t)
+	pd := newTestPopData(defaultDoubtPolicy())
+	rnd := rand.New(rand.NewPCG(1, 2))
+	classes := []string{"allowlist", "denylist", "doubtlist"}
+	sources := []string{"dns-tapir", "feed", "local", "other"}
+	name := func() string { return fmt.Sprintf("n%d.example.", rnd.IntN(40)) }
+	entry := func() tapir.TapirName {
+		return tn(name(), tapir.TagMask(rnd.IntN(1<<6)), tapir.Action(rnd.IntN(2)))
+	}
+	newList := func(class, src string) *PopList {
+		return &PopList{WBGlist: &tapir.WBGlist{Name: src, Type: class, Format: "map"}, Names: newMemNames(src)}
+	}
+
+	// A list that is replaced or removed is closed now or a bit later.
+	var stale []NameStore
+	retire := func(list *PopList) {
+		if rnd.IntN(2) == 0 {
+			list.Names.Close()
+			return
+		}
+		if stale = append(stale, list.Names); len(stale) > 16 {
+			stale[0].Close()
+			stale = stale[1:]
+		}
+	}
+
+	for step := range 3000 {
+		class, src := classes[rnd.IntN(len(classes))], sources[rnd.IntN(len(sources))]
+		list := pd.Lists[class][src]
+		op := "put"
+		switch {
+		case list == nil || rnd.IntN(100) < 3:
+			op = "add"
+			if list != nil {
+				retire(list)
+				op = "replace"
+			}
+			list = newList(class, src)
+			if list.Names.(*memNames).slot < 0 {
+				t.Fatalf("step %d: no free slot in the index", step)
+			}
+			pd.Lists[class][src] = list
+		case rnd.IntN(100) < 2:
+			delete(pd.Lists[class], src)
+			retire(list)
+			op = "remove"
+		case rnd.IntN(100) < 3:
+			names := map[string]tapir.TapirName{}
+			for range rnd.IntN(10) {
+				e := entry()
+				names[e.Name] = e
+			}
+			list.setNames(names)
+			op = "reload"
+		case rnd.IntN(3) == 0:
+			list.Names.Delete(name())
+			op = "delete"
+		}
+		list.Names.Put(entry())
+
+		for i := range 40 {
+			q := fmt.Sprintf("n%d.example.", i)
+			for _, class := range classes {
+				if got, want := pd.listOf(class, q), scanListOf(pd, class, q); !reflect.DeepEqual(got, want) {
+					t.Fatalf("step %d (%s %s/%s): listOf(%s, %s) = %v, want %v",
+						step, op, class, src, class, q, got, want)
+				}
+			}
+		}
+	}
+}
+
+// BenchmarkListOf compares the lookups of decide() with the index to a scan
+// of every list, as the number of doubtlists grows. A name is in two of them.
+func BenchmarkListOf(b *testing.B) {
+	for _, n := range []int{4, 16, 64} {
+		old := nameTab
+		nameTab = &nameTable{ids: map[string]uint32{}}
+		pd := newTestPopData(defaultDoubtPolicy())
+		for i := range n {
+			src := fmt.Sprintf("src%d", i)
+			list := &PopList{WBGlist: &tapir.WBGlist{Name: src, Type: "doubtlist", Format: "map"}, Names: newMemNames(src)}
+			for j := range 1000 {
+				if j%n == i || j%n == (i+1)%n {
+					list.Names.Put(tn(fmt.Sprintf("n%d.example.", j), 0, 0))
+				}
+			}
+			pd.Lists["doubtlist"][src] = list
+		}
+		b.Run(fmt.Sprintf("sources=%d/index", n), func(b *testing.B) {
+			for i := 0; b.Loop(); i++ {
+				for _, class := range []string{"allowlist", "denylist", "doubtlist"} {
+					pd.listOf(class, fmt.Sprintf("n%d.example.", i%1000))
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("sources=%d/scan", n), func(b *testing.B) {
+			for i := 0; b.Loop(); i++ {
+				for _, class := range []string{"allowlist", "denylist", "doubtlist"} {
+					scanListOf(pd, class, fmt.Sprintf("n%d.example.", i%1000))
+				}
+			}
+		})
+		nameTab = old
+	}
+}
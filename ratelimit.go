@@ -0,0 +1,277 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// Abuse protection for the DNS engine. Every client gets a token bucket per
+// class of request (queries, NOTIFYs and zone transfers), the number of
+// concurrent outbound transfers is capped, and a zone only has one
+// NOTIFY-triggered refresh queued for the RefreshEngine at a time.
+
+type requestClass int
+
+const (
+	classQuery requestClass = iota
+	classNotify
+	classXfr
+	numRequestClasses
+)
+
+var requestClassToString = [numRequestClasses]string{"query", "notify", "xfr"}
+
+// Defaults for dnsengine.ratelimit.<class>.rate and burst, and for
+// dnsengine.maxtransfers.
+var defaultRateLimits = [numRequestClasses]rateLimit{
+	classQuery:  {Rate: 100, Burst: 200},
+	classNotify: {Rate: 1, Burst: 10},
+	classXfr:    {Rate: 0.5, Burst: 10},
+}
+
+const defaultMaxTransfers = 10
+
+// limiterMaxClients is the number of clients tracked per class. When a new
+// client comes along, the buckets that have filled up again are forgotten,
+// or else the one that was used longest ago.
+const limiterMaxClients = 10000
+
+type rateLimit struct {
+	Rate  float64 // tokens per second
+	Burst float64 // size of the bucket
+}
+
+type tokenBucket struct {
+	client  netip.Addr
+	tokens  float64
+	last    time.Time
+	limited bool // the last request was refused, so the next refusal is not logged
+}
+
+// clientLimiter is the set of token buckets for one class of requests. The
+// buckets are kept in order of use, so that a flood of new (possibly spoofed)
+// clients costs the same for every request and never more memory than
+// limiterMaxClients buckets.
+type clientLimiter struct {
+	limit   rateLimit
+	mu      sync.Mutex
+	clients map[netip.Addr]*list.Element // of *tokenBucket
+	recent  *list.List                   // the buckets, most recently used first
+}
+
+func newClientLimiter(limit rateLimit) *clientLimiter {
+	return &clientLimiter{limit: limit, clients: map[netip.Addr]*list.Element{}, recent: list.New()}
+}
+
+// allow takes a token from the bucket of client, if there is one. first is
+// true for the first refusal after a request was allowed.
+func (cl *clientLimiter) allow(client netip.Addr, now time.Time) (ok, first bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	e, exist := cl.clients[client]
+	if exist {
+		cl.recent.MoveToFront(e)
+	} else {
+		if len(cl.clients) >= limiterMaxClients {
+			cl.prune(now)
+		}
+		e = cl.recent.PushFront(&tokenBucket{client: client, tokens: cl.limit.Burst, last: now})
+		cl.clients[client] = e
+	}
+	b := e.Value.(*tokenBucket)
+	b.tokens = min(cl.limit.Burst, b.tokens+now.Sub(b.last).Seconds()*cl.limit.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		first = !b.limited
+		b.limited = true
+		return false, first
+	}
+	b.tokens--
+	b.limited = false
+	return true, false
+}
+
+// prune forgets the clients whose buckets are full again, as a new bucket
+// would be. They are the least recently used ones, so it stops at the first
+// bucket that is not full. If there is still no room for a new client, the
+// least recently used one is forgotten anyway. Every bucket is forgotten at
+// most once, so the cost per request is constant.
+func (cl *clientLimiter) prune(now time.Time) {
+	refill := time.Duration(cl.limit.Burst / cl.limit.Rate * float64(time.Second))
+	for e := cl.recent.Back(); e != nil; e = cl.recent.Back() {
+		b := e.Value.(*tokenBucket)
+		if now.Sub(b.last) < refill && len(cl.clients) < limiterMaxClients {
+			return
+		}
+		cl.recent.Remove(e)
+		delete(cl.clients, b.client)
+		if now.Sub(b.last) < refill {
+			return // the oldest, to make room
+		}
+	}
+}
+
+// DnsLimits holds the abuse protection state of the DNS engine. A nil
+// *DnsLimits allows everything and deduplicates nothing.
+type DnsLimits struct {
+	Active    bool
+	Exempt    []netip.Prefix // clients that are never rate limited, e.g. our downstreams
+	classes   [numRequestClasses]*clientLimiter
+	transfers chan struct{} // semaphore for the outbound transfers
+	draining  atomic.Bool   // no new transfers, we are shutting down
+
+	mu      sync.Mutex
+	pending map[string]bool // zones with a NOTIFY-triggered refresh queued
+}
+
+// NewDnsLimits reads dnsengine.ratelimit and dnsengine.maxtransfers. Rate
+// limiting is on unless dnsengine.ratelimit.active is false; the cap on
+// concurrent transfers and the NOTIFY deduplication always apply.
+func NewDnsLimits() (*DnsLimits, error) {
+	dl := &DnsLimits{
+		Active:  !viper.IsSet("dnsengine.ratelimit.active") || viper.GetBool("dnsengine.ratelimit.active"),
+		pending: map[string]bool{},
+	}
+	exempt, err := parsePrefixes(viper.GetStringSlice("dnsengine.ratelimit.exempt"))
+	if err != nil {
+		return nil, fmt.Errorf("dnsengine.ratelimit.exempt: %v", err)
+	}
+	dl.Exempt = exempt
+
+	for class, name := range requestClassToString {
+		limit := defaultRateLimits[class]
+		key := "dnsengine.ratelimit." + name
+		if viper.IsSet(key + ".rate") {
+			limit.Rate = viper.GetFloat64(key + ".rate")
+		}
+		if viper.IsSet(key + ".burst") {
+			limit.Burst = viper.GetFloat64(key + ".burst")
+		}
+		if limit.Rate <= 0 || limit.Burst < 1 {
+			return nil, fmt.Errorf("%s: rate must be positive and burst at least 1 (rate %v, burst %v)",
+				key, limit.Rate, limit.Burst)
+		}
+		dl.classes[class] = newClientLimiter(limit)
+	}
+
+	maxtransfers := defaultMaxTransfers
+	if viper.IsSet("dnsengine.maxtransfers") {
+		maxtransfers = viper.GetInt("dnsengine.maxtransfers")
+	}
+	if maxtransfers < 1 {
+		return nil, fmt.Errorf("dnsengine.maxtransfers must be at least 1, not %d", maxtransfers)
+	}
+	dl.transfers = make(chan struct{}, maxtransfers)
+	return dl, nil
+}
+
+// classify returns the class of the request r, which has passed checkQuery.
+func classify(r *dns.Msg) requestClass {
+	switch {
+	case r.Opcode == dns.OpcodeNotify:
+		return classNotify
+	case r.Question[0].Qtype == dns.TypeAXFR || r.Question[0].Qtype == dns.TypeIXFR:
+		return classXfr
+	}
+	return classQuery
+}
+
+// Allow reports whether the client at addr may make a request of class.
+func (dl *DnsLimits) Allow(class requestClass, addr net.Addr, lg *slog.Logger) bool {
+	if dl == nil || !dl.Active {
+		return true
+	}
+	ip, ok := clientAddr(addr)
+	if !ok || prefixesContain(dl.Exempt, ip) {
+		return true
+	}
+	client := ip
+	if ip.Is6() {
+		// A single IPv6 client usually has a whole /64 to pick from.
+		client = netip.PrefixFrom(ip, 64).Masked().Addr()
+	}
+	ok, first := dl.classes[class].allow(client, time.Now())
+	if first {
+		lg.Info("DnsLimits: rate limiting the client", "class", requestClassToString[class], "client", client)
+	}
+	return ok
+}
+
+// startTransfer claims one of the outbound transfer slots and reports
+// whether there was one free. Each successful call must be followed by a
+// call to endTransfer.
+func (dl *DnsLimits) startTransfer() bool {
+	if dl == nil {
+		return true
+	}
+	if dl.draining.Load() {
+		return false
+	}
+	select {
+	case dl.transfers <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (dl *DnsLimits) endTransfer() {
+	if dl == nil {
+		return
+	}
+	<-dl.transfers
+}
+
+// drain stops new transfers and waits for the ones in progress to finish, or
+// for ctx to be done. It is the first thing to happen at shutdown.
+func (dl *DnsLimits) drain(ctx context.Context) error {
+	dl.draining.Store(true)
+	for range cap(dl.transfers) {
+		select {
+		case dl.transfers <- struct{}{}:
+		case <-ctx.Done():
+			return fmt.Errorf("transfers still in progress: %v", ctx.Err())
+		}
+	}
+	return nil
+}
+
+// queueRefresh reports whether a NOTIFY-triggered refresh of zone should be
+// queued, i.e. whether there is not one queued already. The RefreshEngine
+// calls refreshDone when it picks up the refresh.
+func (dl *DnsLimits) queueRefresh(zone string) bool {
+	if dl == nil {
+		return true
+	}
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	if dl.pending[zone] {
+		return false
+	}
+	dl.pending[zone] = true
+	return true
+}
+
+func (dl *DnsLimits) refreshDone(zone string) {
+	if dl == nil {
+		return
+	}
+	dl.mu.Lock()
+	delete(dl.pending, zone)
+	dl.mu.Unlock()
+}
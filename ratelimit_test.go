@@ -0,0 +1,190 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/miekg/dns"
+)
+
+func TestClientLimiter(t *testing.T) {
+	cl := newClientLimiter(rateLimit{Rate: 2, Burst: 3})
+	a, b := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	t0 := time.Now()
+
+	steps := []struct {
+		client    netip.Addr
+		at        time.Duration
+		ok, first bool
+	}{
+		{client: a, ok: true},
+		{client: a, ok: true},
+		{client: a, ok: true},
+		{client: a, ok: false, first: true}, // burst used up
+		{client: a, ok: false},              // refusal already logged
+		{client: b, ok: true},               // buckets are per client
+		{client: a, at: 400 * time.Millisecond, ok: false},
+		{client: a, at: 500 * time.Millisecond, ok: true}, // one token back at 2/s
+		{client: a, at: 500 * time.Millisecond, ok: false, first: true},
+		{client: a, at: time.Hour, ok: true}, // never more than the burst
+		{client: a, at: time.Hour, ok: true},
+		{client: a, at: time.Hour, ok: true},
+		{client: a, at: time.Hour, ok: false, first: true},
+	}
+	for i, s := range steps {
+		ok, first := cl.allow(s.client, t0.Add(s.at))
+		if ok != s.ok || first != s.first {
+			t.Errorf("step %d: allow(%s, +%v) = %v, %v; want %v, %v", i, s.client, s.at, ok, first, s.ok, s.first)
+		}
+	}
+
+	cl.prune(t0.Add(time.Hour + time.Second))
+	if len(cl.clients) != 1 {
+		t.Errorf("%d clients after prune, want 1 (%s has an empty bucket)", len(cl.clients), a)
+	}
+}
+
+// TestClientLimiterFlood checks that a flood of new clients, none of whose
+// buckets have filled up again, does not grow the limiter beyond
+// limiterMaxClients: the least recently used clients make room.
+func TestClientLimiterFlood(t *testing.T) {
+	cl := newClientLimiter(rateLimit{Rate: 0.001, Burst: 2})
+	t0 := time.Now()
+	steady := netip.MustParseAddr("198.51.100.1")
+	for i := range 3 * limiterMaxClients {
+		now := t0.Add(time.Duration(i) * time.Microsecond)
+		cl.allow(netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)}), now)
+		cl.allow(steady, now)
+	}
+	if len(cl.clients) != limiterMaxClients || cl.recent.Len() != limiterMaxClients {
+		t.Errorf("%d clients (%d in use order), want %d", len(cl.clients), cl.recent.Len(), limiterMaxClients)
+	}
+	if _, exist := cl.clients[steady]; !exist {
+		t.Errorf("the client in steady use was forgotten")
+	}
+	if _, exist := cl.clients[netip.AddrFrom4([4]byte{10, 0, 0, 0})]; exist {
+		t.Errorf("the first client of the flood is still there")
+	}
+}
+
+func newTestDnsLimits(t *testing.T, maxtransfers int, exempt ...string) *DnsLimits {
+	t.Helper()
+	prefixes, err := parsePrefixes(exempt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl := &DnsLimits{
+		Active:    true,
+		Exempt:    prefixes,
+		transfers: make(chan struct{}, maxtransfers),
+		pending:   map[string]bool{},
+	}
+	for class := range dl.classes {
+		dl.classes[class] = newClientLimiter(rateLimit{Rate: 0.001, Burst: 2})
+	}
+	return dl
+}
+
+func TestDnsLimits(t *testing.T) {
+	dl := newTestDnsLimits(t, 2, "198.51.100.0/24")
+	allowed := func(class requestClass, addr string) int {
+		n := 0
+		for range 5 {
+			if dl.Allow(class, &net.UDPAddr{IP: net.ParseIP(addr), Port: 5300}, compLogger("dnsengine")) {
+				n++
+			}
+		}
+		return n
+	}
+
+	cases := []struct {
+		name  string
+		class requestClass
+		addr  string
+		want  int
+	}{
+		{name: "query", class: classQuery, addr: "192.0.2.1", want: 2},
+		{name: "xfr_separate_bucket", class: classXfr, addr: "192.0.2.1", want: 2},
+		{name: "exempt", class: classQuery, addr: "198.51.100.7", want: 5},
+		{name: "ipv6_64", class: classQuery, addr: "2001:db8::1", want: 2},
+		{name: "ipv6_same_64", class: classQuery, addr: "2001:db8::2", want: 0},
+		{name: "ipv6_other_64", class: classQuery, addr: "2001:db8:0:1::1", want: 2},
+		{name: "mapped_ipv4", class: classQuery, addr: "::ffff:192.0.2.1", want: 0},
+	}
+	for _, c := range cases {
+		if got := allowed(c.class, c.addr); got != c.want {
+			t.Errorf("%s: %d of 5 requests from %s allowed, want %d", c.name, got, c.addr, c.want)
+		}
+	}
+
+	if !dl.startTransfer() || !dl.startTransfer() || dl.startTransfer() {
+		t.Errorf("transfer slots: want 2")
+	}
+	dl.endTransfer()
+	if !dl.startTransfer() {
+		t.Errorf("no transfer slot after endTransfer")
+	}
+
+	if !dl.queueRefresh("a.") || dl.queueRefresh("a.") || !dl.queueRefresh("b.") {
+		t.Errorf("queueRefresh does not deduplicate per zone")
+	}
+	dl.refreshDone("a.")
+	if !dl.queueRefresh("a.") {
+		t.Errorf("queueRefresh after refreshDone refused")
+	}
+}
+
+// TestNotifyFlood checks that a burst of NOTIFYs for an upstream zone queues a
+// single refresh and never blocks the handler.
+func TestNotifyFlood(t *testing.T) {
+	pd := newXfrTestPopData()
+	pd.Limits = newTestDnsLimits(t, 1)
+	pd.Limits.classes[classNotify] = newClientLimiter(rateLimit{Rate: 1, Burst: 100})
+	pd.RpzRefreshCh = make(chan RpzRefresh, 1)
+	pd.RpzSources = map[string]*tapir.ZoneData{"upstream.test.": {ZoneName: "upstream.test.", ZoneType: tapir.RpzZone}}
+
+	conf := &Config{PopData: pd}
+	handler := createHandler(conf)
+
+	notify := func(zone, addr string) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetNotify(zone)
+		w := &xfrRecorder{remote: &net.UDPAddr{IP: net.ParseIP(addr), Port: 5300}}
+		handler(w, r)
+		if len(w.msgs) != 1 {
+			t.Fatalf("%d responses to NOTIFY, want 1", len(w.msgs))
+		}
+		return w.msgs[0]
+	}
+
+	for range 20 {
+		if m := notify("upstream.test.", "192.0.2.1"); m.Rcode != dns.RcodeSuccess {
+			t.Fatalf("NOTIFY answered with %s", dns.RcodeToString[m.Rcode])
+		}
+	}
+	if n := len(pd.RpzRefreshCh); n != 1 {
+		t.Errorf("%d refreshes queued, want 1", n)
+	}
+
+	// Once the RefreshEngine has picked it up, the next NOTIFY queues again.
+	zr := <-pd.RpzRefreshCh
+	pd.Limits.refreshDone(zr.Name)
+	notify("upstream.test.", "192.0.2.1")
+	if n := len(pd.RpzRefreshCh); n != 1 {
+		t.Errorf("%d refreshes queued after refreshDone, want 1", n)
+	}
+
+	// A client over its NOTIFY limit is refused.
+	pd.Limits.classes[classNotify] = newClientLimiter(rateLimit{Rate: 0.001, Burst: 1})
+	notify("upstream.test.", "192.0.2.9")
+	if m := notify("upstream.test.", "192.0.2.9"); m.Rcode != dns.RcodeRefused {
+		t.Errorf("NOTIFY over the limit answered with %s, want REFUSED", dns.RcodeToString[m.Rcode])
+	}
+}
@@ -11,6 +11,37 @@ import (
 
 // type WBGC map[string]*tapir.WBGlist
 
+// scheduleReaping arranges for the Reaper to remove name from wbgl once it
+// expires, replacing any earlier removal. The caller must hold pd.mu.
+func (pd *PopData) scheduleReaping(wbgl *PopList, name string, expires time.Time) {
+	reptime := pd.reaperSlot(expires)
+
+	// Ensure that there are no prior removal events for this name
+	for reaperTime, namesMap := range wbgl.ReaperData {
+		if reaperTime.Before(reptime) {
+			if _, exists := namesMap[name]; exists {
+				delete(namesMap, name)
+				if len(namesMap) == 0 {
+					delete(wbgl.ReaperData, reaperTime)
+				}
+			}
+		}
+	}
+
+	// Add the name to the removal list for the time it will be removed
+	if wbgl.ReaperData[reptime] == nil {
+		wbgl.ReaperData[reptime] = make(map[string]bool)
+	}
+	wbgl.ReaperData[reptime][intern(name)] = true
+}
+
+// reaperSlot returns the time slot of the Reaper that handles what happens at
+// t: the first one after it, so that it is at least ReaperInterval into the
+// future.
+func (pd *PopData) reaperSlot(t time.Time) time.Time {
+	return t.Truncate(pd.ReaperInterval).Add(pd.ReaperInterval)
+}
+
 // 1. Iterate over all lists
 // 2. Delete all items from the list that is in the ReaperData bucket for this time slot
 // 3. Delete the bucket from the ReaperData map
@@ -21,6 +52,7 @@ func (pd *PopData) Reaper(full bool) error {
 	// tpkg := tapir.MqttPkgIn{}
 	tm := tapir.TapirMsg{}
 	pd.Logger.Printf("Reaper: working on time slot %s across all lists", timekey.Format(tapir.TimeLayout))
+	pd.mu.Lock()
 	for _, listtype := range []string{"allowlist", "doubtlist", "denylist"} {
 		for listname, wbgl := range pd.Lists[listtype] {
 			// This loop is here to ensure that we don't have any old data in the ReaperData bucket
@@ -32,7 +64,6 @@ func (pd *PopData) Reaper(full bool) error {
 					}
 
 					pd.Logger.Printf("Reaper: Warning: found old reaperdata for time slot %s (that has already passed). Moving %d names to current time slot (%s)", t.Format(tapir.TimeLayout), len(d), timekey.Format(tapir.TimeLayout))
-					pd.mu.Lock()
 					if _, exist := wbgl.ReaperData[timekey]; !exist {
 						wbgl.ReaperData[timekey] = map[string]bool{}
 					}
@@ -41,17 +72,17 @@ func (pd *PopData) Reaper(full bool) error {
 					}
 					// wbgl.ReaperData[timekey] = d
 					delete(wbgl.ReaperData, t)
-					pd.mu.Unlock()
 				}
 			}
 			// pd.Logger.Printf("Reaper: working on %s %s", listtype, listname)
 			if len(wbgl.ReaperData[timekey]) > 0 {
 				pd.Logger.Printf("Reaper: list [%s][%s] has %d timekeys stored", listtype, listname,
 					len(wbgl.ReaperData[timekey]))
-				pd.mu.Lock()
 				for name := range wbgl.ReaperData[timekey] {
 					pd.Logger.Printf("Reaper: removing %s from %s %s", name, listtype, listname)
-					delete(pd.Lists[listtype][listname].Names, name)
+					if err := wbgl.Names.Delete(name); err != nil {
+						pd.Logger.Printf("Reaper: Error removing %s from %s %s: %v", name, listtype, listname, err)
+					}
 					delete(wbgl.ReaperData[timekey], name)
 					tm.Removed = append(tm.Removed, tapir.Domain{Name: name})
 				}
@@ -60,19 +91,39 @@ func (pd *PopData) Reaper(full bool) error {
 				// 	pd.Logger.Printf("Reaper: remaining: key: %s name: %s", name, item.Name)
 				// }
 				delete(wbgl.ReaperData, timekey)
-				pd.mu.Unlock()
 			}
 		}
 	}
+	pd.mu.Unlock()
 
-	if len(tm.Removed) > 0 {
-		ixfr, err := pd.GenerateRpzIxfr(&tm)
-		if err != nil {
-			pd.Logger.Printf("Reaper: Error from GenerateRpzIxfr(): %v", err)
-		}
-		err = pd.ProcessIxfrIntoAxfr(ixfr)
+	// The names that are no longer new are decided again, as if added.
+	for _, name := range pd.Seen.due(timekey) {
+		tm.Added = append(tm.Added, tapir.Domain{Name: name})
+	}
+	// So are the names whose override starts or ends.
+	names, ended := pd.Overrides.due(timekey, time.Now())
+	for _, name := range names {
+		tm.Added = append(tm.Added, tapir.Domain{Name: name})
+	}
+	if ended > 0 {
+		pd.Logger.Printf("Reaper: %d overrides have ended", ended)
+		pd.saveOverrides()
+	}
+	// A name is kept while any list has it, whatever store the list uses.
+	// The sweep holds the lock of the seen table, which comes after pd.mu.
+	pd.mu.RLock()
+	n := pd.Seen.sweep(time.Now(), func(name string) bool {
+		return pd.Allowlisted(name) || pd.Denylisted(name) || pd.Doubtlisted(name)
+	})
+	pd.mu.RUnlock()
+	if n > 0 {
+		pd.Logger.Printf("Reaper: forgot %d names that have not been seen for %v", n, pd.Seen.retention)
+	}
+
+	if len(tm.Removed) > 0 || len(tm.Added) > 0 {
+		_, err := pd.UpdateRpz(&tm, AuditCause{Trigger: "reaper"})
 		if err != nil {
-			pd.Logger.Printf("Reaper: Error from ProcessIxfrIntoAxfr(): %v", err)
+			pd.Logger.Printf("Reaper: Error from UpdateRpz(): %v", err)
 		}
 	}
 	return nil
@@ -6,7 +6,6 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net"
 	"strconv"
 	"strings"
@@ -24,6 +23,7 @@ type RpzRefresh struct {
 	//	RRKeepFunc  func(uint16) bool
 	RRParseFunc func(*dns.RR, *tapir.ZoneData) bool
 	ZoneType    tapir.ZoneType // 1=xfr, 2=map, 3=slice
+	Xot         bool           // transfer from Upstream over TLS
 	Resp        chan RpzRefreshResult
 }
 
@@ -33,6 +33,14 @@ type RpzRefreshResult struct {
 	ErrorMsg string
 }
 
+// respond sends res to the requester, if it waits for one. NOTIFY-triggered
+// refreshes have no Resp channel.
+func (zr RpzRefresh) respond(res RpzRefreshResult) {
+	if zr.Resp != nil {
+		zr.Resp <- res
+	}
+}
+
 type RefreshCounter struct {
 	Name           string
 	SOARefresh     uint32
@@ -41,11 +49,13 @@ type RefreshCounter struct {
 	//	RRKeepFunc     func(uint16) bool
 	RRParseFunc func(*dns.RR, *tapir.ZoneData) bool
 	Upstream    string
+	Xot         bool
 	Downstreams []string
 }
 
 func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 
+	lg := compLogger("sources")
 	var ObservationsCh = pd.TapirObservations
 
 	var zonerefch = pd.RpzRefreshCh
@@ -62,14 +72,26 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 		reaperTicker.Reset(pd.ReaperInterval)
 	}()
 
+	// The systemd watchdog is pinged while this loop ticks or transfers a
+	// zone, so a RefreshEngine that is stuck gets the POP restarted.
+	go newSdWatchdog().run(pd.Health.Running, stopch)
+	var status string
+
 	if !viper.GetBool("services.refreshengine.active") {
-		log.Printf("Refresh Engine is NOT active. Zones will only be updated on receipt on Notifies.")
-		for range zonerefch {
-			// ensure that we keep reading to keep the channel open
-			continue
+		lg.Info("RefreshEngine: not active, zones are only updated on receipt of NOTIFY")
+		for {
+			select {
+			case zr := <-zonerefch:
+				// ensure that we keep reading to keep the channel open
+				pd.Limits.refreshDone(zr.Name)
+			case now := <-refreshTicker.C:
+				pd.Health.Tick(now)
+			case <-stopch:
+				return
+			}
 		}
 	} else {
-		log.Printf("RefreshEngine: Starting")
+		lg.Info("RefreshEngine: starting")
 	}
 
 	var upstream, zone string
@@ -92,28 +114,28 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 			tm := tapir.TapirMsg{}
 			err := json.Unmarshal(tpkg.Payload, &tm)
 			if err != nil {
-				log.Printf("RefreshEngine: Error unmarshalling TapirMsg: %v", err)
+				lg.Error("RefreshEngine: cannot unmarshal the TapirMsg", "error", err)
 				continue
 			}
 			switch tm.MsgType {
 			case "observation", "intel-update":
-				log.Printf("RefreshEngine: Tapir Observation update: (src: %s) %d additions and %d removals\n",
-					tm.SrcName, len(tm.Added), len(tm.Removed))
-				_, err := pd.ProcessTapirUpdate(tm)
+				lg.Info("RefreshEngine: TAPIR observation update", "source", tm.SrcName,
+					"added", len(tm.Added), "removed", len(tm.Removed))
+				_, err := pd.ProcessTapirUpdate(tm, mqttMsgId(tpkg.Payload))
 				if err != nil {
 					Gconfig.Internal.ComponentStatusCh <- tapir.ComponentStatusUpdate{
 						Status:    tapir.StatusFail,
 						Component: "tapir-observation",
 						Msg:       fmt.Sprintf("ProcessTapirUpdate error: %v", err),
 					}
-					log.Printf("RefreshEngine: Error from ProcessTapirUpdate(): %v", err)
+					lg.Error("RefreshEngine: ProcessTapirUpdate failed", "error", err)
 				}
 				Gconfig.Internal.ComponentStatusCh <- tapir.ComponentStatusUpdate{
 					Status:    tapir.StatusOK,
 					Component: "tapir-observation",
 					Msg:       fmt.Sprintf("ProcessTapirUpdate: MQTT observation message received"),
 				}
-				log.Printf("RefreshEngine: Tapir Observation update evaluated.")
+				lg.Debug("RefreshEngine: TAPIR observation update evaluated")
 
 				//			case "global-config":
 				//				if !strings.HasSuffix(tpkg.Topic, "config") {
@@ -134,7 +156,7 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 				//				}
 
 			default:
-				log.Printf("RefreshEngine: Tapir Message: unknown msg type: %s", tm.MsgType)
+				lg.Warn("RefreshEngine: TAPIR message of unknown type", "type", tm.MsgType)
 				Gconfig.Internal.ComponentStatusCh <- tapir.ComponentStatusUpdate{
 					Status:    tapir.StatusFail,
 					Component: "mqtt-unknown",
@@ -145,24 +167,26 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 
 		case zr = <-zonerefch:
 			zone = zr.Name
-			log.Printf("RefreshEngine: Requested to refresh zone \"%s\"", zone)
+			pd.Limits.refreshDone(zone)
+			lg.Debug("RefreshEngine: requested to refresh zone", "zone", zone)
 			if zone != "" {
-				if zonedata, exist := pd.RpzSources[zone]; exist {
-					log.Printf("RefreshEngine: scheduling immediate refresh for known zone '%s'",
-						zone)
+				if zonedata, exist := pd.RpzSource(zone); exist {
+					lg.Info("RefreshEngine: immediate refresh of a known zone", "zone", zone)
 					if _, known := refreshCounters[zone]; !known {
 						refresh = zonedata.SOA.Refresh
 
 						upstream = zr.Upstream
-						if upstream == "" && zr.Resp != nil {
-							log.Printf("RefreshEngine: %s: Upstream unspecified", zone)
-							zr.Resp <- RpzRefreshResult{Error: true, ErrorMsg: "Upstream unspecified"}
+						if upstream == "" {
+							lg.Error("RefreshEngine: upstream unspecified", "zone", zone)
+							zr.respond(RpzRefreshResult{Error: true, ErrorMsg: "Upstream unspecified"})
+							continue
 						}
 
 						parsefunc = zr.RRParseFunc
-						if parsefunc == nil && zr.Resp != nil {
-							log.Printf("RefreshEngine: %s: ParseFunc unspecified", zone)
-							zr.Resp <- RpzRefreshResult{Error: true, ErrorMsg: "ParseFunc unspecified"}
+						if parsefunc == nil {
+							lg.Error("RefreshEngine: RRParseFunc unspecified", "zone", zone)
+							zr.respond(RpzRefreshResult{Error: true, ErrorMsg: "ParseFunc unspecified"})
+							continue
 						}
 
 						refreshCounters[zone] = &RefreshCounter{
@@ -172,45 +196,41 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 							//							RRKeepFunc:  keepfunc,
 							RRParseFunc: parsefunc,
 							Upstream:    upstream,
+							Xot:         zr.Xot,
 							Downstreams: downstreams,
 						}
-					} else {
-						rc = refreshCounters[zone]
 					}
-					updated, err = pd.RpzSources[zone].Refresh(rc.Upstream)
+					rc = refreshCounters[zone]
+					updated, err = pd.refreshRpzSource(zone, rc.Upstream, rc.Xot, resetSoaSerial)
 					if err != nil {
-						log.Printf("RefreshEngine: Error from zone refresh(%s): %v", zone, err)
+						lg.Error("RefreshEngine: zone refresh failed", "zone", zone, "error", err)
+					} else {
+						pd.Health.ZoneLoaded(zone)
 					}
 
 					if updated {
-						if resetSoaSerial {
-							pd.RpzSources[zone].SOA.Serial = uint32(time.Now().Unix())
-							log.Printf("RefreshEngine: %s updated from upstream. Resetting serial to unixtime: %d",
-								zone, pd.RpzSources[zone].SOA.Serial)
-						}
 						err := pd.NotifyDownstreams()
 						if err != nil {
-							log.Printf("RefreshEngine: Error notifying downstreams: %v", err)
+							lg.Error("RefreshEngine: notifying the downstreams failed", "error", err)
 						}
 					}
-					// showing some apex details:
-					log.Printf("Showing some details for zone %s: ", zone)
-					log.Printf("%s SOA: %s", zone, pd.RpzSources[zone].SOA.String())
-					zr.Resp <- RpzRefreshResult{Msg: "all ok"}
+					zonedata, _ = pd.RpzSource(zone)
+					lg.Debug("RefreshEngine: zone refreshed", "zone", zone, "soa", zonedata.SOA.String())
+					zr.respond(RpzRefreshResult{Msg: "all ok"})
 				} else {
-					log.Printf("RefreshEngine: adding the new zone '%s'", zone)
+					lg.Info("RefreshEngine: adding a new zone", "zone", zone)
 
 					upstream = zr.Upstream
 					if upstream == "" {
-						log.Printf("RefreshEngine: %s: Upstream unspecified", zone)
-						zr.Resp <- RpzRefreshResult{Error: true, ErrorMsg: "Upstream unspecified"}
+						lg.Error("RefreshEngine: upstream unspecified", "zone", zone)
+						zr.respond(RpzRefreshResult{Error: true, ErrorMsg: "Upstream unspecified"})
 						continue
 					}
 
 					parsefunc = zr.RRParseFunc
 					if parsefunc == nil {
-						log.Printf("RefreshEngine: %s: RRParseFunc unspecified", zone)
-						zr.Resp <- RpzRefreshResult{Error: true, ErrorMsg: "RRParseFunc unspecified"}
+						lg.Error("RefreshEngine: RRParseFunc unspecified", "zone", zone)
+						zr.respond(RpzRefreshResult{Error: true, ErrorMsg: "RRParseFunc unspecified"})
 						continue
 					}
 
@@ -220,13 +240,13 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 						//						RRKeepFunc:  keepfunc,
 						RRParseFunc: parsefunc,
 						//						RpzData:     map[string]string{}, // must be initialized
-						Logger: log.Default(),
+						Logger: newLegacyLogger("sources"),
 					}
 					// log.Printf("RefEng: New zone %s, keepfunc: %v", zone, keepfunc)
-					updated, err := zonedata.Refresh(upstream)
+					updated, err := pd.refreshZone(zonedata, upstream, zr.Xot)
 					if err != nil {
-						log.Printf("RefreshEngine: Error from zone refresh(%s): %v", zone, err)
-						zr.Resp <- RpzRefreshResult{Error: true, ErrorMsg: err.Error()}
+						lg.Error("RefreshEngine: zone refresh failed", "zone", zone, "error", err)
+						zr.respond(RpzRefreshResult{Error: true, ErrorMsg: err.Error()})
 						continue
 					}
 
@@ -243,29 +263,33 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 						//						RRKeepFunc:  keepfunc,
 						RRParseFunc: parsefunc,
 						Upstream:    upstream,
+						Xot:         zr.Xot,
 						Downstreams: downstreams,
 					}
 
 					if updated {
 						if resetSoaSerial {
 							zonedata.SOA.Serial = uint32(time.Now().Unix())
-							log.Printf("RefreshEngine: %s updated from upstream. Resetting serial to unixtime: %d",
-								zone, zonedata.SOA.Serial)
+							lg.Info("RefreshEngine: zone updated from upstream, serial reset to unixtime",
+								"zone", zone, "serial", zonedata.SOA.Serial)
 						}
 						// NotifyDownstreams(zonedata, downstreams)
 
 					}
-					pd.mu.Lock()
-					pd.RpzSources[zone] = zonedata
-					pd.mu.Unlock()
+					pd.setRpzSource(zone, zonedata)
 					// XXX: as parsing is done inline to the zone xfr, we don't need to inform
 					// the caller (I hope). I think we do.
-					zr.Resp <- RpzRefreshResult{Msg: "all ok"}
+					zr.respond(RpzRefreshResult{Msg: "all ok"})
 				}
 			}
 
-		case <-refreshTicker.C:
+		case now := <-refreshTicker.C:
 			ObservationsCh = pd.TapirObservations // stupid kludge
+			pd.Health.Tick(now)
+			if s := pd.statusLine(); s != status {
+				status = s
+				sdStatus("%s", status)
+			}
 			// log.Printf("RefEng: ticker. refCounters: %v", refreshCounters)
 			for zone, rc := range refreshCounters {
 				// log.Printf("RefEng: ticker for %s: curref: %d", zone, v.CurRefresh)
@@ -279,39 +303,39 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 						panic("RefreshEngine: parsefunc=nil")
 					}
 
-					log.Printf("RefreshEngine: will refresh zone %s due to refresh counter", zone)
+					lg.Info("RefreshEngine: refreshing zone, the refresh counter expired", "zone", zone)
 					// log.Printf("Len(RpzZones) = %d", len(RpzZones))
-					updated, err := pd.RpzSources[zone].Refresh(upstream)
+					updated, err := pd.refreshRpzSource(zone, upstream, rc.Xot, resetSoaSerial)
 					rc.CurRefresh = rc.SOARefresh
 					if err != nil {
-						log.Printf("RefreshEngine: Error from zd.Refresh(%s): %v", zone, err)
-					}
-					if updated {
-						if resetSoaSerial {
-							pd.RpzSources[zone].SOA.Serial = uint32(time.Now().Unix())
-							log.Printf("RefreshEngine: %s updated from upstream. Resetting serial to unixtime: %d",
-								zone, pd.RpzSources[zone].SOA.Serial)
-
-						}
+						lg.Error("RefreshEngine: zone refresh failed", "zone", zone, "error", err)
+					} else {
+						pd.Health.ZoneLoaded(zone)
 					}
 					if updated {
 						err := pd.NotifyDownstreams()
 						if err != nil {
-							log.Printf("RefreshEngine: Error notifying downstreams: %v", err)
+							lg.Error("RefreshEngine: notifying the downstreams failed", "error", err)
 						}
 					}
 				}
 			}
 
+		case <-stopch:
+			// No more changes to the RPZ, so the state flushed at shutdown
+			// is the final one.
+			lg.Info("RefreshEngine: stopping")
+			return
+
 		case <-reaperTicker.C:
 			err := pd.Reaper(false)
 			if err != nil {
-				log.Printf("Reaper: error: %v", err)
+				compLogger("policy").Error("Reaper failed", "error", err)
 			}
 
 		case cmd = <-rpzcmdch:
 			command := cmd.Command
-			log.Printf("RefreshEngine: recieved an %s command on the RpzCmd channel", command)
+			lg.Debug("RefreshEngine: received a command", "command", command)
 			resp := RpzCmdResponse{
 				Zone: zone,
 			}
@@ -319,13 +343,16 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 			case "BUMP":
 				zone = cmd.Zone
 				if zone != "" {
-					if zd, exist := pd.RpzSources[zone]; exist {
-						log.Printf("RefreshEngine: bumping SOA serial for known zone '%s'",
-							zone)
+					if zd, exist := pd.RpzSource(zone); exist {
+						lg.Debug("RefreshEngine: bumping the SOA serial of a known zone", "zone", zone)
+						bumped := *zd
+						bumped.SOA.Serial = uint32(time.Now().Unix())
+						pd.setRpzSource(zone, &bumped)
 						resp.OldSerial = zd.SOA.Serial
-						zd.SOA.Serial = uint32(time.Now().Unix())
-						resp.NewSerial = zd.SOA.Serial
-						rc = refreshCounters[zone]
+						resp.NewSerial = bumped.SOA.Serial
+						if rc = refreshCounters[zone]; rc == nil {
+							rc = &RefreshCounter{Name: zone}
+						}
 						err := pd.NotifyDownstreams()
 						if err != nil {
 							resp.Error = true
@@ -333,18 +360,18 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 						}
 						resp.Msg = fmt.Sprintf("Zone %s: bumped serial from %d to %d. Notified downstreams: %v",
 							zone, resp.OldSerial, resp.NewSerial, rc.Downstreams)
-						log.Print(resp.Msg)
+						lg.Info("RefreshEngine: bumped the SOA serial", "zone", zone, "old", resp.OldSerial, "new", resp.NewSerial)
 						resp.Status = true
 					} else {
 						resp.Error = true
 						resp.ErrorMsg = fmt.Sprintf("Request to bump serial for unknown zone '%s'", zone)
-						log.Print(resp.ErrorMsg)
+						lg.Warn("RefreshEngine: request to bump the serial of an unknown zone", "zone", zone)
 					}
 				}
 				cmd.Result <- resp
 
 			case "RPZ-ADD":
-				log.Printf("RefreshEngine: recieved an RPZ ADD command: %s (policy %s)", cmd.Domain, cmd.Policy)
+				lg.Debug("RefreshEngine: RPZ-ADD", "name", cmd.Domain, "policy", cmd.Policy)
 				if pd.Allowlisted(cmd.Domain) {
 					resp.Error = true
 					resp.ErrorMsg = fmt.Sprintf("Domain name \"%s\" is allowlisted. No change.",
@@ -375,23 +402,62 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 					cmd.Result <- resp
 					continue
 				}
-				log.Printf("rf: RPZ-ADD 3")
 
 			case "RPZ-REMOVE":
-				log.Printf("RefreshEngine: recieved an RPZ REMOVE command: %s", cmd.Domain)
+				lg.Debug("RefreshEngine: RPZ-REMOVE", "name", cmd.Domain)
 				resp.Msg = "RPZ-REMOVE NYI"
 				cmd.Result <- resp
 
 			case "RPZ-LOOKUP":
-				log.Printf("RefreshEngine: recieved an RPZ LOOKUP command: %s", cmd.Domain)
+				lg.Debug("RefreshEngine: RPZ-LOOKUP", "name", cmd.Domain)
 				// Explain via the same decide() path that builds the served
 				// zone, so the lookup verdict can never disagree with AXFR/IXFR.
 				resp.Msg = pd.LookupReport(cmd.Domain)
 				cmd.Result <- resp
 				continue
 
+			case "LIST-UPDATE":
+				lg.Debug("RefreshEngine: LIST-UPDATE", "listtype", cmd.Update.ListType, "source", cmd.Update.SrcName)
+				ixfr, err := pd.UpdateLocalList(cmd.Update, cmd.Caller)
+				if err != nil {
+					resp.Error = true
+					resp.ErrorMsg = err.Error()
+				}
+				resp.OldSerial, resp.NewSerial = ixfr.FromSerial, ixfr.ToSerial
+				cmd.Result <- resp
+
+			case "OVERRIDE-SET":
+				lg.Debug("RefreshEngine: OVERRIDE-SET", "name", cmd.Override.Name)
+				ixfr, err := pd.SetOverride(*cmd.Override, cmd.Caller)
+				if err != nil {
+					resp.Error = true
+					resp.ErrorMsg = err.Error()
+				}
+				resp.OldSerial, resp.NewSerial = ixfr.FromSerial, ixfr.ToSerial
+				cmd.Result <- resp
+
+			case "OVERRIDE-REMOVE":
+				lg.Debug("RefreshEngine: OVERRIDE-REMOVE", "name", cmd.Domain)
+				ixfr, err := pd.RemoveOverride(cmd.Domain, cmd.Caller)
+				if err != nil {
+					resp.Error = true
+					resp.ErrorMsg = err.Error()
+				}
+				resp.OldSerial, resp.NewSerial = ixfr.FromSerial, ixfr.ToSerial
+				cmd.Result <- resp
+
+			case "LIST-BOOTSTRAP":
+				lg.Debug("RefreshEngine: LIST-BOOTSTRAP", "listtype", cmd.ListType, "source", cmd.RpzSource)
+				ixfr, err := pd.BootstrapList(cmd.ListType, cmd.RpzSource, cmd.Bootstrap, cmd.Since)
+				if err != nil {
+					resp.Error = true
+					resp.ErrorMsg = err.Error()
+				}
+				resp.OldSerial, resp.NewSerial = ixfr.FromSerial, ixfr.ToSerial
+				cmd.Result <- resp
+
 			case "RPZ-LIST-SOURCES":
-				log.Printf("RefreshEngine: recieved an RPZ LIST-SOURCES command")
+				lg.Debug("RefreshEngine: RPZ-LIST-SOURCES")
 				list := []string{}
 				//				for _, wl := range pd.Allowlists {
 				for _, wl := range pd.Lists["allowlist"] {
@@ -415,7 +481,7 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 				cmd.Result <- resp
 
 			default:
-				pd.Logger.Printf("RefreshEngine: unknown command: \"%s\". Ignored.", command)
+				lg.Warn("RefreshEngine: unknown command, ignored", "command", command)
 				resp.Error = true
 				resp.ErrorMsg = fmt.Sprintf("RefreshEngine: unknown command: \"%s\". Ignored.",
 					command)
@@ -426,47 +492,49 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 }
 
 func (pd *PopData) NotifyDownstreams() error {
-	pd.Logger.Printf("RefreshEngine: Notifying %d downstreams for RPZ zone %s", len(pd.Downstreams), pd.Rpz.ZoneName)
+	lg := compLogger("xfr")
+	serial := pd.Rpz.Current().Serial
+	lg.Info("NotifyDownstreams: notifying the downstreams", "zone", pd.Rpz.ZoneName, "serial", serial, "downstreams", len(pd.Downstreams))
 	for _, d := range pd.Downstreams {
 		dest := net.JoinHostPort(d.Address, strconv.Itoa(d.Port))
 		csu := tapir.ComponentStatusUpdate{
 			Component: "downstream-notify",
 			Status:    tapir.StatusFail,
-			Msg:       fmt.Sprintf("Notifying downstream %s about new SOA serial (%d) for RPZ zone %s", dest, pd.Rpz.Axfr.SOA.Serial, pd.Rpz.ZoneName),
+			Msg:       fmt.Sprintf("Notifying downstream %s about new SOA serial (%d) for RPZ zone %s", dest, serial, pd.Rpz.ZoneName),
 			TimeStamp: time.Now(),
 		}
 
 		m := new(dns.Msg)
 		m.SetNotify(pd.Rpz.ZoneName)
-		pd.Rpz.Axfr.SOA.Serial = pd.Rpz.CurrentSerial
-		// m.Ns = append(m.Ns, dns.RR(&pd.Rpz.Axfr.SOA))
-		pd.Logger.Printf("RefreshEngine: Notifying downstream %s about new SOA serial (%d) for RPZ zone %s", dest, pd.Rpz.Axfr.SOA.Serial, pd.Rpz.ZoneName)
+		lg.Debug("NotifyDownstreams: notifying", "downstream", dest, "zone", pd.Rpz.ZoneName, "serial", serial)
 		r, err := dns.Exchange(m, dest)
 		if err != nil {
 			// well, we tried
 			csu.Msg = fmt.Sprintf("Error from downstream %s on NOTIFY(%s): %v", dest, pd.Rpz.ZoneName, err)
 			Gconfig.Internal.ComponentStatusCh <- csu
-			pd.Logger.Println(csu.Msg)
+			lg.Warn("NotifyDownstreams: NOTIFY failed", "downstream", dest, "zone", pd.Rpz.ZoneName, "error", err)
 			continue
 		}
 		if r.Opcode != dns.OpcodeNotify {
 			// well, we tried
 			csu.Msg = fmt.Sprintf("Error: not a NOTIFY response from downstream %s on NOTIFY(%s): %s", dest, pd.Rpz.ZoneName, dns.OpcodeToString[r.Opcode])
 			Gconfig.Internal.ComponentStatusCh <- csu
-			pd.Logger.Println(csu.Msg)
+			lg.Warn("NotifyDownstreams: not a NOTIFY response", "downstream", dest, "zone", pd.Rpz.ZoneName,
+				"opcode", dns.OpcodeToString[r.Opcode])
 			continue
 
 		} else {
 			if r.Rcode != dns.RcodeSuccess {
-				csu.Msg = fmt.Sprintf("Downstream %s responded with rcode %s to NOTIFY(%s) about new SOA serial (%d)", dest, dns.RcodeToString[r.Rcode], pd.Rpz.ZoneName, pd.Rpz.Axfr.SOA.Serial)
+				csu.Msg = fmt.Sprintf("Downstream %s responded with rcode %s to NOTIFY(%s) about new SOA serial (%d)", dest, dns.RcodeToString[r.Rcode], pd.Rpz.ZoneName, serial)
 				Gconfig.Internal.ComponentStatusCh <- csu
-				pd.Logger.Println(csu.Msg)
+				lg.Warn("NotifyDownstreams: NOTIFY refused", "downstream", dest, "zone", pd.Rpz.ZoneName,
+					"rcode", dns.RcodeToString[r.Rcode])
 				continue
 			}
 			csu.Status = tapir.StatusOK
-			csu.Msg = fmt.Sprintf("Downstream %s responded correctly to NOTIFY(%s) about new SOA serial (%d)", dest, pd.Rpz.ZoneName, pd.Rpz.Axfr.SOA.Serial)
+			csu.Msg = fmt.Sprintf("Downstream %s responded correctly to NOTIFY(%s) about new SOA serial (%d)", dest, pd.Rpz.ZoneName, serial)
 			Gconfig.Internal.ComponentStatusCh <- csu
-			pd.Logger.Println(csu.Msg)
+			lg.Debug("NotifyDownstreams: NOTIFY acknowledged", "downstream", dest, "zone", pd.Rpz.ZoneName)
 		}
 	}
 	return nil
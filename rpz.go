@@ -5,6 +5,13 @@
 package main
 
 import (
+	"hash/maphash"
+	"log"
+	"maps"
+	"runtime"
+	"slices"
+	"sync"
+
 	"github.com/dnstapir/tapir"
 	"github.com/miekg/dns"
 )
@@ -12,139 +19,269 @@ import (
 // XXX: Generating a complete new RPZ zone for output to downstream
 
 // Generate the RPZ output based on the currently loaded sources.
-// The output is a tapir.ZoneData, but with only the RRs (i.e. a []dns.RR) populated.
-// Output should consist of:
-// 1. Walk all denylists:
-//    a) remove any allowlisted names
-//    b) rest goes straight into output
-// 2. Walk all doubtlists:
-//    a) remove any already denylisted name
-//    b) remove any allowlisted name
-//    c) collect complete doubt data on each name
-//    d) evalutate the doubt data to make a decision on inclusion or not
-// 3. When all names that should be in the output have been collected:
-//    a) iterate through the list generating dns.RR and put them in a []dns.RR
-//    b) add a header SOA+NS
+// 1. Collect the candidate names: every name in a denylist or a doubtlist,
+//    every name with an override, and every name in the current output (it
+//    may have to go).
+// 2. Split the candidates into shards on a hash of the name and evaluate each
+//    shard in its own goroutine, one per CPU (a small output, or one on a
+//    single CPU, is one shard on the calling goroutine):
+//    a) decide() is the single source of truth: it enforces the overrides,
+//       allowlist precedence, the denylist and the (provisional) doubtlist
+//       policy. A name that does not earn an action is not in the output.
+//    b) compare the result with the current output, which gives the names
+//       that are removed and added, i.e. an IXFR.
+// 3. Merge the shards into a fresh Data and publish it as the next serial,
+//    with the IXFR, so that names that are no longer listed go away.
 
 func (pd *PopData) GenerateRpzAxfr() error {
-	var deny = make(map[string]bool, 10000)
-	var doubt = make(map[string]*tapir.TapirName, 10000)
-
-	for bname, blist := range pd.Lists["denylist"] {
-		pd.Logger.Printf("---> GenerateRpzAxfr: working on denylist %s (%d names)",
-			bname, len(blist.Names))
-		switch blist.Format {
-		case "dawg":
-			pd.Logger.Printf("Cannot list DAWG lists. Ignoring denylist %s.", bname)
-		case "map":
-			for k := range blist.Names {
-				// if tapir.GlobalCF.Debug {
-				// pd.Logger.Printf("Adding name %s from denylist %s to tentative output.",
-				// 	k, bname)
-				// }
-				// if pd.Allowlisted(k) {
-				// pd.Logger.Printf("Denylisted name %s is also allowlisted. Dropped from output.", k)
-				// } else {
-				// pd.Logger.Printf("Denylisted name %s is not allowlisted. Added to output.", k)
-				deny[k] = true
-				// }
-			}
+	pd.Rpz.wmu.Lock()
+	pd.mu.RLock()
+	cur := pd.Rpz.Current()
+	lists := pd.rpzLists()
+	shards := pd.evalShards(cur, pd.collectShards(lists, cur, pd.numShards(lists, cur)))
+	pd.mu.RUnlock()
+
+	size := 0
+	for _, sh := range shards {
+		size += len(sh.data)
+	}
+	data := make(map[string]tapir.Action, size)
+	ixfr := RpzIxfr{FromSerial: cur.Serial, ToSerial: cur.Serial + 1} // XXX: not dealing with serial wraps
+	for _, sh := range shards {
+		for _, r := range sh.data {
+			data[r.Name] = r.Action
 		}
+		ixfr.Removed = append(ixfr.Removed, sh.removed...)
+		ixfr.Added = append(ixfr.Added, sh.added...)
 	}
-	pd.DenylistedNames = deny
-	pd.Logger.Printf("GenRpzAxfr: There are a total of %d Denylisted names in the sources", len(deny))
-
-	// Collect the candidate set of doubtlisted names. A name that is also
-	// denylisted is already handled by the denylist; allowlisted names are
-	// excluded by decide() below (allowlist is absolute), so the per-name
-	// decision is deferred to the emission loop where decide() is the single
-	// authority on both inclusion and action.
-	for gname, glist := range pd.Lists["doubtlist"] {
-		pd.Logger.Printf("---> GenRpzAxfr: working on doubtlist %s (%d names)",
-			gname, len(glist.Names))
-		switch glist.Format {
-		case "map":
-			for k, v := range glist.Names {
-				if _, exists := pd.DenylistedNames[k]; exists {
-					continue // already covered by the denylist
-				}
-				if existing, exists := doubt[k]; exists {
-					// Same name in several doubtlists: merge tags/actions.
-					// Order-independent because OR is commutative.
-					existing.TagMask |= v.TagMask
-					existing.Action |= v.Action
-				} else {
-					v := v // copy; don't alias the map value
-					doubt[k] = &v
-				}
-			}
-		default:
-			pd.Logger.Printf("*** Error: Doubtlist %s has unknown format \"%s\".", gname, glist.Format)
+	changed := len(ixfr.Removed) != 0 || len(ixfr.Added) != 0
+	switch {
+	case !cur.Generated:
+		// The current output is the empty zone of a fresh start, while the
+		// downstreams have what we served before. Their serial says nothing
+		// about what they have, so they must do an AXFR.
+		next := cur.withData(data)
+		next.Generated = true
+		if changed {
+			next.Serial, next.IxfrChain = ixfr.ToSerial, nil
 		}
+		pd.Rpz.publish(next)
+		pd.Logger.Printf("GenerateRpzAxfr: first RPZ output, %d names, serial %d", len(data), next.Serial)
+	case changed:
+		byName := func(a, b RpzRule) int { return canonicalCompare(a.Name, b.Name) }
+		slices.SortFunc(ixfr.Removed, byName)
+		slices.SortFunc(ixfr.Added, byName)
+		next := cur.withData(data)
+		pd.publishIxfr(cur, next, ixfr)
+		pd.Logger.Printf("GenerateRpzAxfr: %d names removed and %d added, new serial %d",
+			len(ixfr.Removed), len(ixfr.Added), next.Serial)
+	}
+	if changed {
+		pd.auditIxfr(ixfr, AuditCause{Trigger: "regenerate"})
 	}
-	pd.DoubtlistedNames = doubt
-	pd.Logger.Printf("GenRpzAxfr: There are a total of %d candidate doubtlisted names in the sources", len(doubt))
+	pd.Rpz.wmu.Unlock()
+	pd.Health.RpzGenerated()
 
-	for name := range pd.DenylistedNames {
-		cname := new(dns.CNAME)
-		cname.Hdr = dns.RR_Header{
-			Name:   name + pd.Rpz.ZoneName,
-			Rrtype: dns.TypeCNAME,
-			Class:  dns.ClassINET,
-			Ttl:    3600,
-		}
-		cname.Target = tapir.ActionToCNAMETarget[pd.Policy.DenylistAction]
-		rr := dns.RR(cname)
+	pd.Logger.Printf("GenerateRpzAxfrData: put %d names in %s", len(data), pd.Rpz.ZoneName)
+	return pd.NotifyDownstreams()
+}
+
+var shardSeed = maphash.MakeSeed()
+
+// rpzShardMinNames is the number of candidate names below which the output is
+// evaluated in one shard on the calling goroutine: starting goroutines and
+// merging their results costs more than it gains for a small output, and
+// always on a single CPU.
+const rpzShardMinNames = 100_000
 
-		rpzn := tapir.RpzName{
-			Name:   name,
-			RR:     &rr,
-			Action: pd.Policy.DenylistAction,
+// rpzShard is the part of the candidate names that one goroutine evaluates.
+type rpzShard struct {
+	names   [][]string // the candidates, one slice per list they came from
+	data    []RpzRule  // the names in the output
+	removed []RpzRule
+	added   []RpzRule
+}
+
+// numShards returns the number of shards for the candidates in lists and cur:
+// one per CPU, or a single one for a small output. The caller must hold
+// pd.mu.
+func (pd *PopData) numShards(lists []*PopList, cur *RpzSnapshot) int {
+	n := runtime.GOMAXPROCS(0)
+	if n == 1 {
+		return 1
+	}
+	size := len(cur.Data)
+	for _, list := range lists {
+		size += list.Names.Len()
+	}
+	if size < rpzShardMinNames {
+		return 1
+	}
+	return n
+}
+
+func shardOf(name string, n int) int {
+	if n == 1 {
+		return 0
+	}
+	return int(maphash.String(shardSeed, name) % uint64(n))
+}
+
+// rpzLists returns the denylists and doubtlists whose names can be listed.
+// The caller must hold pd.mu.
+func (pd *PopData) rpzLists() []*PopList {
+	var lists []*PopList
+	for _, class := range []string{"denylist", "doubtlist"} {
+		for name, list := range pd.Lists[class] {
+			switch list.Format {
+			case "map":
+				lists = append(lists, list)
+			case "dawg":
+				pd.Logger.Printf("Cannot list DAWG lists. Ignoring %s %s.", class, name)
+			default:
+				pd.Logger.Printf("*** Error: %s %s has unknown format \"%s\".", class, name, list.Format)
+			}
 		}
-		pd.mu.Lock()
-		pd.Rpz.Axfr.Data[name+pd.Rpz.ZoneName] = &rpzn
-		pd.mu.Unlock()
 	}
+	return lists
+}
 
-	for name := range pd.DoubtlistedNames {
-		// decide() is the single source of truth: it enforces allowlist
-		// precedence and applies the (provisional) doubtlist policy. A name
-		// that does not earn an action passes through and is not emitted.
-		action, _ := pd.decide(name)
-		if action == tapir.ALLOWLIST {
+// collectShards splits the names in lists, those with an override and those
+// in cur into n shards. With more than one shard the lists are read in
+// parallel. The caller must hold pd.mu.
+func (pd *PopData) collectShards(lists []*PopList, cur *RpzSnapshot, n int) []rpzShard {
+	// split[i][s] are the names from source i (the lists, then cur) in shard s.
+	split := make([][][]string, len(lists)+1)
+	read := func(i int, list *PopList) {
+		split[i] = make([][]string, n)
+		err := list.Names.Range(func(tn tapir.TapirName) bool {
+			s := shardOf(tn.Name, n)
+			split[i][s] = append(split[i][s], tn.Name)
+			return true
+		})
+		if err != nil {
+			pd.Logger.Printf("GenerateRpzAxfr: Error reading %s %s: %v", list.Type, list.Name, err)
+		}
+	}
+	var wg sync.WaitGroup
+	for i, list := range lists {
+		if n == 1 {
+			read(i, list)
 			continue
 		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			read(i, list)
+		}()
+	}
+	split[len(lists)] = make([][]string, n)
+	for name := range cur.Data {
+		s := shardOf(name, n)
+		split[len(lists)][s] = append(split[len(lists)][s], name)
+	}
+	for _, name := range pd.Overrides.Names() {
+		s := shardOf(name, n)
+		split[len(lists)][s] = append(split[len(lists)][s], name)
+	}
+	wg.Wait()
 
-		cname := new(dns.CNAME)
-		cname.Hdr = dns.RR_Header{
-			Name:     name + pd.Rpz.ZoneName,
-			Rrtype:   dns.TypeCNAME,
-			Class:    dns.ClassINET,
-			Ttl:      3600,
-			Rdlength: 1,
+	shards := make([]rpzShard, n)
+	for s := range shards {
+		for i := range split {
+			shards[s].names = append(shards[s].names, split[i][s])
 		}
-		cname.Target = tapir.ActionToCNAMETarget[action]
-		rr := dns.RR(cname)
+	}
+	return shards
+}
+
+// evalShards decides every candidate name in the shards and compares the
+// result with cur. The shards are evaluated in parallel, unless there is only
+// one. The caller must hold pd.mu.
+func (pd *PopData) evalShards(cur *RpzSnapshot, shards []rpzShard) []rpzShard {
+	if len(shards) == 1 {
+		pd.evalShard(cur, &shards[0])
+		return shards
+	}
+	var wg sync.WaitGroup
+	for s := range shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pd.evalShard(cur, &shards[s])
+		}()
+	}
+	wg.Wait()
+	return shards
+}
 
-		rpzn := tapir.RpzName{
-			Name:   name,
-			RR:     &rr,
-			Action: action,
+func (pd *PopData) evalShard(cur *RpzSnapshot, sh *rpzShard) {
+	size := 0
+	for _, names := range sh.names {
+		size += len(names)
+	}
+	seen := make(map[string]bool, size)
+	for _, names := range sh.names {
+		for _, name := range names {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			action, _ := pd.decide(name)
+			old, exist := cur.Data[name]
+			if exist && old != action {
+				sh.removed = append(sh.removed, RpzRule{Name: name, Action: old})
+			}
+			if action == tapir.ALLOWLIST {
+				continue
+			}
+			sh.data = append(sh.data, RpzRule{Name: name, Action: action})
+			if !exist || old != action {
+				sh.added = append(sh.added, RpzRule{Name: name, Action: action})
+			}
 		}
-		pd.mu.Lock()
-		pd.Rpz.Axfr.Data[name+pd.Rpz.ZoneName] = &rpzn
-		pd.mu.Unlock()
 	}
+	sh.names = nil
+}
 
-	//	pd.Rpz.Axfr.Data = pd.Rpz.RpzMap
-	pd.Logger.Printf("GenerateRpzAxfrData: put %d RRs in %s",
-		len(pd.Rpz.Axfr.Data), pd.Rpz.ZoneName)
-	err := pd.NotifyDownstreams()
-	return err
+// listedNames returns the names in the denylists, and the other names in the
+// doubtlists with the tags and actions of all doubtlists merged. It is only
+// used by the debug API. The caller must hold pd.mu.
+func (pd *PopData) listedNames() (map[string]bool, map[string]nameEntry) {
+	deny := map[string]bool{}
+	doubt := map[string]nameEntry{}
+	for _, list := range pd.Lists["denylist"] {
+		if list.Format == "map" {
+			list.Names.Range(func(tn tapir.TapirName) bool {
+				deny[tn.Name] = true
+				return true
+			})
+		}
+	}
+	for _, list := range pd.Lists["doubtlist"] {
+		if list.Format == "map" {
+			list.Names.Range(func(tn tapir.TapirName) bool {
+				if deny[tn.Name] {
+					return true
+				}
+				if existing, exists := doubt[tn.Name]; exists {
+					// Same name in several doubtlists: merge tags/actions.
+					// Order-independent because OR is commutative.
+					existing.tags |= tn.TagMask
+					existing.action |= tn.Action
+					doubt[tn.Name] = existing
+				} else {
+					doubt[tn.Name] = newNameEntry(tn)
+				}
+				return true
+			})
+		}
+	}
+	return deny, doubt
 }
 
 // Generate the RPZ representation of the names in the TapirMsg combined with the currently loaded sources.
-// The output is a []dns.RR with the additions and removals, but without the IXFR SOA serial magic.
+// The output is the names that are removed and added, but without the IXFR SOA serial magic.
 // Algorithm:
 // 1. For each name that is removed in the update:
 //    a) is the name NOT present in current RPZ?
@@ -169,113 +306,73 @@ func (pd *PopData) GenerateRpzAxfr() error {
 //          - is the name present in current RPZ with same policy/action:
 //              => do nothing
 
+//
+// GenerateRpzIxfr only computes the IXFR from the current snapshot, it does not
+// change it. Use UpdateRpz to generate and publish an IXFR as one write.
+
 func (pd *PopData) GenerateRpzIxfr(data *tapir.TapirMsg) (RpzIxfr, error) {
 
-	var removeData, addData []*tapir.RpzName
+	var removeData, addData []RpzRule
+	snap := pd.Rpz.Current()
+	pd.mu.RLock()
+	defer pd.mu.RUnlock()
+	lg := compLogger("policy")
 	pd.Policy.Logger.Printf("GenerateRpzIxfr: %d removed names and %d added names", len(data.Removed), len(data.Added))
 	for _, tn := range data.Removed {
-		tn.Name = dns.Fqdn(tn.Name)
-		pd.Policy.Logger.Printf("GenerateRpzIxfr: evaluating removed name %s", tn.Name)
-		if cur, exist := pd.Rpz.Axfr.Data[tn.Name]; exist {
+		tn.Name = dns.CanonicalName(tn.Name)
+		if oldAction, exist := snap.Data[tn.Name]; exist {
 			newAction, _ := pd.decide(tn.Name)
-			oldAction := cur.Action
 			if newAction != oldAction {
-				if pd.Debug {
-					pd.Policy.Logger.Printf("GenRpzIxfr[DEL]: %s: oldaction(%s) != newaction(%s): -->DELETE",
-						tn.Name,
-						tapir.ActionToString[oldAction],
-						tapir.ActionToString[newAction])
-				}
-				removeData = append(removeData, cur)
+				lg.Debug("GenerateRpzIxfr: removed name has a new action: delete",
+					"name", tn.Name, "old", tapir.ActionToString[oldAction], "new", tapir.ActionToString[newAction])
+				removeData = append(removeData, RpzRule{Name: tn.Name, Action: oldAction})
 
 				if newAction != tapir.ALLOWLIST {
-					cname := new(dns.CNAME)
-					cname.Hdr = dns.RR_Header{
-						Name:     tn.Name + pd.Rpz.ZoneName,
-						Rrtype:   dns.TypeCNAME,
-						Class:    dns.ClassINET,
-						Ttl:      3600,
-						Rdlength: 1,
-					}
-					cname.Target = tapir.ActionToCNAMETarget[newAction]
-					rr := dns.RR(cname)
-
-					addData = append(addData, &tapir.RpzName{
-						Name:   tn.Name,
-						RR:     &rr,
-						Action: newAction,
-					})
+					addData = append(addData, RpzRule{Name: intern(tn.Name), Action: newAction})
 				}
 			} else {
-				if pd.Debug {
-					pd.Policy.Logger.Printf("GenRpzIxfr[DEL]: name %s present in previous policy with same action: -->NO CHANGE", tn.Name)
-				}
+				lg.Debug("GenerateRpzIxfr: removed name has the same action: no change", "name", tn.Name)
 			}
 		} else {
-			if pd.Debug {
-				pd.Policy.Logger.Printf("GenRpzIxfr[DEL]: name %s not present in previous policy, still not included: -->NO CHANGE", tn.Name)
-			}
+			lg.Debug("GenerateRpzIxfr: removed name was not in the RPZ: no change", "name", tn.Name)
 		}
 	}
 
 	var addtorpz bool
 	for _, tn := range data.Added {
-		tn.Name = dns.Fqdn(tn.Name)
-		pd.Policy.Logger.Printf("GenerateRpzIxfr: evaluating added name %s", tn.Name)
+		tn.Name = dns.CanonicalName(tn.Name)
 		addtorpz = false
 		newAction, _ := pd.decide(tn.Name)
-		if cur, exist := pd.Rpz.Axfr.Data[tn.Name]; exist {
+		if cur, exist := snap.Data[tn.Name]; exist {
 			if newAction == tapir.ALLOWLIST {
 				// delete from rpz
-				if pd.Debug {
-					pd.Policy.Logger.Printf("GenRpzIxfr[ADD]: name %s already exists in rpz, new action is ALLOWLIST: -->DELETE", tn.Name)
-				}
-				removeData = append(removeData, cur)
+				lg.Debug("GenerateRpzIxfr: added name is in the RPZ and now allowed: delete", "name", tn.Name)
+				removeData = append(removeData, RpzRule{Name: tn.Name, Action: cur})
 			} else {
-				if cur.Action != newAction {
+				if cur != newAction {
 					// change, delete old rule, add new
-					removeData = append(removeData, cur)
+					removeData = append(removeData, RpzRule{Name: tn.Name, Action: cur})
 					addtorpz = true
-					if pd.Debug {
-						pd.Policy.Logger.Printf("GenRpzIxfr[ADD]: name %s present in rpz, newaction(%s) != oldaction(%s): -->ADD",
-							tn.Name, tapir.ActionToString[newAction],
-							tapir.ActionToString[cur.Action])
-					}
+					lg.Debug("GenerateRpzIxfr: added name is in the RPZ with another action: replace",
+						"name", tn.Name, "old", tapir.ActionToString[cur], "new", tapir.ActionToString[newAction])
 				}
 			}
 		} else {
 			// name doesn't exist in current rpz, what is the action?
 			if newAction != tapir.ALLOWLIST {
 				// add it
-				if pd.Debug {
-					pd.Policy.Logger.Printf("GenRpzIxfr[ADD]: name %s NOT present in rpz, newaction(%s) != ALLOWLIST: -->ADD",
-						tn.Name, tapir.ActionToString[newAction])
-				}
+				lg.Debug("GenerateRpzIxfr: added name is not in the RPZ: add",
+					"name", tn.Name, "new", tapir.ActionToString[newAction])
 				addtorpz = true
 			}
 		}
 		if addtorpz {
-			cname := new(dns.CNAME)
-			cname.Hdr = dns.RR_Header{
-				Name:     tn.Name + pd.Rpz.ZoneName,
-				Rrtype:   dns.TypeCNAME,
-				Class:    dns.ClassINET,
-				Ttl:      3600,
-				Rdlength: 1,
-			}
-			cname.Target = tapir.ActionToCNAMETarget[newAction]
-			rr := dns.RR(cname)
-
-			addData = append(addData, &tapir.RpzName{
-				Name:   tn.Name,
-				RR:     &rr,
-				Action: newAction,
-			})
+			addData = append(addData, RpzRule{Name: intern(tn.Name), Action: newAction})
 		}
 	}
 
 	if len(removeData) != 0 || len(addData) != 0 {
-		curserial := pd.Rpz.CurrentSerial
+		curserial := snap.Serial
 		newserial := curserial + 1 // XXX: not dealing with serial wraps
 		thisixfr := RpzIxfr{
 			FromSerial: curserial,
@@ -283,15 +380,96 @@ func (pd *PopData) GenerateRpzIxfr(data *tapir.TapirMsg) (RpzIxfr, error) {
 			Removed:    removeData,
 			Added:      addData,
 		}
-		pd.Rpz.IxfrChain = append(pd.Rpz.IxfrChain, thisixfr)
-		pd.Rpz.CurrentSerial = newserial
-		if pd.Verbose {
-			pd.Policy.Logger.Printf("GenRpzIxfr: added new IXFR (serial from %d to %d) to chain. Chain has %d IXFRs",
-				curserial, newserial, len(pd.Rpz.IxfrChain))
-		}
+		lg.Debug("GenerateRpzIxfr: generated a new IXFR", "from", curserial, "to", newserial)
 		return thisixfr, nil
 	}
 
 	pd.Policy.Logger.Printf("GenRpzIxfr: no changes in RPZ policy, no new IXFR")
 	return RpzIxfr{}, nil
 }
+
+// UpdateRpz is the write path for an update of the lists: GenerateRpzIxfr
+// works out what the update means for the RPZ output and ProcessIxfrIntoAxfr
+// publishes that as the next serial. Both run under the writer lock, so the
+// IXFR is always applied to the snapshot it was computed from. The lists must
+// already have been changed by the caller. The changes are recorded in the
+// audit log as caused by cause.
+func (pd *PopData) UpdateRpz(tm *tapir.TapirMsg, cause AuditCause) (RpzIxfr, error) {
+	pd.Rpz.wmu.Lock()
+	ixfr, err := pd.GenerateRpzIxfr(tm)
+	if err == nil {
+		err = pd.ProcessIxfrIntoAxfr(ixfr)
+	}
+	if err == nil && ixfr.ToSerial != 0 {
+		pd.auditIxfr(ixfr, cause)
+	}
+	pd.Rpz.wmu.Unlock()
+	if err != nil || ixfr.ToSerial == 0 {
+		return ixfr, err
+	}
+
+	//	pd.Logger.Printf("PIIA Notifying %d downstreams for RPZ zone %s", len(pd.RpzDownstreams), pd.Rpz.ZoneName)
+	return ixfr, pd.NotifyDownstreams()
+}
+
+// Current returns the currently published RPZ snapshot. It must be treated as
+// read-only.
+func (rd *RpzData) Current() *RpzSnapshot {
+	return rd.snap.Load()
+}
+
+// publish makes s the current RPZ snapshot. Only called with rd.wmu held (or
+// during startup, before there are any readers). A nil Owners or Digest is
+// recomputed here, so a writer that changes Data or the apex just clears them.
+func (rd *RpzData) publish(s *RpzSnapshot) {
+	s.seal()
+	rd.snap.Store(s)
+}
+
+// rr returns the CNAME of a trigger name with action. The RRs of the output
+// are made from Data when they are sent, in a transfer, a response or the
+// zone digest, rather than kept for every name.
+func (s *RpzSnapshot) rr(name string, action tapir.Action) dns.RR {
+	return &dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name:   name + s.SOA.Hdr.Name,
+			Rrtype: dns.TypeCNAME,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		Target: tapir.ActionToCNAMETarget[action],
+	}
+}
+
+// seal derives the rest of the snapshot from Serial, the apex and Data: the
+// SOA serial, the canonical order of Data and the zone digest.
+func (s *RpzSnapshot) seal() {
+	s.SOA.Serial = s.Serial
+	if s.Owners == nil {
+		s.Owners = canonicalOrder(s.Data)
+	}
+	if s.Digest == nil && s.SOA.Hdr.Rrtype == dns.TypeSOA {
+		digest, err := s.computeDigest()
+		if err != nil {
+			log.Printf("RpzData: Error computing the zone digest for serial %d: %v", s.Serial, err)
+		}
+		s.Digest = digest
+	}
+}
+
+// clone returns a copy of s that the writer may change before publishing it.
+// Data and IxfrChain are copied; the names in them are shared.
+func (s *RpzSnapshot) clone() *RpzSnapshot {
+	data := make(map[string]tapir.Action, len(s.Data))
+	maps.Copy(data, s.Data)
+	return s.withData(data)
+}
+
+// withData is clone with data instead of a copy of Data.
+func (s *RpzSnapshot) withData(data map[string]tapir.Action) *RpzSnapshot {
+	next := *s
+	next.Data = data
+	next.Owners, next.Digest = nil, nil
+	next.IxfrChain = append([]RpzIxfr(nil), s.IxfrChain...)
+	return &next
+}
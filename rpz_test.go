@@ -0,0 +1,321 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+
+	"github.com/dnstapir/tapir"
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+func TestGenerateRpzAxfr(t *testing.T) {
+	pd := newRunningTestPopData(t)
+	feed := pd.Lists["denylist"]["feed"]
+	feed.Names.Put(tapir.TapirName{Name: "stays.example."}, tapir.TapirName{Name: "goes.example."},
+		tapir.TapirName{Name: "allowed.example."})
+	pd.Lists["allowlist"]["local"] = &PopList{WBGlist: &tapir.WBGlist{Name: "local", Type: "allowlist", Format: "map"},
+		Names: newMemNames("local")}
+	pd.Lists["allowlist"]["local"].Names.Put(tapir.TapirName{Name: "allowed.example."})
+	pd.Rpz.wmu.Lock()
+	stale := pd.Rpz.Current().clone()
+	stale.IxfrChain = []RpzIxfr{{FromSerial: 0, ToSerial: 1}}
+	pd.Rpz.publish(stale)
+	pd.Rpz.wmu.Unlock()
+
+	// The first time the chain is dropped, as the downstreams may have
+	// anything at serial 1.
+	if err := pd.GenerateRpzAxfr(); err != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+	snap := pd.Rpz.Current()
+	if want := []string{"goes.example.", "stays.example."}; !slices.Equal(snap.Owners, want) ||
+		snap.Serial != 2 || len(snap.IxfrChain) != 0 || !snap.Generated {
+		t.Fatalf("first generation: serial %d, names %v, %d IXFRs; want serial 2, names %v, no IXFRs",
+			snap.Serial, snap.Owners, len(snap.IxfrChain), want)
+	}
+
+	if err := pd.GenerateRpzAxfr(); err != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+	if snap := pd.Rpz.Current(); snap.Serial != 2 {
+		t.Errorf("regeneration without changes: serial %d, want 2", snap.Serial)
+	}
+
+	feed.Names.Delete("goes.example.")
+	feed.Names.Put(tapir.TapirName{Name: "new.example."})
+	if err := pd.GenerateRpzAxfr(); err != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+	snap = pd.Rpz.Current()
+	if want := []string{"new.example.", "stays.example."}; !slices.Equal(snap.Owners, want) || snap.Serial != 3 {
+		t.Fatalf("serial %d, names %v; want serial 3, names %v", snap.Serial, snap.Owners, want)
+	}
+	if len(snap.IxfrChain) != 1 {
+		t.Fatalf("%d IXFRs, want 1", len(snap.IxfrChain))
+	}
+	ixfr := snap.IxfrChain[0]
+	if ixfr.FromSerial != 2 || ixfr.ToSerial != 3 ||
+		!slices.Equal(ixfr.Removed, []RpzRule{{Name: "goes.example.", Action: tapir.NODATA}}) ||
+		!slices.Equal(ixfr.Added, []RpzRule{{Name: "new.example.", Action: tapir.NODATA}}) {
+		t.Errorf("IXFR %+v", ixfr)
+	}
+	if ixfr.ToSOA.Serial != 3 || len(ixfr.ApexAdded) != 1 {
+		t.Errorf("IXFR apex: SOA serial %d, %d apex RRs added; want 3 and the ZONEMD", ixfr.ToSOA.Serial, len(ixfr.ApexAdded))
+	}
+}
+
+// TestRpzShards checks that the output does not depend on the number of
+// shards.
+// TestStartupOrder runs the startup steps in the order that main does and
+// checks that the RPZ generated from the sources is what is published.
+func TestStartupOrder(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	deny := write("deny.txt", "bad.example\nworse.example\n")
+	savedSources, savedOutputs := sourcesCfgFile, outputsCfgFile
+	sourcesCfgFile = write("sources.yaml", `sources:
+  deny:
+    active: true
+    name: deny
+    description: test denylist
+    type: denylist
+    format: domains
+    source: file
+`)
+	outputsCfgFile = write("outputs.yaml", `outputs:
+  resolver:
+    active: false
+    format: rpz
+    downstream: 127.0.0.1:5399
+`)
+	savedExiter := POPExiter
+	POPExiter = func(args ...interface{}) { t.Fatalf("POPExiter(%v)", args[0]) }
+
+	settings := map[string]any{
+		"services.rpz.zonename":                "rpz.test.",
+		"sources.deny.filename":                deny,
+		"policy.allowlist.action":              "passthru",
+		"policy.denylist.action":               "nxdomain",
+		"policy.doubtlist.numsources.limit":    3,
+		"policy.doubtlist.numsources.action":   "nxdomain",
+		"policy.doubtlist.numtapirtags.limit":  3,
+		"policy.doubtlist.numtapirtags.action": "nxdomain",
+		"policy.doubtlist.denytapir.action":    "nxdomain",
+	}
+	for k, v := range settings {
+		viper.Set(k, v)
+	}
+	t.Cleanup(func() {
+		for k := range settings {
+			viper.Set(k, nil)
+		}
+		sourcesCfgFile, outputsCfgFile = savedSources, savedOutputs
+		POPExiter = savedExiter
+	})
+
+	var conf Config
+	conf.Internal.ComponentStatusCh = make(chan tapir.ComponentStatusUpdate)
+	go func() {
+		for range conf.Internal.ComponentStatusCh {
+		}
+	}()
+	defer close(conf.Internal.ComponentStatusCh)
+	pd, err := NewPopData(&conf, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewPopData: %v", err)
+	}
+	if err := pd.ParseSourcesNG(); err != nil {
+		t.Fatalf("ParseSourcesNG: %v", err)
+	}
+	if err := pd.ParseOutputs(); err != nil {
+		t.Fatalf("ParseOutputs: %v", err)
+	}
+
+	snap := pd.Rpz.Current()
+	if snap.SOA.Hdr.Name != "rpz.test." {
+		t.Fatalf("SOA = %v, want the apex of rpz.test.", snap.SOA)
+	}
+	if snap.Digest == nil {
+		t.Errorf("the zone has no digest")
+	}
+	for _, name := range []string{"bad.example.", "worse.example."} {
+		if _, exist := snap.Data[name]; !exist {
+			t.Errorf("%s is not in the RPZ: %v", name, snap.Data)
+		}
+	}
+	if owner := snap.rr("bad.example.", tapir.NXDOMAIN).Header().Name; owner != "bad.example.rpz.test." {
+		t.Errorf("owner = %q, want bad.example.rpz.test.", owner)
+	}
+	if _, exist := pd.Outputs["resolver"]; !exist {
+		t.Errorf("the output is missing: %v", pd.Outputs)
+	}
+}
+
+func TestRpzShards(t *testing.T) {
+	pd := benchPopData(t, 3000)
+	cur := pd.Rpz.Current().clone()
+	cur.Data["gone.example."] = tapir.NXDOMAIN
+	cur.Data[benchName(2)] = tapir.NXDOMAIN // denylisted, so NODATA now
+
+	var want map[string]tapir.Action
+	for _, n := range []int{1, 2, 7} {
+		got := map[string]tapir.Action{}
+		var removed, added int
+		for _, sh := range pd.evalShards(cur, pd.collectShards(pd.rpzLists(), cur, n)) {
+			for _, r := range sh.data {
+				got[r.Name] = r.Action
+			}
+			removed += len(sh.removed)
+			added += len(sh.added)
+		}
+		if removed != 2 || added != len(got) {
+			t.Errorf("%d shards: %d removed, %d added of %d names", n, removed, added, len(got))
+		}
+		if want == nil {
+			want = got
+		} else if !maps.Equal(got, want) {
+			t.Errorf("%d shards: %d names, differs from 1 shard with %d", n, len(got), len(want))
+		}
+	}
+	if want[benchName(2)] != tapir.NODATA || want[benchName(0)] != 0 {
+		t.Errorf("%s: %s, %s: %s", benchName(2), tapir.ActionToString[want[benchName(2)]],
+			benchName(0), tapir.ActionToString[want[benchName(0)]])
+	}
+}
+
+// The RPZ benchmarks run on a synthetic dataset of -rpz.names distinct names,
+// spread over the lists like a busy POP would have them: half of them are in
+// the denylist, and most are in one or both of the two doubtlists. Every list
+// parses its own copy of a name, as the real sources do. Run them one at a
+// time, as the dataset is large, and with -cpu for the regeneration:
+//
+//	go test -run '^$' -bench BenchmarkRpzMemory -benchtime 1x
+//	go test -run '^$' -bench BenchmarkRpzRegenerate -benchtime 3x -cpu 1,2,4
+var benchNames = flag.Int("rpz.names", 5_000_000, "number of names in the synthetic dataset of the RPZ benchmarks")
+
+func benchName(i int) string {
+	return fmt.Sprintf("host%d.zone%d.example.", i, i%10007)
+}
+
+// benchPopData returns a PopData with the first n names of the synthetic
+// dataset in its lists.
+func benchPopData(tb testing.TB, n int) *PopData {
+	tb.Helper()
+	pd := newRunningTestPopData(tb)
+
+	lists := []struct {
+		class, source string
+		member        func(int) bool
+		tags          tapir.TagMask
+	}{
+		{class: "allowlist", source: "local", member: func(i int) bool { return i%100 == 0 }},
+		{class: "denylist", source: "feed", member: func(i int) bool { return i%2 == 0 }},
+		{class: "doubtlist", source: "a", member: func(i int) bool { return i%3 != 0 }, tags: 3},
+		{class: "doubtlist", source: "b", member: func(i int) bool { return i%5 != 0 }, tags: 4},
+	}
+	for _, l := range lists {
+		pl := &PopList{WBGlist: &tapir.WBGlist{Name: l.source, Type: l.class, Format: "map"}, Names: newMemNames(l.source)}
+		for i := range n {
+			if l.member(i) {
+				pl.Names.Put(tapir.TapirName{Name: benchName(i), TagMask: l.tags, NumTags: 1})
+			}
+		}
+		pd.Lists[l.class][l.source] = pl
+	}
+	return pd
+}
+
+func heapInUse() uint64 {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
+
+// BenchmarkRpzMemory reports the heap that the lists and the RPZ output take,
+// per name in the dataset.
+func BenchmarkRpzMemory(b *testing.B) {
+	for b.Loop() {
+		base := heapInUse()
+		pd := benchPopData(b, *benchNames)
+		lists := heapInUse()
+		if err := pd.GenerateRpzAxfr(); err != nil {
+			b.Fatalf("GenerateRpzAxfr: %v", err)
+		}
+		rpz := heapInUse()
+		n := float64(*benchNames)
+		b.ReportMetric(float64(lists-base)/n, "lists-B/name")
+		b.ReportMetric(float64(rpz-lists)/n, "rpz-B/name")
+		b.ReportMetric(float64(len(pd.Rpz.Current().Data)), "rpz-names")
+		runtime.KeepAlive(pd)
+	}
+}
+
+func BenchmarkRpzGenerate(b *testing.B) {
+	pd := benchPopData(b, *benchNames)
+	for b.Loop() {
+		if err := pd.GenerateRpzAxfr(); err != nil {
+			b.Fatalf("GenerateRpzAxfr: %v", err)
+		}
+	}
+}
+
+// BenchmarkRpzRegenerate regenerates the output after a small change in the
+// lists, which is published as an IXFR. Use -cpu to compare the number of
+// shards.
+func BenchmarkRpzRegenerate(b *testing.B) {
+	pd := benchPopData(b, *benchNames)
+	if err := pd.GenerateRpzAxfr(); err != nil {
+		b.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+	feed := pd.Lists["denylist"]["feed"]
+	i := 0
+	for b.Loop() {
+		var tns []tapir.TapirName
+		for range 1000 {
+			tns = append(tns, tapir.TapirName{Name: fmt.Sprintf("new%d.example.", i)})
+			i++
+		}
+		feed.Names.Put(tns...)
+		if err := pd.GenerateRpzAxfr(); err != nil {
+			b.Fatalf("GenerateRpzAxfr: %v", err)
+		}
+	}
+	b.ReportMetric(float64(len(pd.Rpz.Current().IxfrChain))/float64(b.N), "ixfrs/op")
+}
+
+// BenchmarkRpzTransfer packs the body of the zone as an AXFR would.
+func BenchmarkRpzTransfer(b *testing.B) {
+	pd := benchPopData(b, *benchNames)
+	if err := pd.GenerateRpzAxfr(); err != nil {
+		b.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+	snap := pd.Rpz.Current()
+	buf := make([]byte, 512)
+	for b.Loop() {
+		for rr := range snap.zoneRRs() {
+			if _, err := dns.PackRR(rr, buf, 0, nil, false); err != nil {
+				b.Fatalf("PackRR: %v", err)
+			}
+		}
+	}
+}
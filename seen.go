@@ -0,0 +1,200 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/spf13/viper"
+)
+
+// The seen table records when each name was first and last seen in a list,
+// over all sources, so that the policy can treat a name that is new on the
+// Internet with more suspicion (the firstseen doubtlist rule) and a lookup can
+// show its age. A name is seen when a source adds it with the time it was
+// observed: MQTT updates, bootstraps, the API and the saved lists. Names from
+// files and zone transfers come without a time and have no age.
+//
+// As the firstseen rule depends on the time, a name that it fired for is
+// decided again by the Reaper once it is no longer new.
+
+const defaultSeenRetention = 30 * 24 * time.Hour
+
+// seenSweepInterval is how often the Reaper forgets the names that have not
+// been seen for the retention time.
+const seenSweepInterval = time.Hour
+
+type seenTimes struct {
+	first, last uint32 // Unix seconds
+}
+
+type SeenTable struct {
+	mu        sync.RWMutex
+	names     map[string]seenTimes
+	aging     map[time.Time][]string // names that are no longer new, by reaper time slot
+	retention time.Duration
+	swept     time.Time
+}
+
+// NewSeenTable returns an empty table that forgets a name when it has not been
+// seen for services.seen.retention.
+func NewSeenTable() (*SeenTable, error) {
+	retention := defaultSeenRetention
+	if s := viper.GetString("services.seen.retention"); s != "" {
+		var err error
+		retention, err = time.ParseDuration(s)
+		if err != nil || retention <= 0 {
+			return nil, fmt.Errorf("services.seen.retention must be a positive duration, like \"720h\"")
+		}
+	}
+	return &SeenTable{
+		names:     map[string]seenTimes{},
+		aging:     map[time.Time][]string{},
+		retention: retention,
+		swept:     time.Now(),
+	}, nil
+}
+
+// see records that name was seen at t. It returns when the name was first
+// seen, and whether that changed.
+func (st *SeenTable) see(name string, t time.Time) (time.Time, bool) {
+	sec := uint32(t.Unix())
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	times, exist := st.names[name]
+	earlier := !exist || sec < times.first
+	if earlier {
+		times.first = sec
+	}
+	times.last = max(times.last, sec)
+	st.names[name] = times
+	return time.Unix(int64(times.first), 0), earlier
+}
+
+// Get returns when name was first and last seen. A nil table has seen nothing.
+func (st *SeenTable) Get(name string) (first, last time.Time, exist bool) {
+	if st == nil {
+		return first, last, false
+	}
+	st.mu.RLock()
+	times, exist := st.names[name]
+	st.mu.RUnlock()
+	if !exist {
+		return first, last, false
+	}
+	return time.Unix(int64(times.first), 0), time.Unix(int64(times.last), 0), true
+}
+
+// due returns the names that are no longer new at the reaper time slot, or at
+// a slot that has passed, and forgets them.
+func (st *SeenTable) due(slot time.Time) []string {
+	if st == nil {
+		return nil
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var names []string
+	for t, aging := range st.aging {
+		if !t.After(slot) {
+			names = append(names, aging...)
+			delete(st.aging, t)
+		}
+	}
+	return names
+}
+
+// sweep forgets the names that have not been seen for the retention time,
+// unless keep says that they are still listed. It does so at most every
+// seenSweepInterval, and returns the number of names forgotten.
+func (st *SeenTable) sweep(now time.Time, keep func(name string) bool) int {
+	if st == nil {
+		return 0
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if now.Sub(st.swept) < seenSweepInterval {
+		return 0
+	}
+	st.swept = now
+	before := uint32(now.Add(-st.retention).Unix())
+	var n int
+	for name, times := range st.names {
+		if times.last < before && !keep(name) {
+			delete(st.names, name)
+			n++
+		}
+	}
+	return n
+}
+
+// age describes when name was first and last seen, for the lookups.
+func (st *SeenTable) age(name string, now time.Time) (string, bool) {
+	first, last, exist := st.Get(name)
+	if !exist {
+		return "", false
+	}
+	return fmt.Sprintf("first seen %s (%s ago), last seen %s (%s ago)",
+		first.UTC().Format(time.RFC3339), now.Sub(first).Round(time.Second),
+		last.UTC().Format(time.RFC3339), now.Sub(last).Round(time.Second)), true
+}
+
+// snapshot returns the table as it is saved in the list store.
+func (st *SeenTable) snapshot(now time.Time) SeenSnapshot {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	snap := SeenSnapshot{Saved: now, Names: make(map[string][2]uint32, len(st.names))}
+	for name, times := range st.names {
+		snap.Names[name] = [2]uint32{times.first, times.last}
+	}
+	return snap
+}
+
+// observe records that the names were seen, at their TimeAdded. A name that is
+// seen for the first time, or earlier than before, is scheduled to be decided
+// again when it is no longer new.
+func (pd *PopData) observe(tns ...tapir.TapirName) {
+	if pd.Seen == nil {
+		return
+	}
+	now := time.Now()
+	for _, tn := range tns {
+		if tn.TimeAdded.IsZero() {
+			continue
+		}
+		name := intern(tn.Name)
+		if first, earlier := pd.Seen.see(name, tn.TimeAdded); earlier {
+			pd.scheduleAging(name, first, now)
+		}
+	}
+}
+
+// scheduleAging has the Reaper decide name again when the firstseen rule no
+// longer fires for it.
+func (pd *PopData) scheduleAging(name string, first, now time.Time) {
+	age := pd.Policy.Doubtlist.FirstSeenAge
+	if age == 0 || !first.Add(age).After(now) {
+		return
+	}
+	slot := pd.reaperSlot(first.Add(age))
+	pd.Seen.mu.Lock()
+	pd.Seen.aging[slot] = append(pd.Seen.aging[slot], name)
+	pd.Seen.mu.Unlock()
+}
+
+// restoreSeen fills the seen table from the list store, before the lists are
+// loaded.
+func (pd *PopData) restoreSeen(snap *SeenSnapshot, now time.Time) {
+	pd.Seen.mu.Lock()
+	for name, times := range snap.Names {
+		pd.Seen.names[name] = seenTimes{first: times[0], last: times[1]}
+	}
+	pd.Seen.mu.Unlock()
+	for name, times := range snap.Names {
+		pd.scheduleAging(name, time.Unix(int64(times[0]), 0), now)
+	}
+}
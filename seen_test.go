@@ -0,0 +1,222 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/spf13/viper"
+)
+
+// newSeenTestPopData returns a PopData with the firstseen rule at 24h and an
+// empty doubtlist "local" that is managed through the API.
+func newSeenTestPopData(t *testing.T) *PopData {
+	t.Helper()
+	pd := newRunningTestPopData(t)
+	pd.Policy.Doubtlist.FirstSeenAge = 24 * time.Hour
+	pd.Policy.Doubtlist.FirstSeenAction = tapir.DROP
+	pd.Lists["doubtlist"]["local"] = &PopList{
+		WBGlist: &tapir.WBGlist{
+			Name: "local", Type: "doubtlist", Format: "map", Datasource: "api",
+			ReaperData: map[time.Time]map[string]bool{},
+		},
+		Names: newMemNames("local"),
+	}
+	return pd
+}
+
+func TestFirstSeenRule(t *testing.T) {
+	pd := newSeenTestPopData(t)
+	now := time.Now()
+	local := pd.Lists["doubtlist"]["local"]
+	names := []tapir.TapirName{
+		{Name: "new.example.", TimeAdded: now.Add(-time.Hour)},
+		{Name: "old.example.", TimeAdded: now.Add(-48 * time.Hour)},
+		{Name: "untimed.example."},
+	}
+	local.Names.Put(names...)
+	pd.observe(names...)
+
+	cases := []struct {
+		name  string
+		seen  time.Time // an observation before the decision, if set
+		want  tapir.Action
+		fired bool
+	}{
+		{name: "new.example.", want: tapir.DROP, fired: true},
+		{name: "old.example.", want: tapir.ALLOWLIST},
+		{name: "untimed.example.", want: tapir.ALLOWLIST},
+		// Seen again: the first time stays.
+		{name: "old.example.", seen: now, want: tapir.ALLOWLIST},
+		// Seen in another source before: no longer new.
+		{name: "new.example.", seen: now.Add(-25 * time.Hour), want: tapir.ALLOWLIST},
+	}
+	for _, c := range cases {
+		if !c.seen.IsZero() {
+			pd.observe(tapir.TapirName{Name: c.name, TimeAdded: c.seen})
+		}
+		action, reason := pd.decide(c.name)
+		fired := len(reason.Fired) == 1 && reason.Fired[0].Rule == "firstseen"
+		if action != c.want || fired != c.fired {
+			t.Errorf("%s: %s, fired %v; want %s, fired %v", c.name, tapir.ActionToString[action], reason.Fired,
+				tapir.ActionToString[c.want], c.fired)
+		}
+	}
+	if first, last, _ := pd.Seen.Get("old.example."); first.Unix() != now.Add(-48*time.Hour).Unix() || last.Unix() != now.Unix() {
+		t.Errorf("old.example.: first seen %v, last seen %v", first, last)
+	}
+	if _, _, exist := pd.Seen.Get("untimed.example."); exist {
+		t.Errorf("untimed.example. has been seen")
+	}
+	if report := pd.LookupReport("old.example."); !strings.Contains(report, "first seen "+now.Add(-48*time.Hour).UTC().Format(time.RFC3339)+" (48h0m") {
+		t.Errorf("LookupReport: %s", report)
+	}
+
+	pd.Policy.Doubtlist.FirstSeenAge = 0
+	if action, _ := pd.decide("new.example."); action != tapir.ALLOWLIST {
+		t.Errorf("without the rule: %s", tapir.ActionToString[action])
+	}
+}
+
+// TestSeenAging checks that a name the firstseen rule fired for leaves the
+// RPZ, in an IXFR, when the Reaper finds that it is no longer new.
+func TestSeenAging(t *testing.T) {
+	pd := newSeenTestPopData(t)
+	now := time.Now()
+	tm := &tapir.TapirMsg{ListType: "doubtlist", SrcName: "local",
+		Added: []tapir.Domain{{Name: "new.example.", TimeAdded: now.Add(-time.Hour)}}}
+	if _, err := pd.UpdateLocalList(tm, "test"); err != nil {
+		t.Fatalf("UpdateLocalList: %v", err)
+	}
+	snap := pd.Rpz.Current()
+	if snap.Data["new.example."] != tapir.DROP {
+		t.Fatalf("new.example. is not in the RPZ: %v", snap.Data)
+	}
+	var aging []string
+	for slot, names := range pd.Seen.aging {
+		if d := slot.Sub(now); d < 23*time.Hour-time.Minute || d > 23*time.Hour+time.Minute {
+			t.Errorf("aging in %v, want 23h", d)
+		}
+		aging = names
+	}
+	if len(pd.Seen.aging) != 1 || len(aging) != 1 || aging[0] != "new.example." {
+		t.Fatalf("aging: %v", pd.Seen.aging)
+	}
+
+	// A day later.
+	pd.Seen.mu.Lock()
+	pd.Seen.names["new.example."] = seenTimes{first: uint32(now.Add(-25 * time.Hour).Unix()), last: uint32(now.Unix())}
+	pd.Seen.aging = map[time.Time][]string{now.Add(-time.Minute): aging}
+	pd.Seen.mu.Unlock()
+	if err := pd.Reaper(false); err != nil {
+		t.Fatalf("Reaper: %v", err)
+	}
+	snap = pd.Rpz.Current()
+	if _, exist := snap.Data["new.example."]; exist || len(pd.Seen.aging) != 0 {
+		t.Errorf("new.example. is still in the RPZ, or still aging: %v", pd.Seen.aging)
+	}
+	if n := len(snap.IxfrChain); n == 0 || len(snap.IxfrChain[n-1].Removed) != 1 {
+		t.Errorf("no IXFR with the removal: %+v", snap.IxfrChain)
+	}
+}
+
+func TestSeenStore(t *testing.T) {
+	viper.Set("services.liststore.dir", t.TempDir())
+	defer viper.Set("services.liststore.dir", "")
+	ls, err := NewListStore()
+	if err != nil {
+		t.Fatalf("NewListStore: %v", err)
+	}
+	if snap, err := ls.LoadSeen(); snap != nil || err != nil {
+		t.Fatalf("LoadSeen before saving: %v, %v", snap, err)
+	}
+
+	now := time.Now()
+	pd := newSeenTestPopData(t)
+	pd.observe(tapir.TapirName{Name: "new.example.", TimeAdded: now.Add(-time.Hour)},
+		tapir.TapirName{Name: "old.example.", TimeAdded: now.Add(-48 * time.Hour)},
+		tapir.TapirName{Name: "old.example.", TimeAdded: now.Add(-2 * time.Hour)})
+	if err := ls.Save(pd); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	snap, err := ls.LoadSeen()
+	if err != nil || snap == nil {
+		t.Fatalf("LoadSeen: %v, %v", snap, err)
+	}
+	restored := newSeenTestPopData(t)
+	restored.restoreSeen(snap, now)
+	for _, name := range []string{"new.example.", "old.example."} {
+		f1, l1, _ := pd.Seen.Get(name)
+		f2, l2, exist := restored.Seen.Get(name)
+		if !exist || !f1.Equal(f2) || !l1.Equal(l2) {
+			t.Errorf("%s: first %v, last %v; want %v, %v", name, f2, l2, f1, l1)
+		}
+	}
+	// Only the new name comes of age later.
+	if len(restored.Seen.aging) != 1 {
+		t.Errorf("aging after the restore: %v", restored.Seen.aging)
+	}
+}
+
+// TestSeenSweepListed checks that the Reaper keeps the first-seen time of a
+// name that has not been seen for the retention time while a list still has
+// it, also when the list is on disk.
+func TestSeenSweepListed(t *testing.T) {
+	viper.Set("services.namestore.dir", t.TempDir())
+	defer viper.Set("services.namestore.dir", "")
+	pd := newSeenTestPopData(t)
+	pl, err := newPopList(&tapir.WBGlist{Name: "ondisk", Type: "doubtlist", Format: "map", Datasource: "mqtt",
+		ReaperData: map[time.Time]map[string]bool{}}, "disk")
+	if err != nil {
+		t.Fatalf("newPopList: %v", err)
+	}
+	defer pl.Names.Close()
+	pd.Lists["doubtlist"]["ondisk"] = pl
+
+	now := time.Now()
+	old := now.Add(-40 * 24 * time.Hour)
+	pl.Names.Put(tapir.TapirName{Name: "listed.example.", TimeAdded: old})
+	pd.observe(tapir.TapirName{Name: "listed.example.", TimeAdded: old},
+		tapir.TapirName{Name: "gone.example.", TimeAdded: old})
+	pd.Seen.swept = now.Add(-seenSweepInterval)
+
+	if err := pd.Reaper(false); err != nil {
+		t.Fatalf("Reaper: %v", err)
+	}
+	if first, _, exist := pd.Seen.Get("listed.example."); !exist || first.Unix() != old.Unix() {
+		t.Errorf("listed.example.: first seen %v, %v", first, exist)
+	}
+	if _, _, exist := pd.Seen.Get("gone.example."); exist {
+		t.Errorf("gone.example. was not forgotten")
+	}
+}
+
+func TestSeenSweep(t *testing.T) {
+	st, err := NewSeenTable()
+	if err != nil {
+		t.Fatalf("NewSeenTable: %v", err)
+	}
+	now := time.Now()
+	st.see("recent.example.", now.Add(-time.Hour))
+	st.see("gone.example.", now.Add(-40*24*time.Hour))
+	st.see("listed.example.", now.Add(-40*24*time.Hour))
+	listed := func(name string) bool { return name == "listed.example." }
+
+	if n := st.sweep(now, listed); n != 0 {
+		t.Errorf("swept %d names right after the start", n)
+	}
+	if n := st.sweep(now.Add(seenSweepInterval), listed); n != 1 {
+		t.Errorf("swept %d names, want 1", n)
+	}
+	for name, want := range map[string]bool{"recent.example.": true, "gone.example.": false, "listed.example.": true} {
+		if _, _, exist := st.Get(name); exist != want {
+			t.Errorf("%s: seen %v, want %v", name, exist, want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Coordinated shutdown. Components register what must be done to stop them
+// with OnShutdown; Run does it in stage order when the POP is told to stop
+// (SIGINT, SIGTERM, the "stop" API command) or dies through POPExiter.
+
+type shutdownStage int
+
+const (
+	shutdownDrain   shutdownStage = iota // stop accepting work, finish what is in flight
+	shutdownServers                      // close the DNS and HTTP servers
+	shutdownEngines                      // stop MQTT and the internal engines
+	shutdownState                        // flush state to disk
+)
+
+// shutdownTimeout is how long Run waits for all stages together. In-flight
+// transfers that take longer are cut off.
+const shutdownTimeout = 30 * time.Second
+
+type shutdownHook struct {
+	stage shutdownStage
+	name  string
+	fn    func(ctx context.Context) error
+}
+
+type Shutdown struct {
+	ctx    context.Context // cancelled when the shutdown starts
+	cancel context.CancelFunc
+	done   chan struct{} // closed when Run has finished
+
+	mu      sync.Mutex
+	started bool
+	hooks   []shutdownHook
+}
+
+func NewShutdown() *Shutdown {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Shutdown{ctx: ctx, cancel: cancel, done: make(chan struct{})}
+}
+
+// Context returns a context that is cancelled as soon as the shutdown starts.
+func (s *Shutdown) Context() context.Context { return s.ctx }
+
+// OnShutdown registers fn to be called in stage. Hooks in the same stage are
+// called in the order they were registered. The context passed to fn carries
+// the shutdown deadline.
+func (s *Shutdown) OnShutdown(stage shutdownStage, name string, fn func(ctx context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		log.Printf("Shutdown: %s registered after the shutdown started, ignored", name)
+		return
+	}
+	s.hooks = append(s.hooks, shutdownHook{stage: stage, name: name, fn: fn})
+}
+
+// Run shuts down: it cancels Context() and calls the hooks, stage by stage,
+// within shutdownTimeout. Only the first call does anything; later calls wait
+// for it to finish, but no longer than shutdownTimeout, as they may come from
+// a hook.
+func (s *Shutdown) Run(reason string) {
+	s.mu.Lock()
+	if s.started {
+		s.mu.Unlock()
+		select {
+		case <-s.done:
+		case <-time.After(shutdownTimeout):
+		}
+		return
+	}
+	s.started = true
+	hooks := slices.Clone(s.hooks)
+	s.mu.Unlock()
+	defer close(s.done)
+
+	log.Printf("Shutdown: %s. Shutting down (deadline %v)", reason, shutdownTimeout)
+	if err := sdNotify("STOPPING=1"); err != nil {
+		log.Printf("Shutdown: %v", err)
+	}
+	s.cancel()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	slices.SortStableFunc(hooks, func(a, b shutdownHook) int { return int(a.stage) - int(b.stage) })
+	for _, h := range hooks {
+		if err := h.fn(ctx); err != nil {
+			log.Printf("Shutdown: %s: %v", h.name, err)
+		}
+	}
+	log.Printf("Shutdown: complete")
+}
+
+// serveHTTP runs srv, with TLS unless certfile is empty, until the shutdown
+// closes it. Any other error is fatal. An inherited socket for srv.Addr is
+// used if there is one.
+func serveHTTP(conf *Config, srv *http.Server, certfile, keyfile string) {
+	conf.Internal.Shutdown.OnShutdown(shutdownServers, "HTTP server on "+srv.Addr, srv.Shutdown)
+	var err error
+	l := inheritedSockets.listener(srv.Addr)
+	switch {
+	case l != nil && certfile != "":
+		err = srv.ServeTLS(l, certfile, keyfile)
+	case l != nil:
+		err = srv.Serve(l)
+	case certfile != "":
+		err = srv.ListenAndServeTLS(certfile, keyfile)
+	default:
+		err = srv.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		POPExiter(err)
+	}
+}
+
+// untilDone runs fn, which does not take a context, but gives up when ctx
+// is done.
+func untilDone(ctx context.Context, fn func() error) error {
+	errch := make(chan error, 1)
+	go func() { errch <- fn() }()
+	select {
+	case err := <-errch:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
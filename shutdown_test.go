@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestShutdownRun(t *testing.T) {
+	s := NewShutdown()
+	var calls []string
+	hook := func(name string, err error) func(context.Context) error {
+		return func(ctx context.Context) error {
+			if _, ok := ctx.Deadline(); !ok {
+				t.Errorf("%s: no deadline", name)
+			}
+			if s.Context().Err() == nil {
+				t.Errorf("%s: Context() not cancelled", name)
+			}
+			calls = append(calls, name)
+			return err
+		}
+	}
+	// Registered out of order; run by stage, then in order of registration.
+	s.OnShutdown(shutdownState, "state", hook("state", nil))
+	s.OnShutdown(shutdownServers, "dns", hook("dns", errors.New("not started")))
+	s.OnShutdown(shutdownDrain, "drain", hook("drain", nil))
+	s.OnShutdown(shutdownServers, "http", hook("http", nil))
+
+	s.Run("test")
+	s.Run("again") // returns at once, the shutdown is done
+	s.OnShutdown(shutdownState, "late", hook("late", nil))
+
+	if want := []string{"drain", "dns", "http", "state"}; !slices.Equal(calls, want) {
+		t.Errorf("hooks called %v, want %v", calls, want)
+	}
+}
+
+func TestDnsLimitsDrain(t *testing.T) {
+	dl := newTestDnsLimits(t, 2)
+	if !dl.startTransfer() {
+		t.Fatal("no transfer slot")
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		dl.endTransfer() // the transfer in flight finishes
+	}()
+	if err := dl.drain(context.Background()); err != nil {
+		t.Errorf("drain: %v", err)
+	}
+	if dl.startTransfer() {
+		t.Errorf("transfer started after drain")
+	}
+
+	// A transfer that does not finish is cut off at the deadline.
+	dl = newTestDnsLimits(t, 2)
+	dl.startTransfer()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := dl.drain(ctx); err == nil {
+		t.Errorf("drain with a transfer in flight returned nil")
+	}
+}
+
+// TestServeHTTPShutdown checks that an HTTP server closed by the shutdown is
+// not treated as a fatal error.
+func TestServeHTTPShutdown(t *testing.T) {
+	saved := POPExiter
+	defer func() { POPExiter = saved }()
+	POPExiter = func(args ...interface{}) { t.Errorf("POPExiter(%v)", args[0]) }
+
+	conf := &Config{}
+	conf.Internal.Shutdown = NewShutdown()
+	srv := &http.Server{Addr: "127.0.0.1:0"}
+	done := make(chan struct{})
+	go func() {
+		serveHTTP(conf, srv, "", "")
+		close(done)
+	}()
+	for registered := false; !registered; time.Sleep(time.Millisecond) {
+		conf.Internal.Shutdown.mu.Lock()
+		registered = len(conf.Internal.Shutdown.hooks) > 0
+		conf.Internal.Shutdown.mu.Unlock()
+	}
+	conf.Internal.Shutdown.Run("test")
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("serveHTTP did not return after the shutdown")
+	}
+}
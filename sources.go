@@ -20,41 +20,51 @@ import (
 )
 
 func NewPopData(conf *Config, lg *log.Logger) (*PopData, error) {
-	rpzdata := RpzData{
-		CurrentSerial: 1,
-		ZoneName:      viper.GetString("services.rpz.zonename"),
-		IxfrChain:     []RpzIxfr{},
-		Axfr: RpzAxfr{
-			Data: map[string]*tapir.RpzName{},
-		},
-		// RpzMap: map[string]*tapir.RpzName{},
-	}
-
 	repint := viper.GetInt("services.reaper.interval")
 	if repint == 0 {
 		repint = 60
 	}
 
 	pd := PopData{
-		Lists:             map[string]map[string]*tapir.WBGlist{},
+		Lists:             map[string]map[string]*PopList{},
 		Logger:            lg,
 		MqttLogger:        conf.Loggers.Mqtt,
 		RpzRefreshCh:      make(chan RpzRefresh, 10),
 		RpzCommandCh:      make(chan RpzCmdData, 10),
 		ComponentStatusCh: conf.Internal.ComponentStatusCh,
-		Rpz:               rpzdata,
 		ReaperInterval:    time.Duration(repint) * time.Second,
-		Verbose:           viper.GetBool("log.verbose"),
-		Debug:             viper.GetBool("log.debug"),
 	}
 
-	pd.Lists["allowlist"] = make(map[string]*tapir.WBGlist, 3)
-	pd.Lists["doubtlist"] = make(map[string]*tapir.WBGlist, 3)
-	pd.Lists["denylist"] = make(map[string]*tapir.WBGlist, 3)
+	pd.Rpz.ZoneName = viper.GetString("services.rpz.zonename")
+
+	explain, err := NewExplainConf(pd.Rpz.ZoneName)
+	if err != nil {
+		POPExiter("NewPopData: Error from NewExplainConf(): %v", err)
+	}
+	pd.Explain = explain
+
+	pd.Limits, err = NewDnsLimits()
+	if err != nil {
+		POPExiter("NewPopData: Error from NewDnsLimits(): %v", err)
+	}
+
+	pd.Audit, err = NewAuditor()
+	if err != nil {
+		POPExiter("NewPopData: Error from NewAuditor(): %v", err)
+	}
+
+	pd.ListStore, err = NewListStore()
+	if err != nil {
+		POPExiter("NewPopData: Error from NewListStore(): %v", err)
+	}
+
+	pd.Lists["allowlist"] = make(map[string]*PopList, 3)
+	pd.Lists["doubtlist"] = make(map[string]*PopList, 3)
+	pd.Lists["denylist"] = make(map[string]*PopList, 3)
 	pd.Downstreams = map[string]RpzDownstream{}
 	pd.DownstreamSerials = map[string]uint32{}
 
-	err := pd.ParseOutputs()
+	err = pd.ParseOutputs()
 	if err != nil {
 		POPExiter("NewPopData: Error from ParseOutputs(): %v", err)
 	}
@@ -62,9 +72,15 @@ func NewPopData(conf *Config, lg *log.Logger) (*PopData, error) {
 	//	pd.Rpz.IxfrChain = map[uint32]RpzIxfr{}
 	pd.RpzSources = map[string]*tapir.ZoneData{}
 
+	// The first, still empty, version of the RPZ output. BootstrapRpzOutput
+	// adds the apex and GenerateRpzAxfr the data.
+	pd.Rpz.publish(&RpzSnapshot{
+		Serial: pd.cachedSerial(),
+		Data:   map[string]tapir.Action{},
+	})
 	err = pd.BootstrapRpzOutput()
 	if err != nil {
-		pd.Logger.Printf("Error from BootstrapRpzOutput(): %v", err)
+		compLogger("policy").Error("NewPopData: BootstrapRpzOutput failed", "error", err)
 	}
 
 	pd.Policy.Logger = conf.Loggers.Policy
@@ -108,14 +124,47 @@ func NewPopData(conf *Config, lg *log.Logger) (*PopData, error) {
 		POPExiter("Error parsing policy: %v", err)
 	}
 
+	if age := viper.GetString("policy.doubtlist.firstseen.age"); age != "" {
+		pd.Policy.Doubtlist.FirstSeenAge, err = time.ParseDuration(age)
+		if err != nil || pd.Policy.Doubtlist.FirstSeenAge < 0 {
+			POPExiter("Error parsing policy: doubtlist.firstseen.age must be a duration, like \"24h\"")
+		}
+		pd.Policy.Doubtlist.FirstSeenAction, err =
+			tapir.StringToAction(viper.GetString("policy.doubtlist.firstseen.action"))
+		if err != nil {
+			POPExiter("Error parsing policy: %v", err)
+		}
+	}
+
+	// The seen table is restored before the lists, which only add to it.
+	pd.Seen, err = NewSeenTable()
+	if err != nil {
+		POPExiter("NewPopData: Error from NewSeenTable(): %v", err)
+	}
+	if snap, err := pd.ListStore.LoadSeen(); err != nil {
+		compLogger("main").Warn("NewPopData: cannot load the seen table, names start out without an age", "error", err)
+	} else if snap != nil {
+		pd.restoreSeen(snap, time.Now())
+		compLogger("main").Info("NewPopData: restored the first and last seen times", "names", len(snap.Names))
+	}
+
+	pd.Overrides = NewOverrideTable()
+	if saved, err := pd.ListStore.LoadOverrides(); err != nil {
+		compLogger("main").Warn("NewPopData: cannot load the overrides, starting without them", "error", err)
+	} else if len(saved) > 0 {
+		n := pd.restoreOverrides(saved, time.Now())
+		compLogger("main").Info("NewPopData: restored the overrides", "overrides", n, "ended", len(saved)-n)
+	}
+
 	// Note: We can not parse data sources here, as RefreshEngine has not yet started.
 	conf.PopData = &pd
 	return &pd, nil
 }
 
 func (pd *PopData) ParseSourcesNG() error {
+	lg := compLogger("sources")
 	var srcfoo SrcFoo
-	configFile := filepath.Clean(tapir.PopSourcesCfgFile)
+	configFile := filepath.Clean(sourcesCfgFile)
 	data, err := os.ReadFile(configFile)
 	if err != nil {
 		return fmt.Errorf("error reading config file: %v", err)
@@ -131,32 +180,34 @@ func (pd *PopData) ParseSourcesNG() error {
 	//	}
 
 	pd.mu.Lock()
-	pd.Lists["allowlist"]["allow_catchall"] =
-		&tapir.WBGlist{
+	pd.Lists["allowlist"]["allow_catchall"] = &PopList{
+		WBGlist: &tapir.WBGlist{
 			Name:        "allow_catchall",
 			Description: "Allowlist consisting of allow names found in deny- or doubtlist sources",
 			Type:        "allowlist",
 			SrcFormat:   "none",
 			Format:      "map",
 			Datasource:  "Data misplaced in other sources",
-			Names:       map[string]tapir.TapirName{},
 			ReaperData:  map[time.Time]map[string]bool{},
-		}
-	pd.Lists["doubtlist"]["doubt_catchall"] =
-		&tapir.WBGlist{
+		},
+		Names: newMemNames("allow_catchall"),
+	}
+	pd.Lists["doubtlist"]["doubt_catchall"] = &PopList{
+		WBGlist: &tapir.WBGlist{
 			Name:        "doubt_catchall",
 			Description: "Doubtlist consisting of doubt names found in allowlist sources",
 			Type:        "doubtlist",
 			SrcFormat:   "none",
 			Format:      "map",
 			Datasource:  "Data misplaced in other sources",
-			Names:       map[string]tapir.TapirName{},
 			ReaperData:  map[time.Time]map[string]bool{},
-		}
+		},
+		Names: newMemNames("doubt_catchall"),
+	}
 	pd.mu.Unlock()
 
 	srcs := srcfoo.Sources
-	pd.Logger.Printf("*** ParseSourcesNG: there are %d sources defined in config", len(srcs))
+	lg.Info("ParseSourcesNG: sources defined in the config", "sources", len(srcs))
 
 	// Each active source is parsed in its own goroutine. We use an errgroup
 	// rather than a hand-rolled WaitGroup/counter+channel: a source completes
@@ -168,43 +219,41 @@ func (pd *PopData) ParseSourcesNG() error {
 
 	for name, src := range srcs {
 		if !*src.Active {
-			pd.Logger.Printf("*** ParseSourcesNG: Source \"%s\" is not active. Ignored.", name)
+			lg.Info("ParseSourcesNG: source is not active, ignored", "source", name)
 			continue
 		}
-		if pd.Debug {
-			pd.Logger.Printf("=== ParseSourcesNG: Source: %s (%s) will be used (list type %s)", name, src.Name, src.Type)
-		}
+		lg.Debug("ParseSourcesNG: source will be used", "source", name, "name", src.Name, "type", src.Type)
 
 		name, src := name, src // capture range vars for the closure
+		pd.Health.ExpectSource(src.Name, src.Source, dns.Fqdn(src.Zone))
 
-		g.Go(func() error {
-			pd.Logger.Printf("--> parsing source \"%s\" (source %s)", name, src.Source)
+		parse := func() error {
+			lg.Info("ParseSourcesNG: parsing source", "source", name, "type", src.Source)
 
-			newsource := tapir.WBGlist{
+			newsource, err := newPopList(&tapir.WBGlist{
 				Name:        src.Name,
 				Description: src.Description,
 				Type:        src.Type,
 				SrcFormat:   src.Format,
 				Datasource:  src.Source,
-				Names:       map[string]tapir.TapirName{},
 				ReaperData:  map[time.Time]map[string]bool{},
 				Filename:    src.Filename,
 				RpzUpstream: src.Upstream,
 				RpzZoneName: dns.Fqdn(src.Zone),
+			}, src.Store)
+			if err != nil {
+				return fmt.Errorf("source %q: %v", name, err)
 			}
 
 			switch src.Source {
 			case "mqtt":
-				if pd.Debug {
-					pd.Logger.Printf("ParseSourcesNG: Fetching MQTT validator key for topic %s", src.Topic)
-				}
+				lg.Debug("ParseSourcesNG: fetching the MQTT validator key", "topic", src.Topic)
 
-				pd.Logger.Printf("ParseSourcesNG: Adding topic '%s' to MQTT Engine", src.Topic)
+				lg.Info("ParseSourcesNG: adding the topic to the MQTT engine", "topic", src.Topic)
 				err := pd.MqttEngine.SubToTopic(src.Topic, pd.TapirObservations, "struct", true) // XXX: Brr. kludge.
 				if err != nil {
 					POPExiter("Error adding topic %s to MQTT Engine: %v", src.Topic, err)
 				}
-				pd.Logger.Printf("ParseSourcesNG: Topic data for topic %s", src.Topic)
 
 				mqttDetails := tapir.MqttDetails{
 					Topics:       []string{src.Topic},
@@ -216,30 +265,74 @@ func (pd *PopData) ParseSourcesNG() error {
 				newsource.Immutable = src.Immutable
 
 				newsource.Format = "map" // for now
+				// The snapshot from the list store, if any, is what we had
+				// before the restart. The bootstrap data is reconciled with it.
+				snap, err := pd.ListStore.Load("doubtlist", newsource.Name)
+				if err != nil {
+					lg.Error("ParseSourcesNG: cannot load the saved list", "source", src.Name, "error", err)
+				}
+				if snap != nil {
+					reaped, err := pd.restoreList(newsource, snap, time.Now())
+					if err != nil {
+						return fmt.Errorf("error restoring MQTT source %s: %v", src.Name, err)
+					}
+					lg.Info("ParseSourcesNG: loaded the saved MQTT source", "source", src.Name,
+						"names", newsource.Names.Len(), "saved", snap.Saved.Format(tapir.TimeLayout), "expired", reaped)
+				}
+				var bootstrapErr error
 				if len(src.Bootstrap) > 0 {
-					pd.Logger.Printf("ParseSourcesNG: The %s MQTT source has %d bootstrap servers: %v", src.Name, len(src.Bootstrap), src.Bootstrap)
+					lg.Info("ParseSourcesNG: bootstrapping the MQTT source", "source", src.Name, "servers", src.Bootstrap)
+					since := time.Now()
 					tmp, err := pd.BootstrapMqttSource(src)
 					if err != nil {
-						pd.Logger.Printf("Error bootstrapping MQTT source %s: %v", src.Name, err)
-					} else {
-						newsource = *tmp
+						lg.Error("ParseSourcesNG: bootstrapping the MQTT source failed", "source", src.Name, "error", err)
+						bootstrapErr = err
+						go pd.retryBootstrap(src)
+					} else if _, err := pd.reconcileList(newsource, tmp, since); err != nil {
+						return fmt.Errorf("error storing the bootstrapped MQTT source %s: %v", src.Name, err)
+					}
+				}
+				pd.mu.Lock()
+				pd.Lists["doubtlist"][newsource.Name] = newsource
+				lg.Info("ParseSourcesNG: created list", "type", "doubtlist", "source", newsource.Name)
+				pd.mu.Unlock()
+				// The list is kept and fed over MQTT, but unless it was
+				// restored from the list store it is not loaded until a
+				// bootstrap has succeeded.
+				if bootstrapErr != nil {
+					if snap != nil {
+						lg.Warn("ParseSourcesNG: MQTT source not bootstrapped, using the saved list until it can be", "source", src.Name)
+						return nil
 					}
+					return fmt.Errorf("error bootstrapping MQTT source %s: %v", src.Name, bootstrapErr)
 				}
+				return nil
+			case "api":
+				// Starts out empty and is managed through /api/v2.
+				if _, exist := pd.Lists[src.Type]; !exist {
+					return fmt.Errorf("source %q has unknown list type %q", name, src.Type)
+				}
+				newsource.Format = "map"
 				pd.mu.Lock()
-				pd.Lists["doubtlist"][newsource.Name] = &newsource
-				pd.Logger.Printf("Created list [doubtlist][%s]", newsource.Name)
+				pd.Lists[src.Type][newsource.Name] = newsource
 				pd.mu.Unlock()
-				pd.Logger.Printf("*** MQTT sources are only managed via RefreshEngine.")
+				lg.Info("ParseSourcesNG: created list, managed through the API", "type", src.Type, "source", newsource.Name)
 				return nil
 			case "file":
-				return pd.ParseLocalFile(name, &newsource)
+				return pd.ParseLocalFile(name, newsource)
 			case "xfr":
-				err := pd.ParseRpzFeed(name, &newsource)
-				pd.Logger.Printf("source \"%s\" now returned from ParseRpzFeed().", name)
+				err := pd.ParseRpzFeed(name, newsource)
 				return err
 			default:
 				return fmt.Errorf("unhandled source type %q for source %q", src.Source, name)
 			}
+		}
+		g.Go(func() error {
+			err := parse()
+			if err == nil {
+				pd.Health.SourceLoaded(src.Name)
+			}
+			return err
 		})
 	}
 
@@ -252,9 +345,9 @@ func (pd *PopData) ParseSourcesNG() error {
 	// failed feed as fatal. (Whether some classes of source failure SHOULD be
 	// fatal is the broader fatal-vs-degrade question tracked in #154.)
 	if err := g.Wait(); err != nil {
-		log.Printf("ParseSourcesNG: at least one source failed to parse (non-fatal, continuing): %v", err)
+		lg.Error("ParseSourcesNG: at least one source failed to parse (non-fatal, continuing)", "error", err)
 	}
-	pd.Logger.Printf("ParseSources: all sources done.")
+	lg.Info("ParseSourcesNG: all sources done")
 
 	if pd.MqttEngine != nil && !pd.TapirMqttEngineRunning {
 		err := pd.StartMqttEngine(pd.MqttEngine)
@@ -263,18 +356,17 @@ func (pd *PopData) ParseSourcesNG() error {
 		}
 	}
 
-	pd.Logger.Printf("ParseSources: static sources done.")
-
 	err = pd.GenerateRpzAxfr()
 	if err != nil {
-		pd.Logger.Printf("ParseSources: Error from GenerateRpzAxfr(): %v", err)
+		compLogger("policy").Error("ParseSourcesNG: GenerateRpzAxfr failed", "error", err)
 	}
 
 	return nil
 }
 
-func (pd *PopData) ParseLocalFile(sourceid string, s *tapir.WBGlist) error {
-	pd.Logger.Printf("ParseLocalFile: %s (%s)", sourceid, s.Type)
+func (pd *PopData) ParseLocalFile(sourceid string, s *PopList) error {
+	lg := compLogger("sources")
+	lg.Info("ParseLocalFile: loading", "source", sourceid, "type", s.Type)
 	var df dawg.Finder
 	var err error
 
@@ -286,9 +378,9 @@ func (pd *PopData) ParseLocalFile(sourceid string, s *tapir.WBGlist) error {
 
 	switch s.SrcFormat {
 	case "domains":
-		s.Names = map[string]tapir.TapirName{}
+		names := map[string]tapir.TapirName{}
 		s.Format = "map"
-		_, err := tapir.ParseText(s.Filename, s.Names, true)
+		_, err := tapir.ParseText(s.Filename, names, true)
 		if err != nil {
 			if os.IsNotExist(err) {
 				POPExiter("ParseLocalFile: source %s (type file: %s) does not exist",
@@ -296,11 +388,14 @@ func (pd *PopData) ParseLocalFile(sourceid string, s *tapir.WBGlist) error {
 			}
 			POPExiter("ParseLocalFile: error parsing file %s: %v", s.Filename, err)
 		}
+		if err := s.setNames(names); err != nil {
+			return fmt.Errorf("ParseLocalFile: source %s: %v", sourceid, err)
+		}
 
 	case "csv":
-		s.Names = map[string]tapir.TapirName{}
+		names := map[string]tapir.TapirName{}
 		s.Format = "map"
-		_, err := tapir.ParseCSV(s.Filename, s.Names, true)
+		_, err := tapir.ParseCSV(s.Filename, names, true)
 		if err != nil {
 			if os.IsNotExist(err) {
 				POPExiter("ParseLocalFile: source %s (type file: %s) does not exist",
@@ -308,18 +403,21 @@ func (pd *PopData) ParseLocalFile(sourceid string, s *tapir.WBGlist) error {
 			}
 			POPExiter("ParseLocalFile: error parsing file %s: %v", s.Filename, err)
 		}
+		if err := s.setNames(names); err != nil {
+			return fmt.Errorf("ParseLocalFile: source %s: %v", sourceid, err)
+		}
 
 	case "dawg":
 		if s.Type != "allowlist" {
 			POPExiter("Error: source %s (file %s): DAWG is only defined for allowlists.",
 				sourceid, s.Filename)
 		}
-		pd.Logger.Printf("ParseLocalFile: loading DAWG: %s", s.Filename)
+		lg.Info("ParseLocalFile: loading DAWG", "file", s.Filename)
 		df, err = dawg.Load(s.Filename)
 		if err != nil {
 			POPExiter("Error from dawg.Load(%s): %v", s.Filename, err)
 		}
-		pd.Logger.Printf("ParseLocalFile: DAWG loaded")
+		lg.Info("ParseLocalFile: DAWG loaded", "file", s.Filename)
 		s.Format = "dawg"
 		s.Dawgf = df
 
@@ -334,7 +432,7 @@ func (pd *PopData) ParseLocalFile(sourceid string, s *tapir.WBGlist) error {
 	return nil
 }
 
-func (pd *PopData) ParseRpzFeed(sourceid string, s *tapir.WBGlist) error {
+func (pd *PopData) ParseRpzFeed(sourceid string, s *PopList) error {
 	//	zone := viper.GetString(fmt.Sprintf("sources.%s.zone", sourceid)) // XXX: not the way to do it
 	//	if zone == "" {
 	//		return fmt.Errorf("Unable to load RPZ source %s, upstream zone not specified.",
@@ -347,11 +445,10 @@ func (pd *PopData) ParseRpzFeed(sourceid string, s *tapir.WBGlist) error {
 		return fmt.Errorf("unable to load RPZ source %s, upstream address not specified", sourceid)
 	}
 
-	s.Names = map[string]tapir.TapirName{} // must initialize
 	s.Format = "map"
 	//	s.RpzZoneName = dns.Fqdn(zone)
 	//	s.RpzUpstream = upstream
-	pd.Logger.Printf("---> SetupRPZFeed: about to transfer zone %s from %s", s.RpzZoneName, s.RpzUpstream)
+	compLogger("sources").Info("ParseRpzFeed: transferring zone", "zone", s.RpzZoneName, "upstream", s.RpzUpstream)
 
 	var reRpt = make(chan RpzRefreshResult, 1)
 	pd.RpzRefreshCh <- RpzRefresh{
@@ -359,15 +456,20 @@ func (pd *PopData) ParseRpzFeed(sourceid string, s *tapir.WBGlist) error {
 		Upstream:    s.RpzUpstream,
 		RRParseFunc: pd.RpzParseFuncFactory(s),
 		ZoneType:    tapir.RpzZone,
+		Xot:         viper.GetBool(fmt.Sprintf("sources.%s.xot", sourceid)),
 		Resp:        reRpt,
 	}
 
-	<-reRpt
+	res := <-reRpt
 
 	pd.mu.Lock()
 	pd.Lists[s.Type][s.Name] = s
 	pd.mu.Unlock()
-	pd.Logger.Printf("ParseRpzFeed: parsing RPZ %s complete", s.RpzZoneName)
+	if res.Error {
+		// Kept, as the RefreshEngine will retry the transfer.
+		return fmt.Errorf("transfer of RPZ %s from %s failed: %s", s.RpzZoneName, s.RpzUpstream, res.ErrorMsg)
+	}
+	compLogger("sources").Info("ParseRpzFeed: RPZ parsed", "zone", s.RpzZoneName)
 
 	return nil
 }
@@ -379,16 +481,14 @@ func (pd *PopData) ParseRpzFeed(sourceid string, s *tapir.WBGlist) error {
 //  2. If a "{doubt|deny}list" RPZ source has a rule with an "rpz-passthru." (i.e. allowlist) action then that
 //     rule doesn't really belong in a "{doubt|deny}list" source. So we take that rule an put it in the
 //     allow_catchall bucket instead.
-func (pd *PopData) RpzParseFuncFactory(s *tapir.WBGlist) func(*dns.RR, *tapir.ZoneData) bool {
+func (pd *PopData) RpzParseFuncFactory(s *PopList) func(*dns.RR, *tapir.ZoneData) bool {
+	lg := compLogger("sources")
 	return func(rr *dns.RR, zd *tapir.ZoneData) bool {
 		var action tapir.Action
-		name := strings.TrimSuffix((*rr).Header().Name, zd.ZoneName)
+		name := strings.TrimSuffix(dns.CanonicalName((*rr).Header().Name), dns.CanonicalName(zd.ZoneName))
 		switch (*rr).Header().Rrtype {
 		case dns.TypeSOA, dns.TypeNS:
-			if tapir.GlobalCF.Debug {
-				pd.Logger.Printf("ParseFunc: RPZ %s: looking at %s", zd.ZoneName,
-					dns.TypeToString[(*rr).Header().Rrtype])
-			}
+			lg.Debug("ParseFunc: apex RR", "zone", zd.ZoneName, "type", dns.TypeToString[(*rr).Header().Rrtype])
 			return true
 		case dns.TypeCNAME:
 			switch (*rr).(*dns.CNAME).Target {
@@ -401,50 +501,100 @@ func (pd *PopData) RpzParseFuncFactory(s *tapir.WBGlist) func(*dns.RR, *tapir.Zo
 			case "rpz-passthru.":
 				action = tapir.ALLOWLIST
 			default:
-				pd.Logger.Printf("UNKNOWN RPZ action: \"%s\" (src: %s)", (*rr).(*dns.CNAME).Target, s.Name)
+				lg.Warn("ParseFunc: unknown RPZ action", "action", (*rr).(*dns.CNAME).Target, "source", s.Name)
 				action = tapir.UnknownAction
 			}
-			if tapir.GlobalCF.Debug {
-				pd.Logger.Printf("ParseFunc: zone %s: name %s action: %v", zd.ZoneName,
-					name, action)
-			}
+			lg.Debug("ParseFunc: RPZ rule", "zone", zd.ZoneName, "name", name, "action", tapir.ActionToString[action])
+			// The list may already be in use (this is a refresh), so it is only
+			// changed under the lock, like the catchall lists.
+			pd.mu.Lock()
+			var err error
 			switch s.Type {
 			case "allowlist":
 				if action == tapir.ALLOWLIST {
-					s.Names[name] = tapir.TapirName{Name: name} // drop all other actions
+					err = s.Names.Put(tapir.TapirName{Name: name}) // drop all other actions
 				} else {
-					pd.Logger.Printf("Warning: allowlist RPZ source %s has denylisted name: %s",
-						s.RpzZoneName, name)
-					pd.mu.Lock()
-					pd.Lists["doubtlist"]["doubt_catchall"].Names[name] =
+					lg.Warn("ParseFunc: allowlist RPZ source has a denylisted name", "zone", s.RpzZoneName, "name", name)
+					err = pd.Lists["doubtlist"]["doubt_catchall"].Names.Put(
 						tapir.TapirName{
 							Name:   name,
 							Action: action,
-						} // drop all other actions
-					pd.mu.Unlock()
+						}) // drop all other actions
 				}
 			case "denylist":
 				if action != tapir.ALLOWLIST {
-					s.Names[name] = tapir.TapirName{Name: name, Action: action}
+					err = s.Names.Put(tapir.TapirName{Name: name, Action: action})
 				} else {
-					pd.Logger.Printf("Warning: denylist RPZ source %s has allowlisted name: %s",
-						s.RpzZoneName, name)
-					pd.mu.Lock()
-					pd.Lists["allowlist"]["allow_catchall"].Names[name] = tapir.TapirName{Name: name}
-					pd.mu.Unlock()
+					lg.Warn("ParseFunc: denylist RPZ source has an allowlisted name", "zone", s.RpzZoneName, "name", name)
+					err = pd.Lists["allowlist"]["allow_catchall"].Names.Put(tapir.TapirName{Name: name})
 				}
 			case "doubtlist":
 				if action != tapir.ALLOWLIST {
-					s.Names[name] = tapir.TapirName{Name: name, Action: action}
+					err = s.Names.Put(tapir.TapirName{Name: name, Action: action})
 				} else {
-					pd.Logger.Printf("Warning: doubtlist RPZ source %s has allowlisted name: %s",
-						s.RpzZoneName, name)
-					pd.mu.Lock()
-					pd.Lists["allowlist"]["allow_catchall"].Names[name] = tapir.TapirName{Name: name}
-					pd.mu.Unlock()
+					lg.Warn("ParseFunc: doubtlist RPZ source has an allowlisted name", "zone", s.RpzZoneName, "name", name)
+					err = pd.Lists["allowlist"]["allow_catchall"].Names.Put(tapir.TapirName{Name: name})
 				}
 			}
+			pd.mu.Unlock()
+			if err != nil {
+				lg.Error("ParseFunc: cannot store the name", "zone", s.RpzZoneName, "name", name, "error", err)
+			}
 		}
 		return true
 	}
 }
+
+// RpzSource returns the upstream zone with the given name. The ZoneData of an
+// RPZ source is never changed in place once it is in pd.RpzSources: a refresh
+// works on a copy that setRpzSource then swaps in.
+func (pd *PopData) RpzSource(zone string) (*tapir.ZoneData, bool) {
+	pd.mu.RLock()
+	defer pd.mu.RUnlock()
+	zd, exist := pd.RpzSources[zone]
+	return zd, exist
+}
+
+// RpzSourceNames returns the names of all upstream zones.
+func (pd *PopData) RpzSourceNames() []string {
+	pd.mu.RLock()
+	defer pd.mu.RUnlock()
+	zones := make([]string, 0, len(pd.RpzSources))
+	for zone := range pd.RpzSources {
+		zones = append(zones, zone)
+	}
+	return zones
+}
+
+func (pd *PopData) setRpzSource(zone string, zd *tapir.ZoneData) {
+	pd.mu.Lock()
+	pd.RpzSources[zone] = zd
+	pd.mu.Unlock()
+}
+
+// refreshRpzSource refreshes an already known upstream zone. The transfer is
+// done into a shallow copy of the current ZoneData, which replaces it when the
+// zone was updated. The copy shares the maps of the current ZoneData, but a
+// transfer only replaces them with new ones (FetchFromUpstream, xotRefresh),
+// so RpzSource readers never see a half transferred zone. The lists are not
+// isolated like that: RRParseFunc puts every name into the list as it is
+// transferred, so an RPZ generated during a transfer may have part of the new
+// names.
+func (pd *PopData) refreshRpzSource(zone, upstream string, xot, resetSerial bool) (bool, error) {
+	cur, exist := pd.RpzSource(zone)
+	if !exist {
+		return false, fmt.Errorf("zone %s is not a known RPZ source", zone)
+	}
+	next := *cur
+	updated, err := pd.refreshZone(&next, upstream, xot)
+	if err != nil || !updated {
+		return false, err
+	}
+	if resetSerial {
+		next.SOA.Serial = uint32(time.Now().Unix())
+		compLogger("sources").Info("RefreshEngine: zone updated from upstream, serial reset to unixtime",
+			"zone", zone, "serial", next.SOA.Serial)
+	}
+	pd.setRpzSource(zone, &next)
+	return true, nil
+}
@@ -21,6 +21,7 @@ func (pd *PopData) StatusUpdater(conf *Config, stopch chan struct{}) {
 		pd.Logger.Printf("*** StatusUpdater: not active, will just read status updates from channel and not publish anything")
 		for csu := range pd.ComponentStatusCh {
 			log.Printf("StatusUpdater: got status update message: %+v", csu)
+			pd.Health.ComponentStatus(csu)
 		}
 	}
 
@@ -107,6 +108,7 @@ func (pd *PopData) StatusUpdater(conf *Config, stopch chan struct{}) {
 			}
 		case csu = <-pd.ComponentStatusCh:
 			log.Printf("StatusUpdater: got status update message: %v", csu)
+			pd.Health.ComponentStatus(csu)
 			switch csu.Status {
 			case tapir.StatusFail, tapir.StatusWarn, tapir.StatusOK:
 				log.Printf("StatusUpdater: status failure: %s", csu.Msg)
@@ -6,6 +6,7 @@ package main
 import (
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dnstapir/tapir"
@@ -14,7 +15,7 @@ import (
 
 type PopData struct {
 	mu                     sync.RWMutex
-	Lists                  map[string]map[string]*tapir.WBGlist
+	Lists                  map[string]map[string]*PopList
 	RpzRefreshCh           chan RpzRefresh
 	RpzCommandCh           chan RpzCmdData
 	TapirMqttEngineRunning bool
@@ -25,19 +26,32 @@ type PopData struct {
 	ComponentStatusCh chan tapir.ComponentStatusUpdate
 	Logger            *log.Logger
 	MqttLogger        *log.Logger
-	DenylistedNames  map[string]bool
-	DoubtlistedNames   map[string]*tapir.TapirName
 	Policy            PopPolicy
 	Rpz               RpzData
 	RpzSources        map[string]*tapir.ZoneData
+	Outputs           map[string]PopOutput
 	Downstreams       map[string]RpzDownstream // map[ipaddr]RpzDownstream
 	DownstreamSerials map[string]uint32        // New map to track SOA serials by address
 	ReaperInterval    time.Duration
+	XfrStats          XfrStats
+	Explain           ExplainConf
+	Limits            *DnsLimits
+	Health            Health
+	Audit             *Auditor
+	ListStore         *ListStore
+	Seen              *SeenTable
+	Overrides         *OverrideTable
 	MqttEngine        *tapir.MqttEngine
-	Verbose           bool
-	Debug             bool
 }
 
+// XfrStats counts the outbound IXFR responses by the strategy that PlanIxfr
+// chose for them. Updated from the DNS goroutines, so the counters are atomic.
+type XfrStats struct {
+	Ixfr [numIxfrStrategies]atomic.Uint64
+}
+
+func (xs *XfrStats) Count(s IxfrStrategy) { xs.Ixfr[s].Add(1) }
+
 type RpzDownstream struct {
 	Address string
 	Port    int
@@ -46,27 +60,45 @@ type RpzDownstream struct {
 }
 
 type RpzData struct {
-	CurrentSerial uint32
-	ZoneName      string
-	Axfr          RpzAxfr
-	IxfrChain     []RpzIxfr // NOTE: the IxfrChain is in reverse order, newest first!
+	ZoneName string
+	wmu      sync.Mutex                  // held by the writer while it builds and publishes the next snapshot
+	snap     atomic.Pointer[RpzSnapshot] // the published RPZ output, read lock-free from the DNS goroutines
 	// RpzZone       *tapir.ZoneData
 	// RpzMap map[string]*tapir.RpzName
 }
 
-type RpzIxfr struct {
-	FromSerial uint32
-	ToSerial   uint32
-	Removed    []*tapir.RpzName
-	Added      []*tapir.RpzName
+// RpzSnapshot is one version of the RPZ output. Once published it is never
+// modified: the writer copies the current snapshot, applies its changes and
+// swaps the copy in. A transfer loads the snapshot once and streams only that,
+// so it always sends a single consistent serial.
+type RpzSnapshot struct {
+	Serial    uint32
+	SOA       dns.SOA // apex SOA, with Serial already set
+	NSrrs     []dns.RR
+	Glue      []dns.RR                // addresses of the nameservers inside the zone, in canonical order
+	Data      map[string]tapir.Action // keyed on the trigger name, i.e. without the RPZ zone name
+	Owners    []string                // the keys of Data in canonical DNS name order
+	Digest    []byte                  // SHA-384 zone digest, as in the apex ZONEMD
+	IxfrChain []RpzIxfr               // Oldest first; the last IXFR ends at Serial
+	Generated bool                    // Data has been generated from the lists since the start
 }
 
-type RpzAxfr struct {
-	Serial   uint32
-	SOA      dns.SOA
-	NSrrs    []dns.RR
-	Data     map[string]*tapir.RpzName
-	ZoneData *tapir.ZoneData
+// RpzRule is a trigger name in the RPZ output with its action. The CNAME that
+// it stands for is made by RpzSnapshot.rr when it is sent.
+type RpzRule struct {
+	Name   string
+	Action tapir.Action
+}
+
+type RpzIxfr struct {
+	FromSerial  uint32
+	ToSerial    uint32
+	Removed     []RpzRule
+	Added       []RpzRule
+	FromSOA     dns.SOA  // the SOA at FromSerial; unset if only the serial differs from the current SOA
+	ToSOA       dns.SOA  // the SOA at ToSerial; ditto
+	ApexRemoved []dns.RR // NS, glue and ZONEMD RRs that go away
+	ApexAdded   []dns.RR // and their replacements
 }
 
 type PopPolicy struct {
@@ -83,6 +115,8 @@ type DoubtlistPolicy struct {
 	NumTapirTagsAction tapir.Action
 	DenyTapirTags     tapir.TagMask
 	DenyTapirAction   tapir.Action
+	FirstSeenAge      time.Duration // 0 if the firstseen rule is not used
+	FirstSeenAction   tapir.Action
 }
 
 // type WBGC map[string]*tapir.WBGlist
@@ -0,0 +1,391 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// systemd integration, without libsystemd: the sd_notify(3) protocol for
+// READY=1, STOPPING=1, STATUS= and WATCHDOG=1, socket activation
+// (sd_listen_fds(3)) and the native journal protocol for log.output journald.
+// Outside systemd, i.e. without NOTIFY_SOCKET or LISTEN_FDS in the
+// environment, all of it but the journal does nothing.
+
+// sdNotify sends state to the service manager. It is a no-op unless
+// NOTIFY_SOCKET is set.
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+	if name[0] == '@' {
+		name = "\x00" + name[1:] // abstract socket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("sdNotify: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("sdNotify: %v", err)
+	}
+	return nil
+}
+
+// sdStatus sends a STATUS= line, logging rather than returning errors.
+func sdStatus(format string, args ...any) {
+	if err := sdNotify("STATUS=" + fmt.Sprintf(format, args...)); err != nil {
+		log.Printf("sdStatus: %v", err)
+	}
+}
+
+// sdWatchdog pings the systemd watchdog (WatchdogSec= in the unit) at half
+// the interval that systemd asks for, as long as the POP is running.
+type sdWatchdog struct {
+	interval time.Duration // zero if the watchdog is not enabled
+	last     time.Time
+}
+
+// newSdWatchdog reads WATCHDOG_USEC and WATCHDOG_PID, as sd_watchdog_enabled(3).
+func newSdWatchdog() *sdWatchdog {
+	wd := &sdWatchdog{}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return wd
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return wd
+	}
+	wd.interval = time.Duration(usec) * time.Microsecond
+	return wd
+}
+
+// ping sends WATCHDOG=1 if half the interval has passed since the last one.
+func (wd *sdWatchdog) ping(now time.Time) {
+	if wd.interval == 0 || now.Sub(wd.last) < wd.interval/2 {
+		return
+	}
+	wd.last = now
+	if err := sdNotify("WATCHDOG=1"); err != nil {
+		log.Printf("sdWatchdog: %v", err)
+	}
+}
+
+// run pings the watchdog from its own goroutine until stop is closed. The
+// pings stop when running reports that the RefreshEngine has not ticked for
+// half the interval, so that systemd restarts a POP that is stuck, but go on
+// while it is transferring a zone.
+func (wd *sdWatchdog) run(running func(now time.Time, maxAge time.Duration) bool, stop chan struct{}) {
+	if wd.interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(wd.interval / 4)
+	defer ticker.Stop()
+	stuck := false
+	for {
+		select {
+		case now := <-ticker.C:
+			if running(now, wd.interval/2) {
+				stuck = false
+				wd.ping(now)
+			} else if !stuck {
+				stuck = true
+				log.Printf("sdWatchdog: the RefreshEngine has not ticked for %v, not pinging the watchdog", wd.interval/2)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// sdListenFdsStart is the first file descriptor passed by systemd.
+const sdListenFdsStart = 3
+
+// sdSockets are the sockets inherited through socket activation. The
+// servers take the ones that match their configured addresses and bind the
+// rest themselves.
+type sdSockets struct {
+	mu        sync.Mutex
+	listeners []net.Listener
+	conns     []net.PacketConn
+}
+
+var inheritedSockets sdSockets
+
+// sdListenFds picks up the sockets passed by systemd, as sd_listen_fds(3),
+// and unsets the variables so that they are not inherited further.
+func sdListenFds() error {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	files := make([]*os.File, n)
+	for i := range files {
+		name := fmt.Sprintf("LISTEN_FD_%d", sdListenFdsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		files[i] = os.NewFile(uintptr(sdListenFdsStart+i), name)
+	}
+	return inheritedSockets.add(files)
+}
+
+// add takes over the sockets in files, which are closed. Stream sockets
+// become listeners and datagram sockets packet connections.
+func (s *sdSockets) add(files []*os.File) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range files {
+		if l, err := net.FileListener(f); err == nil {
+			log.Printf("sdListenFds: inherited %s listener %s (%s)", l.Addr().Network(), l.Addr(), f.Name())
+			s.listeners = append(s.listeners, l)
+		} else if pc, err := net.FilePacketConn(f); err == nil {
+			log.Printf("sdListenFds: inherited %s socket %s (%s)", pc.LocalAddr().Network(), pc.LocalAddr(), f.Name())
+			s.conns = append(s.conns, pc)
+		} else {
+			f.Close()
+			return fmt.Errorf("sdListenFds: %s is neither a stream nor a datagram socket: %v", f.Name(), err)
+		}
+		f.Close() // FileListener and FilePacketConn have their own copy
+	}
+	return nil
+}
+
+// sameAddr reports whether the socket address sa is the configured address
+// addr (ip:port).
+func sameAddr(sa net.Addr, addr string) bool {
+	want, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return false
+	}
+	var got netip.AddrPort
+	switch sa := sa.(type) {
+	case *net.TCPAddr:
+		got = sa.AddrPort()
+	case *net.UDPAddr:
+		got = sa.AddrPort()
+	default:
+		return false
+	}
+	return got.Port() == want.Port() && got.Addr().Unmap() == want.Addr().Unmap()
+}
+
+// listener returns the inherited stream socket bound to addr, if any. Each
+// socket is handed out once.
+func (s *sdSockets) listener(addr string) net.Listener {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, l := range s.listeners {
+		if sameAddr(l.Addr(), addr) {
+			s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
+			return l
+		}
+	}
+	return nil
+}
+
+// packetConn returns the inherited datagram socket bound to addr, if any.
+func (s *sdSockets) packetConn(addr string) net.PacketConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, pc := range s.conns {
+		if sameAddr(pc.LocalAddr(), addr) {
+			s.conns = append(s.conns[:i], s.conns[i+1:]...)
+			return pc
+		}
+	}
+	return nil
+}
+
+// listenAndServeDNS is server.ListenAndServe, on the inherited socket for
+// server.Addr if there is one.
+func listenAndServeDNS(server *dns.Server) error {
+	switch server.Net {
+	case "udp":
+		if pc := inheritedSockets.packetConn(server.Addr); pc != nil {
+			server.PacketConn = pc
+			return server.ActivateAndServe()
+		}
+	case "tcp":
+		if l := inheritedSockets.listener(server.Addr); l != nil {
+			server.Listener = l
+			return server.ActivateAndServe()
+		}
+	case "tcp-tls":
+		if l := inheritedSockets.listener(server.Addr); l != nil {
+			server.Listener = tls.NewListener(l, server.TLSConfig)
+			return server.ActivateAndServe()
+		}
+	}
+	return server.ListenAndServe()
+}
+
+// statusLine summarizes the RPZ and the list sizes for STATUS=.
+func (pd *PopData) statusLine() string {
+	pd.mu.RLock()
+	var sizes []string
+	for _, listtype := range []string{"allowlist", "denylist", "doubtlist"} {
+		n := 0
+		for _, wbgl := range pd.Lists[listtype] {
+			n += wbgl.Names.Len()
+		}
+		sizes = append(sizes, fmt.Sprintf("%s %d", listtype, n))
+	}
+	pd.mu.RUnlock()
+	snap := pd.Rpz.Current()
+	return fmt.Sprintf("RPZ serial %d with %d names; %s", snap.Serial, len(snap.Data), strings.Join(sizes, ", "))
+}
+
+// journalSocket is where journald receives native protocol messages.
+var journalSocket = "/run/systemd/journal/socket"
+
+// journalHandler is a slog.Handler that sends each record to journald as one
+// datagram in the native protocol (systemd.journal-fields(7)), with the
+// attributes as journal fields.
+type journalHandler struct {
+	conn      *net.UnixConn
+	addSource bool
+	prefix    string      // of the field names, from WithGroup
+	fields    []slog.Attr // from WithAttrs, with the prefix already applied
+}
+
+func newJournalHandler(addSource bool) (*journalHandler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journalHandler{conn: conn, addSource: addSource}, nil
+}
+
+func (h *journalHandler) Enabled(ctx context.Context, level slog.Level) bool { return true }
+
+// journalPriority maps a level to a syslog priority.
+func journalPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3 // err
+	case level >= slog.LevelWarn:
+		return 4 // warning
+	case level >= slog.LevelInfo:
+		return 6 // info
+	}
+	return 7 // debug
+}
+
+// journalField makes a valid journal field name of an attribute key:
+// uppercase letters, digits and underscores, not starting with an underscore
+// or a digit.
+func journalField(key string) string {
+	name := []byte(strings.ToUpper(key))
+	for i, c := range name {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			name[i] = '_'
+		}
+	}
+	return strings.TrimLeft(string(name), "_0123456789")
+}
+
+// appendJournalField appends one field. Values with a newline are sent in
+// the binary form, with their length.
+func appendJournalField(buf []byte, name, value string) []byte {
+	if name == "" {
+		return buf
+	}
+	if !strings.Contains(value, "\n") {
+		return fmt.Appendf(buf, "%s=%s\n", name, value)
+	}
+	buf = append(buf, name...)
+	buf = append(buf, '\n')
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(value)))
+	buf = append(buf, value...)
+	return append(buf, '\n')
+}
+
+// appendJournalAttr appends an attribute, with groups flattened into the
+// field name.
+func appendJournalAttr(buf []byte, prefix string, a slog.Attr) []byte {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "_"
+		}
+		for _, ga := range a.Value.Group() {
+			buf = appendJournalAttr(buf, prefix, ga)
+		}
+		return buf
+	}
+	value := a.Value.String()
+	if a.Value.Kind() == slog.KindTime {
+		value = a.Value.Time().Format(time.RFC3339Nano)
+	}
+	return appendJournalField(buf, journalField(prefix+a.Key), value)
+}
+
+func (h *journalHandler) Handle(ctx context.Context, r slog.Record) error {
+	buf := appendJournalField(nil, "MESSAGE", r.Message)
+	buf = appendJournalField(buf, "PRIORITY", strconv.Itoa(journalPriority(r.Level)))
+	buf = appendJournalField(buf, "SYSLOG_IDENTIFIER", "tapir-pop")
+	if h.addSource && r.PC != 0 {
+		f, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		buf = appendJournalField(buf, "CODE_FILE", f.File)
+		buf = appendJournalField(buf, "CODE_LINE", strconv.Itoa(f.Line))
+		buf = appendJournalField(buf, "CODE_FUNC", f.Function)
+	}
+	for _, a := range h.fields {
+		buf = appendJournalAttr(buf, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		buf = appendJournalAttr(buf, h.prefix, a)
+		return true
+	})
+	_, err := h.conn.Write(buf)
+	return err
+}
+
+func (h *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.fields = slices.Clone(h.fields)
+	for _, a := range attrs {
+		if h.prefix != "" {
+			a = slog.Group(strings.TrimSuffix(h.prefix, "_"), a)
+		}
+		h2.fields = append(h2.fields, a)
+	}
+	return &h2
+}
+
+func (h *journalHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.prefix += name + "_"
+	return &h2
+}
@@ -0,0 +1,189 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// notifySocket listens on a NOTIFY_SOCKET and returns a function that reads
+// the next message, "" if none arrives.
+func notifySocket(t *testing.T) func() string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return func() string {
+		buf := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return ""
+		}
+		return string(buf[:n])
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("sdNotify without NOTIFY_SOCKET: %v", err)
+	}
+
+	next := notifySocket(t)
+	if err := sdNotify("READY=1\nSTATUS=ok"); err != nil {
+		t.Fatalf("sdNotify: %v", err)
+	}
+	if got := next(); got != "READY=1\nSTATUS=ok" {
+		t.Errorf("received %q", got)
+	}
+}
+
+func TestSdWatchdog(t *testing.T) {
+	next := notifySocket(t)
+	t0 := time.Now()
+
+	cases := []struct {
+		name  string
+		usec  string
+		pid   string
+		pings []time.Duration // offsets from t0
+		want  int             // WATCHDOG=1 messages sent
+	}{
+		{name: "disabled", pings: []time.Duration{0, time.Hour}},
+		{name: "other_pid", usec: "2000000", pid: "1", pings: []time.Duration{0}},
+		{name: "half_interval", usec: "2000000", pid: strconv.Itoa(os.Getpid()),
+			pings: []time.Duration{0, 500 * time.Millisecond, time.Second, 1500 * time.Millisecond, 2 * time.Second},
+			want:  3},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Setenv("WATCHDOG_USEC", c.usec)
+			t.Setenv("WATCHDOG_PID", c.pid)
+			wd := newSdWatchdog()
+			for _, at := range c.pings {
+				wd.ping(t0.Add(at))
+			}
+			got := 0
+			for msg := next(); msg != ""; msg = next() {
+				if msg != "WATCHDOG=1" {
+					t.Errorf("received %q", msg)
+				}
+				got++
+			}
+			if got != c.want {
+				t.Errorf("%d pings sent, want %d", got, c.want)
+			}
+		})
+	}
+}
+
+func TestSdWatchdogRun(t *testing.T) {
+	next := notifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "40000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+
+	cases := []struct {
+		name  string
+		setup func(h *Health)
+		pings bool
+	}{
+		// A tick in the future stands for a loop that ticks all through the test.
+		{name: "ticking", setup: func(h *Health) { h.Tick(time.Now().Add(time.Minute)) }, pings: true},
+		{name: "stuck", setup: func(h *Health) { h.Tick(time.Now().Add(-time.Minute)) }},
+		{name: "transferring", setup: func(h *Health) {
+			h.Tick(time.Now().Add(-time.Minute))
+			h.Transfer()
+		}, pings: true},
+		{name: "not_started", setup: func(h *Health) {}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var h Health
+			c.setup(&h)
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				newSdWatchdog().run(h.Running, stop)
+				close(done)
+			}()
+			time.Sleep(200 * time.Millisecond)
+			close(stop)
+			<-done
+			got := 0
+			for msg := next(); msg != ""; msg = next() {
+				got++
+			}
+			if pings := got > 0; pings != c.pings {
+				t.Errorf("%d pings sent, want pings: %v", got, c.pings)
+			}
+		})
+	}
+}
+
+func TestSdSockets(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: ln.Addr().(*net.TCPAddr).Port})
+	if err != nil {
+		t.Skipf("UDP port %d busy: %v", ln.Addr().(*net.TCPAddr).Port, err)
+	}
+	defer pc.Close()
+	lnf, err := ln.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcf, err := pc.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s sdSockets
+	if err := s.add([]*os.File{lnf, pcf}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	addr := ln.Addr().String()
+
+	if l := s.listener("127.0.0.2:" + strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)); l != nil {
+		t.Errorf("listener for another address: %v", l.Addr())
+	}
+	l := s.listener(addr)
+	if l == nil {
+		t.Fatalf("no inherited listener for %s", addr)
+	}
+	defer l.Close()
+	if s.listener(addr) != nil {
+		t.Errorf("listener for %s handed out twice", addr)
+	}
+	c := s.packetConn(addr)
+	if c == nil {
+		t.Fatalf("no inherited datagram socket for %s", addr)
+	}
+	defer c.Close()
+
+	// The inherited listener is the same socket.
+	go func() {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept on inherited listener: %v", err)
+	}
+	conn.Close()
+}
@@ -6,10 +6,8 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"math"
 	"net"
-	"strings"
 	"sync"
 	"time"
 
@@ -19,48 +17,31 @@ import (
 )
 
 func (pd *PopData) BootstrapRpzOutput() error {
-	apextmpl := `
-$TTL 3600
-${ZONE}		IN	SOA	mname. hostmaster.dnstapir.se. (
-				${SERIAL}
-				60
-				60
-				86400
-				60 )
-${ZONE}		IN	NS	ns1.${ZONE}
-${ZONE}		IN	NS	ns2.${ZONE}
-ns1.${ZONE}	IN	A	127.0.0.1
-ns2.${ZONE}	IN	AAAA	::1`
-
-	rpzzone := viper.GetString("services.rpz.zonename")
-	apex := strings.Replace(apextmpl, "${ZONE}", rpzzone, -1)
-	apex = strings.Replace(apex, "${SERIAL}", fmt.Sprintf("%d", pd.Rpz.CurrentSerial), -1)
-
-	zd := tapir.ZoneData{
-		ZoneName: rpzzone,
-		ZoneType: tapir.RpzZone,
-		Logger:   log.Default(),
-		Verbose:  true,
-		Debug:    true,
-	}
-
-	_, err := zd.ReadZoneString(apex)
+	var conf RpzConf
+	if err := viper.UnmarshalKey("services.rpz", &conf); err != nil {
+		return err
+	}
+	apex, err := NewRpzApex(conf)
 	if err != nil {
-		pd.Logger.Printf("Error from ReadZoneString(): %v", err)
+		return err
 	}
-	// pd.Rpz.CurrentSerial = serial
 
-	pd.mu.Lock()
-	pd.Rpz.Axfr.ZoneData = &zd // XXX: This is not thread safe
-	pd.Rpz.Axfr.SOA = zd.SOA
-	pd.Rpz.Axfr.NSrrs = zd.NSrrs
-	pd.mu.Unlock()
+	pd.Rpz.wmu.Lock()
+	next := *pd.Rpz.Current()
+	next.SOA = apex.SOA
+	next.NSrrs = apex.NSrrs
+	next.Glue = apex.Glue
+	next.Digest = nil
+	pd.Rpz.publish(&next)
+	pd.Rpz.wmu.Unlock()
 	return nil
 }
 
 func (pd *PopData) RpzAxfrOut(w dns.ResponseWriter, r *dns.Msg) (uint32, int, error) {
 
+	lg := compLogger("xfr")
 	zone := pd.Rpz.ZoneName
+	snap := pd.Rpz.Current()
 
 	// if pd.Verbose {
 	//		pd.Logger.Printf("RpzAxfrOut: Will try to serve RPZ %s (%d RRs)", zone,
@@ -75,8 +56,7 @@ func (pd *PopData) RpzAxfrOut(w dns.ResponseWriter, r *dns.Msg) (uint32, int, er
 	go func() {
 		err := tr.Out(w, r, outbound_xfr)
 		if err != nil {
-			fmt.Printf("Error from transfer.Out(): %v\n", err)
-			pd.Logger.Printf("Error from transfer.Out(): %v", err)
+			lg.Error("RpzAxfrOut: transfer.Out failed", "zone", zone, "error", err)
 		}
 		wg.Done()
 	}()
@@ -84,17 +64,19 @@ func (pd *PopData) RpzAxfrOut(w dns.ResponseWriter, r *dns.Msg) (uint32, int, er
 	count := 0
 	send_count := 0
 
-	pd.Rpz.Axfr.SOA.Serial = pd.Rpz.CurrentSerial
-	rrs := []dns.RR{dns.RR(&pd.Rpz.Axfr.SOA)}
+	soa := snap.SOA
+	rrs := []dns.RR{dns.RR(&soa)}
 	// pd.Logger.Printf("RpzAxfrOut: Adding SOA RR to env:%s", rrs[0].String())
 	var total_sent int
 
-	rrs = append(rrs, pd.Rpz.Axfr.NSrrs...)
+	rrs = append(rrs, snap.NSrrs...)
+	rrs = append(rrs, snap.apexRRs()...)
 	count = len(rrs)
 
-	for _, rpzn := range pd.Rpz.Axfr.Data {
-		// pd.Logger.Printf("RpzAxfrOut: Adding RR to env:%s", (*rpzn.RR).String())
-		rrs = append(rrs, *rpzn.RR)
+	// zoneRRs is in canonical order, so every AXFR of a serial is identical.
+	for rr := range snap.zoneRRs() {
+		// pd.Logger.Printf("RpzAxfrOut: Adding RR to env:%s", rr.String())
+		rrs = append(rrs, rr)
 		count++
 		if count >= 500 {
 			send_count++
@@ -107,7 +89,7 @@ func (pd *PopData) RpzAxfrOut(w dns.ResponseWriter, r *dns.Msg) (uint32, int, er
 		}
 	}
 
-	rrs = append(rrs, dns.RR(&pd.Rpz.Axfr.SOA)) // trailing SOA
+	rrs = append(rrs, dns.RR(&soa)) // trailing SOA
 
 	total_sent += len(rrs)
 	//	pd.Logger.Printf("RpzAxfrOut: Zone %s: Sending final %d RRs (including trailing SOA, total sent %d)\n",
@@ -118,12 +100,12 @@ func (pd *PopData) RpzAxfrOut(w dns.ResponseWriter, r *dns.Msg) (uint32, int, er
 	wg.Wait()        // wait until everything is written out
 	err := w.Close() // close connection
 	if err != nil {
-		pd.Logger.Printf("RpzAxfrOut: Error from Close(): %v", err)
+		lg.Warn("RpzAxfrOut: Close failed", "zone", zone, "error", err)
 	}
 
-	pd.Logger.Printf("ZoneTransferOut: %s: Sent %d RRs (including SOA twice).", zone, total_sent)
+	lg.Info("RpzAxfrOut: AXFR sent", "zone", zone, "serial", snap.Serial, "rrs", total_sent, "downstream", w.RemoteAddr().String())
 
-	return pd.Rpz.CurrentSerial, total_sent - 1, nil
+	return snap.Serial, total_sent - 1, nil
 }
 
 // An IXFR has the following structure:
@@ -154,6 +136,7 @@ func (pd *PopData) RpzAxfrOut(w dns.ResponseWriter, r *dns.Msg) (uint32, int, er
 // Returns: serial that we gave the client, number of RRs sent, error
 func (pd *PopData) RpzIxfrOut(w dns.ResponseWriter, r *dns.Msg) (uint32, int, error) {
 
+	lg := compLogger("xfr")
 	var curserial uint32 = 0 // serial that the client claims to have
 
 	if len(r.Ns) > 0 {
@@ -162,14 +145,14 @@ func (pd *PopData) RpzIxfrOut(w dns.ResponseWriter, r *dns.Msg) (uint32, int, er
 			case *dns.SOA:
 				curserial = rr.Serial
 			default:
-				pd.Logger.Printf("RpzIxfrOut: unexpected RR in IXFR request Authority section:\n%s\n", rr.String())
+				lg.Warn("RpzIxfrOut: unexpected RR in the Authority section of the IXFR request", "rr", rr.String())
 			}
 		}
 	}
 
 	downstream, _, err := net.SplitHostPort(w.RemoteAddr().String())
 	if err != nil {
-		pd.Logger.Printf("RpzIxfrOut: Error from net.SplitHostPort(): %v", err)
+		lg.Error("RpzIxfrOut: cannot split the client address", "error", err)
 		return 0, 0, err
 	}
 
@@ -181,15 +164,17 @@ func (pd *PopData) RpzIxfrOut(w dns.ResponseWriter, r *dns.Msg) (uint32, int, er
 	zone := pd.Rpz.ZoneName
 	pd.mu.Unlock()
 
-	if len(pd.Rpz.IxfrChain) == 0 {
-		pd.Logger.Printf("RpzIxfrOut: Downstream %s claims to have RPZ %s with serial %d, but the IXFR chain is empty; AXFR needed", downstream, zone, curserial)
+	snap := pd.Rpz.Current()
+	if len(snap.IxfrChain) == 0 {
+		lg.Info("RpzIxfrOut: the IXFR chain is empty, AXFR needed", "downstream", downstream, "zone", zone, "serial", curserial)
 		serial, _, err := pd.RpzAxfrOut(w, r)
 		if err != nil {
 			return 0, 0, err
 		}
 		return serial, 0, nil
-	} else if curserial < pd.Rpz.IxfrChain[0].FromSerial {
-		pd.Logger.Printf("RpzIxfrOut: Downstream %s claims to have RPZ %s with serial %d, but the IXFR chain starts at %d; AXFR needed", downstream, zone, curserial, pd.Rpz.IxfrChain[0].FromSerial)
+	} else if curserial < snap.IxfrChain[0].FromSerial {
+		lg.Info("RpzIxfrOut: the serial is older than the IXFR chain, AXFR needed", "downstream", downstream, "zone", zone,
+			"serial", curserial, "chain", snap.IxfrChain[0].FromSerial)
 		serial, _, err := pd.RpzAxfrOut(w, r)
 		if err != nil {
 			return 0, 0, err
@@ -197,12 +182,24 @@ func (pd *PopData) RpzIxfrOut(w dns.ResponseWriter, r *dns.Msg) (uint32, int, er
 		return serial, 0, nil
 	}
 
-	if pd.Verbose {
-		pd.Logger.Printf("RpzIxfrOut: Will try to serve RPZ %s to %v (%d IXFRs in chain)\n", zone,
-			w.RemoteAddr().String(), len(pd.Rpz.IxfrChain))
-		pd.Logger.Printf("RpzIxfrOut: Client claims to have RPZ %s with serial %d", zone, curserial)
+	plan := snap.PlanIxfr(curserial)
+	pd.XfrStats.Count(plan.Strategy)
+	lg.Info("RpzIxfrOut: IXFR planned", "downstream", downstream, "zone", zone, "serial", curserial,
+		"chained", plan.Cost[IxfrChained], "condensed", plan.Cost[IxfrCondensed], "full", plan.Cost[IxfrFullZone], "strategy", plan.Strategy.String())
+
+	if plan.Strategy == IxfrFullZone {
+		// RFC 1995, section 4: an IXFR may be answered with the full zone in
+		// AXFR format when that is cheaper than sending the differences.
+		serial, _, err := pd.RpzAxfrOut(w, r)
+		if err != nil {
+			return 0, 0, err
+		}
+		return serial, 0, nil
 	}
 
+	lg.Debug("RpzIxfrOut: serving IXFR", "zone", zone, "downstream", w.RemoteAddr().String(),
+		"serial", curserial, "chain", len(snap.IxfrChain), "ixfrs", len(plan.Ixfrs))
+
 	outbound_xfr := make(chan *dns.Envelope)
 	tr := new(dns.Transfer)
 	var wg sync.WaitGroup
@@ -211,7 +208,7 @@ func (pd *PopData) RpzIxfrOut(w dns.ResponseWriter, r *dns.Msg) (uint32, int, er
 	go func() {
 		err := tr.Out(w, r, outbound_xfr)
 		if err != nil {
-			pd.Logger.Printf("Error from transfer.Out(): %v", err)
+			lg.Error("RpzIxfrOut: transfer.Out failed", "zone", zone, "error", err)
 			pd.ComponentStatusCh <- tapir.ComponentStatusUpdate{
 				Component: "rpz-ixfr",
 				Status:    tapir.StatusFail,
@@ -226,79 +223,57 @@ func (pd *PopData) RpzIxfrOut(w dns.ResponseWriter, r *dns.Msg) (uint32, int, er
 
 	var total_sent int
 
-	pd.Rpz.Axfr.SOA.Serial = pd.Rpz.CurrentSerial
-	rrs = append(rrs, dns.RR(&pd.Rpz.Axfr.SOA))
+	soa := snap.SOA
+	rrs = append(rrs, dns.RR(&soa))
 
 	var totcount, count int
 	var finalSerial uint32
-	for _, ixfr := range pd.Rpz.IxfrChain {
-		pd.Logger.Printf("RpzIxfrOut: checking client serial(%d) against IXFR[from:%d, to:%d]",
-			curserial, ixfr.FromSerial, ixfr.ToSerial)
-		if ixfr.FromSerial >= curserial {
-			finalSerial = ixfr.ToSerial
-			pd.Logger.Printf("PushIxfrs: pushing the IXFR[from:%d, to:%d] onto output",
-				ixfr.FromSerial, ixfr.ToSerial)
-			fromsoa := dns.Copy(dns.RR(&pd.Rpz.Axfr.ZoneData.SOA))
-			fromsoa.(*dns.SOA).Serial = ixfr.FromSerial
-			if pd.Debug {
-				pd.Logger.Printf("IxfrOut: adding FROMSOA to output: %s", fromsoa.String())
-			}
-			rrs = append(rrs, fromsoa)
+	for _, ixfr := range plan.Ixfrs {
+		finalSerial = ixfr.ToSerial
+		lg.Debug("RpzIxfrOut: pushing the IXFR onto the output", "from", ixfr.FromSerial, "to", ixfr.ToSerial)
+		fromsoa := ixfr.soa(snap.SOA, ixfr.FromSOA, ixfr.FromSerial)
+		lg.Debug("RpzIxfrOut: adding the FROMSOA", "rr", fromsoa)
+		rrs = append(rrs, fromsoa)
+		rrs = append(rrs, ixfr.ApexRemoved...)
+		count += 1 + len(ixfr.ApexRemoved)
+		lg.Debug("RpzIxfrOut: removals", "from", ixfr.FromSerial, "to", ixfr.ToSerial, "rrs", len(ixfr.Removed))
+		for _, tn := range ixfr.Removed {
+			lg.Debug("RpzIxfrOut: removing name", "name", tn.Name)
+			rrs = append(rrs, snap.rr(tn.Name, tn.Action))
 			count++
-			pd.Logger.Printf("RpzIxfrOut: IXFR[%d,%d] has %d RRs in the removal list",
-				ixfr.FromSerial, ixfr.ToSerial, len(ixfr.Removed))
-			for _, tn := range ixfr.Removed {
-				if pd.Debug {
-					pd.Logger.Printf("DEL: adding RR to ixfr output: %s", tn.Name)
-				}
-				rrs = append(rrs, *tn.RR) // should do proper slice magic instead
-				count++
-				if count >= 500 {
-					pd.Logger.Printf("Sending %d RRs\n", len(rrs))
-					for _, rr := range rrs {
-						pd.Logger.Printf("SEND DELS: %s", rr.String())
-					}
-					outbound_xfr <- &dns.Envelope{RR: rrs}
-					rrs = []dns.RR{}
-					totcount += count
-					count = 0
-				}
+			if count >= 500 {
+				lg.Debug("RpzIxfrOut: sending removals", "rrs", len(rrs))
+				outbound_xfr <- &dns.Envelope{RR: rrs}
+				rrs = []dns.RR{}
+				totcount += count
+				count = 0
 			}
-			tosoa := dns.Copy(dns.RR(&pd.Rpz.Axfr.ZoneData.SOA))
-			tosoa.(*dns.SOA).Serial = ixfr.ToSerial
-			if pd.Debug {
-				pd.Logger.Printf("RpzIxfrOut: adding TOSOA to output: %s", tosoa.String())
-			}
-			rrs = append(rrs, tosoa)
+		}
+		tosoa := ixfr.soa(snap.SOA, ixfr.ToSOA, ixfr.ToSerial)
+		lg.Debug("RpzIxfrOut: adding the TOSOA", "rr", tosoa)
+		rrs = append(rrs, tosoa)
+		rrs = append(rrs, ixfr.ApexAdded...)
+		count += 1 + len(ixfr.ApexAdded)
+		lg.Debug("RpzIxfrOut: additions", "from", ixfr.FromSerial, "to", ixfr.ToSerial, "rrs", len(ixfr.Added))
+		for _, tn := range ixfr.Added {
+			lg.Debug("RpzIxfrOut: adding name", "name", tn.Name)
+			rrs = append(rrs, snap.rr(tn.Name, tn.Action))
 			count++
-			pd.Logger.Printf("RpzIxfrOut: IXFR[%d,%d] has %d RRs in the added list",
-				ixfr.FromSerial, ixfr.ToSerial, len(ixfr.Added))
-			for _, tn := range ixfr.Added {
-				if pd.Debug {
-					pd.Logger.Printf("ADD: adding RR to ixfr output: %s", tn.Name)
-				}
-				rrs = append(rrs, *tn.RR) // should do proper slice magic instead
-				count++
-				if count >= 500 {
-					pd.Logger.Printf("Sending %d RRs\n", len(rrs))
-					for _, rr := range rrs {
-						pd.Logger.Printf("SEND ADDS: %s", rr.String())
-					}
-					outbound_xfr <- &dns.Envelope{RR: rrs}
-					// fmt.Printf("Sent %d RRs: done\n", len(rrs))
-					rrs = []dns.RR{}
-					totcount += count
-					count = 0
-				}
+			if count >= 500 {
+				lg.Debug("RpzIxfrOut: sending additions", "rrs", len(rrs))
+				outbound_xfr <- &dns.Envelope{RR: rrs}
+				// fmt.Printf("Sent %d RRs: done\n", len(rrs))
+				rrs = []dns.RR{}
+				totcount += count
+				count = 0
 			}
 		}
 	}
 
-	rrs = append(rrs, dns.RR(&pd.Rpz.Axfr.SOA)) // trailing SOA
+	rrs = append(rrs, dns.RR(&soa)) // trailing SOA
 
 	total_sent += len(rrs)
-	pd.Logger.Printf("RpzIxfrOut: Zone %s: Sending final %d RRs (including trailing SOA, total sent %d)\n",
-		zone, len(rrs), total_sent)
+	lg.Debug("RpzIxfrOut: sending the final RRs", "zone", zone, "rrs", len(rrs))
 
 	//	pd.Logger.Printf("Sending %d RRs\n", len(rrs))
 	//	for _, rr := range rrs {
@@ -310,7 +285,7 @@ func (pd *PopData) RpzIxfrOut(w dns.ResponseWriter, r *dns.Msg) (uint32, int, er
 	wg.Wait()       // wait until everything is written out
 	err = w.Close() // close connection
 	if err != nil {
-		pd.Logger.Printf("RpzIxfrOut: Error from Close(): %v", err)
+		lg.Warn("RpzIxfrOut: Close failed", "zone", zone, "error", err)
 	}
 
 	pd.ComponentStatusCh <- tapir.ComponentStatusUpdate{
@@ -319,36 +294,229 @@ func (pd *PopData) RpzIxfrOut(w dns.ResponseWriter, r *dns.Msg) (uint32, int, er
 		TimeStamp: time.Now(),
 	}
 
-	pd.Logger.Printf("RpzIxfrOut: %s: Sent %d RRs (including SOA twice).", zone, total_sent)
+	lg.Info("RpzIxfrOut: IXFR sent", "zone", zone, "serial", finalSerial, "rrs", total_sent, "downstream", downstream)
 	err = pd.PruneRpzIxfrChain()
 	if err != nil {
-		pd.Logger.Printf("RpzIxfrOut: Error from PruneRpzIxfrChain(): %v", err)
+		lg.Error("RpzIxfrOut: PruneRpzIxfrChain failed", "error", err)
 	}
 
 	return finalSerial, total_sent - 1, nil
 }
 
+// PruneRpzIxfrChain drops the IXFRs that no known downstream needs any more.
+// It is a write like any other: the pruned chain is published as a new
+// snapshot (sharing Data with the current one) with the same serial.
 func (pd *PopData) PruneRpzIxfrChain() error {
 	lowSerial := uint32(math.MaxUint32)
+	pd.mu.RLock()
 	for _, serial := range pd.DownstreamSerials {
 		if serial < lowSerial {
 			lowSerial = serial
 		}
 	}
+	pd.mu.RUnlock()
+
+	pd.Rpz.wmu.Lock()
+	defer pd.Rpz.wmu.Unlock()
+	cur := pd.Rpz.Current()
 
 	indexToDeleteUpTo := -1
-	for i := 0; i < len(pd.Rpz.IxfrChain); i++ {
-		if pd.Rpz.IxfrChain[i].FromSerial == lowSerial {
+	for i := 0; i < len(cur.IxfrChain); i++ {
+		if cur.IxfrChain[i].FromSerial == lowSerial {
 			indexToDeleteUpTo = i - 2
 			break
 		}
 	}
 
 	if indexToDeleteUpTo >= 0 {
-		pd.Rpz.IxfrChain = pd.Rpz.IxfrChain[indexToDeleteUpTo+1:]
-		pd.Logger.Printf("PruneRpzIxfrChain: Pruning IXFR chain up to two serials before serial %d", lowSerial)
+		next := *cur
+		next.IxfrChain = cur.IxfrChain[indexToDeleteUpTo+1:]
+		pd.Rpz.publish(&next)
+		compLogger("xfr").Info("PruneRpzIxfrChain: pruned the IXFR chain up to two serials before the lowest downstream serial", "serial", lowSerial)
 	} else {
-		pd.Logger.Printf("PruneRpzIxfrChain: Nothing to prune from the IXFR chain")
+		compLogger("xfr").Debug("PruneRpzIxfrChain: nothing to prune from the IXFR chain")
 	}
 	return nil
 }
+
+// IxfrStrategy is the shape of the response chosen for an IXFR request.
+type IxfrStrategy int
+
+const (
+	IxfrChained   IxfrStrategy = iota // replay every IXFR in the chain from the client serial
+	IxfrCondensed                     // a single diff from the client serial to the current serial
+	IxfrFullZone                      // the full zone, AXFR style (RFC 1995, section 4)
+	numIxfrStrategies
+)
+
+func (s IxfrStrategy) String() string {
+	switch s {
+	case IxfrChained:
+		return "chained"
+	case IxfrCondensed:
+		return "condensed"
+	case IxfrFullZone:
+		return "full-zone"
+	default:
+		return "unknown"
+	}
+}
+
+// IxfrPlan is the outcome of PlanIxfr. Cost holds the estimated number of RRs
+// (including SOAs) that each strategy would put on the wire; the cheapest one
+// is the Strategy. Ixfrs are the diffs to send, empty for IxfrFullZone.
+type IxfrPlan struct {
+	Strategy IxfrStrategy
+	Cost     [numIxfrStrategies]int
+	Ixfrs    []RpzIxfr
+}
+
+// PlanIxfr decides how to answer an IXFR from a client that has clientSerial.
+// The RRs in the RPZ are all CNAMEs of roughly the same size, so the number
+// of RRs is a good enough estimate of the size of the response. On a tie the
+// simpler strategy wins, in the order chained, condensed, full zone.
+func (s *RpzSnapshot) PlanIxfr(clientSerial uint32) IxfrPlan {
+	var plan IxfrPlan
+
+	var chain []RpzIxfr
+	for _, ixfr := range s.IxfrChain {
+		if ixfr.FromSerial >= clientSerial {
+			chain = append(chain, ixfr)
+		}
+	}
+
+	// Every response is wrapped in a leading and a trailing SOA.
+	plan.Cost[IxfrChained] = 2
+	for _, ixfr := range chain {
+		plan.Cost[IxfrChained] += ixfr.size()
+	}
+	plan.Cost[IxfrFullZone] = 2 + len(s.NSrrs) + len(s.apexRRs()) + len(s.Glue) + len(s.Data)
+
+	condensed := chain
+	if len(chain) > 1 {
+		condensed = []RpzIxfr{CondenseIxfrs(chain)}
+	}
+	plan.Cost[IxfrCondensed] = 2
+	for _, ixfr := range condensed {
+		plan.Cost[IxfrCondensed] += ixfr.size()
+	}
+
+	plan.Strategy, plan.Ixfrs = IxfrChained, chain
+	if plan.Cost[IxfrCondensed] < plan.Cost[plan.Strategy] {
+		plan.Strategy, plan.Ixfrs = IxfrCondensed, condensed
+	}
+	if plan.Cost[IxfrFullZone] < plan.Cost[plan.Strategy] {
+		plan.Strategy, plan.Ixfrs = IxfrFullZone, nil
+	}
+	return plan
+}
+
+// CondenseIxfrs folds a contiguous run of IXFRs (oldest first) into a single
+// IXFR from the first FromSerial to the last ToSerial. A name that is added
+// and later removed again, or that flips action and back, cancels out.
+func CondenseIxfrs(chain []RpzIxfr) RpzIxfr {
+	type change struct {
+		before *RpzRule // the RR the client has, nil if none
+		after  *RpzRule // the RR the client should end up with, nil if none
+	}
+	changes := map[string]*change{}
+	var order []string // first-seen order, so the output is deterministic
+
+	lookup := func(name string, before *RpzRule) *change {
+		c, exist := changes[name]
+		if !exist {
+			// The first time a name is seen decides what the client has:
+			// if it is first removed the client has it, if it is first
+			// added the client does not.
+			c = &change{before: before}
+			changes[name] = c
+			order = append(order, name)
+		}
+		return c
+	}
+
+	for _, ixfr := range chain {
+		for _, rpzn := range ixfr.Removed {
+			lookup(rpzn.Name, &rpzn).after = nil
+		}
+		for _, rpzn := range ixfr.Added {
+			lookup(rpzn.Name, nil).after = &rpzn
+		}
+	}
+
+	res := RpzIxfr{
+		FromSerial: chain[0].FromSerial,
+		ToSerial:   chain[len(chain)-1].ToSerial,
+		FromSOA:    chain[0].FromSOA,
+		ToSOA:      chain[len(chain)-1].ToSOA,
+	}
+	res.ApexRemoved, res.ApexAdded = condenseApex(chain)
+	for _, name := range order {
+		c := changes[name]
+		if c.before != nil && c.after != nil && c.before.Action == c.after.Action {
+			continue // back where the client started
+		}
+		if c.before != nil {
+			res.Removed = append(res.Removed, *c.before)
+		}
+		if c.after != nil {
+			res.Added = append(res.Added, *c.after)
+		}
+	}
+	return res
+}
+
+// condenseApex folds the apex changes of a run of IXFRs in the same way as
+// CondenseIxfrs does the names. The ZONEMDs of the serials in between cancel.
+func condenseApex(chain []RpzIxfr) (removed, added []dns.RR) {
+	type change struct {
+		rr       dns.RR
+		had, has bool
+	}
+	changes := map[string]*change{}
+	var order []string
+	lookup := func(rr dns.RR, had bool) *change {
+		key := rr.String()
+		c, exist := changes[key]
+		if !exist {
+			c = &change{rr: rr, had: had}
+			changes[key] = c
+			order = append(order, key)
+		}
+		return c
+	}
+
+	for _, ixfr := range chain {
+		for _, rr := range ixfr.ApexRemoved {
+			lookup(rr, true).has = false
+		}
+		for _, rr := range ixfr.ApexAdded {
+			lookup(rr, false).has = true
+		}
+	}
+	for _, key := range order {
+		switch c := changes[key]; {
+		case c.had && !c.has:
+			removed = append(removed, c.rr)
+		case c.has && !c.had:
+			added = append(added, c.rr)
+		}
+	}
+	return removed, added
+}
+
+// size is the number of RRs the IXFR takes in a response, SOAs included.
+func (ixfr RpzIxfr) size() int {
+	return 2 + len(ixfr.ApexRemoved) + len(ixfr.Removed) + len(ixfr.ApexAdded) + len(ixfr.Added)
+}
+
+// soa returns the SOA RR at serial for an IXFR: the recorded one if there is
+// one, otherwise cur with the serial replaced.
+func (ixfr RpzIxfr) soa(cur, recorded dns.SOA, serial uint32) dns.RR {
+	soa := cur
+	if recorded.Hdr.Rrtype == dns.TypeSOA {
+		soa = recorded
+	}
+	soa.Serial = serial
+	return &soa
+}
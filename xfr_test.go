@@ -0,0 +1,408 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/miekg/dns"
+)
+
+// rn is a terse constructor for an RpzRule.
+func rn(name string, action tapir.Action) RpzRule {
+	return RpzRule{Name: name, Action: action}
+}
+
+func ixfr(from, to uint32, removed, added []RpzRule) RpzIxfr {
+	return RpzIxfr{FromSerial: from, ToSerial: to, Removed: removed, Added: added}
+}
+
+func TestCondenseIxfrs(t *testing.T) {
+	cases := []struct {
+		name        string
+		chain       []RpzIxfr
+		wantRemoved []string
+		wantAdded   []string
+	}{
+		{
+			name: "added_then_removed_cancels",
+			chain: []RpzIxfr{
+				ixfr(1, 2, nil, []RpzRule{rn("a.", tapir.NXDOMAIN)}),
+				ixfr(2, 3, []RpzRule{rn("a.", tapir.NXDOMAIN)}, nil),
+			},
+		},
+		{
+			name: "removed_then_readded_same_action_cancels",
+			chain: []RpzIxfr{
+				ixfr(1, 2, []RpzRule{rn("a.", tapir.NXDOMAIN)}, nil),
+				ixfr(2, 3, nil, []RpzRule{rn("a.", tapir.NXDOMAIN)}),
+			},
+		},
+		{
+			name: "action_change_survives",
+			chain: []RpzIxfr{
+				ixfr(1, 2, []RpzRule{rn("a.", tapir.NXDOMAIN)}, nil),
+				ixfr(2, 3, nil, []RpzRule{rn("a.", tapir.NODATA)}),
+			},
+			wantRemoved: []string{"a.:NXDOMAIN"},
+			wantAdded:   []string{"a.:NODATA"},
+		},
+		{
+			name: "independent_names_kept_in_order",
+			chain: []RpzIxfr{
+				ixfr(1, 2, nil, []RpzRule{rn("b.", tapir.NXDOMAIN)}),
+				ixfr(2, 3, []RpzRule{rn("c.", tapir.DROP)}, []RpzRule{rn("a.", tapir.NODATA)}),
+			},
+			wantRemoved: []string{"c.:DROP"},
+			wantAdded:   []string{"b.:NXDOMAIN", "a.:NODATA"},
+		},
+	}
+
+	names := func(rpzns []RpzRule) []string {
+		var out []string
+		for _, rpzn := range rpzns {
+			out = append(out, fmt.Sprintf("%s:%s", rpzn.Name, tapir.ActionToString[rpzn.Action]))
+		}
+		return out
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := CondenseIxfrs(tc.chain)
+			if got.FromSerial != 1 || got.ToSerial != 3 {
+				t.Errorf("serials = %d->%d, want 1->3", got.FromSerial, got.ToSerial)
+			}
+			if g, w := fmt.Sprint(names(got.Removed)), fmt.Sprint(tc.wantRemoved); g != w {
+				t.Errorf("removed = %s, want %s", g, w)
+			}
+			if g, w := fmt.Sprint(names(got.Added)), fmt.Sprint(tc.wantAdded); g != w {
+				t.Errorf("added = %s, want %s", g, w)
+			}
+		})
+	}
+}
+
+func TestPlanIxfr(t *testing.T) {
+	churn := []RpzIxfr{
+		ixfr(1, 2, nil, []RpzRule{rn("a.", tapir.NXDOMAIN)}),
+		ixfr(2, 3, []RpzRule{rn("a.", tapir.NXDOMAIN)}, nil),
+		ixfr(3, 4, nil, []RpzRule{rn("a.", tapir.NXDOMAIN)}),
+		ixfr(4, 5, []RpzRule{rn("a.", tapir.NXDOMAIN)}, nil),
+	}
+	growth := []RpzIxfr{
+		ixfr(1, 2, nil, []RpzRule{rn("a.", tapir.NXDOMAIN), rn("b.", tapir.NXDOMAIN)}),
+		ixfr(2, 3, nil, []RpzRule{rn("c.", tapir.NXDOMAIN), rn("d.", tapir.NXDOMAIN)}),
+	}
+
+	cases := []struct {
+		name   string
+		chain  []RpzIxfr
+		zone   int // number of names in the full zone
+		client uint32
+		want   IxfrStrategy
+	}{
+		{"single_diff_is_chained", growth[:1], 100, 1, IxfrChained},
+		{"churn_condenses", churn, 100, 1, IxfrCondensed},
+		{"tail_of_chain_only", churn, 100, 4, IxfrChained},
+		{"small_zone_is_full", growth, 2, 1, IxfrFullZone},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			snap := &RpzSnapshot{IxfrChain: tc.chain, Data: map[string]tapir.Action{}}
+			for i := 0; i < tc.zone; i++ {
+				name := fmt.Sprintf("n%d.", i)
+				snap.Data[name] = tapir.NXDOMAIN
+			}
+			plan := snap.PlanIxfr(tc.client)
+			if plan.Strategy != tc.want {
+				t.Errorf("strategy = %s (costs %v), want %s", plan.Strategy, plan.Cost, tc.want)
+			}
+		})
+	}
+}
+
+// --- concurrent transfers and updates ---------------------------------------
+//
+// Run with `go test -race`. One writer feeds updates through UpdateRpz while
+// AXFR, IXFR and query goroutines read the RPZ output. Every transfer must
+// describe exactly the zone content of the serial in its leading SOA.
+
+// xfrRecorder is a dns.ResponseWriter that keeps what is written to it.
+type xfrRecorder struct {
+	remote net.Addr
+	msgs   []*dns.Msg
+}
+
+func (w *xfrRecorder) LocalAddr() net.Addr         { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (w *xfrRecorder) RemoteAddr() net.Addr        { return w.remote }
+func (w *xfrRecorder) WriteMsg(m *dns.Msg) error   { w.msgs = append(w.msgs, m); return nil }
+func (w *xfrRecorder) Write(b []byte) (int, error) { return len(b), nil }
+func (w *xfrRecorder) Close() error                { return nil }
+func (w *xfrRecorder) TsigStatus() error           { return nil }
+func (w *xfrRecorder) TsigTimersOnly(bool)         {}
+func (w *xfrRecorder) Hijack()                     {}
+
+func (w *xfrRecorder) answer() []dns.RR {
+	var rrs []dns.RR
+	for _, m := range w.msgs {
+		rrs = append(rrs, m.Answer...)
+	}
+	return rrs
+}
+
+// newXfrTestPopData returns a PopData with an empty denylist "feed" and a
+// published RPZ apex at serial 1.
+func newXfrTestPopData() *PopData {
+	quiet := log.New(io.Discard, "", 0)
+	pd := newTestPopData(defaultDoubtPolicy(), listFixture{class: "denylist", source: "feed"})
+	pd.Logger, pd.Policy.Logger = quiet, quiet
+	pd.DownstreamSerials = map[string]uint32{}
+	pd.ComponentStatusCh = make(chan tapir.ComponentStatusUpdate, 10)
+	pd.Rpz.ZoneName = "rpz.test."
+
+	soa, _ := dns.NewRR("rpz.test. 3600 IN SOA mname. hostmaster.dnstapir.se. 1 60 60 86400 60")
+	ns, _ := dns.NewRR("rpz.test. 3600 IN NS ns1.rpz.test.")
+	pd.Rpz.publish(&RpzSnapshot{
+		Serial: 1,
+		SOA:    *soa.(*dns.SOA),
+		NSrrs:  []dns.RR{ns},
+		Data:   map[string]tapir.Action{},
+	})
+	return pd
+}
+
+// newRunningTestPopData is newXfrTestPopData for the tests that update the
+// RPZ: the component status updates are drained, the Reaper works in
+// one-minute slots, and the seen and override tables are empty.
+func newRunningTestPopData(tb testing.TB) *PopData {
+	tb.Helper()
+	pd := newXfrTestPopData()
+	go func() {
+		for range pd.ComponentStatusCh {
+		}
+	}()
+	tb.Cleanup(func() { close(pd.ComponentStatusCh) })
+	pd.ReaperInterval = time.Minute
+	var err error
+	if pd.Seen, err = NewSeenTable(); err != nil {
+		tb.Fatalf("NewSeenTable: %v", err)
+	}
+	pd.Overrides = NewOverrideTable()
+	return pd
+}
+
+func TestConcurrentXfrAndUpdate(t *testing.T) {
+	const updates = 300
+	pd := newRunningTestPopData(t)
+
+	// Every update changes the output, so update i takes the zone to serial
+	// i+2. Every fourth update removes the name that the previous one added.
+	type op struct {
+		name   string
+		remove bool
+	}
+	ops := make([]op, updates)
+	zone := map[uint32]map[string]bool{1: {}}
+	for i := range ops {
+		cur := map[string]bool{}
+		for name := range zone[uint32(i+1)] {
+			cur[name] = true
+		}
+		if i%4 == 3 {
+			ops[i] = op{name: ops[i-1].name, remove: true}
+			delete(cur, ops[i].name)
+		} else {
+			ops[i] = op{name: fmt.Sprintf("name%d.example.", i)}
+			cur[ops[i].name] = true
+		}
+		zone[uint32(i+2)] = cur
+	}
+
+	// check verifies that rrs is a well-formed transfer of the zone at the
+	// serial of the leading SOA, starting from what a client at clientSerial has.
+	check := func(kind string, rrs []dns.RR, clientSerial uint32) {
+		if len(rrs) < 2 {
+			t.Errorf("%s: only %d RRs", kind, len(rrs))
+			return
+		}
+		first, ok1 := rrs[0].(*dns.SOA)
+		last, ok2 := rrs[len(rrs)-1].(*dns.SOA)
+		if !ok1 || !ok2 || first.Serial != last.Serial {
+			t.Errorf("%s: transfer does not start and end with the same SOA", kind)
+			return
+		}
+		want := zone[first.Serial]
+
+		got := map[string]bool{}
+		if soa, isIxfr := rrs[1].(*dns.SOA); isIxfr && kind == "IXFR" {
+			for name := range zone[clientSerial] {
+				got[name] = true
+			}
+			// Each diff is: from SOA, removals, to SOA, additions.
+			serial := clientSerial
+			deleting := false
+			for _, rr := range rrs[1 : len(rrs)-1] {
+				if soa, ok := rr.(*dns.SOA); ok {
+					if !deleting && soa.Serial != serial {
+						t.Errorf("IXFR: diff from serial %d, client is at %d", soa.Serial, serial)
+						return
+					}
+					if deleting {
+						serial = soa.Serial
+					}
+					deleting = !deleting
+					continue
+				}
+				if zonemd, ok := rr.(*dns.ZONEMD); ok {
+					// The old ZONEMD goes with the removals, the new one
+					// with the additions; either matches the SOA before it.
+					if zonemd.Serial != serial {
+						t.Errorf("IXFR: ZONEMD has serial %d, want %d", zonemd.Serial, serial)
+					}
+					continue
+				}
+				name := strings.TrimSuffix(rr.Header().Name, pd.Rpz.ZoneName)
+				if !deleting {
+					got[name] = true
+				} else {
+					delete(got, name)
+				}
+			}
+			if serial != first.Serial {
+				t.Errorf("IXFR: diffs end at serial %d, SOA says %d (first diff from %d)", serial, first.Serial, soa.Serial)
+			}
+		} else {
+			prev := ""
+			for _, rr := range rrs {
+				if zonemd, ok := rr.(*dns.ZONEMD); ok && zonemd.Serial != first.Serial {
+					t.Errorf("%s: ZONEMD has serial %d, SOA says %d", kind, zonemd.Serial, first.Serial)
+				}
+				if cname, ok := rr.(*dns.CNAME); ok {
+					if prev != "" && canonicalCompare(prev, cname.Hdr.Name) >= 0 {
+						t.Errorf("%s: serial %d: %s sent after %s", kind, first.Serial, cname.Hdr.Name, prev)
+					}
+					prev = cname.Hdr.Name
+					got[strings.TrimSuffix(cname.Hdr.Name, pd.Rpz.ZoneName)] = true
+				}
+			}
+		}
+
+		if len(got) != len(want) {
+			t.Errorf("%s: serial %d has %d names, want %d", kind, first.Serial, len(got), len(want))
+			return
+		}
+		for name := range want {
+			if !got[name] {
+				t.Errorf("%s: serial %d is missing %s", kind, first.Serial, name)
+				return
+			}
+		}
+	}
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(3)
+		remote := &net.TCPAddr{IP: net.IPv4(192, 0, 2, byte(i+1)), Port: 5300}
+
+		go func() { // AXFR
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				r := new(dns.Msg)
+				r.SetAxfr(pd.Rpz.ZoneName)
+				w := &xfrRecorder{remote: remote}
+				if _, _, err := pd.RpzAxfrOut(w, r); err != nil {
+					t.Errorf("RpzAxfrOut: %v", err)
+					return
+				}
+				check("AXFR", w.answer(), 0)
+			}
+		}()
+
+		go func(back uint32) { // IXFR, from a few serials back
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				client := pd.Rpz.Current().Serial
+				if client > back {
+					client -= back
+				}
+				r := new(dns.Msg)
+				r.SetIxfr(pd.Rpz.ZoneName, client, "mname.", "hostmaster.dnstapir.se.")
+				w := &xfrRecorder{remote: remote}
+				if _, _, err := pd.RpzIxfrOut(w, r); err != nil {
+					t.Errorf("RpzIxfrOut: %v", err)
+					return
+				}
+				check("IXFR", w.answer(), client)
+			}
+		}(uint32(i * 3))
+
+		go func() { // queries
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// name0 is added by update 0, which publishes serial 2,
+				// and is never removed.
+				added := pd.Rpz.Current().Serial >= 2
+				r := new(dns.Msg)
+				r.SetQuestion("name0.example."+pd.Rpz.ZoneName, dns.TypeCNAME)
+				w := &xfrRecorder{remote: remote}
+				if err := pd.QueryResponder(w, r, r.Question[0].Name, dns.TypeCNAME, compLogger("dnsengine")); err != nil {
+					t.Errorf("QueryResponder: %v", err)
+					return
+				}
+				if rcode := w.msgs[0].Rcode; rcode != dns.RcodeSuccess && (added || rcode != dns.RcodeNameError) {
+					t.Errorf("query for name0.example: rcode %s", dns.RcodeToString[rcode])
+				}
+			}
+		}()
+	}
+
+	feed := pd.Lists["denylist"]["feed"]
+	for i, o := range ops {
+		tm := tapir.TapirMsg{}
+		pd.mu.Lock()
+		if o.remove {
+			feed.Names.Delete(o.name)
+			tm.Removed = []tapir.Domain{{Name: o.name}}
+		} else {
+			feed.Names.Put(tapir.TapirName{Name: o.name})
+			tm.Added = []tapir.Domain{{Name: o.name}}
+		}
+		pd.mu.Unlock()
+
+		if _, err := pd.UpdateRpz(&tm, AuditCause{}); err != nil {
+			t.Fatalf("UpdateRpz(%d): %v", i, err)
+		}
+		if serial := pd.Rpz.Current().Serial; serial != uint32(i+2) {
+			t.Fatalf("after update %d serial is %d, want %d", i, serial, i+2)
+		}
+	}
+	close(done)
+	readers.Wait()
+}
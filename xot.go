@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+
+	"github.com/dnstapir/tapir"
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// Zone transfers over TLS (XoT, RFC 9103). The DNS engine serves the RPZ
+// output on dnsengine.tlsaddresses, and RPZ sources with "xot: true" are
+// transferred from their upstream over TLS. Both ends use the POP
+// certificate (certs.tapir-pop.cert/key) and the CA in certs.cacertfile.
+
+// RFC 9103, section 7.1: XoT uses the "dot" ALPN and requires TLS 1.3.
+const xotALPN = "dot"
+
+// xotServerConfig returns the TLS config for the XoT listeners. With mtls set
+// only clients with a certificate signed by the CA in cafile get to connect.
+func xotServerConfig(certfile, keyfile, cafile string, mtls bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading XoT certificate: %v", err)
+	}
+
+	config := &tls.Config{}
+	if mtls {
+		config, err = tapir.NewServerConfig(cafile, tls.RequireAndVerifyClientCert)
+		if err != nil {
+			return nil, fmt.Errorf("error loading XoT client CA: %v", err)
+		}
+	}
+	config.Certificates = []tls.Certificate{cert}
+	config.NextProtos = []string{xotALPN}
+	config.MinVersion = tls.VersionTLS13
+	return config, nil
+}
+
+// xotClientConfig returns the TLS config for transfers from XoT upstreams. The
+// POP certificate is presented in case the upstream requires mutual TLS.
+func xotClientConfig(certfile, keyfile, cafile string) (*tls.Config, error) {
+	config, err := tapir.NewClientConfig(cafile, keyfile, certfile)
+	if err != nil {
+		return nil, fmt.Errorf("error creating XoT client config: %v", err)
+	}
+	config.NextProtos = []string{xotALPN}
+	config.MinVersion = tls.VersionTLS13
+	return config, nil
+}
+
+// refreshZone refreshes zd from upstream, over TLS if xot is set. The health
+// checks and the systemd watchdog know that a transfer is in progress.
+func (pd *PopData) refreshZone(zd *tapir.ZoneData, upstream string, xot bool) (bool, error) {
+	defer pd.Health.Transfer()()
+	if !xot {
+		return zd.Refresh(upstream)
+	}
+	config, err := xotClientConfig(viper.GetString("certs.tapir-pop.cert"),
+		viper.GetString("certs.tapir-pop.key"), viper.GetString("certs.cacertfile"))
+	if err != nil {
+		return false, err
+	}
+	return xotRefresh(zd, upstream, config)
+}
+
+// xotRefresh is zd.Refresh over TLS: it checks the upstream SOA serial and
+// transfers the zone if it has increased.
+func xotRefresh(zd *tapir.ZoneData, upstream string, config *tls.Config) (bool, error) {
+	c := &dns.Client{Net: "tcp-tls", TLSConfig: config}
+	m := new(dns.Msg)
+	m.SetQuestion(zd.ZoneName, dns.TypeSOA)
+	r, _, err := c.Exchange(m, upstream)
+	if err != nil {
+		return false, fmt.Errorf("xotRefresh: error from SOA query for %s to %s: %v", zd.ZoneName, upstream, err)
+	}
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) == 0 {
+		log.Printf("xotRefresh: %s: upstream %s answered the SOA query with %s", zd.ZoneName, upstream,
+			dns.RcodeToString[r.Rcode])
+		return false, nil // never mind, as zd.Refresh
+	}
+	soa, ok := r.Answer[0].(*dns.SOA)
+	if !ok || soa.Serial <= zd.IncomingSerial {
+		return false, nil
+	}
+	log.Printf("xotRefresh: %s: upstream serial has increased: %d-->%d", zd.ZoneName, zd.IncomingSerial, soa.Serial)
+
+	// Transfer into a fresh ZoneData and only copy it over when complete, as
+	// FetchFromUpstream does.
+	next := tapir.ZoneData{
+		ZoneName:    zd.ZoneName,
+		ZoneType:    zd.ZoneType,
+		RRParseFunc: zd.RRParseFunc,
+		Logger:      zd.Logger,
+		Verbose:     zd.Verbose,
+		Data:        map[string]tapir.OwnerData{},
+	}
+	m = new(dns.Msg)
+	m.SetAxfr(zd.ZoneName)
+	tr := &dns.Transfer{TLS: config}
+	envch, err := tr.In(m, upstream)
+	if err != nil {
+		return false, fmt.Errorf("xotRefresh: error from transfer of %s from %s: %v", zd.ZoneName, upstream, err)
+	}
+	for env := range envch {
+		if env.Error != nil {
+			return false, fmt.Errorf("xotRefresh: transfer of %s from %s failed: %v", zd.ZoneName, upstream, env.Error)
+		}
+		for _, rr := range env.RR {
+			next.RRSortFunc(rr, nil)
+		}
+	}
+	next.ComputeIndices()
+	next.XfrType = "axfr"
+	if err := next.Sync(); err != nil {
+		return false, err
+	}
+
+	zd.RRs, zd.Owners, zd.OwnerIndex, zd.BodyRRs = next.RRs, next.Owners, next.OwnerIndex, next.BodyRRs
+	zd.SOA, zd.IncomingSerial, zd.NSrrs, zd.ApexLen = next.SOA, next.SOA.Serial, next.NSrrs, next.ApexLen
+	zd.XfrType, zd.Data = next.XfrType, next.Data
+	log.Printf("xotRefresh: %s transferred from %s over TLS, serial %d", zd.ZoneName, upstream, zd.IncomingSerial)
+	return true, nil
+}
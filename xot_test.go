@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/miekg/dns"
+)
+
+// writeTestPKI writes a CA and a certificate signed by it for each of the
+// names to dir, and returns the path of the CA file. The certificates are
+// valid for 127.0.0.1 and for both server and client use.
+func writeTestPKI(t *testing.T, dir string, names ...string) string {
+	t.Helper()
+	writePEM := func(path, typ string, der []byte) {
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	cakey := newKey()
+	catmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, catmpl, catmpl, &cakey.PublicKey, cakey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cafile := filepath.Join(dir, "ca.crt")
+	writePEM(cafile, "CERTIFICATE", caDER)
+
+	for i, name := range names {
+		key := newKey()
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, catmpl, &key.PublicKey, cakey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writePEM(filepath.Join(dir, name+".crt"), "CERTIFICATE", der)
+		writePEM(filepath.Join(dir, name+".key"), "EC PRIVATE KEY", keyDER)
+	}
+	return cafile
+}
+
+// TestXoT serves the RPZ output over XoT with mutual TLS and transfers it
+// with xotRefresh, as an upstream RPZ source with "xot: true" would be.
+func TestXoT(t *testing.T) {
+	dir := t.TempDir()
+	cafile := writeTestPKI(t, dir, "server", "client")
+	file := func(name string) string { return filepath.Join(dir, name) }
+
+	pd := newXfrTestPopData()
+	feed := pd.Lists["denylist"]["feed"]
+	tm := tapir.TapirMsg{}
+	for _, name := range []string{"a.example.", "b.example."} {
+		feed.Names.Put(tapir.TapirName{Name: name})
+		tm.Added = append(tm.Added, tapir.Domain{Name: name})
+	}
+	if _, err := pd.UpdateRpz(&tm, AuditCause{}); err != nil {
+		t.Fatalf("UpdateRpz: %v", err)
+	}
+
+	serverConfig, err := xotServerConfig(file("server.crt"), file("server.key"), cafile, true)
+	if err != nil {
+		t.Fatalf("xotServerConfig: %v", err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quiet := log.New(io.Discard, "", 0)
+	server := &dns.Server{Listener: ln, Net: "tcp-tls", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		pd.RpzResponder(w, r, r.Question[0].Qtype, compLogger("dnsengine"))
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	upstream := ln.Addr().String()
+
+	t.Run("mutual_tls", func(t *testing.T) {
+		config, err := xotClientConfig(file("client.crt"), file("client.key"), cafile)
+		if err != nil {
+			t.Fatalf("xotClientConfig: %v", err)
+		}
+		var cnames int
+		zd := &tapir.ZoneData{
+			ZoneName: pd.Rpz.ZoneName,
+			ZoneType: tapir.RpzZone,
+			Logger:   quiet,
+			RRParseFunc: func(rr *dns.RR, zd *tapir.ZoneData) bool {
+				if (*rr).Header().Rrtype == dns.TypeCNAME {
+					cnames++
+				}
+				return true
+			},
+		}
+		updated, err := xotRefresh(zd, upstream, config)
+		if err != nil || !updated {
+			t.Fatalf("xotRefresh = %v, %v; want true, nil", updated, err)
+		}
+		if zd.IncomingSerial != pd.Rpz.Current().Serial || cnames != 2 {
+			t.Errorf("transferred serial %d with %d CNAMEs, want serial %d with 2", zd.IncomingSerial, cnames,
+				pd.Rpz.Current().Serial)
+		}
+
+		// Nothing new upstream, so no transfer.
+		if updated, err := xotRefresh(zd, upstream, config); err != nil || updated {
+			t.Errorf("second xotRefresh = %v, %v; want false, nil", updated, err)
+		}
+	})
+
+	t.Run("no_client_cert", func(t *testing.T) {
+		config, err := tapir.NewSimpleClientConfig(cafile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.NextProtos = []string{xotALPN}
+		zd := &tapir.ZoneData{ZoneName: pd.Rpz.ZoneName, ZoneType: tapir.RpzZone, Logger: quiet}
+		if _, err := xotRefresh(zd, upstream, config); err == nil {
+			t.Errorf("xotRefresh without a client certificate succeeded")
+		}
+	})
+}
@@ -0,0 +1,200 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"slices"
+	"strings"
+
+	"github.com/dnstapir/tapir"
+	"github.com/miekg/dns"
+)
+
+// Canonical ordering and the zone digest of the RPZ output.
+//
+// Every snapshot carries its trigger names in canonical DNS name order
+// (RFC 4034, section 6.1), which is the order AXFR streams them in, and a
+// digest over the complete zone computed as for a ZONEMD record with the
+// SIMPLE scheme and SHA-384 (RFC 8976). Both are worked out by the writer
+// before the snapshot is published, so readers never pay for them.
+
+// canonicalCompare compares two domain names in canonical DNS name order:
+// label by label starting from the root, each label compared as lower-cased
+// octets, with a name sorting before its children. Escaped dots inside labels
+// are not handled; they do not occur in the RPZ sources.
+func canonicalCompare(a, b string) int {
+	a, b = strings.TrimSuffix(a, "."), strings.TrimSuffix(b, ".")
+	for a != "" && b != "" {
+		la, ra := lastLabel(a)
+		lb, rb := lastLabel(b)
+		if c := compareLabel(la, lb); c != 0 {
+			return c
+		}
+		a, b = ra, rb
+	}
+	return len(a) - len(b) // the one with labels left is the child
+}
+
+func lastLabel(name string) (label, rest string) {
+	i := strings.LastIndexByte(name, '.')
+	if i < 0 {
+		return name, ""
+	}
+	return name[i+1:], name[:i]
+}
+
+func compareLabel(a, b string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		ca, cb := lower(a[i]), lower(b[i])
+		if ca != cb {
+			return int(ca) - int(cb)
+		}
+	}
+	return len(a) - len(b)
+}
+
+func lower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// canonicalOrder returns the names in data in canonical order. All owner names
+// in the RPZ share the zone name as suffix, so ordering the trigger names
+// orders the owners.
+func canonicalOrder(data map[string]tapir.Action) []string {
+	owners := make([]string, 0, len(data))
+	for name := range data {
+		owners = append(owners, name)
+	}
+	slices.SortFunc(owners, canonicalCompare)
+	return owners
+}
+
+// mergeOwners returns the canonical order of data, which is prev with the
+// changes in ixfr applied. This is a single merge pass instead of a full sort,
+// so an IXFR costs O(zone size + IXFR size log IXFR size).
+func mergeOwners(prev []string, data map[string]tapir.Action, ixfr RpzIxfr) []string {
+	added := map[string]bool{}
+	for _, rpzn := range ixfr.Added {
+		if _, exist := data[rpzn.Name]; exist {
+			added[rpzn.Name] = true
+		}
+	}
+	newnames := make([]string, 0, len(added))
+	for name := range added {
+		newnames = append(newnames, name)
+	}
+	slices.SortFunc(newnames, canonicalCompare)
+
+	owners := make([]string, 0, len(data))
+	for _, name := range prev {
+		if _, exist := data[name]; !exist || added[name] {
+			continue // removed, or re-added below
+		}
+		for len(newnames) > 0 && canonicalCompare(newnames[0], name) < 0 {
+			owners = append(owners, newnames[0])
+			newnames = newnames[1:]
+		}
+		owners = append(owners, name)
+	}
+	return append(owners, newnames...)
+}
+
+// canonicalWire returns rr in the canonical wire format of RFC 4034, section
+// 6.2: uncompressed, with the owner name and the names in the RDATA of the
+// types that occur in the RPZ lower-cased.
+func canonicalWire(rr dns.RR) ([]byte, error) {
+	rr = dns.Copy(rr)
+	rr.Header().Name = dns.CanonicalName(rr.Header().Name)
+	switch rr := rr.(type) {
+	case *dns.SOA:
+		rr.Ns, rr.Mbox = dns.CanonicalName(rr.Ns), dns.CanonicalName(rr.Mbox)
+	case *dns.NS:
+		rr.Ns = dns.CanonicalName(rr.Ns)
+	case *dns.CNAME:
+		rr.Target = dns.CanonicalName(rr.Target)
+	}
+	buf := make([]byte, dns.Len(rr))
+	off, err := dns.PackRR(rr, buf, 0, nil, false)
+	return buf[:off], err
+}
+
+// computeDigest computes the SHA-384 digest of the zone in the snapshot over
+// all RRs in canonical order, apex first. The ZONEMD RR itself is not part of
+// the digest (RFC 8976, section 3.3.1).
+func (s *RpzSnapshot) computeDigest() ([]byte, error) {
+	h := sha512.New384()
+
+	// At the apex the RRsets go in type order (NS before SOA) and the RRs
+	// within an RRset in the order of their canonical RDATA.
+	var apex [][]byte
+	soa := s.SOA
+	for _, rr := range append([]dns.RR{&soa}, s.NSrrs...) {
+		wire, err := canonicalWire(rr)
+		if err != nil {
+			return nil, err
+		}
+		apex = append(apex, wire)
+	}
+	n := len(soa.Hdr.Name) + 1 // length of the apex name in wire format
+	slices.SortFunc(apex, func(a, b []byte) int {
+		// The owner is the same, so compare the type, then the RDATA.
+		if a, b := wireType(a, n), wireType(b, n); a != b {
+			return int(a) - int(b)
+		}
+		return strings.Compare(string(a[n+10:]), string(b[n+10:]))
+	})
+	for _, wire := range apex {
+		h.Write(wire)
+	}
+
+	for rr := range s.zoneRRs() {
+		wire, err := canonicalWire(rr)
+		if err != nil {
+			return nil, err
+		}
+		h.Write(wire)
+	}
+	return h.Sum(nil), nil
+}
+
+// wireType returns the type of an RR in wire format whose owner name is n
+// octets long.
+func wireType(wire []byte, n int) uint16 {
+	return uint16(wire[n])<<8 | uint16(wire[n+1])
+}
+
+// ZONEMD returns the apex ZONEMD RR for the snapshot, or nil if there is no
+// digest (no apex yet).
+func (s *RpzSnapshot) ZONEMD() *dns.ZONEMD {
+	if s.Digest == nil {
+		return nil
+	}
+	return &dns.ZONEMD{
+		Hdr: dns.RR_Header{
+			Name:   s.SOA.Hdr.Name,
+			Rrtype: dns.TypeZONEMD,
+			Class:  dns.ClassINET,
+			Ttl:    s.SOA.Hdr.Ttl,
+		},
+		Serial: s.Serial,
+		Scheme: dns.ZoneMDSchemeSimple,
+		Hash:   dns.ZoneMDHashAlgSHA384,
+		Digest: hex.EncodeToString(s.Digest),
+	}
+}
+
+// apexRRs returns the apex RRs of the snapshot that follow the SOA in a
+// transfer and change with the serial, i.e. the ZONEMD.
+func (s *RpzSnapshot) apexRRs() []dns.RR {
+	if zonemd := s.ZONEMD(); zonemd != nil {
+		return []dns.RR{zonemd}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2026 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/dnstapir/tapir"
+	"github.com/miekg/dns"
+)
+
+// TestCanonicalCompare sorts the example from RFC 4034, section 6.1 (minus the
+// names with escaped octets) from a scrambled order.
+func TestCanonicalCompare(t *testing.T) {
+	want := []string{
+		"example.",
+		"a.example.",
+		"yljkjljk.a.example.",
+		"Z.a.example.",
+		"zABC.a.EXAMPLE.",
+		"z.example.",
+		"*.z.example.",
+	}
+	got := []string{want[4], want[6], want[0], want[3], want[5], want[1], want[2]}
+	slices.SortFunc(got, canonicalCompare)
+	if !slices.Equal(got, want) {
+		t.Errorf("sorted = %v, want %v", got, want)
+	}
+}
+
+// TestComputeDigest checks the digest against the simple example zone in RFC
+// 8976, appendix A.1.
+func TestComputeDigest(t *testing.T) {
+	rr := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatalf("NewRR(%q): %v", s, err)
+		}
+		return rr
+	}
+	ns1 := rr("ns1.example. 3600 IN A 203.0.113.63")
+	ns2 := rr("ns2.example. 3600 IN AAAA 2001:db8::63")
+	s := &RpzSnapshot{
+		Serial: 2018031900,
+		SOA:    *rr("example. 86400 IN SOA ns1.example. admin.example. 2018031900 1800 900 604800 86400").(*dns.SOA),
+		NSrrs: []dns.RR{
+			rr("example. 86400 IN NS ns2.example."),
+			rr("example. 86400 IN NS ns1.example."),
+		},
+		Glue: []dns.RR{ns1, ns2},
+		Data: map[string]tapir.Action{},
+	}
+	s.seal()
+
+	want := "c68090d90a7aed716bc459f9340e3d7c1370d4d24b7e2fc3a1ddc0b9a87153b9a9713b3c9ae5cc27777f98b8e730044c"
+	if got := s.ZONEMD(); got == nil || got.Digest != want {
+		t.Errorf("ZONEMD = %v, want digest %s", got, want)
+	} else if got.Serial != s.Serial {
+		t.Errorf("ZONEMD serial = %d, want %d", got.Serial, s.Serial)
+	}
+}